@@ -82,6 +82,7 @@ type KeyValueCache struct {
 	udpUnix    *nnet.UnixUDP
 	tcpNormal  *nnet.TCPClient
 	addr       string
+	myAddr     string
 	keepAlive  bool // only tcp mode
 	lookupChan chan interface{}
 }
@@ -167,8 +168,8 @@ func (receiver *KeyValueCache) Initialize(addr string, keepAlive bool) error {
 		receiver.udpUnix = nnet.CreateUnixUDPWithFormat(packets.PacketFormatNB, codecs.CodecIMv2)
 		receiver.udpUnix.OnDataDecoded = onKeyValueMsgRet
 		receiver.udpUnix.SetControllerAssociatedObject(receiver)
-		myAddr := fmt.Sprintf("/tmp/nbkv_client_%d.sock", os.Getpid())
-		err := receiver.udpUnix.Bind(myAddr)
+		receiver.myAddr = nnet.NewUnixClientAddr("nbkv_client")
+		err := receiver.udpUnix.Bind(receiver.myAddr)
 		if err != nil {
 			return err
 		}
@@ -176,6 +177,15 @@ func (receiver *KeyValueCache) Initialize(addr string, keepAlive bool) error {
 	return nil
 }
 
+func (receiver *KeyValueCache) Close() {
+	if receiver.udpUnix != nil {
+		receiver.udpUnix.Close()
+	}
+	if receiver.tcpNormal != nil {
+		receiver.tcpNormal.Close()
+	}
+}
+
 func (receiver *KeyValueCache) CmdRet(ret interface{}) {
 	go func() {
 		receiver.lookupChan <- ret
@@ -191,8 +201,7 @@ func (receiver *KeyValueCache) execCmd(cmd int, key string, value interface{}) (
 	}
 	req[KeyValueFieldSid] = fmt.Sprintf("nbkv_sid_%d_%d", os.Getpid(), nnet.NewSessionID())
 	if receiver.udpUnix != nil {
-		myAddr := fmt.Sprintf("/tmp/nbkv_client_%d.sock", os.Getpid())
-		req[KeyValueFieldFrom] = myAddr
+		req[KeyValueFieldFrom] = receiver.myAddr
 		receiver.udpUnix.SendTo(receiver.addr, req)
 	} else {
 		if !receiver.keepAlive {
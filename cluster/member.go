@@ -0,0 +1,374 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/messages"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+type MemberConfig struct {
+	//心跳间隔，默认 3 秒
+	HeartbeatInterval time.Duration
+	//超过该时间没有收到 registry 的心跳回应即认为 registry 失联，默认为 3 倍心跳间隔
+	HeartbeatTimeout time.Duration
+}
+
+// 节点的负载，随心跳上报
+type LoadReporter func() (cpu float64, mem int64, goroutine int)
+
+type Member struct {
+	OnNodeCome     func(Node)
+	OnNodeBye      func(Node)
+	OnNodeChange   func(Node)
+	OnRegistryLost func()
+	//为 nil 时只上报内存及协程数
+	LoadReporter LoadReporter
+
+	config     MemberConfig
+	self       Node
+	client     *nnet.TCPClient
+	view       map[int]map[string]Node
+	subscribed map[int]bool
+	lastAck    time.Time
+	joined     bool
+	mutex      sync.Mutex
+	closeCh    chan struct{}
+}
+
+// self 为本节点信息，Role 为 RoleSlave/RoleAdapter/RoleGateway 之一，Id 为空时由 registry 分配
+func CreateMember(self Node, config MemberConfig) *Member {
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = 3 * time.Second
+	}
+	if config.HeartbeatTimeout <= config.HeartbeatInterval {
+		config.HeartbeatTimeout = 3 * config.HeartbeatInterval
+	}
+	m := new(Member)
+	m.config = config
+	m.self = self
+	m.view = make(map[int]map[string]Node)
+	m.subscribed = make(map[int]bool)
+	return m
+}
+
+func (receiver *Member) Join(addr string, port int) error {
+	if _, ok := roleMessageTypes[receiver.self.Role]; !ok {
+		return errors.ErrorUnknownRole
+	}
+	client := nnet.CreateTCPClient(packets.PacketFormatNB, codecs.CodecIMv2)
+	client.OnDataDecoded = receiver.onData
+	client.OnBye = receiver.onBye
+	if err := client.Connect(addr, port); err != nil {
+		return err
+	}
+
+	receiver.mutex.Lock()
+	receiver.client = client
+	receiver.joined = true
+	receiver.lastAck = time.Now()
+	receiver.closeCh = make(chan struct{})
+	closeCh := receiver.closeCh
+	receiver.mutex.Unlock()
+
+	if err := receiver.hello(); err != nil {
+		receiver.Leave()
+		return err
+	}
+	go receiver.heartbeat(closeCh)
+	return nil
+}
+
+// 订阅指定角色的节点变化，registry 会立即返回当前列表
+func (receiver *Member) Subscribe(roles ...int) error {
+	for _, role := range roles {
+		if !roleSubscribable(role) {
+			return errors.ErrorUnknownRole
+		}
+	}
+	for _, role := range roles {
+		receiver.mutex.Lock()
+		receiver.subscribed[role] = true
+		receiver.mutex.Unlock()
+		if err := receiver.send(roleMessageTypes[role].list, codecs.IMMap{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 修改本节点信息并通知 registry，registry 会向订阅者推送变化
+func (receiver *Member) Update(fn func(node *Node)) error {
+	receiver.mutex.Lock()
+	role := receiver.self.Role
+	fn(&receiver.self)
+	receiver.self.Role = role
+	receiver.mutex.Unlock()
+	return receiver.hello()
+}
+
+func (receiver *Member) GetSelf() Node {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.self
+}
+
+// 查询已订阅角色的节点，按 Id 排序
+func (receiver *Member) Lookup(role int) []Node {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	nodes := make([]Node, 0, len(receiver.view[role]))
+	for _, node := range receiver.view[role] {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+func (receiver *Member) Get(role int, id string) (Node, bool) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	node, ok := receiver.view[role][id]
+	return node, ok
+}
+
+func (receiver *Member) Leave() {
+	receiver.leave()
+}
+
+// 返回是否由本次调用断开
+func (receiver *Member) leave() bool {
+	receiver.mutex.Lock()
+	if !receiver.joined {
+		receiver.mutex.Unlock()
+		return false
+	}
+	receiver.joined = false
+	close(receiver.closeCh)
+	client := receiver.client
+	receiver.mutex.Unlock()
+	client.Close()
+	return true
+}
+
+func (receiver *Member) hello() error {
+	receiver.mutex.Lock()
+	self := receiver.self
+	receiver.mutex.Unlock()
+	return receiver.send(roleMessageTypes[self.Role].hello, self.encode())
+}
+
+func (receiver *Member) send(tp int, body codecs.IMMap) error {
+	receiver.mutex.Lock()
+	client := receiver.client
+	joined := receiver.joined
+	tag := receiver.self.Role
+	receiver.mutex.Unlock()
+	if !joined {
+		return errors.ErrorNotJoined
+	}
+	data, err := createNodeMessage(tag, tp, body)
+	if err != nil {
+		return err
+	}
+	client.Send(data)
+	return nil
+}
+
+func (receiver *Member) heartbeat(closeCh chan struct{}) {
+	defer utils.LogPanic(recover())
+
+	ticker := time.NewTicker(receiver.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		receiver.mutex.Lock()
+		lost := time.Since(receiver.lastAck) > receiver.config.HeartbeatTimeout
+		receiver.mutex.Unlock()
+		if lost {
+			utils.LogError("### registry 心跳超时")
+			receiver.lost()
+			return
+		}
+
+		var load Node
+		if receiver.LoadReporter != nil {
+			load.Cpu, load.Mem, load.Goroutine = receiver.LoadReporter()
+		} else {
+			var ms runtime.MemStats
+			runtime.ReadMemStats(&ms)
+			load.Mem = int64(ms.Sys)
+			load.Goroutine = runtime.NumGoroutine()
+		}
+		body := codecs.IMMap{
+			messages.ProtocolKeyCpu:       load.Cpu,
+			messages.ProtocolKeyMem:       load.Mem,
+			messages.ProtocolKeyGoroutine: load.Goroutine,
+		}
+		if err := receiver.send(messages.ProtocolTypeHeart, body); err != nil {
+			return
+		}
+	}
+}
+
+func (receiver *Member) onBye(nnet.Controller) error {
+	receiver.lost()
+	return nil
+}
+
+func (receiver *Member) lost() {
+	if receiver.leave() && receiver.OnRegistryLost != nil {
+		receiver.OnRegistryLost()
+	}
+}
+
+func (receiver *Member) onData(controller nnet.Controller, addr string, data codecs.IMData) error {
+	msg, err := messages.MessageFromData(controller, addr, data)
+	if err != nil {
+		return nil
+	}
+	tp := msg.GetType()
+
+	receiver.mutex.Lock()
+	receiver.lastAck = time.Now()
+	receiver.mutex.Unlock()
+	if tp == messages.ProtocolTypeHeart {
+		return nil
+	}
+
+	role, ok := roleOfType(tp)
+	if !ok {
+		return nil
+	}
+	types := roleMessageTypes[role]
+	switch tp {
+	case types.hello:
+		//registry 对注册的回应，记录分配的 Id
+		node := decodeNode(msg.GetBody())
+		receiver.mutex.Lock()
+		if receiver.self.Id == "" {
+			receiver.self.Id = node.Id
+		}
+		receiver.mutex.Unlock()
+	case types.list:
+		receiver.onList(role, msg.GetBody())
+	case types.come, types.change:
+		node := decodeNode(msg.GetBody())
+		node.Role = role
+		node.LastHeartbeat = time.Now()
+		receiver.mutex.Lock()
+		if !receiver.subscribed[role] {
+			receiver.mutex.Unlock()
+			return nil
+		}
+		nodes := receiver.viewOf(role)
+		_, exists := nodes[node.Id]
+		nodes[node.Id] = node
+		receiver.mutex.Unlock()
+		if tp == types.come && !exists {
+			if receiver.OnNodeCome != nil {
+				receiver.OnNodeCome(node)
+			}
+		} else if receiver.OnNodeChange != nil {
+			receiver.OnNodeChange(node)
+		}
+	case types.bye:
+		node := decodeNode(msg.GetBody())
+		node.Role = role
+		receiver.mutex.Lock()
+		_, exists := receiver.view[role][node.Id]
+		delete(receiver.view[role], node.Id)
+		receiver.mutex.Unlock()
+		if exists && receiver.OnNodeBye != nil {
+			receiver.OnNodeBye(node)
+		}
+	}
+	return nil
+}
+
+// 以 registry 返回的列表替换本地视图，并对差异触发回调
+func (receiver *Member) onList(role int, body codecs.IMMap) {
+	list, _ := codecs.CreateMapReader(body).TryReadValue(messages.ProtocolKeyValue).(codecs.IMSlice)
+	fresh := make(map[string]Node, len(list))
+	for _, item := range list {
+		if m, ok := item.(codecs.IMMap); ok {
+			node := decodeNode(m)
+			node.Role = role
+			node.LastHeartbeat = time.Now()
+			fresh[node.Id] = node
+		}
+	}
+
+	var come, bye, change []Node
+	receiver.mutex.Lock()
+	old := receiver.view[role]
+	for id, node := range fresh {
+		if prev, ok := old[id]; !ok {
+			come = append(come, node)
+		} else if !prev.sameAs(node) {
+			change = append(change, node)
+		}
+	}
+	for id, node := range old {
+		if _, ok := fresh[id]; !ok {
+			bye = append(bye, node)
+		}
+	}
+	receiver.view[role] = fresh
+	receiver.mutex.Unlock()
+
+	for _, node := range come {
+		if receiver.OnNodeCome != nil {
+			receiver.OnNodeCome(node)
+		}
+	}
+	for _, node := range change {
+		if receiver.OnNodeChange != nil {
+			receiver.OnNodeChange(node)
+		}
+	}
+	for _, node := range bye {
+		if receiver.OnNodeBye != nil {
+			receiver.OnNodeBye(node)
+		}
+	}
+}
+
+// 调用方需持有 mutex
+func (receiver *Member) viewOf(role int) map[string]Node {
+	nodes, ok := receiver.view[role]
+	if !ok {
+		nodes = make(map[string]Node)
+		receiver.view[role] = nodes
+	}
+	return nodes
+}
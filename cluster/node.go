@@ -0,0 +1,184 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/messages"
+)
+
+/*
+集群成员管理及服务发现
+	registry 为中心节点(tag 为 ProtocolTagMaster)，各节点以 TCP 连接 registry:
+		节点 => registry   ProtocolTypeSlaveHello/AdapterHello/GatewayHello 注册或更新自身信息
+		                   ProtocolTypeHeart 定期心跳，携带 cpu/内存/协程数
+		                   ProtocolTypeSlaves/Adapters 订阅该角色，registry 以同类型消息返回当前列表
+		registry => 节点   ProtocolTypeSlaveCome/Bye/Change、AdapterCome/Bye/Change 推送给订阅者
+		                   ProtocolTypeHeart 回应心跳，节点据此判断 registry 是否可用
+	超过 HeartbeatTimeout 没有心跳或连接断开的节点视为离开
+	协议中没有 gateway 的列表及变化通知类型，gateway 只能注册，不能被订阅
+*/
+
+// 节点角色，取值与消息 tag 一致
+const (
+	RoleSlave   = messages.ProtocolTagSlave
+	RoleAdapter = messages.ProtocolTagAdapter
+	RoleGateway = messages.ProtocolTagGateway
+)
+
+// 节点信息中 ProtocolKeyValue 以外的扩展字段
+const nodeKeyMeta = messages.ProtocolKeyArgs
+
+type Node struct {
+	Id          string
+	Role        int
+	Host        string
+	LocalHost   string
+	TcpAddr     string
+	UnixAddr    string
+	UnixMsgAddr string
+	Meta        codecs.IMMap
+	//以下字段由心跳更新
+	Cpu           float64
+	Mem           int64
+	Goroutine     int
+	LastHeartbeat time.Time
+}
+
+type roleTypes struct {
+	hello  int
+	list   int
+	come   int
+	bye    int
+	change int
+}
+
+var roleMessageTypes = map[int]roleTypes{
+	RoleSlave: {
+		hello:  messages.ProtocolTypeSlaveHello,
+		list:   messages.ProtocolTypeSlaves,
+		come:   messages.ProtocolTypeSlaveCome,
+		bye:    messages.ProtocolTypeSlaveBye,
+		change: messages.ProtocolTypeSlaveChange,
+	},
+	RoleAdapter: {
+		hello:  messages.ProtocolTypeAdapterHello,
+		list:   messages.ProtocolTypeAdapters,
+		come:   messages.ProtocolTypeAdapterCome,
+		bye:    messages.ProtocolTypeAdapterBye,
+		change: messages.ProtocolTypeAdapterChange,
+	},
+	RoleGateway: {
+		hello: messages.ProtocolTypeGatewayHello,
+	},
+}
+
+// 根据消息类型查找对应的角色
+func roleOfType(tp int) (int, bool) {
+	if tp == 0 {
+		return 0, false
+	}
+	for role, types := range roleMessageTypes {
+		switch tp {
+		case types.hello, types.list, types.come, types.bye, types.change:
+			return role, true
+		}
+	}
+	return 0, false
+}
+
+// 角色是否支持订阅
+func roleSubscribable(role int) bool {
+	return roleMessageTypes[role].list != 0
+}
+
+func (receiver Node) encode() codecs.IMMap {
+	m := codecs.IMMap{
+		messages.ProtocolKeyId:    receiver.Id,
+		messages.ProtocolKeyValue: receiver.Role,
+	}
+	if receiver.Host != "" {
+		m[messages.ProtocolKeyHost] = receiver.Host
+	}
+	if receiver.LocalHost != "" {
+		m[messages.ProtocolKeyLocalHost] = receiver.LocalHost
+	}
+	if receiver.TcpAddr != "" {
+		m[messages.ProtocolKeyTcpAddr] = receiver.TcpAddr
+	}
+	if receiver.UnixAddr != "" {
+		m[messages.ProtocolKeyUnixAddr] = receiver.UnixAddr
+	}
+	if receiver.UnixMsgAddr != "" {
+		m[messages.ProtocolKeyUnixMsgAddr] = receiver.UnixMsgAddr
+	}
+	if len(receiver.Meta) > 0 {
+		m[nodeKeyMeta] = receiver.Meta
+	}
+	if !receiver.LastHeartbeat.IsZero() {
+		m[messages.ProtocolKeyCpu] = receiver.Cpu
+		m[messages.ProtocolKeyMem] = receiver.Mem
+		m[messages.ProtocolKeyGoroutine] = receiver.Goroutine
+	}
+	return m
+}
+
+func decodeNode(m codecs.IMMap) Node {
+	reader := codecs.CreateMapReader(m)
+	var node Node
+	node.Id = reader.StrValueOf(messages.ProtocolKeyId, "")
+	node.Role = int(reader.IntValueOf(messages.ProtocolKeyValue, 0))
+	node.Host = reader.StrValueOf(messages.ProtocolKeyHost, "")
+	node.LocalHost = reader.StrValueOf(messages.ProtocolKeyLocalHost, "")
+	node.TcpAddr = reader.StrValueOf(messages.ProtocolKeyTcpAddr, "")
+	node.UnixAddr = reader.StrValueOf(messages.ProtocolKeyUnixAddr, "")
+	node.UnixMsgAddr = reader.StrValueOf(messages.ProtocolKeyUnixMsgAddr, "")
+	if meta, ok := reader.TryReadValue(nodeKeyMeta).(codecs.IMMap); ok {
+		node.Meta = meta
+	}
+	node.Cpu = reader.FloatValueOf(messages.ProtocolKeyCpu, 0)
+	node.Mem = reader.IntValueOf(messages.ProtocolKeyMem, 0)
+	node.Goroutine = int(reader.IntValueOf(messages.ProtocolKeyGoroutine, 0))
+	return node
+}
+
+// 除负载以外的信息是否一致，用于判断是否需要推送变化通知
+func (receiver Node) sameAs(other Node) bool {
+	if receiver.Id != other.Id || receiver.Role != other.Role ||
+		receiver.Host != other.Host || receiver.LocalHost != other.LocalHost ||
+		receiver.TcpAddr != other.TcpAddr || receiver.UnixAddr != other.UnixAddr ||
+		receiver.UnixMsgAddr != other.UnixMsgAddr || len(receiver.Meta) != len(other.Meta) {
+		return false
+	}
+	for k, v := range receiver.Meta {
+		if ov, ok := other.Meta[k]; !ok || !reflect.DeepEqual(v, ov) {
+			return false
+		}
+	}
+	return true
+}
+
+func createNodeMessage(tag int, tp int, body codecs.IMMap) (codecs.IMData, error) {
+	msg := messages.CreateS2SMessage(tp)
+	msg.SetTag(tag)
+	msg.SetBody(body)
+	return messages.DataFromMessage(msg)
+}
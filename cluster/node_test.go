@@ -0,0 +1,98 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/messages"
+)
+
+func TestNodeEncodeRoundTrip(t *testing.T) {
+	node := Node{
+		Id:            "s1",
+		Role:          RoleSlave,
+		Host:          "10.0.0.1",
+		LocalHost:     "127.0.0.1",
+		TcpAddr:       "10.0.0.1:9000",
+		UnixAddr:      "/tmp/s1.sock",
+		UnixMsgAddr:   "/tmp/s1_fd.sock",
+		Meta:          codecs.IMMap{"zone": "a"},
+		Cpu:           12.5,
+		Mem:           1 << 20,
+		Goroutine:     42,
+		LastHeartbeat: time.Now(),
+	}
+	got := decodeNode(node.encode())
+	if !got.sameAs(node) {
+		t.Fatalf("decoded = %+v", got)
+	}
+	if got.Cpu != node.Cpu || got.Mem != node.Mem || got.Goroutine != node.Goroutine {
+		t.Fatalf("load = %v %v %v", got.Cpu, got.Mem, got.Goroutine)
+	}
+
+	//没有心跳的节点不携带负载
+	bare := Node{Id: "s2", Role: RoleSlave}.encode()
+	if _, ok := bare[messages.ProtocolKeyCpu]; ok {
+		t.Fatalf("encoded = %v", bare)
+	}
+}
+
+func TestNodeSameAsIgnoresLoad(t *testing.T) {
+	a := Node{Id: "s1", Role: RoleSlave, Meta: codecs.IMMap{"zone": "a"}}
+	b := a
+	b.Cpu = 99
+	b.LastHeartbeat = time.Now()
+	if !a.sameAs(b) {
+		t.Fatal("load changes should not count")
+	}
+	b.Meta = codecs.IMMap{"zone": "b"}
+	if a.sameAs(b) {
+		t.Fatal("meta changes should count")
+	}
+	b.Meta = codecs.IMMap{"zone": "a", "rack": 1}
+	if a.sameAs(b) {
+		t.Fatal("extra meta keys should count")
+	}
+}
+
+func TestRoleOfType(t *testing.T) {
+	cases := map[int]int{
+		messages.ProtocolTypeSlaveHello:    RoleSlave,
+		messages.ProtocolTypeSlaveBye:      RoleSlave,
+		messages.ProtocolTypeAdapters:      RoleAdapter,
+		messages.ProtocolTypeAdapterChange: RoleAdapter,
+		messages.ProtocolTypeGatewayHello:  RoleGateway,
+	}
+	for tp, want := range cases {
+		if role, ok := roleOfType(tp); !ok || role != want {
+			t.Errorf("roleOfType(%d) = %d, %v; want %d", tp, role, ok, want)
+		}
+	}
+	if _, ok := roleOfType(0); ok {
+		t.Error("type 0 should not match a role")
+	}
+	if _, ok := roleOfType(messages.ProtocolTypeHeart); ok {
+		t.Error("heartbeats should not match a role")
+	}
+	if roleSubscribable(RoleGateway) || !roleSubscribable(RoleSlave) || !roleSubscribable(RoleAdapter) {
+		t.Error("only slaves and adapters are subscribable")
+	}
+}
@@ -0,0 +1,348 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/messages"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+type RegistryConfig struct {
+	//超过该时间没有心跳的节点视为离开，默认 10 秒
+	HeartbeatTimeout time.Duration
+}
+
+type registryEntry struct {
+	node       Node
+	controller nnet.Controller
+}
+
+type Registry struct {
+	OnNodeCome   func(Node)
+	OnNodeBye    func(Node)
+	OnNodeChange func(Node)
+
+	config      RegistryConfig
+	server      *nnet.TCPServer
+	nodes       map[string]*registryEntry
+	sessions    map[nnet.SessionID]string
+	subscribers map[int]map[nnet.SessionID]nnet.Controller
+	mutex       sync.Mutex
+	closeOnce   sync.Once
+	closeCh     chan struct{}
+}
+
+func CreateRegistry(config RegistryConfig) *Registry {
+	if config.HeartbeatTimeout <= 0 {
+		config.HeartbeatTimeout = 10 * time.Second
+	}
+	r := new(Registry)
+	r.config = config
+	r.nodes = make(map[string]*registryEntry)
+	r.sessions = make(map[nnet.SessionID]string)
+	r.subscribers = make(map[int]map[nnet.SessionID]nnet.Controller)
+	r.closeCh = make(chan struct{})
+	r.server = nnet.CreateTCPServer()
+	r.server.Format = packets.PacketFormatNB
+	r.server.Codec = codecs.CodecIMv2
+	r.server.OnDataDecoded = r.OnDataDecoded
+	r.server.OnBye = r.onBye
+	return r
+}
+
+func (receiver *Registry) Bind(addr string, port int) error {
+	if err := receiver.server.Bind(addr, port); err != nil {
+		return err
+	}
+	receiver.server.Schedule()
+	go receiver.watch()
+	return nil
+}
+
+func (receiver *Registry) Close() {
+	receiver.closeOnce.Do(func() {
+		close(receiver.closeCh)
+		receiver.server.Close()
+	})
+}
+
+// 查询指定角色的全部节点，按 Id 排序
+func (receiver *Registry) Lookup(role int) []Node {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.lookup(role)
+}
+
+func (receiver *Registry) Get(id string) (Node, bool) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	entry, ok := receiver.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	return entry.node, true
+}
+
+func (receiver *Registry) lookup(role int) []Node {
+	nodes := make([]Node, 0)
+	for _, entry := range receiver.nodes {
+		if entry.node.Role == role {
+			nodes = append(nodes, entry.node)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Id < nodes[j].Id })
+	return nodes
+}
+
+// 可直接作为其他服务器的 OnDataDecoded，以便与已有的服务共用端口
+func (receiver *Registry) OnDataDecoded(controller nnet.Controller, addr string, data codecs.IMData) error {
+	msg, err := messages.MessageFromData(controller, addr, data)
+	if err != nil {
+		return nil
+	}
+	tp := msg.GetType()
+	if tp == messages.ProtocolTypeHeart {
+		receiver.onHeart(controller, msg)
+		return nil
+	}
+	role, ok := roleOfType(tp)
+	if !ok {
+		return nil
+	}
+	types := roleMessageTypes[role]
+	switch tp {
+	case types.hello:
+		receiver.onHello(controller, role, msg)
+	case types.list:
+		receiver.onSubscribe(controller, role)
+	}
+	return nil
+}
+
+func (receiver *Registry) onHello(controller nnet.Controller, role int, msg *messages.Message) {
+	node := decodeNode(msg.GetBody())
+	node.Role = role
+	node.LastHeartbeat = time.Now()
+	sessionId := controller.GetSessionID()
+
+	receiver.mutex.Lock()
+	if node.Id == "" {
+		//沿用同一连接上已分配的 Id
+		if id, ok := receiver.sessions[sessionId]; ok {
+			node.Id = id
+		} else {
+			node.Id = fmt.Sprintf("%d-%s", role, controller.GetSource())
+		}
+	}
+	if node.Host == "" {
+		node.Host = controller.GetSource()
+	}
+	var byes []Node
+	if id, ok := receiver.sessions[sessionId]; ok && id != node.Id {
+		//同一连接更换了 Id，先移除旧的节点
+		if gone, ok := receiver.remove(id, "Id 变更"); ok {
+			byes = append(byes, gone)
+		}
+	}
+	old, exists := receiver.nodes[node.Id]
+	if exists && old.node.Role != role {
+		if gone, ok := receiver.remove(node.Id, "角色变更"); ok {
+			byes = append(byes, gone)
+		}
+		exists = false
+	}
+
+	event := 0
+	var stale nnet.Controller
+	switch {
+	case !exists:
+		event = roleMessageTypes[role].come
+	case old.controller.GetSessionID() != sessionId:
+		//同一 Id 从新的连接注册，旧连接视为失效
+		utils.LogWarn("### 节点 %s 从新的连接 %s 注册，关闭旧连接", node.Id, controller.GetSource())
+		delete(receiver.sessions, old.controller.GetSessionID())
+		stale = old.controller
+		event = roleMessageTypes[role].change
+	case !old.node.sameAs(node):
+		event = roleMessageTypes[role].change
+	}
+	receiver.nodes[node.Id] = &registryEntry{node: node, controller: controller}
+	receiver.sessions[sessionId] = node.Id
+	receiver.publish(role, event, node)
+	receiver.mutex.Unlock()
+
+	if stale != nil {
+		stale.Close()
+	}
+	if receiver.OnNodeBye != nil {
+		for _, gone := range byes {
+			receiver.OnNodeBye(gone)
+		}
+	}
+
+	//回应注册结果，节点据此获得分配的 Id
+	if data, err := createNodeMessage(messages.ProtocolTagMaster, roleMessageTypes[role].hello, node.encode()); err == nil {
+		controller.Send(data)
+	}
+
+	switch event {
+	case roleMessageTypes[role].come:
+		utils.LogInfo("### 节点 %s (%s) 加入", node.Id, node.Host)
+		if receiver.OnNodeCome != nil {
+			receiver.OnNodeCome(node)
+		}
+	case roleMessageTypes[role].change:
+		if receiver.OnNodeChange != nil {
+			receiver.OnNodeChange(node)
+		}
+	}
+}
+
+func (receiver *Registry) onHeart(controller nnet.Controller, msg *messages.Message) {
+	receiver.mutex.Lock()
+	if id, ok := receiver.sessions[controller.GetSessionID()]; ok {
+		if entry, ok := receiver.nodes[id]; ok {
+			load := decodeNode(msg.GetBody())
+			entry.node.Cpu = load.Cpu
+			entry.node.Mem = load.Mem
+			entry.node.Goroutine = load.Goroutine
+			entry.node.LastHeartbeat = time.Now()
+		}
+	}
+	receiver.mutex.Unlock()
+
+	if data, err := createNodeMessage(messages.ProtocolTagMaster, messages.ProtocolTypeHeart, codecs.IMMap{}); err == nil {
+		controller.Send(data)
+	}
+}
+
+func (receiver *Registry) onSubscribe(controller nnet.Controller, role int) {
+	if !roleSubscribable(role) {
+		return
+	}
+	receiver.mutex.Lock()
+	subs, ok := receiver.subscribers[role]
+	if !ok {
+		subs = make(map[nnet.SessionID]nnet.Controller)
+		receiver.subscribers[role] = subs
+	}
+	subs[controller.GetSessionID()] = controller
+	nodes := receiver.lookup(role)
+	receiver.mutex.Unlock()
+
+	list := make(codecs.IMSlice, 0, len(nodes))
+	for _, node := range nodes {
+		list = append(list, node.encode())
+	}
+	if data, err := createNodeMessage(messages.ProtocolTagMaster, roleMessageTypes[role].list, codecs.IMMap{messages.ProtocolKeyValue: list}); err == nil {
+		controller.Send(data)
+	}
+}
+
+func (receiver *Registry) onBye(controller nnet.Controller) error {
+	sessionId := controller.GetSessionID()
+	receiver.mutex.Lock()
+	for _, subs := range receiver.subscribers {
+		delete(subs, sessionId)
+	}
+	var node Node
+	var removed bool
+	if id, ok := receiver.sessions[sessionId]; ok {
+		node, removed = receiver.remove(id, "连接断开")
+	}
+	receiver.mutex.Unlock()
+
+	if removed && receiver.OnNodeBye != nil {
+		receiver.OnNodeBye(node)
+	}
+	return nil
+}
+
+// 调用方需持有 mutex
+func (receiver *Registry) remove(id string, reason string) (Node, bool) {
+	entry, ok := receiver.nodes[id]
+	if !ok {
+		return Node{}, false
+	}
+	delete(receiver.nodes, id)
+	if receiver.sessions[entry.controller.GetSessionID()] == id {
+		delete(receiver.sessions, entry.controller.GetSessionID())
+	}
+	receiver.publish(entry.node.Role, roleMessageTypes[entry.node.Role].bye, entry.node)
+	utils.LogInfo("### 节点 %s 离开: %s", id, reason)
+	return entry.node, true
+}
+
+// 将节点变化推送给该角色的订阅者，调用方需持有 mutex
+func (receiver *Registry) publish(role int, event int, node Node) {
+	if event == 0 {
+		return
+	}
+	subs := receiver.subscribers[role]
+	if len(subs) == 0 {
+		return
+	}
+	data, err := createNodeMessage(messages.ProtocolTagMaster, event, node.encode())
+	if err != nil {
+		return
+	}
+	for _, controller := range subs {
+		controller.Send(data)
+	}
+}
+
+func (receiver *Registry) watch() {
+	defer utils.LogPanic(recover())
+
+	ticker := time.NewTicker(receiver.config.HeartbeatTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		var gone []registryEntry
+		receiver.mutex.Lock()
+		for id, entry := range receiver.nodes {
+			if now.Sub(entry.node.LastHeartbeat) > receiver.config.HeartbeatTimeout {
+				if node, ok := receiver.remove(id, "心跳超时"); ok {
+					gone = append(gone, registryEntry{node: node, controller: entry.controller})
+				}
+			}
+		}
+		receiver.mutex.Unlock()
+
+		for _, entry := range gone {
+			entry.controller.Close()
+			if receiver.OnNodeBye != nil {
+				receiver.OnNodeBye(entry.node)
+			}
+		}
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cluster
+
+import (
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/utils"
+)
+
+func TestMain(m *testing.M) {
+	utils.LogInit(utils.LogLevelError, "")
+	os.Exit(m.Run())
+}
+
+// 在本地空闲端口启动 registry
+func startTestRegistry(t *testing.T, config RegistryConfig) (*Registry, string) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	r := CreateRegistry(config)
+	if err := r.Bind(addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(r.Close)
+	return r, addr
+}
+
+func joinTestMember(t *testing.T, addr string, self Node, config MemberConfig, setup func(m *Member)) *Member {
+	t.Helper()
+	m := CreateMember(self, config)
+	if setup != nil {
+		setup(m)
+	}
+	if err := m.Join(addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Leave)
+	return m
+}
+
+// 等待条件成立，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// 记录节点变化回调
+type nodeEvents struct {
+	mutex  sync.Mutex
+	events []string
+}
+
+func (receiver *nodeEvents) hook(come, bye, change *func(Node)) {
+	record := func(kind string) func(Node) {
+		return func(node Node) {
+			receiver.mutex.Lock()
+			receiver.events = append(receiver.events, kind+":"+node.Id)
+			receiver.mutex.Unlock()
+		}
+	}
+	*come = record("come")
+	*bye = record("bye")
+	*change = record("change")
+}
+
+func (receiver *nodeEvents) has(event string) bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	for _, e := range receiver.events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeIds(nodes []Node) []string {
+	ids := make([]string, len(nodes))
+	for i, node := range nodes {
+		ids[i] = node.Id
+	}
+	return ids
+}
+
+func TestRegistryMembershipEvents(t *testing.T) {
+	var registryEvents nodeEvents
+	r, addr := startTestRegistry(t, RegistryConfig{})
+	registryEvents.hook(&r.OnNodeCome, &r.OnNodeBye, &r.OnNodeChange)
+
+	joinTestMember(t, addr, Node{Id: "s1", Role: RoleSlave, TcpAddr: "10.0.0.1:1"}, MemberConfig{}, nil)
+	waitFor(t, "s1 registered", func() bool { _, ok := r.Get("s1"); return ok })
+
+	var events nodeEvents
+	watcher := joinTestMember(t, addr, Node{Id: "a1", Role: RoleAdapter}, MemberConfig{}, func(m *Member) {
+		events.hook(&m.OnNodeCome, &m.OnNodeBye, &m.OnNodeChange)
+	})
+	if err := watcher.Subscribe(RoleSlave); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "initial list", func() bool { return events.has("come:s1") })
+
+	s2 := CreateMember(Node{Id: "s2", Role: RoleSlave}, MemberConfig{})
+	if err := s2.Join(addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "s2 come", func() bool { return events.has("come:s2") })
+	if ids := nodeIds(watcher.Lookup(RoleSlave)); len(ids) != 2 || ids[0] != "s1" || ids[1] != "s2" {
+		t.Fatalf("watcher view = %v", ids)
+	}
+
+	if err := s2.Update(func(node *Node) { node.TcpAddr = "10.0.0.2:2" }); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "s2 change", func() bool { return events.has("change:s2") })
+	if node, _ := watcher.Get(RoleSlave, "s2"); node.TcpAddr != "10.0.0.2:2" {
+		t.Fatalf("s2 = %+v", node)
+	}
+
+	s2.Leave()
+	waitFor(t, "s2 bye", func() bool { return events.has("bye:s2") })
+	if ids := nodeIds(r.Lookup(RoleSlave)); len(ids) != 1 || ids[0] != "s1" {
+		t.Fatalf("registry slaves = %v", ids)
+	}
+	if ids := nodeIds(watcher.Lookup(RoleSlave)); len(ids) != 1 || ids[0] != "s1" {
+		t.Fatalf("watcher view = %v", ids)
+	}
+	for _, e := range []string{"come:s1", "come:a1", "come:s2", "change:s2", "bye:s2"} {
+		if !registryEvents.has(e) {
+			t.Errorf("registry missing event %s: %v", e, registryEvents.events)
+		}
+	}
+	//未订阅的角色不会出现在视图中
+	if nodes := watcher.Lookup(RoleAdapter); len(nodes) != 0 {
+		t.Fatalf("adapter view = %v", nodeIds(nodes))
+	}
+}
+
+func TestRegistryAssignsId(t *testing.T) {
+	r, addr := startTestRegistry(t, RegistryConfig{})
+	m := joinTestMember(t, addr, Node{Role: RoleGateway}, MemberConfig{}, nil)
+	waitFor(t, "assigned id", func() bool { return m.GetSelf().Id != "" })
+
+	id := m.GetSelf().Id
+	node, ok := r.Get(id)
+	if !ok || node.Role != RoleGateway || node.Host == "" {
+		t.Fatalf("node = %+v, %v", node, ok)
+	}
+	//gateway 不能被订阅
+	if err := m.Subscribe(RoleGateway); err == nil {
+		t.Fatal("subscribing gateways should fail")
+	}
+}
+
+func TestRegistryReplacesStaleConnection(t *testing.T) {
+	r, addr := startTestRegistry(t, RegistryConfig{})
+	lost := make(chan struct{})
+	joinTestMember(t, addr, Node{Id: "s1", Role: RoleSlave}, MemberConfig{}, func(m *Member) {
+		m.OnRegistryLost = func() { close(lost) }
+	})
+	waitFor(t, "s1 registered", func() bool { _, ok := r.Get("s1"); return ok })
+
+	joinTestMember(t, addr, Node{Id: "s1", Role: RoleSlave, TcpAddr: "10.0.0.9:9"}, MemberConfig{}, nil)
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("old connection should be closed")
+	}
+	node, ok := r.Get("s1")
+	if !ok || node.TcpAddr != "10.0.0.9:9" {
+		t.Fatalf("s1 = %+v, %v", node, ok)
+	}
+}
+
+func TestRegistryHeartbeatExpiry(t *testing.T) {
+	r, addr := startTestRegistry(t, RegistryConfig{HeartbeatTimeout: 100 * time.Millisecond})
+	var events nodeEvents
+	events.hook(&r.OnNodeCome, &r.OnNodeBye, &r.OnNodeChange)
+
+	//心跳间隔远小于超时的节点会一直保留
+	alive := joinTestMember(t, addr, Node{Id: "alive", Role: RoleSlave}, MemberConfig{HeartbeatInterval: 20 * time.Millisecond}, nil)
+	//不发送心跳的节点超时后被移除，连接也会被关闭
+	lost := make(chan struct{})
+	joinTestMember(t, addr, Node{Id: "silent", Role: RoleSlave}, MemberConfig{HeartbeatInterval: time.Hour}, func(m *Member) {
+		m.OnRegistryLost = func() { close(lost) }
+	})
+	waitFor(t, "both registered", func() bool { return len(r.Lookup(RoleSlave)) == 2 })
+
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("silent member should lose the registry")
+	}
+	waitFor(t, "silent bye", func() bool { return events.has("bye:silent") })
+
+	time.Sleep(300 * time.Millisecond)
+	if ids := nodeIds(r.Lookup(RoleSlave)); len(ids) != 1 || ids[0] != "alive" {
+		t.Fatalf("registry slaves = %v", ids)
+	}
+	node, _ := r.Get("alive")
+	if node.LastHeartbeat.IsZero() || time.Since(node.LastHeartbeat) > 100*time.Millisecond {
+		t.Fatalf("alive heartbeat = %s", node.LastHeartbeat)
+	}
+	if events.has("bye:alive") {
+		t.Fatal("alive should not expire")
+	}
+	if self := alive.GetSelf(); self.Id != "alive" {
+		t.Fatalf("self = %+v", self)
+	}
+}
+
+func TestMemberDetectsRegistryLoss(t *testing.T) {
+	r, addr := startTestRegistry(t, RegistryConfig{})
+	lost := make(chan struct{})
+	m := joinTestMember(t, addr, Node{Id: "s1", Role: RoleSlave}, MemberConfig{}, func(m *Member) {
+		m.OnRegistryLost = func() { close(lost) }
+	})
+	waitFor(t, "s1 registered", func() bool { _, ok := r.Get("s1"); return ok })
+
+	r.Close()
+	select {
+	case <-lost:
+	case <-time.After(5 * time.Second):
+		t.Fatal("member should detect registry loss")
+	}
+	if err := m.Update(func(node *Node) { node.TcpAddr = "x" }); err == nil {
+		t.Fatal("update after registry loss should fail")
+	}
+}
@@ -45,7 +45,7 @@ func RegisterCodec(codec *nbcodecs.Codec) error {
 	nbutils.LogVerbose(">>> 注册编解码器 封包协议[%d][ver.%d] [%s]", codec.Protocol, codec.Version, codec.Name)
 	_, ok := collectionCodecs[k]
 	if ok {
-		return nberrors.Errorf("!!! 封包协议[%d][%s] 版本[%d] 已经注册，无需重复注册", codec.Protocol, codec.Version, codec.Name)
+		return nberrors.Errorf("!!! 封包协议[%d][%s] 版本[%d] 已经注册，无需重复注册", codec.Protocol, codec.Name, codec.Version)
 	}
 
 	collectionCodecs[k] = codec
@@ -84,6 +84,15 @@ func RegisterPacketFormat(fmt *nbpackets.PacketFormat) error {
 	return nil
 }
 
+func FindPacketFormat(tag string) (error, *nbpackets.PacketFormat) {
+	for _, f := range collectionPacketFormats {
+		if f.Tag == tag {
+			return nil, f
+		}
+	}
+	return nberrors.Errorf("!!! 封包格式 %s 不存在", tag), nil
+}
+
 func MatchPacketFormat(data []byte) (error, *nbpackets.PacketFormat) {
 	formats := collectionPacketFormats
 	sort.Slice(formats, func(i, j int) bool {
@@ -34,3 +34,20 @@ var ErrorDataNotReady = Errorf("Data length is not enough")
 var ErrorDataNotMatch = Errorf("Cannot match any packet format")
 var ErrorDataIsDamage = Errorf("Data length is not match")
 var ErrorRemoteReqClose = Errorf("The remote host request close it")
+var ErrorSendQueueFull = Errorf("The send queue is full")
+var ErrorAddressDenied = Errorf("The address is denied")
+var ErrorRateLimited = Errorf("The rate limit is exceeded")
+var ErrorTooManyConnections = Errorf("Too many connections")
+var ErrorPeerUnreachable = Errorf("The peer is unreachable")
+var ErrorDatagramTooLarge = Errorf("The datagram is too large")
+var ErrorUnsupportedNetwork = Errorf("The network is not supported")
+var ErrorUnixAddrInUse = Errorf("The unix socket address is in use")
+var ErrorCredentialsUnsupported = Errorf("Peer credentials are not supported on this platform")
+var ErrorPeerNotAllowed = Errorf("The peer is not allowed")
+var ErrorControllerScheduled = Errorf("The controller is already scheduled")
+var ErrorUnexpectedFileHandle = Errorf("The file handle is unexpected")
+var ErrorHandleTransferNotSet = Errorf("The handle transfer is not set")
+var ErrorNoWorkerAvailable = Errorf("No worker is available")
+var ErrorNotWorker = Errorf("The process is not a worker")
+var ErrorUnknownRole = Errorf("The node role is unknown")
+var ErrorNotJoined = Errorf("The member has not joined the cluster")
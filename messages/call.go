@@ -0,0 +1,197 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/nnet"
+)
+
+var ErrorCallAborted = errors.Errorf("The call is aborted because the controller is stopped")
+
+type callKey struct {
+	sessionId nnet.SessionID
+	serial    int64
+}
+
+type callResult struct {
+	message *Message
+	err     error
+}
+
+// 等待应答的调用，应答需与请求的消息类型相同，且为请求方向对应的应答方向
+type pendingCall struct {
+	result chan callResult
+	scheme int64
+	tp     int64
+}
+
+var calls sync.Map
+var callSerial int64
+
+func init() {
+	//序号起点随机化，降低与对端自行生成的序号冲突的可能
+	callSerial = rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(1 << 40)
+	nnet.AddControllerStopObserver(func(controller nnet.Controller) error {
+		CancelCalls(controller)
+		return nil
+	})
+}
+
+// 应答消息的方向，服务器之间的应答方向与请求相同
+func returnScheme(scheme int64) int64 {
+	switch scheme {
+	case ProtocolSchemeC2S:
+		return ProtocolSchemeS2C
+	case ProtocolSchemeS2C:
+		return ProtocolSchemeC2S
+	}
+	return scheme
+}
+
+func nextCallSerial() int64 {
+	serial := atomic.AddInt64(&callSerial, 1)
+	if serial <= 0 {
+		atomic.CompareAndSwapInt64(&callSerial, serial, 1)
+		return nextCallSerial()
+	}
+	return serial
+}
+
+// 通过 controller 发送请求消息并等待对端以相同序号返回的应答
+// 序号由本方法分配并写回 msg，ctx 取消或超时时返回 ctx.Err()
+func Call(ctx context.Context, controller nnet.Controller, msg *Message) (*Message, error) {
+	return CallTo(ctx, controller, "", msg)
+}
+
+// 与 Call 相同，addr 不为空时使用 SendTo 发往指定地址(用于 unix 数据报等无连接控制器)
+func CallTo(ctx context.Context, controller nnet.Controller, addr string, msg *Message) (*Message, error) {
+	data, err := DataFromMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	mapData := data.(codecs.IMMap)
+	reply, err := CallData(ctx, controller, addr, mapData)
+	msg.messageSerial = codecs.Int64FromInterface(mapData[ProtocolKeySerial])
+	return reply, err
+}
+
+// 以原始消息表发起调用，会覆盖其中的 ProtocolKeySerial
+// ctx 携带链路上下文或设置了导出器时记录调用的 Span，并在 data 未携带时写入 ProtocolKeyTrace
+func CallData(ctx context.Context, controller nnet.Controller, addr string, data codecs.IMMap) (reply *Message, err error) {
+	if controller == nil {
+		return nil, errors.ErrorSessionIsNotExists
+	}
+
+	var span *Span
+	if _, ok := TraceFromContext(ctx); ok || getSpanExporter() != nil {
+		ctx, span = StartSpan(ctx, fmt.Sprintf("call %v-%v", data[ProtocolKeyScheme], data[ProtocolKeyType]))
+		if _, ok := data[ProtocolKeyTrace]; !ok {
+			data[ProtocolKeyTrace] = span.Context.String()
+		}
+		defer func() {
+			if err == nil && reply != nil && reply.GetErrorCode() != ProtocolErrorCodeOK {
+				span.SetAttribute("error_code", reply.GetErrorCode())
+			}
+			span.End(err)
+		}()
+	}
+
+	serial := nextCallSerial()
+	data[ProtocolKeySerial] = serial
+
+	reader := codecs.CreateMapReader(data)
+	key := callKey{sessionId: controller.GetSessionID(), serial: serial}
+	call := &pendingCall{
+		result: make(chan callResult, 1),
+		scheme: returnScheme(reader.IntValueOf(ProtocolKeyScheme, 0)),
+		tp:     reader.IntValueOf(ProtocolKeyType, 0),
+	}
+	calls.Store(key, call)
+	defer calls.Delete(key)
+
+	if addr == "" {
+		_, err = controller.Send(data)
+	} else {
+		_, err = controller.SendTo(addr, data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case result := <-call.result:
+		return result.message, result.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// 尝试将收到的数据作为应答交付给等待中的调用，成功交付返回 true
+// 只有序号、消息类型及应答方向都与请求相符的消息才被视为应答，对端发来的同序号请求不受影响
+func ResolveCall(controller nnet.Controller, addr string, data codecs.IMData) bool {
+	mapData, ok := data.(codecs.IMMap)
+	if !ok || controller == nil {
+		return false
+	}
+	reader := codecs.CreateMapReader(mapData)
+	serial := reader.IntValueOf(ProtocolKeySerial, 0)
+	if serial <= 0 {
+		return false
+	}
+
+	v, ok := calls.Load(callKey{sessionId: controller.GetSessionID(), serial: serial})
+	if !ok {
+		return false
+	}
+	call := v.(*pendingCall)
+	if reader.IntValueOf(ProtocolKeyScheme, 0) != call.scheme || reader.IntValueOf(ProtocolKeyType, 0) != call.tp {
+		return false
+	}
+
+	msg, err := MessageFromData(controller, addr, data)
+	select {
+	case call.result <- callResult{message: msg, err: err}:
+	default:
+		//已有应答，重复的应答直接忽略
+	}
+	return true
+}
+
+// 中止经由 controller 发起的所有调用
+func CancelCalls(controller nnet.Controller) {
+	sessionId := controller.GetSessionID()
+	calls.Range(func(k, v interface{}) bool {
+		key := k.(callKey)
+		if key.sessionId == sessionId {
+			select {
+			case v.(*pendingCall).result <- callResult{err: ErrorCallAborted}:
+			default:
+			}
+		}
+		return true
+	})
+}
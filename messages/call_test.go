@@ -0,0 +1,201 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+)
+
+func replyTo(request codecs.IMMap, body codecs.IMMap) codecs.IMMap {
+	reply := codecs.IMMap{
+		ProtocolKeySerial: request[ProtocolKeySerial],
+		ProtocolKeyType:   request[ProtocolKeyType],
+		ProtocolKeyBody:   body,
+	}
+	if scheme, ok := request[ProtocolKeyScheme]; ok {
+		reply[ProtocolKeyScheme] = returnScheme(codecs.Int64FromInterface(scheme))
+	}
+	return reply
+}
+
+func TestCallResolvesReplyBySerial(t *testing.T) {
+	controller := createTestController(1)
+	controller.onSend = func(data codecs.IMMap) {
+		go ResolveCall(controller, "", replyTo(data, codecs.IMMap{1: "pong"}))
+	}
+
+	msg := CreateS2SMessage(100)
+	reply, err := Call(context.Background(), controller, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetSearial() <= 0 {
+		t.Fatalf("serial %d was not written back", msg.GetSearial())
+	}
+	if reply.GetSearial() != msg.GetSearial() || reply.GetBody()[1] != "pong" {
+		t.Fatalf("reply = %+v", reply)
+	}
+}
+
+func TestResolveCallMatchesSessionAndSerial(t *testing.T) {
+	controller := createTestController(2)
+	other := createTestController(3)
+	requests := make(chan codecs.IMMap, 1)
+	controller.onSend = func(data codecs.IMMap) { requests <- data }
+
+	done := make(chan *Message, 1)
+	go func() {
+		reply, _ := CallData(context.Background(), controller, "", codecs.IMMap{ProtocolKeyType: 1})
+		done <- reply
+	}()
+	request := <-requests
+
+	wrongSerial := replyTo(request, nil)
+	wrongSerial[ProtocolKeySerial] = codecs.Int64FromInterface(request[ProtocolKeySerial]) + 1
+	if ResolveCall(controller, "", wrongSerial) {
+		t.Fatal("a reply with another serial should not resolve the call")
+	}
+	if ResolveCall(other, "", replyTo(request, nil)) {
+		t.Fatal("a reply from another session should not resolve the call")
+	}
+	if ResolveCall(controller, "", codecs.IMMap{ProtocolKeyType: 1}) {
+		t.Fatal("a message without serial is not a reply")
+	}
+	if ResolveCall(controller, "", "not a map") {
+		t.Fatal("non-map data is not a reply")
+	}
+	wrongType := replyTo(request, nil)
+	wrongType[ProtocolKeyType] = 2
+	if ResolveCall(controller, "", wrongType) {
+		t.Fatal("a message of another type is not a reply")
+	}
+
+	if !ResolveCall(controller, "", replyTo(request, codecs.IMMap{1: 1})) {
+		t.Fatal("the matching reply should resolve the call")
+	}
+	//重复的应答被吸收
+	ResolveCall(controller, "", replyTo(request, codecs.IMMap{1: 2}))
+	select {
+	case reply := <-done:
+		if reply.GetBody()[1] != 1 {
+			t.Fatalf("got the duplicate reply: %v", reply.GetBody())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call not resolved")
+	}
+}
+
+func TestResolveCallIgnoresRequestsWithSameSerial(t *testing.T) {
+	controller := createTestController(7)
+	requests := make(chan codecs.IMMap, 1)
+	controller.onSend = func(data codecs.IMMap) { requests <- data }
+
+	done := make(chan *Message, 1)
+	go func() {
+		reply, _ := Call(context.Background(), controller, CreateC2SMessage(1))
+		done <- reply
+	}()
+	request := <-requests
+
+	//对端恰好以相同序号发来的请求
+	peerRequest := codecs.IMMap{
+		ProtocolKeyScheme: ProtocolSchemeC2S,
+		ProtocolKeyType:   request[ProtocolKeyType],
+		ProtocolKeySerial: request[ProtocolKeySerial],
+	}
+	if ResolveCall(controller, "", peerRequest) {
+		t.Fatal("a request in the same direction should not resolve the call")
+	}
+
+	reply := replyTo(request, codecs.IMMap{1: 1})
+	if reply[ProtocolKeyScheme] != int64(ProtocolSchemeS2C) {
+		t.Fatalf("reply scheme = %v", reply[ProtocolKeyScheme])
+	}
+	if !ResolveCall(controller, "", reply) {
+		t.Fatal("the return message should resolve the call")
+	}
+	select {
+	case msg := <-done:
+		if msg.GetBody()[1] != 1 {
+			t.Fatalf("got %v", msg.GetBody())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("call not resolved")
+	}
+}
+
+func TestCallTimeoutCleansUp(t *testing.T) {
+	controller := createTestController(4)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	_, err := CallData(ctx, controller, "", codecs.IMMap{ProtocolKeyType: 1})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("err = %v; want DeadlineExceeded", err)
+	}
+	request := controller.sentMessages()[0]
+	if ResolveCall(controller, "", replyTo(request, nil)) {
+		t.Fatal("a late reply should not find the timed out call")
+	}
+}
+
+func TestCancelCallsAbortsOnlyThatSession(t *testing.T) {
+	controller := createTestController(5)
+	other := createTestController(6)
+	sent := make(chan struct{}, 2)
+	controller.onSend = func(codecs.IMMap) { sent <- struct{}{} }
+	other.onSend = func(codecs.IMMap) { sent <- struct{}{} }
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := CallData(context.Background(), controller, "", codecs.IMMap{ProtocolKeyType: 1})
+		errs <- err
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	otherErr := make(chan error, 1)
+	go func() {
+		_, err := CallData(ctx, other, "", codecs.IMMap{ProtocolKeyType: 1})
+		otherErr <- err
+	}()
+	<-sent
+	<-sent
+
+	CancelCalls(controller)
+	if err := <-errs; err != ErrorCallAborted {
+		t.Fatalf("err = %v; want ErrorCallAborted", err)
+	}
+	if err := <-otherErr; err != context.DeadlineExceeded {
+		t.Fatalf("other session err = %v; want it untouched until its deadline", err)
+	}
+}
+
+func TestNextCallSerialIsPositiveAndUnique(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 1000; i++ {
+		serial := nextCallSerial()
+		if serial <= 0 || seen[serial] {
+			t.Fatalf("bad serial %d", serial)
+		}
+		seen[serial] = true
+	}
+}
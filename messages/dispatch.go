@@ -18,11 +18,13 @@
 package messages
 
 import (
-	"fmt"
-	"runtime"
+	"context"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/nnet"
 	"github.com/packing/clove/utils"
 )
 
@@ -30,16 +32,62 @@ const MaxAsyncMessageProcCount = 1024
 
 type MessageProcFunc = func(*Message) error
 
+// 注册消息处理函数时 tag 或 type 使用该值表示匹配任意值
+const MessageMatchAny = -1
+
+type routeKey struct {
+	scheme int
+	tag    int
+	tp     int
+}
+
+func (receiver routeKey) String() string {
+	part := func(v int) string {
+		if v == MessageMatchAny {
+			return "*"
+		}
+		return strconv.Itoa(v)
+	}
+	return part(receiver.scheme) + "-" + part(receiver.tag) + "-" + part(receiver.tp)
+}
+
 type Dispatcher struct {
-	fns          map[string]MessageProcFunc
+	queue        MessageQueue
+	fns          map[routeKey]MessageProcFunc
+	defaultFn    MessageProcFunc
+	chains       map[routeKey]MessageProcFunc //注册时即组合好中间件，分派时只做查表
+	tagChains    map[routeKey]MessageProcFunc //通配标签的处理函数按消息的各个标签组合的中间件
+	defaultChain MessageProcFunc
+	schemeChains map[middlewareKey]MessageProcFunc //默认处理函数按消息的 scheme/标签组合的中间件
+	stats        map[routeKey]*routeStats
+	defaultStats *routeStats
+	routeMutex   sync.RWMutex
+	middlewares  []MessageMiddleware
+	routeMws     map[middlewareKey][]MessageMiddleware
 	syncChannel  chan *Message
 	asyncCount   int
 	asyncTime    int64
 	asyncTotal   int64
 	asyncTimeMax int64
 	asyncTimeMin int64
+	queuePolicy  int
+	droppedCount int64
 	mutex        sync.Mutex
 	mutexTime    sync.Mutex
+
+	//分片有序分派模式，workers 为空时使用无序的异步分派
+	workerCount int
+	workerDepth int
+	workers     []chan *Message
+	ShardKey    func(*Message) uint64
+
+	asyncSem chan int
+	stopCh   chan int
+	stopOnce *sync.Once
+	group    sync.WaitGroup
+
+	//没有任何处理函数(包括默认处理函数)接收的消息会回调该函数
+	OnUnhandled func(*Message)
 }
 
 type MessageObject interface {
@@ -47,14 +95,85 @@ type MessageObject interface {
 }
 
 func CreateDispatcher() *Dispatcher {
+	return CreateDispatcherWithQueue(GlobalMessageQueue)
+}
+
+// 创建从指定消息队列读取消息的分派器，用于在同一进程内运行多个相互独立的服务
+func CreateDispatcherWithQueue(queue MessageQueue) *Dispatcher {
 	sor := new(Dispatcher)
-	sor.fns = make(map[string]MessageProcFunc)
+	sor.queue = queue
+	sor.fns = make(map[routeKey]MessageProcFunc)
+	sor.chains = make(map[routeKey]MessageProcFunc)
+	sor.tagChains = make(map[routeKey]MessageProcFunc)
+	sor.schemeChains = make(map[middlewareKey]MessageProcFunc)
+	sor.stats = make(map[routeKey]*routeStats)
+	sor.defaultStats = new(routeStats)
+	sor.middlewares = make([]MessageMiddleware, 0)
+	sor.routeMws = make(map[middlewareKey][]MessageMiddleware)
 	sor.syncChannel = make(chan *Message, 102400)
 	sor.asyncCount = 0
 	sor.asyncTime = 0
+	sor.ShardKey = defaultShardKey
 	return sor
 }
 
+func (receiver *Dispatcher) GetQueue() MessageQueue {
+	return receiver.queue
+}
+
+// 将解码后的数据推入本分派器的消息队列，可直接赋值给 TCPServer/UnixUDP 等的 OnDataDecoded
+// 队列已满时按 SetQueuePolicy 设置的方式处理，默认与 MessageQueue.Push 相同
+func (receiver *Dispatcher) Push(controller nnet.Controller, addr string, data codecs.IMData) error {
+	dropped, err := receiver.queue.pushWithPolicy(controller, addr, data, receiver.GetQueuePolicy())
+	if dropped {
+		receiver.mutex.Lock()
+		receiver.droppedCount += 1
+		receiver.mutex.Unlock()
+	}
+	return err
+}
+
+// 设置 Push 在消息队列已满时的处理方式，取值为 QueuePolicyHandOff/QueuePolicyBlock/QueuePolicyDrop
+func (receiver *Dispatcher) SetQueuePolicy(policy int) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.queuePolicy = policy
+}
+
+func (receiver *Dispatcher) GetQueuePolicy() int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.queuePolicy
+}
+
+// 因消息队列已满被 Push 抛弃的消息数量(QueuePolicyDrop)
+func (receiver *Dispatcher) GetDroppedMessages() int64 {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.droppedCount
+}
+
+// 默认以消息携带的首个会话ID分片，没有时使用来源连接的会话ID
+func defaultShardKey(message *Message) uint64 {
+	if len(message.messageSessionId) > 0 {
+		return message.messageSessionId[0]
+	}
+	if message.controller != nil {
+		return message.controller.GetSessionID()
+	}
+	return 0
+}
+
+// 启用分片有序分派: 相同分片键的消息由同一个工作协程按到达顺序处理
+// workers 为工作协程数量，queueDepth 为每个工作协程的队列深度，需在 Dispatch 之前调用
+func (receiver *Dispatcher) SetWorkerPool(workers int, queueDepth int) {
+	if queueDepth <= 0 {
+		queueDepth = 1024
+	}
+	receiver.workerCount = workers
+	receiver.workerDepth = queueDepth
+}
+
 func (receiver *Dispatcher) recordAsyncTime(tv int64) {
 	receiver.mutexTime.Lock()
 	defer receiver.mutexTime.Unlock()
@@ -63,9 +182,7 @@ func (receiver *Dispatcher) recordAsyncTime(tv int64) {
 	if tv > receiver.asyncTimeMax {
 		receiver.asyncTimeMax = tv
 	}
-	if tv < receiver.asyncTimeMin {
-		receiver.asyncTimeMin = tv
-	} else if receiver.asyncTimeMin == 0 {
+	if receiver.asyncTotal == 1 || tv < receiver.asyncTimeMin {
 		receiver.asyncTimeMin = tv
 	}
 }
@@ -97,9 +214,101 @@ func (receiver *Dispatcher) GetAsyncInfo() (int64, int64, int64) {
 	return 0, receiver.asyncTimeMax, receiver.asyncTimeMin
 }
 
+// 注册消息处理函数，tag 或 tp 为 MessageMatchAny 时匹配该 scheme 下的任意值
+// 匹配优先级: 精确匹配 > 任意类型 > 任意标签 > 任意标签及类型
 func (receiver *Dispatcher) MessageMapped(scheme, tag, tp int, fn MessageProcFunc) {
-	key := fmt.Sprintf("%d-%d-%d", scheme, tag, tp)
+	receiver.routeMutex.Lock()
+	defer receiver.routeMutex.Unlock()
+	key := routeKey{scheme: scheme, tag: tag, tp: tp}
 	receiver.fns[key] = fn
+	if _, ok := receiver.stats[key]; !ok {
+		receiver.stats[key] = new(routeStats)
+	}
+	receiver.composeAllLocked()
+}
+
+// 注销消息处理函数，可在分派过程中调用，已有的统计会保留
+func (receiver *Dispatcher) MessageUnmapped(scheme, tag, tp int) {
+	receiver.routeMutex.Lock()
+	defer receiver.routeMutex.Unlock()
+	delete(receiver.fns, routeKey{scheme: scheme, tag: tag, tp: tp})
+	receiver.composeAllLocked()
+}
+
+// 设置默认处理函数，处理没有匹配到任何已注册处理函数的消息，传入 nil 取消
+func (receiver *Dispatcher) SetDefaultHandler(fn MessageProcFunc) {
+	receiver.routeMutex.Lock()
+	defer receiver.routeMutex.Unlock()
+	receiver.defaultFn = fn
+	receiver.composeAllLocked()
+}
+
+// 注册作用于所有消息的中间件，先注册的位于外层
+func (receiver *Dispatcher) Use(mws ...MessageMiddleware) {
+	receiver.routeMutex.Lock()
+	defer receiver.routeMutex.Unlock()
+	receiver.middlewares = append(receiver.middlewares, mws...)
+	receiver.composeAllLocked()
+}
+
+// 注册仅作用于指定 scheme/tag 消息的中间件，位于全局中间件之内
+// 按消息本身的 scheme/标签生效，无论消息由精确匹配、通配还是默认处理函数处理
+// tag 为 MessageMatchAny 时作用于该 scheme 下的所有消息，位于指定标签的中间件之外
+func (receiver *Dispatcher) UseFor(scheme, tag int, mws ...MessageMiddleware) {
+	receiver.routeMutex.Lock()
+	defer receiver.routeMutex.Unlock()
+	key := middlewareKey{scheme: scheme, tag: tag}
+	receiver.routeMws[key] = append(receiver.routeMws[key], mws...)
+	receiver.composeAllLocked()
+}
+
+// 以 scheme 及 tags 对应的中间件组合处理函数，调用方需持有 routeMutex
+// 组合顺序由外至内: 全局中间件、scheme 下任意标签的中间件、各标签的中间件
+func (receiver *Dispatcher) composeLocked(fn MessageProcFunc, scheme int, tags ...int) MessageProcFunc {
+	for i := len(tags) - 1; i >= 0; i-- {
+		if tags[i] == MessageMatchAny {
+			continue
+		}
+		if mws, ok := receiver.routeMws[middlewareKey{scheme: scheme, tag: tags[i]}]; ok {
+			fn = chainMiddlewares(fn, mws)
+		}
+	}
+	if mws, ok := receiver.routeMws[middlewareKey{scheme: scheme, tag: MessageMatchAny}]; ok {
+		fn = chainMiddlewares(fn, mws)
+	}
+	return chainMiddlewares(fn, receiver.middlewares)
+}
+
+// 处理函数或中间件变化后重新组合全部处理函数，调用方需持有 routeMutex 写锁
+func (receiver *Dispatcher) composeAllLocked() {
+	receiver.chains = make(map[routeKey]MessageProcFunc, len(receiver.fns))
+	receiver.tagChains = make(map[routeKey]MessageProcFunc)
+	receiver.schemeChains = make(map[middlewareKey]MessageProcFunc)
+	for key, fn := range receiver.fns {
+		receiver.chains[key] = receiver.composeLocked(fn, key.scheme, key.tag)
+		if key.tag != MessageMatchAny {
+			continue
+		}
+		//通配标签的处理函数同样需要经过消息所带标签的中间件
+		for mkey := range receiver.routeMws {
+			if mkey.scheme == key.scheme && mkey.tag != MessageMatchAny {
+				receiver.tagChains[routeKey{scheme: key.scheme, tag: mkey.tag, tp: key.tp}] = receiver.composeLocked(fn, key.scheme, mkey.tag)
+			}
+		}
+	}
+
+	receiver.defaultChain = nil
+	if receiver.defaultFn == nil {
+		return
+	}
+	receiver.defaultChain = chainMiddlewares(receiver.defaultFn, receiver.middlewares)
+	for mkey := range receiver.routeMws {
+		receiver.schemeChains[mkey] = receiver.composeLocked(receiver.defaultFn, mkey.scheme, mkey.tag)
+		anyKey := middlewareKey{scheme: mkey.scheme, tag: MessageMatchAny}
+		if _, ok := receiver.schemeChains[anyKey]; !ok {
+			receiver.schemeChains[anyKey] = receiver.composeLocked(receiver.defaultFn, mkey.scheme)
+		}
+	}
 }
 
 func (receiver *Dispatcher) MessageObjectMapped(scheme, tag int, o MessageObject) {
@@ -109,57 +318,261 @@ func (receiver *Dispatcher) MessageObjectMapped(scheme, tag int, o MessageObject
 	}
 }
 
-func (receiver *Dispatcher) execMessageProc(message *Message, count bool) {
-	for _, tag := range message.messageTag {
-		key := fmt.Sprintf("%d-%d-%d", message.messageScheme, tag, message.messageType)
-		fn, ok := receiver.fns[key]
-		if ok {
-			if count {
-				receiver.incAsyncCount()
+// 注销通过 MessageObjectMapped 注册的处理函数
+func (receiver *Dispatcher) MessageObjectUnmapped(scheme, tag int, o MessageObject) {
+	for k := range o.GetMappedTypes() {
+		receiver.MessageUnmapped(scheme, tag, k)
+	}
+}
+
+// 查找已组合中间件的处理函数，调用方需持有 routeMutex 读锁
+func (receiver *Dispatcher) lookup(scheme, tag, tp int) (routeKey, MessageProcFunc, *routeStats) {
+	keys := [4]routeKey{
+		{scheme: scheme, tag: tag, tp: tp},
+		{scheme: scheme, tag: tag, tp: MessageMatchAny},
+		{scheme: scheme, tag: MessageMatchAny, tp: tp},
+		{scheme: scheme, tag: MessageMatchAny, tp: MessageMatchAny},
+	}
+	for _, key := range keys {
+		fn, ok := receiver.chains[key]
+		if !ok {
+			continue
+		}
+		if key.tag == MessageMatchAny && tag != MessageMatchAny {
+			if tagFn, ok := receiver.tagChains[routeKey{scheme: scheme, tag: tag, tp: key.tp}]; ok {
+				fn = tagFn
 			}
-			st := time.Now().UnixNano()
-			fn(message)
-			st = time.Now().UnixNano() - st
-			if count {
-				receiver.recordAsyncTime(st)
-				receiver.decAsyncCount()
+		}
+		return key, fn, receiver.stats[key]
+	}
+	return routeKey{}, nil, nil
+}
+
+// 默认处理函数，调用方需持有 routeMutex 读锁
+func (receiver *Dispatcher) lookupDefault(scheme, tag int) MessageProcFunc {
+	if fn, ok := receiver.schemeChains[middlewareKey{scheme: scheme, tag: tag}]; ok {
+		return fn
+	}
+	if fn, ok := receiver.schemeChains[middlewareKey{scheme: scheme, tag: MessageMatchAny}]; ok {
+		return fn
+	}
+	return receiver.defaultChain
+}
+
+func (receiver *Dispatcher) execHandler(message *Message, key routeKey, fn MessageProcFunc, stats *routeStats, count bool) {
+	if count {
+		receiver.incAsyncCount()
+	}
+	//消息携带链路上下文或设置了导出器时，为每次处理记录一个 Span
+	var span *Span
+	parent := message.GetContext()
+	if _, ok := TraceFromContext(parent); ok || getSpanExporter() != nil {
+		var ctx context.Context
+		ctx, span = StartSpan(parent, "handle "+key.String())
+		message.SetContext(ctx)
+	}
+
+	stats.Begin()
+	st := time.Now()
+	var err error
+	defer func() {
+		//未被 RecoverMiddleware 捕获的 panic 在记录后继续抛出
+		r := recover()
+		elapsed := time.Since(st)
+		stats.end(elapsed, err, r != nil)
+		if span != nil {
+			if r != nil {
+				span.End(panicError{value: r})
+			} else {
+				span.End(err)
 			}
+			message.SetContext(parent)
+		}
+		if count {
+			receiver.recordAsyncTime(int64(elapsed))
+			receiver.decAsyncCount()
+		}
+		if r != nil {
+			panic(r)
 		}
+	}()
+	if err = fn(message); err != nil {
+		utils.LogVerbose(">>> 消息 %s 处理返回错误 %s", key.String(), err.Error())
 	}
 }
 
-func (receiver *Dispatcher) Dispatch() {
-	go func() {
+func (receiver *Dispatcher) execMessageProc(message *Message, count bool) {
+	scheme, tp := message.messageScheme, message.messageType
+	handled := false
+	//带有多个标签时，通配及默认处理函数只执行一次，需经过所有标签的中间件
+	var tags []int
+	if len(message.messageTag) > 1 {
+		tags = make([]int, len(message.messageTag))
+		for i, tag := range message.messageTag {
+			tags[i] = codecs.IntFromInterface(tag)
+		}
+	}
+	//同一个通配处理函数只会因多个标签被执行一次
+	anyTagRun, anyAllRun := false, false
+	run := func(tag int) {
+		receiver.routeMutex.RLock()
+		key, fn, stats := receiver.lookup(scheme, tag, tp)
+		if fn != nil && key.tag == MessageMatchAny && tags != nil {
+			fn = receiver.composeLocked(receiver.fns[key], scheme, tags...)
+		}
+		receiver.routeMutex.RUnlock()
+		if fn == nil {
+			return
+		}
+		if key.tag == MessageMatchAny {
+			if key.tp == MessageMatchAny {
+				if anyAllRun {
+					return
+				}
+				anyAllRun = true
+			} else {
+				if anyTagRun {
+					return
+				}
+				anyTagRun = true
+			}
+		}
+		handled = true
+		receiver.execHandler(message, key, fn, stats, count)
+	}
+
+	if len(message.messageTag) == 0 {
+		run(MessageMatchAny)
+	}
+	for _, tag := range message.messageTag {
+		run(codecs.IntFromInterface(tag))
+	}
+	if handled {
+		return
+	}
+
+	receiver.routeMutex.RLock()
+	var fn MessageProcFunc
+	switch {
+	case receiver.defaultFn == nil:
+	case tags != nil:
+		fn = receiver.composeLocked(receiver.defaultFn, scheme, tags...)
+	case len(message.messageTag) == 1:
+		fn = receiver.lookupDefault(scheme, codecs.IntFromInterface(message.messageTag[0]))
+	default:
+		fn = receiver.lookupDefault(scheme, MessageMatchAny)
+	}
+	receiver.routeMutex.RUnlock()
+	if fn != nil {
+		receiver.execHandler(message, routeKey{scheme: scheme, tag: MessageMatchAny, tp: tp}, fn, receiver.defaultStats, count)
+		return
+	}
+
+	if receiver.OnUnhandled != nil {
+		receiver.OnUnhandled(message)
+	} else {
+		utils.LogVerbose(">>> 消息 %d-%v-%d 没有对应的处理函数", scheme, message.messageTag, tp)
+	}
+}
+
+func (receiver *Dispatcher) processSync() {
+	defer receiver.group.Done()
+	for {
 		syncMessage, ok := <-receiver.syncChannel
-		if ok {
-			receiver.execMessageProc(syncMessage, false)
+		if !ok {
+			break
 		}
+		receiver.execMessageProc(syncMessage, false)
+	}
+}
+
+func (receiver *Dispatcher) processWorker(ch chan *Message) {
+	defer receiver.group.Done()
+	for {
+		message, ok := <-ch
+		if !ok {
+			break
+		}
+		receiver.execMessageProc(message, true)
+	}
+}
+
+func (receiver *Dispatcher) dispatchMessage(message *Message) {
+	if message.messageSync {
+		receiver.syncChannel <- message
+		return
+	}
+
+	if len(receiver.workers) > 0 {
+		key := receiver.ShardKey(message)
+		receiver.workers[key%uint64(len(receiver.workers))] <- message
+		return
+	}
+
+	//异步处理数量达到上限时阻塞，直到有处理完成
+	receiver.asyncSem <- 1
+	receiver.group.Add(1)
+	go func() {
+		defer func() {
+			<-receiver.asyncSem
+			receiver.group.Done()
+		}()
+		receiver.execMessageProc(message, true)
 	}()
+}
+
+func (receiver *Dispatcher) Dispatch() {
+	receiver.syncChannel = make(chan *Message, 102400)
+	receiver.asyncSem = make(chan int, MaxAsyncMessageProcCount)
+	receiver.stopCh = make(chan int)
+	receiver.stopOnce = new(sync.Once)
+
+	receiver.group.Add(1)
+	go receiver.processSync()
+
+	receiver.workers = make([]chan *Message, receiver.workerCount)
+	for i := range receiver.workers {
+		receiver.workers[i] = make(chan *Message, receiver.workerDepth)
+		receiver.group.Add(1)
+		go receiver.processWorker(receiver.workers[i])
+	}
 
+	receiver.group.Add(1)
 	go func() {
-		for {
-			if receiver.GetAsyncCount() >= MaxAsyncMessageProcCount {
-				utils.LogInfo("消息分派器阻塞 %d 协程 %d", receiver.GetAsyncCount(), runtime.NumGoroutine())
-				time.Sleep(1 * time.Millisecond)
-				continue
-			}
-			message := GlobalMessageQueue.Pop()
-			if message == nil {
-				utils.LogInfo("消息分派器抛出")
-				break
+		defer func() {
+			close(receiver.syncChannel)
+			for _, ch := range receiver.workers {
+				close(ch)
 			}
+			receiver.group.Done()
+		}()
 
-			if message.messageSync {
-				go func() {
-					receiver.syncChannel <- message
-				}()
-			} else {
-				go func() {
-					receiver.execMessageProc(message, true)
-				}()
+		for {
+			select {
+			case <-receiver.stopCh:
+				utils.LogInfo("消息分派器停止")
+				return
+			case message, ok := <-receiver.queue:
+				if !ok || message == nil {
+					utils.LogInfo("消息分派器抛出")
+					return
+				}
+				receiver.dispatchMessage(message)
 			}
 		}
 	}()
 }
 
+// 停止分派新消息，并等待已分派的消息处理完毕
+func (receiver *Dispatcher) Stop() {
+	if receiver.stopOnce == nil {
+		return
+	}
+	receiver.stopOnce.Do(func() {
+		close(receiver.stopCh)
+	})
+	receiver.group.Wait()
+}
+
+// 默认分派器，读取 GlobalMessageQueue
 var GlobalDispatcher = CreateDispatcher()
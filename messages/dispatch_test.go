@@ -0,0 +1,247 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/nnet"
+)
+
+func sessionMessage(session nnet.SessionID, seq int, sync bool) codecs.IMMap {
+	return codecs.IMMap{
+		ProtocolKeyScheme:    int64(ProtocolSchemeC2S),
+		ProtocolKeyType:      int64(10),
+		ProtocolKeySessionId: codecs.IMSlice{int64(session)},
+		ProtocolKeySync:      sync,
+		ProtocolKeyBody:      codecs.IMMap{1: int64(seq)},
+	}
+}
+
+func TestWorkerPoolKeepsPerSessionOrder(t *testing.T) {
+	const sessions, perSession = 8, 200
+	queue := CreateMessageQueue(sessions * perSession)
+	d := CreateDispatcherWithQueue(queue)
+	d.SetWorkerPool(3, 16)
+
+	var mutex sync.Mutex
+	got := make(map[nnet.SessionID][]int64)
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		session := msg.GetSessionId()[0]
+		seq := codecs.Int64FromInterface(msg.GetBody()[1])
+		mutex.Lock()
+		got[session] = append(got[session], seq)
+		mutex.Unlock()
+		//放大不同分片之间的交错
+		if seq%17 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})
+
+	d.SetQueuePolicy(QueuePolicyBlock)
+	controller := createTestController(1)
+	for i := 0; i < perSession; i++ {
+		for s := 1; s <= sessions; s++ {
+			if err := d.Push(controller, "", sessionMessage(nnet.SessionID(s), i, false)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	d.Dispatch()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	d.Stop()
+
+	if len(got) != sessions {
+		t.Fatalf("got %d sessions; want %d", len(got), sessions)
+	}
+	for session, seqs := range got {
+		if len(seqs) != perSession {
+			t.Fatalf("session %d handled %d messages; want %d", session, len(seqs), perSession)
+		}
+		for i, seq := range seqs {
+			if seq != int64(i) {
+				t.Fatalf("session %d message %d has seq %d", session, i, seq)
+			}
+		}
+	}
+}
+
+func TestSyncMessagesHandledInOrder(t *testing.T) {
+	const count = 100
+	queue := CreateMessageQueue(count)
+	d := CreateDispatcherWithQueue(queue)
+	var got []int64
+	var mutex sync.Mutex
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		mutex.Lock()
+		got = append(got, codecs.Int64FromInterface(msg.GetBody()[1]))
+		mutex.Unlock()
+		return nil
+	})
+	d.SetQueuePolicy(QueuePolicyBlock)
+	controller := createTestController(1)
+	for i := 0; i < count; i++ {
+		d.Push(controller, "", sessionMessage(nnet.SessionID(i), i, true))
+	}
+	d.Dispatch()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(queue) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	d.Stop()
+
+	//同步通道不会在处理一条后退出
+	if len(got) != count {
+		t.Fatalf("handled %d sync messages; want %d", len(got), count)
+	}
+	for i, seq := range got {
+		if seq != int64(i) {
+			t.Fatalf("message %d has seq %d", i, seq)
+		}
+	}
+}
+
+func TestQueuePolicyOnFullQueue(t *testing.T) {
+	controller := createTestController(1)
+
+	//默认不阻塞调用方，由新协程等待入队
+	handOff := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	for i := 0; i < 2; i++ {
+		if err := handOff.Push(controller, "", sessionMessage(1, i, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handOff.GetQueue().Pop()
+	if msg := handOff.GetQueue().Pop(); msg == nil {
+		t.Fatal("the handed off message was lost")
+	}
+
+	drop := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	drop.SetQueuePolicy(QueuePolicyDrop)
+	for i := 0; i < 3; i++ {
+		if err := drop.Push(controller, "", sessionMessage(1, i, false)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := drop.GetDroppedMessages(); n != 2 {
+		t.Fatalf("dropped = %d; want 2", n)
+	}
+	if msg := drop.GetQueue().Pop(); codecs.Int64FromInterface(msg.GetBody()[1]) != 0 {
+		t.Fatalf("kept %v; want the first message", msg.GetBody())
+	}
+}
+
+func TestStopWaitsForInflightHandlers(t *testing.T) {
+	queue := CreateMessageQueue(4)
+	d := CreateDispatcherWithQueue(queue)
+	var finished int32
+	started := make(chan int, 4)
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		started <- 1
+		time.Sleep(30 * time.Millisecond)
+		atomic.AddInt32(&finished, 1)
+		return nil
+	})
+	d.Dispatch()
+	controller := createTestController(1)
+	for i := 0; i < 4; i++ {
+		queue.Push(controller, "", sessionMessage(nnet.SessionID(i), i, false))
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-started:
+		case <-time.After(time.Second):
+			t.Fatal("handler did not start")
+		}
+	}
+	d.Stop()
+	if n := atomic.LoadInt32(&finished); n != 4 {
+		t.Fatalf("finished %d handlers before Stop returned; want 4", n)
+	}
+	//重复 Stop 不会阻塞或 panic
+	d.Stop()
+}
+
+func TestStopBeforeDispatch(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	d.Stop()
+}
+
+func TestDispatchersWithSeparateQueuesAreIsolated(t *testing.T) {
+	gateway := CreateDispatcherWithQueue(CreateMessageQueue(8))
+	admin := CreateDispatcherWithQueue(CreateMessageQueue(8))
+	gatewayCh := make(chan int64, 8)
+	adminCh := make(chan int64, 8)
+	gateway.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		gatewayCh <- codecs.Int64FromInterface(msg.GetBody()[1])
+		return nil
+	})
+	admin.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		adminCh <- codecs.Int64FromInterface(msg.GetBody()[1])
+		return nil
+	})
+	gateway.Dispatch()
+	admin.Dispatch()
+	defer gateway.Stop()
+	defer admin.Stop()
+
+	controller := createTestController(1)
+	//Push 可直接作为 OnDataDecoded 使用
+	var onDataDecoded func(nnet.Controller, string, codecs.IMData) error = gateway.Push
+	if err := onDataDecoded(controller, "", sessionMessage(1, 1, false)); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Push(controller, "", sessionMessage(1, 2, false)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		ch   chan int64
+		want int64
+	}{{gatewayCh, 1}, {adminCh, 2}} {
+		select {
+		case got := <-c.ch:
+			if got != c.want {
+				t.Fatalf("got %d; want %d", got, c.want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %d was not handled", c.want)
+		}
+	}
+	select {
+	case got := <-gatewayCh:
+		t.Fatalf("gateway handled extra message %d", got)
+	case got := <-adminCh:
+		t.Fatalf("admin handled extra message %d", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if len(GlobalMessageQueue) != 0 {
+		t.Fatal("global queue should not receive messages")
+	}
+	if gateway.GetQueue() == admin.GetQueue() {
+		t.Fatal("dispatchers should not share a queue")
+	}
+}
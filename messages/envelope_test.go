@@ -0,0 +1,156 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"testing"
+
+	"github.com/packing/clove/codecs"
+)
+
+func TestNegotiateEnvelopeVersion(t *testing.T) {
+	cases := map[int]int{
+		-1:                         EnvelopeVersion1,
+		0:                          EnvelopeVersion1,
+		EnvelopeVersion1:           EnvelopeVersion1,
+		EnvelopeVersion2:           EnvelopeVersion2,
+		EnvelopeVersionCurrent + 5: EnvelopeVersionCurrent,
+	}
+	for peer, want := range cases {
+		if got := NegotiateEnvelopeVersion(peer); got != want {
+			t.Fatalf("NegotiateEnvelopeVersion(%d) = %d; want %d", peer, got, want)
+		}
+	}
+	if EnvelopeSupports(EnvelopeVersion1, ProtocolKeyTrace) || !EnvelopeSupports(EnvelopeVersion2, ProtocolKeyTrace) {
+		t.Fatal("ProtocolKeyTrace was introduced in version 2")
+	}
+	if EnvelopeSupports(EnvelopeVersionCurrent, 0x7f) {
+		t.Fatal("unknown keys are not part of any envelope")
+	}
+}
+
+func TestSplitEnvelopeInfersVersionAndKeepsUnknownFields(t *testing.T) {
+	extra, version := splitEnvelope(codecs.IMMap{
+		ProtocolKeyScheme:      1,
+		int64(ProtocolKeyType): 2,
+		uint8(0x7f):            "future",
+		"name":                 "kept",
+	})
+	if version != EnvelopeVersion1 {
+		t.Fatalf("version = %d; want 1", version)
+	}
+	if len(extra) != 2 || extra[uint8(0x7f)] != "future" || extra["name"] != "kept" {
+		t.Fatalf("extra = %v", extra)
+	}
+
+	extra, version = splitEnvelope(codecs.IMMap{ProtocolKeyScheme: 1, int32(ProtocolKeyTrace): w3cExample})
+	if version != EnvelopeVersion2 || extra != nil {
+		t.Fatalf("version %d extra %v; want 2 and no extra", version, extra)
+	}
+}
+
+func TestMessageVersionFromEnvelope(t *testing.T) {
+	cases := []struct {
+		data codecs.IMMap
+		want int
+	}{
+		{codecs.IMMap{ProtocolKeyScheme: int64(1)}, EnvelopeVersion1},
+		{codecs.IMMap{ProtocolKeyTrace: w3cExample}, EnvelopeVersion2},
+		{codecs.IMMap{ProtocolKeyVersion: int64(9)}, 9},
+		//显式的版本优先于按键推断的版本
+		{codecs.IMMap{ProtocolKeyVersion: int64(1), ProtocolKeyTrace: w3cExample}, EnvelopeVersion1},
+	}
+	for _, c := range cases {
+		msg, err := MessageFromData(nil, "", c.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.GetVersion() != c.want {
+			t.Fatalf("%v: version = %d; want %d", c.data, msg.GetVersion(), c.want)
+		}
+	}
+	if v := CreateS2SMessage(1).GetVersion(); v != EnvelopeVersionCurrent {
+		t.Fatalf("new message version = %d; want current", v)
+	}
+}
+
+func TestReplyToVersion1RequestOmitsNewKeys(t *testing.T) {
+	request, _ := MessageFromData(createTestController(1), "", codecs.IMMap{
+		ProtocolKeyScheme: int64(ProtocolSchemeC2S),
+		ProtocolKeyType:   int64(10),
+		ProtocolKeySerial: int64(3),
+	})
+	parent, _ := ParseTraceContext(w3cExample)
+	reply := CreateC2SReturnMessage(request)
+	reply.SetTrace(parent)
+	data, _ := DataFromMessage(reply)
+	m := data.(codecs.IMMap)
+	if _, ok := m[ProtocolKeyVersion]; ok {
+		t.Fatal("version 1 reply must not carry ProtocolKeyVersion")
+	}
+	if _, ok := m[ProtocolKeyTrace]; ok {
+		t.Fatal("version 1 reply must not carry ProtocolKeyTrace")
+	}
+
+	//更高版本的请求以当前版本应答
+	request, _ = MessageFromData(createTestController(1), "", codecs.IMMap{ProtocolKeyVersion: int64(EnvelopeVersionCurrent + 1)})
+	data, _ = DataFromMessage(CreateC2SReturnMessage(request))
+	if v := data.(codecs.IMMap)[ProtocolKeyVersion]; v != EnvelopeVersionCurrent {
+		t.Fatalf("reply version = %v; want %d", v, EnvelopeVersionCurrent)
+	}
+}
+
+func TestUnknownFieldsSurviveRelay(t *testing.T) {
+	src := codecs.IMMap{
+		ProtocolKeyScheme:  int64(ProtocolSchemeS2S),
+		ProtocolKeyType:    int64(10),
+		ProtocolKeyVersion: int64(EnvelopeVersionCurrent + 1),
+		int64(0x7f):        "from a newer peer",
+		"meta":             codecs.IMMap{"k": "v"},
+	}
+	var data codecs.IMData = src
+	err, encoded := codecs.CodecIMv2.Encoder.Encode(&data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err, decoded, _ := codecs.CodecIMv2.Decoder.Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := MessageFromData(nil, "", decoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetType() != 10 || codecs.CreateMapReader(msg.GetExtras()).StrValueOf(0x7f, "") != "from a newer peer" {
+		t.Fatalf("type %d extras %v", msg.GetType(), msg.GetExtras())
+	}
+
+	msg.SetExtra(ProtocolKeyType, 99)
+	out, _ := DataFromMessage(msg)
+	m := out.(codecs.IMMap)
+	if m["meta"] == nil || codecs.CreateMapReader(m).StrValueOf(0x7f, "") != "from a newer peer" {
+		t.Fatalf("relayed message lost unknown fields: %v", m)
+	}
+	//与已知信封键相同的额外字段被覆盖
+	if m[ProtocolKeyType] != 10 {
+		t.Fatalf("type = %v; want 10", m[ProtocolKeyType])
+	}
+	if m[ProtocolKeyVersion] != EnvelopeVersionCurrent+1 {
+		t.Fatalf("relayed version = %v; want %d", m[ProtocolKeyVersion], EnvelopeVersionCurrent+1)
+	}
+}
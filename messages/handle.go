@@ -0,0 +1,192 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/utils"
+)
+
+// 自行从消息体解码的请求类型，需以指针接收者实现
+type BodyDecoder interface {
+	DecodeBody(body codecs.IMMap) error
+}
+
+// 自行编码为消息体的应答类型
+type BodyEncoder interface {
+	EncodeBody() (codecs.IMMap, error)
+}
+
+// 已向请求方回复过错误应答的错误，ErrorReplyMiddleware 不会再次回复
+type repliedError struct {
+	error
+}
+
+func (receiver repliedError) Cause() error {
+	return receiver.error
+}
+
+// 沿 Cause 或 Unwrap 链查找 repliedError，被中间件再次包装的已应答错误同样视为已应答
+func isRepliedError(err error) bool {
+	for err != nil {
+		if _, ok := err.(repliedError); ok {
+			return true
+		}
+		switch e := err.(type) {
+		case interface{ Cause() error }:
+			err = e.Cause()
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// 将消息体解码到 v 指向的值
+// v 实现 BodyDecoder 时由其自行解码，否则经由 JSON 转换，字段名可用 json 标签指定
+func DecodeBody(body codecs.IMMap, v interface{}) error {
+	switch dst := v.(type) {
+	case *codecs.IMMap:
+		*dst = body
+		return nil
+	case BodyDecoder:
+		return dst.DecodeBody(body)
+	}
+	bs, err := json.Marshal(jsonValueOf(body))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// 将 v 编码为消息体，规则与 DecodeBody 对应
+// 经由 JSON 转换时整数保持为 int64，[]byte 将成为 base64 字符串
+func EncodeBody(v interface{}) (codecs.IMMap, error) {
+	//处理函数返回的空指针(如 (*Reply)(nil))同样视为没有消息体
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return nil, nil
+	}
+	switch src := v.(type) {
+	case nil:
+		return nil, nil
+	case codecs.IMMap:
+		return src, nil
+	case BodyEncoder:
+		return src.EncodeBody()
+	}
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(bs))
+	decoder.UseNumber()
+	var raw interface{}
+	if err = decoder.Decode(&raw); err != nil {
+		return nil, err
+	}
+	body, ok := imValueOf(raw).(codecs.IMMap)
+	if !ok {
+		return nil, fmt.Errorf("message body must be an object, got %T", v)
+	}
+	return body, nil
+}
+
+func jsonValueOf(v codecs.IMData) interface{} {
+	switch value := v.(type) {
+	case codecs.IMMap:
+		m := make(map[string]interface{}, len(value))
+		for k, e := range value {
+			m[fmt.Sprint(k)] = jsonValueOf(e)
+		}
+		return m
+	case codecs.IMSlice:
+		s := make([]interface{}, len(value))
+		for i, e := range value {
+			s[i] = jsonValueOf(e)
+		}
+		return s
+	default:
+		return v
+	}
+}
+
+func imValueOf(v interface{}) codecs.IMData {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		m := make(codecs.IMMap, len(value))
+		for k, e := range value {
+			m[k] = imValueOf(e)
+		}
+		return m
+	case []interface{}:
+		s := make(codecs.IMSlice, len(value))
+		for i, e := range value {
+			s[i] = imValueOf(e)
+		}
+		return s
+	case json.Number:
+		if i, err := value.Int64(); err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	default:
+		return v
+	}
+}
+
+// 注册类型化的请求处理函数
+// 请求消息体被解码为 Req，返回的 Resp 编码为应答消息体并保留请求的序列号，
+// 返回错误时应答只携带由 ErrorCodeOf 得到的错误码，消息体无法解码时错误码为 ProtocolErrorCodeBadRequest
+func Handle[Req, Resp any](d *Dispatcher, scheme, tag, tp int, fn func(context.Context, *Message, Req) (Resp, error)) {
+	d.MessageMapped(scheme, tag, tp, func(msg *Message) error {
+		reply := CreateC2SReturnMessage(msg)
+
+		var req Req
+		err := DecodeBody(msg.GetBody(), &req)
+		if err != nil {
+			err = NewMessageError(ProtocolErrorCodeBadRequest, err.Error())
+		} else {
+			var resp Resp
+			resp, err = fn(msg.GetContext(), msg, req)
+			if err == nil {
+				var body codecs.IMMap
+				body, err = EncodeBody(resp)
+				reply.SetBody(body)
+			}
+		}
+		reply.SetErrorCode(ErrorCodeOf(err))
+
+		if replyErr := ReplyMessage(msg, reply); replyErr != nil {
+			utils.LogWarn(">>> 回复应答失败 %s", replyErr.Error())
+			return err
+		}
+		if err != nil {
+			return repliedError{err}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,172 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+)
+
+type echoRequest struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+type echoResponse struct {
+	Greeting string `json:"greeting"`
+	Count    int64  `json:"count"`
+}
+
+func bodyMessage(t *testing.T, controller *testController, body codecs.IMMap) *Message {
+	t.Helper()
+	msg, err := MessageFromData(controller, "", codecs.IMMap{
+		ProtocolKeyScheme: int64(ProtocolSchemeC2S),
+		ProtocolKeyType:   int64(20),
+		ProtocolKeySerial: int64(99),
+		ProtocolKeyBody:   body,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func onlyReply(t *testing.T, controller *testController) *Message {
+	t.Helper()
+	sent := controller.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies; want 1", len(sent))
+	}
+	reply, err := MessageFromData(nil, "", sent[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestHandleDecodesRequestAndEncodesReply(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	Handle(d, ProtocolSchemeC2S, MessageMatchAny, 20, func(ctx context.Context, msg *Message, req echoRequest) (echoResponse, error) {
+		return echoResponse{Greeting: "hello " + req.Name, Count: int64(req.Count * 2)}, nil
+	})
+	controller := createTestController(1)
+	d.execMessageProc(bodyMessage(t, controller, codecs.IMMap{"name": "bob", "count": int64(21)}), false)
+
+	reply := onlyReply(t, controller)
+	if reply.GetSearial() != 99 || reply.GetType() != 20 || reply.GetScheme() != ProtocolSchemeS2C {
+		t.Fatalf("reply header = serial %d type %d scheme %d", reply.GetSearial(), reply.GetType(), reply.GetScheme())
+	}
+	if reply.GetErrorCode() != ProtocolErrorCodeOK {
+		t.Fatalf("error code = %d", reply.GetErrorCode())
+	}
+	body := reply.GetBody()
+	if body["greeting"] != "hello bob" || codecs.Int64FromInterface(body["count"]) != 42 {
+		t.Fatalf("reply body = %v", body)
+	}
+}
+
+func TestHandleMapsErrorsToCodes(t *testing.T) {
+	cases := []struct {
+		err  error
+		code int
+	}{
+		{NewMessageError(7, "custom"), 7},
+		{errors.WithStack(ErrorUnauthorized), ProtocolErrorCodeUnauthorized},
+		{fmt.Errorf("plain"), ProtocolErrorCodeInternal},
+	}
+	for _, c := range cases {
+		d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+		Handle(d, ProtocolSchemeC2S, MessageMatchAny, 20, func(ctx context.Context, msg *Message, req codecs.IMMap) (*echoResponse, error) {
+			return nil, c.err
+		})
+		controller := createTestController(1)
+		d.execMessageProc(bodyMessage(t, controller, codecs.IMMap{}), false)
+		reply := onlyReply(t, controller)
+		if reply.GetErrorCode() != c.code || reply.GetBody() != nil {
+			t.Fatalf("%v: code %d body %v; want code %d without body", c.err, reply.GetErrorCode(), reply.GetBody(), c.code)
+		}
+	}
+}
+
+func TestHandleNilPointerReplyHasNoBody(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	Handle(d, ProtocolSchemeC2S, MessageMatchAny, 20, func(ctx context.Context, msg *Message, req codecs.IMMap) (*echoResponse, error) {
+		return nil, nil
+	})
+	controller := createTestController(1)
+	d.execMessageProc(bodyMessage(t, controller, codecs.IMMap{}), false)
+	reply := onlyReply(t, controller)
+	if reply.GetErrorCode() != ProtocolErrorCodeOK || reply.GetBody() != nil {
+		t.Fatalf("code %d body %v; want OK without body", reply.GetErrorCode(), reply.GetBody())
+	}
+
+	if body, err := EncodeBody((*echoResponse)(nil)); body != nil || err != nil {
+		t.Fatalf("EncodeBody = %v, %v; want nil, nil", body, err)
+	}
+}
+
+func TestHandleBadRequest(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	called := false
+	Handle(d, ProtocolSchemeC2S, MessageMatchAny, 20, func(ctx context.Context, msg *Message, req echoRequest) (echoResponse, error) {
+		called = true
+		return echoResponse{}, nil
+	})
+	controller := createTestController(1)
+	d.execMessageProc(bodyMessage(t, controller, codecs.IMMap{"count": "many"}), false)
+	if called {
+		t.Fatal("handler should not run for an undecodable body")
+	}
+	if code := onlyReply(t, controller).GetErrorCode(); code != ProtocolErrorCodeBadRequest {
+		t.Fatalf("error code = %d; want bad request", code)
+	}
+}
+
+func TestErrorReplyMiddlewareDoesNotReplyTwiceForWrappedError(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	d.Use(ErrorReplyMiddleware)
+	//位于内层的中间件再次包装了 Handle 返回的错误
+	d.Use(func(next MessageProcFunc) MessageProcFunc {
+		return func(msg *Message) error {
+			return errors.WithMessage(next(msg), "wrapped")
+		}
+	})
+	Handle(d, ProtocolSchemeC2S, MessageMatchAny, 20, func(ctx context.Context, msg *Message, req codecs.IMMap) (codecs.IMMap, error) {
+		return nil, NewMessageError(5, "failed")
+	})
+	controller := createTestController(1)
+	msg := bodyMessage(t, controller, codecs.IMMap{})
+	seen := d.chains[routeKey{scheme: ProtocolSchemeC2S, tag: MessageMatchAny, tp: 20}](msg)
+	if seen == nil {
+		t.Fatal("already replied error should be passed through")
+	}
+	if code := onlyReply(t, controller).GetErrorCode(); code != 5 {
+		t.Fatalf("error code = %d; want 5", code)
+	}
+
+	if !isRepliedError(fmt.Errorf("std: %w", repliedError{fmt.Errorf("x")})) {
+		t.Fatal("Unwrap chain should be followed")
+	}
+	if isRepliedError(errors.WithStack(fmt.Errorf("x"))) {
+		t.Fatal("plain error reported as replied")
+	}
+}
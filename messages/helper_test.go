@@ -0,0 +1,100 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/utils"
+)
+
+func TestMain(m *testing.M) {
+	utils.LogInit(utils.LogLevelError, "")
+	os.Exit(m.Run())
+}
+
+// 只实现测试需要的方法，其余方法调用时会 panic
+type testController struct {
+	nnet.Controller
+	id     nnet.SessionID
+	onSend func(data codecs.IMMap)
+	mutex  sync.Mutex
+	sent   []codecs.IMMap
+}
+
+func createTestController(id nnet.SessionID) *testController {
+	return &testController{id: id}
+}
+
+func (receiver *testController) GetSessionID() nnet.SessionID {
+	return receiver.id
+}
+
+func (receiver *testController) GetSource() string {
+	return "test"
+}
+
+func (receiver *testController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+	for _, m := range msg {
+		data := m.(codecs.IMMap)
+		receiver.mutex.Lock()
+		receiver.sent = append(receiver.sent, data)
+		onSend := receiver.onSend
+		receiver.mutex.Unlock()
+		if onSend != nil {
+			onSend(data)
+		}
+	}
+	return nil, nil
+}
+
+func (receiver *testController) SendTo(addr string, msg ...codecs.IMData) ([]codecs.IMData, error) {
+	return receiver.Send(msg...)
+}
+
+func (receiver *testController) sentMessages() []codecs.IMMap {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return append([]codecs.IMMap(nil), receiver.sent...)
+}
+
+// 以解码后的数据构造来自 controller 的消息，与队列收到的消息一致
+func createTestMessage(t *testing.T, controller nnet.Controller, scheme, tp int, tags ...int) *Message {
+	t.Helper()
+	data := codecs.IMMap{
+		ProtocolKeyScheme: int64(scheme),
+		ProtocolKeyType:   int64(tp),
+		ProtocolKeySerial: int64(7),
+	}
+	if len(tags) > 0 {
+		itags := make(codecs.IMSlice, len(tags))
+		for i, tag := range tags {
+			itags[i] = int64(tag)
+		}
+		data[ProtocolKeyTag] = itags
+	}
+	msg, err := MessageFromData(controller, "", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
@@ -18,6 +18,8 @@
 package messages
 
 import (
+	"context"
+
 	"github.com/packing/clove/codecs"
 	"github.com/packing/clove/errors"
 	"github.com/packing/clove/nnet"
@@ -42,6 +44,10 @@ type Message struct {
 	messageSrcData   codecs.IMData
 	addr             string
 	unixAddr         string
+	messageTrace     TraceContext
+	messageVersion   int
+	messageExtra     codecs.IMMap
+	ctx              context.Context
 }
 
 func MessageFromData(controller nnet.Controller, addr string, data codecs.IMData) (*Message, error) {
@@ -60,6 +66,13 @@ func MessageFromData(controller nnet.Controller, addr string, data codecs.IMData
 	msg.messageSerial = reader.IntValueOf(ProtocolKeySerial, 0)
 	msg.unixAddr = reader.StrValueOf(ProtocolKeyUnixAddr, "")
 	msg.messageAdapterId = reader.UintValueOf(ProtocolKeyKeyAdapterId, 0)
+	var keysVersion int
+	msg.messageExtra, keysVersion = splitEnvelope(mapData)
+	msg.messageVersion = int(reader.IntValueOf(ProtocolKeyVersion, int64(keysVersion)))
+	if trace := reader.StrValueOf(ProtocolKeyTrace, ""); trace != "" {
+		//无法识别的链路上下文直接忽略，不影响消息处理
+		msg.messageTrace, _ = ParseTraceContext(trace)
+	}
 
 	msg.messageSessionId = make([]nnet.SessionID, 0)
 	sessIds := reader.TryReadValue(ProtocolKeySessionId)
@@ -100,8 +113,35 @@ func MessageFromData(controller nnet.Controller, addr string, data codecs.IMData
 	return msg, nil
 }
 
+// 取出不属于已知信封键的字段(没有时为 nil)，以及出现的已知键所需的最低信封版本
+// 后者用于未携带 ProtocolKeyVersion 的消息
+func splitEnvelope(mapData codecs.IMMap) (codecs.IMMap, int) {
+	var extra codecs.IMMap
+	version := EnvelopeVersion1
+	for k, v := range mapData {
+		switch k.(type) {
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+			if keyVersion, ok := envelopeKeyVersions[codecs.IntFromInterface(k)]; ok {
+				if keyVersion > version {
+					version = keyVersion
+				}
+				continue
+			}
+		}
+		if extra == nil {
+			extra = make(codecs.IMMap)
+		}
+		extra[k] = v
+	}
+	return extra, version
+}
+
+// 按消息的信封版本编码，版本不支持的键不会写出，保留的未知字段原样写出
 func DataFromMessage(message *Message) (codecs.IMData, error) {
 	msg := make(codecs.IMMap)
+	for k, v := range message.messageExtra {
+		msg[k] = v
+	}
 	msg[ProtocolKeyScheme] = message.messageScheme
 	msg[ProtocolKeyType] = message.messageType
 	msg[ProtocolKeyTag] = message.messageTag
@@ -117,6 +157,14 @@ func DataFromMessage(message *Message) (codecs.IMData, error) {
 	msg[ProtocolKeyBody] = message.messageBody
 	msg[ProtocolKeyErrorCode] = message.messageErrorCode
 	msg[ProtocolKeySerial] = message.messageSerial
+
+	version := message.GetVersion()
+	if EnvelopeSupports(version, ProtocolKeyVersion) {
+		msg[ProtocolKeyVersion] = version
+	}
+	if message.messageTrace.IsValid() && EnvelopeSupports(version, ProtocolKeyTrace) {
+		msg[ProtocolKeyTrace] = message.messageTrace.String()
+	}
 	return msg, nil
 }
 
@@ -154,6 +202,14 @@ func (receiver Message) GetController() nnet.Controller {
 	return receiver.controller
 }
 
+// 发送该消息的本地进程凭据，仅来自开启了凭据接收的 unix 套接字的消息可用
+func (receiver Message) GetPeerCredentials() (nnet.PeerCredentials, bool) {
+	if receiver.controller == nil {
+		return nnet.PeerCredentials{}, false
+	}
+	return nnet.PeerCredentialsOf(receiver.controller)
+}
+
 func (receiver Message) GetSrcData() codecs.IMData {
 	return receiver.messageSrcData
 }
@@ -243,6 +299,60 @@ func (receiver Message) GetBody() codecs.IMMap {
 	return receiver.messageBody
 }
 
+// 消息的信封版本，新建的消息为 EnvelopeVersionCurrent
+func (receiver *Message) SetVersion(version int) {
+	receiver.messageVersion = version
+}
+
+func (receiver Message) GetVersion() int {
+	if receiver.messageVersion <= 0 {
+		return EnvelopeVersionCurrent
+	}
+	return receiver.messageVersion
+}
+
+// 读取收到消息时保留的未知信封字段
+func (receiver Message) GetExtra(key codecs.IMData) codecs.IMData {
+	return receiver.messageExtra[key]
+}
+
+// 设置额外的信封字段，与已知信封键相同的键在编码时会被覆盖
+func (receiver *Message) SetExtra(key codecs.IMData, value codecs.IMData) {
+	if receiver.messageExtra == nil {
+		receiver.messageExtra = make(codecs.IMMap)
+	}
+	receiver.messageExtra[key] = value
+}
+
+func (receiver Message) GetExtras() codecs.IMMap {
+	return receiver.messageExtra
+}
+
+// 消息携带的链路上下文，发出时写入 ProtocolKeyTrace
+func (receiver *Message) SetTrace(tc TraceContext) {
+	receiver.messageTrace = tc
+}
+
+func (receiver Message) GetTrace() TraceContext {
+	return receiver.messageTrace
+}
+
+// 处理该消息时使用的上下文，分派器会在其中放入处理函数的链路上下文
+// 未设置时为携带消息自身链路上下文的 context.Background()
+func (receiver *Message) SetContext(ctx context.Context) {
+	receiver.ctx = ctx
+}
+
+func (receiver Message) GetContext() context.Context {
+	if receiver.ctx != nil {
+		return receiver.ctx
+	}
+	if receiver.messageTrace.IsValid() {
+		return ContextWithTrace(context.Background(), receiver.messageTrace)
+	}
+	return context.Background()
+}
+
 func CreateS2SMessage(tp int) *Message {
 	msg := new(Message)
 	msg.messageType = tp
@@ -270,5 +380,25 @@ func CreateC2SReturnMessage(c2sMsg *Message) *Message {
 	msg.messageScheme = ProtocolSchemeS2C
 	msg.SetSessionId(c2sMsg.GetSessionId())
 	msg.messageSerial = c2sMsg.messageSerial
+	msg.messageTrace = c2sMsg.messageTrace
+	msg.messageVersion = NegotiateEnvelopeVersion(c2sMsg.GetVersion())
 	return msg
 }
+
+// 向请求消息的来源回复消息，来自 unix 数据报的请求将回复至其携带的 unix 地址
+func ReplyMessage(request *Message, reply *Message) error {
+	controller := request.GetController()
+	if controller == nil {
+		return errors.ErrorSessionIsNotExists
+	}
+	data, err := DataFromMessage(reply)
+	if err != nil {
+		return err
+	}
+	if request.unixAddr != "" {
+		_, err = controller.SendTo(request.unixAddr, data)
+	} else {
+		_, err = controller.Send(data)
+	}
+	return err
+}
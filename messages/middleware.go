@@ -0,0 +1,142 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"time"
+
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/utils"
+)
+
+type MessageMiddleware = func(next MessageProcFunc) MessageProcFunc
+
+// 带错误码的处理错误，ErrorReplyMiddleware 会将错误码写入应答消息
+type MessageError struct {
+	code int
+	msg  string
+}
+
+func NewMessageError(code int, msg string) *MessageError {
+	return &MessageError{code: code, msg: msg}
+}
+
+func (receiver *MessageError) Error() string {
+	return receiver.msg
+}
+
+func (receiver *MessageError) ErrorCode() int {
+	return receiver.code
+}
+
+var ErrorUnauthorized = NewMessageError(ProtocolErrorCodeUnauthorized, "The message is unauthorized")
+
+// 取得错误对应的错误码，未携带错误码的错误视为内部错误
+func ErrorCodeOf(err error) int {
+	if err == nil {
+		return ProtocolErrorCodeOK
+	}
+	if coder, ok := errors.Cause(err).(interface{ ErrorCode() int }); ok {
+		return coder.ErrorCode()
+	}
+	return ProtocolErrorCodeInternal
+}
+
+type middlewareKey struct {
+	scheme int
+	tag    int
+}
+
+func chainMiddlewares(fn MessageProcFunc, mws []MessageMiddleware) MessageProcFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		fn = mws[i](fn)
+	}
+	return fn
+}
+
+// 捕获处理函数中的panic并转换为错误
+func RecoverMiddleware(next MessageProcFunc) MessageProcFunc {
+	return func(msg *Message) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				if e, ok := r.(error); ok {
+					utils.LogPanic(e)
+				} else {
+					utils.LogError("消息处理 panic: %v", r)
+				}
+				err = errors.WithStack(panicError{value: r})
+			}
+		}()
+		return next(msg)
+	}
+}
+
+func LogMiddleware(next MessageProcFunc) MessageProcFunc {
+	return func(msg *Message) error {
+		utils.LogVerbose(">>> 处理消息 %d-%v-%d 来自 %s", msg.GetScheme(), msg.GetTag(), msg.GetType(), msg.GetSource())
+		err := next(msg)
+		if err != nil {
+			utils.LogWarn(">>> 处理消息 %d-%v-%d 返回错误 %s", msg.GetScheme(), msg.GetTag(), msg.GetType(), err.Error())
+		}
+		return err
+	}
+}
+
+// 每次处理完成后以耗时和返回的错误调用 fn，可用于统计或链路追踪
+func TimingMiddleware(fn func(*Message, time.Duration, error)) MessageMiddleware {
+	return func(next MessageProcFunc) MessageProcFunc {
+		return func(msg *Message) error {
+			st := time.Now()
+			err := next(msg)
+			fn(msg, time.Since(st), err)
+			return err
+		}
+	}
+}
+
+// check 返回错误时不再调用后续处理函数
+func AuthMiddleware(check func(*Message) error) MessageMiddleware {
+	return func(next MessageProcFunc) MessageProcFunc {
+		return func(msg *Message) error {
+			if err := check(msg); err != nil {
+				return err
+			}
+			return next(msg)
+		}
+	}
+}
+
+// 处理函数返回错误时，向请求方回复携带错误码的应答，错误在此被消化
+func ErrorReplyMiddleware(next MessageProcFunc) MessageProcFunc {
+	return func(msg *Message) error {
+		err := next(msg)
+		if err == nil {
+			return nil
+		}
+		if isRepliedError(err) {
+			return err
+		}
+		reply := CreateC2SReturnMessage(msg)
+		reply.SetErrorCode(ErrorCodeOf(err))
+		if replyErr := ReplyMessage(msg, reply); replyErr != nil {
+			utils.LogWarn(">>> 回复错误应答失败 %s", replyErr.Error())
+			return err
+		}
+		return nil
+	}
+}
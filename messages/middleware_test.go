@@ -0,0 +1,206 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+)
+
+func traceMiddleware(trace *[]string, name string) MessageMiddleware {
+	return func(next MessageProcFunc) MessageProcFunc {
+		return func(msg *Message) error {
+			*trace = append(*trace, name+">")
+			err := next(msg)
+			*trace = append(*trace, "<"+name)
+			return err
+		}
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var trace []string
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, func(msg *Message) error {
+		trace = append(trace, "handler")
+		return nil
+	})
+	d.Use(traceMiddleware(&trace, "g1"), traceMiddleware(&trace, "g2"))
+	d.UseFor(ProtocolSchemeC2S, 1, traceMiddleware(&trace, "r1"))
+	//其他标签的中间件不参与
+	d.UseFor(ProtocolSchemeC2S, 2, traceMiddleware(&trace, "r2"))
+
+	d.execMessageProc(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10, 1), false)
+	got := strings.Join(trace, " ")
+	if want := "g1> g2> r1> handler <r1 <g2 <g1"; got != want {
+		t.Fatalf("trace = %q; want %q", got, want)
+	}
+}
+
+func TestRouteMiddlewaresApplyToWildcardHandler(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var trace []string
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		trace = append(trace, "handler")
+		return nil
+	})
+	d.UseFor(ProtocolSchemeC2S, MessageMatchAny, traceMiddleware(&trace, "any"))
+	d.UseFor(ProtocolSchemeC2S, 5, traceMiddleware(&trace, "tag5"))
+	d.UseFor(ProtocolSchemeC2S, 6, traceMiddleware(&trace, "tag6"))
+
+	controller := createTestController(1)
+	d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, 10, 5), false)
+	if got, want := strings.Join(trace, " "), "any> tag5> handler <tag5 <any"; got != want {
+		t.Fatalf("trace = %q; want %q", got, want)
+	}
+
+	//通配处理函数只执行一次，经过所有标签的中间件
+	trace = nil
+	d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, 10, 5, 6), false)
+	if got, want := strings.Join(trace, " "), "any> tag5> tag6> handler <tag6 <tag5 <any"; got != want {
+		t.Fatalf("trace = %q; want %q", got, want)
+	}
+}
+
+func TestRouteMiddlewaresApplyToDefaultHandler(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var trace []string
+	d.SetDefaultHandler(func(msg *Message) error {
+		trace = append(trace, "default")
+		return nil
+	})
+	d.Use(traceMiddleware(&trace, "g"))
+	d.UseFor(ProtocolSchemeC2S, MessageMatchAny, traceMiddleware(&trace, "any"))
+	d.UseFor(ProtocolSchemeC2S, 5, traceMiddleware(&trace, "tag5"))
+
+	controller := createTestController(1)
+	cases := []struct {
+		scheme int
+		tags   []int
+		want   string
+	}{
+		{ProtocolSchemeC2S, []int{5}, "g> any> tag5> default <tag5 <any <g"},
+		{ProtocolSchemeC2S, []int{1}, "g> any> default <any <g"},
+		{ProtocolSchemeC2S, nil, "g> any> default <any <g"},
+		{ProtocolSchemeS2S, []int{5}, "g> default <g"},
+	}
+	for _, c := range cases {
+		trace = nil
+		d.execMessageProc(createTestMessage(t, controller, c.scheme, 10, c.tags...), false)
+		if got := strings.Join(trace, " "); got != c.want {
+			t.Fatalf("scheme %d tags %v: trace = %q; want %q", c.scheme, c.tags, got, c.want)
+		}
+	}
+}
+
+func TestAuthMiddlewareStopsChain(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	called := false
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, func(msg *Message) error {
+		called = true
+		return nil
+	})
+	var got error
+	d.Use(TimingMiddleware(func(msg *Message, elapsed time.Duration, err error) {
+		got = err
+	}))
+	d.Use(AuthMiddleware(func(msg *Message) error { return ErrorUnauthorized }))
+
+	d.execMessageProc(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10, 1), false)
+	if called {
+		t.Fatal("handler should not run when auth fails")
+	}
+	if got != ErrorUnauthorized {
+		t.Fatalf("timing saw err = %v; want ErrorUnauthorized", got)
+	}
+}
+
+func TestRecoverMiddlewareConvertsPanic(t *testing.T) {
+	fn := RecoverMiddleware(func(msg *Message) error { panic("boom") })
+	err := fn(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10))
+	if err == nil || !strings.Contains(err.Error(), "boom") {
+		t.Fatalf("err = %v; want panic error", err)
+	}
+	if ErrorCodeOf(err) != ProtocolErrorCodeInternal {
+		t.Fatalf("code = %d; want internal", ErrorCodeOf(err))
+	}
+}
+
+func TestErrorReplyMiddlewareRepliesWithCode(t *testing.T) {
+	controller := createTestController(1)
+	fn := ErrorReplyMiddleware(func(msg *Message) error {
+		return NewMessageError(42, "denied")
+	})
+	msg := createTestMessage(t, controller, ProtocolSchemeC2S, 10)
+	if err := fn(msg); err != nil {
+		t.Fatalf("err = %v; want nil after reply", err)
+	}
+	sent := controller.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies; want 1", len(sent))
+	}
+	reader := codecs.CreateMapReader(sent[0])
+	if code := reader.IntValueOf(ProtocolKeyErrorCode, 0); code != 42 {
+		t.Fatalf("error code = %d; want 42", code)
+	}
+	if serial := reader.IntValueOf(ProtocolKeySerial, 0); serial != msg.GetSearial() {
+		t.Fatalf("serial = %d; want %d", serial, msg.GetSearial())
+	}
+	if scheme := reader.IntValueOf(ProtocolKeyScheme, 0); scheme != ProtocolSchemeS2C {
+		t.Fatalf("scheme = %d; want S2C", scheme)
+	}
+}
+
+func TestErrorReplyMiddlewareSkipsSuccessAndWrappedCodes(t *testing.T) {
+	controller := createTestController(1)
+	ok := ErrorReplyMiddleware(func(msg *Message) error { return nil })
+	if err := ok(createTestMessage(t, controller, ProtocolSchemeC2S, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if len(controller.sentMessages()) != 0 {
+		t.Fatal("no reply expected on success")
+	}
+
+	//包装后的错误仍能取得错误码
+	wrapped := ErrorReplyMiddleware(func(msg *Message) error {
+		return errors.WithStack(ErrorUnauthorized)
+	})
+	if err := wrapped(createTestMessage(t, controller, ProtocolSchemeC2S, 10)); err != nil {
+		t.Fatal(err)
+	}
+	sent := controller.sentMessages()
+	if len(sent) != 1 {
+		t.Fatalf("sent %d replies; want 1", len(sent))
+	}
+	if code := codecs.CreateMapReader(sent[0]).IntValueOf(ProtocolKeyErrorCode, 0); code != ProtocolErrorCodeUnauthorized {
+		t.Fatalf("error code = %d; want %d", code, ProtocolErrorCodeUnauthorized)
+	}
+
+	//普通错误视为内部错误
+	plain := ErrorReplyMiddleware(func(msg *Message) error { return fmt.Errorf("oops") })
+	plain(createTestMessage(t, controller, ProtocolSchemeC2S, 10))
+	sent = controller.sentMessages()
+	if code := codecs.CreateMapReader(sent[1]).IntValueOf(ProtocolKeyErrorCode, 0); code != ProtocolErrorCodeInternal {
+		t.Fatalf("error code = %d; want internal", code)
+	}
+}
@@ -46,6 +46,8 @@ const (
 	ProtocolKeyActions = 0x29
 	ProtocolKeyCmd     = 0x30
 	ProtocolKeyResult  = 0x31
+	ProtocolKeyTrace   = 0x32
+	ProtocolKeyVersion = 0x33
 
 	ProtocolKeySidForLock   = 0x88
 	ProtocolKeyKeyForLock   = 0x89
@@ -92,6 +94,63 @@ const (
 	ProtocolTagClient  = 0x03
 	ProtocolTagStorage = 0x04
 	ProtocolTagPeer    = 0x05
+	ProtocolTagGateway = 0x06
 
-	ProtocolErrorCodeOK = 0
+	ProtocolErrorCodeOK           = 0
+	ProtocolErrorCodeInternal     = -1
+	ProtocolErrorCodeUnauthorized = -2
+	ProtocolErrorCodeBadRequest   = -3
 )
+
+/*
+消息信封版本兼容矩阵
+
+| 版本 | 新增的信封键                           | 与旧版本对端通信                                   |
+|------|----------------------------------------|----------------------------------------------------|
+| 1    | scheme/type/tag/sessionId/sync/body/   | 没有 ProtocolKeyVersion 的消息按出现的键推断版本   |
+|      | errorCode/serial/unixAddr/adapterId    |                                                    |
+| 2    | ProtocolKeyVersion, ProtocolKeyTrace   | 版本 1 的对端忽略新增键; 对版本 1 请求的应答以版本 |
+|      |                                        | 1 编码，不携带新增键                               |
+
+无法识别的信封键在 MessageFromData 中被保留，并由 DataFromMessage 原样写出，
+因此经由本版本中转的消息不会丢失更新版本对端添加的字段。
+收到高于 EnvelopeVersionCurrent 的消息时仍按已知的键解析，应答使用双方都支持的版本。
+*/
+const (
+	EnvelopeVersion1       = 1
+	EnvelopeVersion2       = 2
+	EnvelopeVersionCurrent = EnvelopeVersion2
+)
+
+// 信封键及其引入的版本
+var envelopeKeyVersions = map[int]int{
+	ProtocolKeyScheme:       EnvelopeVersion1,
+	ProtocolKeyType:         EnvelopeVersion1,
+	ProtocolKeyTag:          EnvelopeVersion1,
+	ProtocolKeySessionId:    EnvelopeVersion1,
+	ProtocolKeySync:         EnvelopeVersion1,
+	ProtocolKeyBody:         EnvelopeVersion1,
+	ProtocolKeyErrorCode:    EnvelopeVersion1,
+	ProtocolKeySerial:       EnvelopeVersion1,
+	ProtocolKeyUnixAddr:     EnvelopeVersion1,
+	ProtocolKeyKeyAdapterId: EnvelopeVersion1,
+	ProtocolKeyTrace:        EnvelopeVersion2,
+	ProtocolKeyVersion:      EnvelopeVersion2,
+}
+
+// 判断指定版本的信封是否包含 key
+func EnvelopeSupports(version int, key int) bool {
+	v, ok := envelopeKeyVersions[key]
+	return ok && v <= version
+}
+
+// 与版本为 peer 的对端通信时使用的信封版本
+func NegotiateEnvelopeVersion(peer int) int {
+	if peer <= 0 {
+		return EnvelopeVersion1
+	}
+	if peer < EnvelopeVersionCurrent {
+		return peer
+	}
+	return EnvelopeVersionCurrent
+}
@@ -24,16 +24,47 @@ import (
 
 type MessageQueue chan *Message
 
+// Dispatcher.Push 在消息队列已满时的处理方式
+const (
+	QueuePolicyHandOff = iota //由新协程等待入队，不阻塞调用方，但同一连接的消息可能乱序
+	QueuePolicyBlock          //阻塞调用方(通常为连接的读取协程)直到队列有空余，保持同一连接的消息顺序
+	QueuePolicyDrop           //直接抛弃该消息并计数
+)
+
+func CreateMessageQueue(size int) MessageQueue {
+	return make(MessageQueue, size)
+}
+
 func (receiver MessageQueue) Push(controller nnet.Controller, addr string, data codecs.IMData) error {
+	_, err := receiver.pushWithPolicy(controller, addr, data, QueuePolicyHandOff)
+	return err
+}
+
+// 按 policy 将数据推入队列，返回消息是否因队列已满被抛弃
+func (receiver MessageQueue) pushWithPolicy(controller nnet.Controller, addr string, data codecs.IMData, policy int) (bool, error) {
+	if ResolveCall(controller, addr, data) {
+		return false, nil
+	}
 	msg, err := MessageFromData(controller, addr, data)
 	if err != nil {
-		return err
+		return false, err
+	}
+	switch policy {
+	case QueuePolicyBlock:
+		receiver <- msg
+	case QueuePolicyDrop:
+		select {
+		case receiver <- msg:
+		default:
+			return true, nil
+		}
+	default:
+		var ch = receiver
+		go func() {
+			ch <- msg
+		}()
 	}
-	var ch = receiver
-	go func() {
-		ch <- msg
-	}()
-	return nil
+	return false, nil
 }
 
 func (receiver MessageQueue) Pop() *Message {
@@ -44,4 +75,5 @@ func (receiver MessageQueue) Pop() *Message {
 	return msg
 }
 
-var GlobalMessageQueue = make(MessageQueue, 102400)
+// 默认消息队列，GlobalDispatcher 从此队列读取消息
+var GlobalMessageQueue = CreateMessageQueue(102400)
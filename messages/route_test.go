@@ -0,0 +1,167 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"testing"
+)
+
+func routeRecorder(got *[]string, name string) MessageProcFunc {
+	return func(msg *Message) error {
+		*got = append(*got, name)
+		return nil
+	}
+}
+
+func TestLookupPrecedence(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var got []string
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, routeRecorder(&got, "exact"))
+	d.MessageMapped(ProtocolSchemeC2S, 1, MessageMatchAny, routeRecorder(&got, "anyType"))
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, routeRecorder(&got, "anyTag"))
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, MessageMatchAny, routeRecorder(&got, "anyAll"))
+	controller := createTestController(1)
+
+	cases := []struct {
+		tag, tp int
+		want    string
+	}{
+		{1, 10, "exact"},
+		{1, 11, "anyType"},
+		{2, 10, "anyTag"},
+		{2, 11, "anyAll"},
+	}
+	for _, c := range cases {
+		got = nil
+		d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, c.tp, c.tag), false)
+		if len(got) != 1 || got[0] != c.want {
+			t.Fatalf("tag %d type %d handled by %v; want %s", c.tag, c.tp, got, c.want)
+		}
+	}
+
+	//其他 scheme 不会匹配通配处理函数
+	got = nil
+	d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeS2S, 10, 1), false)
+	if len(got) != 0 {
+		t.Fatalf("S2S message handled by %v", got)
+	}
+}
+
+func TestWildcardRunsOncePerMessage(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var got []string
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, routeRecorder(&got, "tag1"))
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, routeRecorder(&got, "anyTag"))
+
+	d.execMessageProc(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10, 1, 2, 3), false)
+	if len(got) != 2 || got[0] != "tag1" || got[1] != "anyTag" {
+		t.Fatalf("handled by %v; want [tag1 anyTag]", got)
+	}
+
+	//没有标签的消息匹配通配标签
+	got = nil
+	d.execMessageProc(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10), false)
+	if len(got) != 1 || got[0] != "anyTag" {
+		t.Fatalf("untagged message handled by %v; want [anyTag]", got)
+	}
+}
+
+func TestDefaultHandlerAndUnhandledHook(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var got []string
+	var unhandled []*Message
+	d.OnUnhandled = func(msg *Message) { unhandled = append(unhandled, msg) }
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, routeRecorder(&got, "exact"))
+	controller := createTestController(1)
+
+	d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, 11, 1), false)
+	if len(got) != 0 || len(unhandled) != 1 || unhandled[0].GetType() != 11 {
+		t.Fatalf("got %v, unhandled %d; want only OnUnhandled", got, len(unhandled))
+	}
+
+	d.SetDefaultHandler(routeRecorder(&got, "default"))
+	d.Use(traceMiddleware(&got, "mw"))
+	d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, 11, 1), false)
+	if len(got) != 3 || got[0] != "mw>" || got[1] != "default" || got[2] != "<mw" {
+		t.Fatalf("got %v; want default handler wrapped by global middleware", got)
+	}
+	if len(unhandled) != 1 {
+		t.Fatal("OnUnhandled should not run when a default handler exists")
+	}
+
+	got = nil
+	d.SetDefaultHandler(nil)
+	d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, 11, 1), false)
+	if len(got) != 0 || len(unhandled) != 2 {
+		t.Fatalf("got %v, unhandled %d after removing default handler", got, len(unhandled))
+	}
+}
+
+func TestMessageUnmappedFallsBackToWildcard(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var got []string
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, routeRecorder(&got, "exact"))
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, MessageMatchAny, routeRecorder(&got, "anyAll"))
+	d.MessageUnmapped(ProtocolSchemeC2S, 1, 10)
+
+	d.execMessageProc(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10, 1), false)
+	if len(got) != 1 || got[0] != "anyAll" {
+		t.Fatalf("handled by %v; want [anyAll]", got)
+	}
+	//统计在注销后保留
+	if _, ok := d.stats[routeKey{scheme: ProtocolSchemeC2S, tag: 1, tp: 10}]; !ok {
+		t.Fatal("stats of unmapped route should be kept")
+	}
+}
+
+func TestMiddlewareChainComposedAtRegistration(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var got []string
+	wraps := 0
+	counting := func(next MessageProcFunc) MessageProcFunc {
+		wraps++
+		return next
+	}
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, routeRecorder(&got, "exact"))
+	d.Use(counting)
+	//后注册的路由中间件同样作用于已注册的处理函数
+	d.UseFor(ProtocolSchemeC2S, 1, traceMiddleware(&got, "r"))
+	wraps = 0
+
+	controller := createTestController(1)
+	for i := 0; i < 10; i++ {
+		got = nil
+		d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, 10, 1), false)
+	}
+	if wraps != 0 {
+		t.Fatalf("middlewares composed %d times during dispatch", wraps)
+	}
+	if len(got) != 3 || got[0] != "r>" || got[1] != "exact" || got[2] != "<r" {
+		t.Fatalf("got %v; want route middleware applied", got)
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		d.routeMutex.RLock()
+		d.lookup(ProtocolSchemeC2S, 2, 10)
+		d.lookup(ProtocolSchemeC2S, 1, 10)
+		d.routeMutex.RUnlock()
+	})
+	if allocs != 0 {
+		t.Fatalf("lookup allocates %.1f times per call", allocs)
+	}
+}
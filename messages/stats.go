@@ -0,0 +1,270 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// 处理耗时直方图各桶的上界，最后还有一个无上界的桶
+var latencyBounds = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	2500 * time.Microsecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// 直方图各桶的上界，RouteStat.Buckets 比其多一个无上界的桶
+func LatencyBounds() []time.Duration {
+	bounds := make([]time.Duration, len(latencyBounds))
+	copy(bounds, latencyBounds[:])
+	return bounds
+}
+
+// 处理函数中发生 panic 并被 RecoverMiddleware 捕获时返回的错误
+type panicError struct {
+	value interface{}
+}
+
+func (receiver panicError) Error() string {
+	return fmt.Sprintf("panic: %v", receiver.value)
+}
+
+func isPanicError(err error) bool {
+	type causer interface {
+		Cause() error
+	}
+	for err != nil {
+		if _, ok := err.(panicError); ok {
+			return true
+		}
+		cause, ok := err.(causer)
+		if !ok {
+			return false
+		}
+		err = cause.Cause()
+	}
+	return false
+}
+
+// 处理或调用的次数、错误及耗时直方图统计，零值可用，可并发使用
+type CallStats struct {
+	calls     int64
+	errors    int64
+	panics    int64
+	inFlight  int64
+	totalTime int64
+	buckets   [len(latencyBounds) + 1]int64
+}
+
+type routeStats = CallStats
+
+// 开始一次处理，计入正在处理的数量
+func (receiver *CallStats) Begin() {
+	atomic.AddInt64(&receiver.inFlight, 1)
+}
+
+// 结束一次由 Begin 开始的处理并记录其耗时和结果
+func (receiver *CallStats) End(elapsed time.Duration, err error) {
+	receiver.end(elapsed, err, false)
+}
+
+func (receiver *CallStats) end(elapsed time.Duration, err error, panicked bool) {
+	atomic.AddInt64(&receiver.inFlight, -1)
+	atomic.AddInt64(&receiver.calls, 1)
+	atomic.AddInt64(&receiver.totalTime, int64(elapsed))
+	i := sort.Search(len(latencyBounds), func(i int) bool { return elapsed <= latencyBounds[i] })
+	atomic.AddInt64(&receiver.buckets[i], 1)
+	if panicked || isPanicError(err) {
+		atomic.AddInt64(&receiver.panics, 1)
+	} else if err != nil {
+		atomic.AddInt64(&receiver.errors, 1)
+	}
+}
+
+// 清零累计统计，正在处理的数量不受影响
+func (receiver *CallStats) Reset() {
+	atomic.StoreInt64(&receiver.calls, 0)
+	atomic.StoreInt64(&receiver.errors, 0)
+	atomic.StoreInt64(&receiver.panics, 0)
+	atomic.StoreInt64(&receiver.totalTime, 0)
+	for i := range receiver.buckets {
+		atomic.StoreInt64(&receiver.buckets[i], 0)
+	}
+}
+
+func (receiver *CallStats) Snapshot() CallStat {
+	stat := CallStat{
+		Calls:     atomic.LoadInt64(&receiver.calls),
+		Errors:    atomic.LoadInt64(&receiver.errors),
+		Panics:    atomic.LoadInt64(&receiver.panics),
+		InFlight:  atomic.LoadInt64(&receiver.inFlight),
+		TotalTime: time.Duration(atomic.LoadInt64(&receiver.totalTime)),
+		Buckets:   make([]int64, len(receiver.buckets)),
+	}
+	for i := range receiver.buckets {
+		stat.Buckets[i] = atomic.LoadInt64(&receiver.buckets[i])
+	}
+	stat.P50 = stat.Percentile(0.5)
+	stat.P90 = stat.Percentile(0.9)
+	stat.P99 = stat.Percentile(0.99)
+	return stat
+}
+
+// CallStats 的快照
+type CallStat struct {
+	Calls     int64
+	Errors    int64
+	Panics    int64
+	InFlight  int64
+	TotalTime time.Duration
+	Buckets   []int64 //与 LatencyBounds 对应的各桶计数，非累计
+	P50       time.Duration
+	P90       time.Duration
+	P99       time.Duration
+}
+
+// 单个路由的处理统计，Tag/Type 为 MessageMatchAny 表示通配路由
+type RouteStat struct {
+	CallStat
+	Scheme  int
+	Tag     int
+	Type    int
+	Default bool //默认处理函数的统计
+}
+
+func routeStatOf(key routeKey, stats *routeStats) RouteStat {
+	return RouteStat{CallStat: stats.Snapshot(), Scheme: key.scheme, Tag: key.tag, Type: key.tp}
+}
+
+// 由直方图估算耗时分位数，在所在桶内线性插值，落在最后一个桶时返回最大的桶上界
+func (receiver CallStat) Percentile(p float64) time.Duration {
+	var total int64
+	for _, n := range receiver.Buckets {
+		total += n
+	}
+	if total == 0 {
+		return 0
+	}
+	rank := p * float64(total)
+	var seen int64
+	for i, n := range receiver.Buckets {
+		if n == 0 || float64(seen+n) < rank {
+			seen += n
+			continue
+		}
+		if i >= len(latencyBounds) {
+			break
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		frac := (rank - float64(seen)) / float64(n)
+		return lower + time.Duration(frac*float64(latencyBounds[i]-lower))
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+func (receiver CallStat) AverageTime() time.Duration {
+	if receiver.Calls == 0 {
+		return 0
+	}
+	return receiver.TotalTime / time.Duration(receiver.Calls)
+}
+
+// 分派器统计快照
+type DispatcherStat struct {
+	QueueDepth     int
+	QueueCapacity  int
+	SyncQueueDepth int
+	WorkerDepth    []int
+	AsyncCount     int
+	Routes         []RouteStat
+}
+
+// 取得分派器当前统计的快照，可用于导出到监控系统
+func (receiver *Dispatcher) GetStat() DispatcherStat {
+	stat := DispatcherStat{
+		QueueDepth:    len(receiver.queue),
+		QueueCapacity: cap(receiver.queue),
+		AsyncCount:    receiver.GetAsyncCount(),
+	}
+	if receiver.syncChannel != nil {
+		stat.SyncQueueDepth = len(receiver.syncChannel)
+	}
+	stat.WorkerDepth = make([]int, len(receiver.workers))
+	for i, ch := range receiver.workers {
+		stat.WorkerDepth[i] = len(ch)
+	}
+
+	receiver.routeMutex.RLock()
+	stat.Routes = make([]RouteStat, 0, len(receiver.stats)+1)
+	for key, stats := range receiver.stats {
+		stat.Routes = append(stat.Routes, routeStatOf(key, stats))
+	}
+	receiver.routeMutex.RUnlock()
+	sort.Slice(stat.Routes, func(i, j int) bool {
+		a, b := stat.Routes[i], stat.Routes[j]
+		if a.Scheme != b.Scheme {
+			return a.Scheme < b.Scheme
+		}
+		if a.Tag != b.Tag {
+			return a.Tag < b.Tag
+		}
+		return a.Type < b.Type
+	})
+
+	def := routeStatOf(routeKey{scheme: MessageMatchAny, tag: MessageMatchAny, tp: MessageMatchAny}, receiver.defaultStats)
+	def.Default = true
+	stat.Routes = append(stat.Routes, def)
+	return stat
+}
+
+// 清零各路由的累计统计及 GetAsyncInfo 的统计，正在处理的数量不受影响
+func (receiver *Dispatcher) ResetStat() {
+	receiver.routeMutex.RLock()
+	for _, stats := range receiver.stats {
+		stats.Reset()
+	}
+	receiver.routeMutex.RUnlock()
+	receiver.defaultStats.Reset()
+
+	receiver.mutexTime.Lock()
+	defer receiver.mutexTime.Unlock()
+	receiver.asyncTime = 0
+	receiver.asyncTotal = 0
+	receiver.asyncTimeMax = 0
+	receiver.asyncTimeMin = 0
+}
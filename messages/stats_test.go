@@ -0,0 +1,164 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+func TestCallStatsBucketsAndCounters(t *testing.T) {
+	var stats CallStats
+	stats.Begin()
+	stats.Begin()
+	if st := stats.Snapshot(); st.InFlight != 2 || st.Calls != 0 {
+		t.Fatalf("snapshot = %+v", st)
+	}
+	stats.End(10*time.Microsecond, nil)
+	stats.End(time.Minute, fmt.Errorf("failed"))
+	stats.Begin()
+	stats.End(75*time.Microsecond, errors.WithStack(panicError{value: "boom"}))
+	stats.Begin()
+	stats.end(time.Millisecond, nil, true)
+
+	st := stats.Snapshot()
+	if st.Calls != 4 || st.Errors != 1 || st.Panics != 2 || st.InFlight != 0 {
+		t.Fatalf("snapshot = %+v", st)
+	}
+	if len(st.Buckets) != len(LatencyBounds())+1 {
+		t.Fatalf("%d buckets; want %d", len(st.Buckets), len(LatencyBounds())+1)
+	}
+	//上界包含在桶内
+	want := map[int]int64{0: 1, 1: 1, 4: 1, len(st.Buckets) - 1: 1}
+	for i, n := range st.Buckets {
+		if n != want[i] {
+			t.Fatalf("bucket %d = %d; want %d (buckets %v)", i, n, want[i], st.Buckets)
+		}
+	}
+	if avg := st.AverageTime(); avg != st.TotalTime/4 {
+		t.Fatalf("average = %v", avg)
+	}
+
+	stats.Begin()
+	stats.Reset()
+	st = stats.Snapshot()
+	if st.Calls != 0 || st.Errors != 0 || st.Panics != 0 || st.TotalTime != 0 || st.InFlight != 1 {
+		t.Fatalf("after reset = %+v", st)
+	}
+	if st.AverageTime() != 0 || st.Percentile(0.5) != 0 {
+		t.Fatal("empty stats should report zero times")
+	}
+}
+
+func TestPercentileInterpolatesWithinBucket(t *testing.T) {
+	bounds := LatencyBounds()
+	buckets := func(counts map[int]int64) []int64 {
+		b := make([]int64, len(bounds)+1)
+		for i, n := range counts {
+			b[i] = n
+		}
+		return b
+	}
+	cases := []struct {
+		counts map[int]int64
+		p      float64
+		want   time.Duration
+	}{
+		{map[int]int64{0: 100}, 0.5, 25 * time.Microsecond},
+		{map[int]int64{1: 10, 2: 10}, 0.5, 100 * time.Microsecond},
+		{map[int]int64{1: 10, 2: 10}, 0.75, 175 * time.Microsecond},
+		{map[int]int64{1: 10, 2: 10}, 1, 250 * time.Microsecond},
+		//超出最大上界的部分只能报告最大上界
+		{map[int]int64{0: 1, len(bounds): 9}, 0.99, bounds[len(bounds)-1]},
+	}
+	for _, c := range cases {
+		st := CallStat{Buckets: buckets(c.counts)}
+		if got := st.Percentile(c.p); got != c.want {
+			t.Fatalf("p%v of %v = %v; want %v", c.p*100, c.counts, got, c.want)
+		}
+	}
+}
+
+func TestDispatcherRouteStats(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(4))
+	d.Use(RecoverMiddleware)
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, func(msg *Message) error { return nil })
+	d.MessageMapped(ProtocolSchemeC2S, 1, 11, func(msg *Message) error { return fmt.Errorf("failed") })
+	d.MessageMapped(ProtocolSchemeC2S, 1, 12, func(msg *Message) error { panic("boom") })
+	d.SetDefaultHandler(func(msg *Message) error { return nil })
+	controller := createTestController(1)
+	for _, tp := range []int{10, 10, 11, 12, 13} {
+		d.execMessageProc(createTestMessage(t, controller, ProtocolSchemeC2S, tp, 1), true)
+	}
+
+	stat := d.GetStat()
+	if stat.QueueCapacity != 4 || stat.QueueDepth != 0 {
+		t.Fatalf("queue depth %d capacity %d", stat.QueueDepth, stat.QueueCapacity)
+	}
+	if len(stat.Routes) != 4 {
+		t.Fatalf("%d routes; want 3 and default", len(stat.Routes))
+	}
+	want := []struct {
+		tp                    int
+		calls, errors, panics int64
+	}{{10, 2, 0, 0}, {11, 1, 1, 0}, {12, 1, 0, 1}}
+	for i, w := range want {
+		r := stat.Routes[i]
+		if r.Type != w.tp || r.Calls != w.calls || r.Errors != w.errors || r.Panics != w.panics || r.Default {
+			t.Fatalf("route %d = %+v; want %+v", i, r, w)
+		}
+	}
+	if def := stat.Routes[3]; !def.Default || def.Calls != 1 {
+		t.Fatalf("default route = %+v", def)
+	}
+
+	avg, max, min := d.GetAsyncInfo()
+	if avg <= 0 || max < min || min <= 0 {
+		t.Fatalf("async info = %d %d %d", avg, max, min)
+	}
+	d.ResetStat()
+	if avg, max, min := d.GetAsyncInfo(); avg != 0 || max != 0 || min != 0 {
+		t.Fatalf("async info after reset = %d %d %d", avg, max, min)
+	}
+	if r := d.GetStat().Routes[0]; r.Calls != 0 {
+		t.Fatalf("route after reset = %+v", r)
+	}
+}
+
+func TestUnrecoveredPanicIsCountedAndRethrown(t *testing.T) {
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	d.MessageMapped(ProtocolSchemeC2S, 1, 10, func(msg *Message) error { panic("boom") })
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Fatalf("recovered %v; want boom", r)
+			}
+		}()
+		d.execMessageProc(createTestMessage(t, createTestController(1), ProtocolSchemeC2S, 10, 1), true)
+	}()
+	r := d.GetStat().Routes[0]
+	if r.Calls != 1 || r.Panics != 1 || r.InFlight != 0 {
+		t.Fatalf("route = %+v", r)
+	}
+	if d.GetAsyncCount() != 0 {
+		t.Fatalf("async count = %d after panic", d.GetAsyncCount())
+	}
+}
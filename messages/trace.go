@@ -0,0 +1,195 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+var ErrorInvalidTraceContext = errors.Errorf("The trace context is invalid")
+
+// 随消息在进程间传递的链路上下文，文本形式与 W3C traceparent 相同
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Sampled bool
+}
+
+func (receiver TraceContext) IsValid() bool {
+	return receiver.TraceID != [16]byte{} && receiver.SpanID != [8]byte{}
+}
+
+func (receiver TraceContext) String() string {
+	flags := 0
+	if receiver.Sampled {
+		flags = 1
+	}
+	return fmt.Sprintf("00-%x-%x-%02x", receiver.TraceID, receiver.SpanID, flags)
+}
+
+func ParseTraceContext(s string) (TraceContext, error) {
+	var tc TraceContext
+	parts := strings.Split(s, "-")
+	if len(parts) != 4 || parts[0] != "00" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tc, ErrorInvalidTraceContext
+	}
+	if _, err := hex.Decode(tc.TraceID[:], []byte(parts[1])); err != nil {
+		return tc, ErrorInvalidTraceContext
+	}
+	if _, err := hex.Decode(tc.SpanID[:], []byte(parts[2])); err != nil {
+		return tc, ErrorInvalidTraceContext
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return tc, ErrorInvalidTraceContext
+	}
+	tc.Sampled = flags[0]&1 == 1
+	if !tc.IsValid() {
+		return tc, ErrorInvalidTraceContext
+	}
+	return tc, nil
+}
+
+type traceContextKey struct{}
+
+func ContextWithTrace(ctx context.Context, tc TraceContext) context.Context {
+	return context.WithValue(ctx, traceContextKey{}, tc)
+}
+
+func TraceFromContext(ctx context.Context) (TraceContext, bool) {
+	tc, ok := ctx.Value(traceContextKey{}).(TraceContext)
+	return tc, ok && tc.IsValid()
+}
+
+// 一次处理或调用的耗时记录，由 StartSpan 创建，调用 End 后交给 SpanExporter
+type Span struct {
+	Name       string
+	Context    TraceContext
+	ParentID   [8]byte
+	StartTime  time.Time
+	EndTime    time.Time
+	Attributes map[string]interface{}
+	Error      string
+}
+
+func (receiver *Span) SetAttribute(key string, value interface{}) {
+	if receiver == nil {
+		return
+	}
+	if receiver.Attributes == nil {
+		receiver.Attributes = make(map[string]interface{})
+	}
+	receiver.Attributes[key] = value
+}
+
+// 结束并导出，err 不为空时记录为失败，对 nil 调用无效果
+func (receiver *Span) End(err error) {
+	if receiver == nil {
+		return
+	}
+	receiver.EndTime = time.Now()
+	if err != nil {
+		receiver.Error = err.Error()
+	}
+	if exporter := getSpanExporter(); exporter != nil && receiver.Context.Sampled {
+		exporter.ExportSpan(receiver)
+	}
+}
+
+type SpanExporter interface {
+	ExportSpan(span *Span)
+}
+
+var spanExporter SpanExporter
+var spanExporterMutex sync.RWMutex
+
+// 设置全局的 Span 导出器，为 nil 时只传递链路上下文而不记录 Span
+func SetSpanExporter(exporter SpanExporter) {
+	spanExporterMutex.Lock()
+	defer spanExporterMutex.Unlock()
+	spanExporter = exporter
+}
+
+func getSpanExporter() SpanExporter {
+	spanExporterMutex.RLock()
+	defer spanExporterMutex.RUnlock()
+	return spanExporter
+}
+
+func newSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return
+}
+
+// 以 ctx 中的链路上下文为父节点开始一个 Span，没有时开始新的链路
+// 没有设置导出器且 ctx 中没有链路上下文时不产生 Span，返回的 Span 为 nil
+func StartSpan(ctx context.Context, name string) (context.Context, *Span) {
+	parent, hasParent := TraceFromContext(ctx)
+	if !hasParent && getSpanExporter() == nil {
+		return ctx, nil
+	}
+	span := &Span{Name: name, StartTime: time.Now()}
+	if hasParent {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Sampled = parent.Sampled
+		span.ParentID = parent.SpanID
+	} else {
+		rand.Read(span.Context.TraceID[:])
+		span.Context.Sampled = true
+	}
+	span.Context.SpanID = newSpanID()
+	return ContextWithTrace(ctx, span.Context), span
+}
+
+// 将 Span 保存在内存中的导出器，用于测试
+type MemorySpanExporter struct {
+	spans []Span
+	mutex sync.Mutex
+}
+
+func CreateMemorySpanExporter() *MemorySpanExporter {
+	return new(MemorySpanExporter)
+}
+
+func (receiver *MemorySpanExporter) ExportSpan(span *Span) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.spans = append(receiver.spans, *span)
+}
+
+func (receiver *MemorySpanExporter) Spans() []Span {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	spans := make([]Span, len(receiver.spans))
+	copy(spans, receiver.spans)
+	return spans
+}
+
+func (receiver *MemorySpanExporter) Reset() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.spans = nil
+}
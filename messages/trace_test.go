@@ -0,0 +1,210 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package messages
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/packing/clove/codecs"
+)
+
+const w3cExample = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func TestTraceContextRoundTrip(t *testing.T) {
+	tc, err := ParseTraceContext(w3cExample)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tc.Sampled || tc.TraceID[0] != 0x4b || tc.SpanID[7] != 0xb7 {
+		t.Fatalf("parsed %+v", tc)
+	}
+	if got := tc.String(); got != w3cExample {
+		t.Fatalf("String() = %s; want %s", got, w3cExample)
+	}
+
+	//只使用 sampled 标志位
+	tc, err = ParseTraceContext("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-02")
+	if err != nil || tc.Sampled {
+		t.Fatalf("flags 02: %+v, %v; want not sampled", tc, err)
+	}
+	if got := tc.String(); !strings.HasSuffix(got, "-00") {
+		t.Fatalf("String() = %s; want flags 00", got)
+	}
+}
+
+func TestParseTraceContextRejectsInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1",
+		"00-zbf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902bz-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-zz",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		w3cExample + "-extra",
+	}
+	for _, s := range invalid {
+		if _, err := ParseTraceContext(s); err != ErrorInvalidTraceContext {
+			t.Fatalf("ParseTraceContext(%q) err = %v; want ErrorInvalidTraceContext", s, err)
+		}
+	}
+}
+
+func TestStartSpanWithAndWithoutParent(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "orphan")
+	if span != nil || ctx != context.Background() {
+		t.Fatal("no span expected without parent or exporter")
+	}
+	//对 nil Span 的调用无效果
+	span.SetAttribute("k", 1)
+	span.End(nil)
+
+	parent, _ := ParseTraceContext(w3cExample)
+	ctx, span = StartSpan(ContextWithTrace(context.Background(), parent), "child")
+	if span == nil {
+		t.Fatal("span expected with a parent")
+	}
+	if span.Context.TraceID != parent.TraceID || span.ParentID != parent.SpanID || span.Context.SpanID == parent.SpanID {
+		t.Fatalf("span = %+v", span)
+	}
+	if tc, ok := TraceFromContext(ctx); !ok || tc != span.Context {
+		t.Fatalf("context carries %+v, %v", tc, ok)
+	}
+
+	exporter := CreateMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+	_, root := StartSpan(context.Background(), "root")
+	if root == nil || !root.Context.IsValid() || !root.Context.Sampled || root.ParentID != [8]byte{} {
+		t.Fatalf("root span = %+v", root)
+	}
+	root.End(nil)
+	span.End(nil)
+	spans := exporter.Spans()
+	if len(spans) != 2 || spans[0].Name != "root" || spans[1].Name != "child" {
+		t.Fatalf("exported %+v", spans)
+	}
+
+	//未采样的链路不导出
+	exporter.Reset()
+	parent.Sampled = false
+	_, span = StartSpan(ContextWithTrace(context.Background(), parent), "unsampled")
+	span.End(nil)
+	if len(exporter.Spans()) != 0 {
+		t.Fatal("unsampled span should not be exported")
+	}
+}
+
+func TestTracePropagatesThroughMessages(t *testing.T) {
+	parent, _ := ParseTraceContext(w3cExample)
+	msg, err := MessageFromData(createTestController(1), "", codecs.IMMap{
+		ProtocolKeyScheme: int64(ProtocolSchemeC2S),
+		ProtocolKeyType:   int64(10),
+		ProtocolKeyTrace:  w3cExample,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.GetTrace() != parent {
+		t.Fatalf("trace = %+v", msg.GetTrace())
+	}
+	if tc, ok := TraceFromContext(msg.GetContext()); !ok || tc != parent {
+		t.Fatal("message context should carry its trace")
+	}
+
+	//应答沿用请求的链路上下文
+	data, err := DataFromMessage(CreateC2SReturnMessage(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data.(codecs.IMMap)[ProtocolKeyTrace] != w3cExample {
+		t.Fatalf("reply trace = %v", data.(codecs.IMMap)[ProtocolKeyTrace])
+	}
+
+	//无法识别的链路上下文被忽略
+	msg, err = MessageFromData(nil, "", codecs.IMMap{ProtocolKeyTrace: "garbage"})
+	if err != nil || msg.GetTrace().IsValid() {
+		t.Fatalf("garbage trace: %+v, %v", msg.GetTrace(), err)
+	}
+}
+
+func TestDispatcherRecordsHandlerSpan(t *testing.T) {
+	exporter := CreateMemorySpanExporter()
+	SetSpanExporter(exporter)
+	defer SetSpanExporter(nil)
+
+	d := CreateDispatcherWithQueue(CreateMessageQueue(1))
+	var handlerTrace TraceContext
+	d.MessageMapped(ProtocolSchemeC2S, MessageMatchAny, 10, func(msg *Message) error {
+		handlerTrace, _ = TraceFromContext(msg.GetContext())
+		return ErrorUnauthorized
+	})
+	msg, _ := MessageFromData(createTestController(1), "", codecs.IMMap{
+		ProtocolKeyScheme: int64(ProtocolSchemeC2S),
+		ProtocolKeyType:   int64(10),
+		ProtocolKeyTrace:  w3cExample,
+	})
+	d.execMessageProc(msg, false)
+
+	spans := exporter.Spans()
+	if len(spans) != 1 {
+		t.Fatalf("exported %d spans; want 1", len(spans))
+	}
+	span := spans[0]
+	parent := msg.GetTrace()
+	if span.Name != "handle 1-*-10" || span.Context.TraceID != parent.TraceID || span.ParentID != parent.SpanID {
+		t.Fatalf("span = %+v", span)
+	}
+	if span.Error != ErrorUnauthorized.Error() {
+		t.Fatalf("span error = %q", span.Error)
+	}
+	if handlerTrace != span.Context {
+		t.Fatal("handler context should carry the handler span")
+	}
+	//处理结束后恢复消息原有的上下文
+	if tc, _ := TraceFromContext(msg.GetContext()); tc != parent {
+		t.Fatal("message context was not restored")
+	}
+}
+
+func TestCallWritesTraceIntoRequest(t *testing.T) {
+	parent, _ := ParseTraceContext(w3cExample)
+	controller := createTestController(1)
+	var sent codecs.IMMap
+	controller.onSend = func(data codecs.IMMap) {
+		sent = data
+		go ResolveCall(controller, "", replyTo(data, nil))
+	}
+	if _, err := Call(ContextWithTrace(context.Background(), parent), controller, CreateS2SMessage(100)); err != nil {
+		t.Fatal(err)
+	}
+	tc, err := ParseTraceContext(codecs.CreateMapReader(sent).StrValueOf(ProtocolKeyTrace, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.TraceID != parent.TraceID || tc.SpanID == parent.SpanID {
+		t.Fatalf("request trace = %+v; want a child of %+v", tc, parent)
+	}
+}
@@ -0,0 +1,333 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/messages"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/storage"
+	"github.com/packing/clove/utils"
+)
+
+const ContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+var mutex sync.RWMutex
+var servers = make(map[string]*nnet.TCPServer)
+var dispatchers = make(map[string]*messages.Dispatcher)
+var storages = make(map[string]*storage.Client)
+
+// 注册需要导出连接数的 TCP 服务，name 作为 server 标签的值
+func RegisterTCPServer(name string, server *nnet.TCPServer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	servers[name] = server
+}
+
+// 注册需要导出统计的分派器，name 作为 dispatcher 标签的值
+func RegisterDispatcher(name string, dispatcher *messages.Dispatcher) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	dispatchers[name] = dispatcher
+}
+
+// 注册需要导出调用耗时的存储客户端，name 作为 client 标签的值
+func RegisterStorageClient(name string, client *storage.Client) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	storages[name] = client
+}
+
+// 移除以 name 注册的所有对象
+func Unregister(name string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	delete(servers, name)
+	delete(dispatchers, name)
+	delete(storages, name)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type metricWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func (receiver *metricWriter) family(name, tp, help string) {
+	receiver.printf("# TYPE %s %s\n# HELP %s %s\n", name, tp, name, help)
+}
+
+func (receiver *metricWriter) sample(name string, labels []string, value float64) {
+	receiver.printf("%s%s %s\n", name, formatLabels(labels), strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (receiver *metricWriter) printf(format string, args ...interface{}) {
+	if receiver.err != nil {
+		return
+	}
+	_, receiver.err = fmt.Fprintf(receiver.w, format, args...)
+}
+
+// labels 为交替排列的标签名和值
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(labels[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(labels[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+func withLabel(labels []string, name, value string) []string {
+	l := make([]string, 0, len(labels)+2)
+	l = append(l, labels...)
+	return append(l, name, value)
+}
+
+// 以 OpenMetrics 直方图输出，桶计数转为累计值
+func (receiver *metricWriter) histogram(name string, labels []string, stat messages.CallStat) {
+	bounds := messages.LatencyBounds()
+	var cumulative int64
+	for i, n := range stat.Buckets {
+		cumulative += n
+		le := "+Inf"
+		if i < len(bounds) {
+			le = strconv.FormatFloat(bounds[i].Seconds(), 'g', -1, 64)
+		}
+		receiver.sample(name+"_bucket", withLabel(labels, "le", le), float64(cumulative))
+	}
+	receiver.sample(name+"_count", labels, float64(cumulative))
+	receiver.sample(name+"_sum", labels, stat.TotalTime.Seconds())
+}
+
+// 以 OpenMetrics 文本格式写出当前的全部统计
+func WriteTo(w io.Writer) error {
+	mw := &metricWriter{w: bufio.NewWriter(w)}
+
+	writeNetMetrics(mw)
+
+	mutex.RLock()
+	serverNames := sortedKeys(servers)
+	dispatcherNames := sortedKeys(dispatchers)
+	storageNames := sortedKeys(storages)
+
+	mw.family("clove_tcp_server_connections", "gauge", "Connections of the TCP server by packet format.")
+	for _, name := range serverNames {
+		counts := servers[name].GetFormatCounts()
+		formats := sortedKeys(counts)
+		for _, format := range formats {
+			mw.sample("clove_tcp_server_connections", []string{"server", name, "format", format}, float64(counts[format]))
+		}
+	}
+
+	dispatcherStats := make([]messages.DispatcherStat, len(dispatcherNames))
+	for i, name := range dispatcherNames {
+		dispatcherStats[i] = dispatchers[name].GetStat()
+	}
+	storageStats := make([]messages.CallStat, len(storageNames))
+	for i, name := range storageNames {
+		storageStats[i] = storages[name].GetCallStat()
+	}
+	mutex.RUnlock()
+
+	writeDispatcherMetrics(mw, dispatcherNames, dispatcherStats)
+	writeStorageMetrics(mw, storageNames, storageStats)
+
+	mw.printf("# EOF\n")
+	if mw.err != nil {
+		return mw.err
+	}
+	return mw.w.Flush()
+}
+
+func writeNetMetrics(mw *metricWriter) {
+	counters := []struct {
+		name  string
+		help  string
+		value int
+	}{
+		{"clove_tcp_sent_bytes", "Bytes written to TCP connections.", nnet.GetTotalTcpSendSize()},
+		{"clove_tcp_received_bytes", "Bytes read from TCP connections.", nnet.GetTotalTcpRecvSize()},
+		{"clove_unix_sent_bytes", "Bytes written to unix sockets.", nnet.GetTotalUnixSendSize()},
+		{"clove_unix_received_bytes", "Bytes read from unix sockets.", nnet.GetTotalUnixRecvSize()},
+		{"clove_handle_received_bytes", "Bytes received along with file handles.", nnet.GetTotalHandleRecvSize()},
+	}
+	for _, c := range counters {
+		mw.family(c.name, "counter", c.help)
+		mw.sample(c.name+"_total", nil, float64(c.value))
+	}
+
+	encodeTime, encodeCount := nnet.GetEncodeTotal()
+	mw.family("clove_encode_seconds", "summary", "Time spent encoding messages.")
+	mw.sample("clove_encode_seconds_count", nil, float64(encodeCount))
+	mw.sample("clove_encode_seconds_sum", nil, time.Duration(encodeTime).Seconds())
+	decodeTime, decodeCount := nnet.GetDecodeTotal()
+	mw.family("clove_decode_seconds", "summary", "Time spent decoding messages.")
+	mw.sample("clove_decode_seconds_count", nil, float64(decodeCount))
+	mw.sample("clove_decode_seconds_sum", nil, time.Duration(decodeTime).Seconds())
+
+	mw.family("clove_decode_instances", "gauge", "Decodes in progress.")
+	mw.sample("clove_decode_instances", nil, float64(nnet.GetDecodeInstanceCount()))
+
+	counts := nnet.GetControllerCounts()
+	kinds := sortedKeys(counts)
+	mw.family("clove_controllers", "gauge", "Scheduled controllers by kind.")
+	for _, kind := range kinds {
+		mw.sample("clove_controllers", []string{"kind", kind}, float64(counts[kind]))
+	}
+}
+
+func routeValue(v int) string {
+	if v == messages.MessageMatchAny {
+		return "*"
+	}
+	return strconv.Itoa(v)
+}
+
+// 默认处理函数的 handler 标签为 default，其余为 route
+func routeLabels(dispatcher string, route messages.RouteStat) []string {
+	handler := "route"
+	if route.Default {
+		handler = "default"
+	}
+	return []string{"dispatcher", dispatcher, "handler", handler,
+		"scheme", routeValue(route.Scheme), "tag", routeValue(route.Tag), "type", routeValue(route.Type)}
+}
+
+func writeDispatcherMetrics(mw *metricWriter, names []string, stats []messages.DispatcherStat) {
+	gauges := []struct {
+		name  string
+		help  string
+		value func(messages.DispatcherStat) int
+	}{
+		{"clove_dispatcher_queue_depth", "Messages waiting in the dispatcher queue.", func(s messages.DispatcherStat) int { return s.QueueDepth }},
+		{"clove_dispatcher_queue_capacity", "Capacity of the dispatcher queue.", func(s messages.DispatcherStat) int { return s.QueueCapacity }},
+		{"clove_dispatcher_sync_queue_depth", "Sync messages waiting to be handled.", func(s messages.DispatcherStat) int { return s.SyncQueueDepth }},
+		{"clove_dispatcher_async_handlers", "Async handlers in progress.", func(s messages.DispatcherStat) int { return s.AsyncCount }},
+	}
+	for _, g := range gauges {
+		mw.family(g.name, "gauge", g.help)
+		for i, name := range names {
+			mw.sample(g.name, []string{"dispatcher", name}, float64(g.value(stats[i])))
+		}
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value func(messages.RouteStat) int64
+	}{
+		{"clove_dispatcher_handler_errors", "Handler calls that returned an error.", func(s messages.RouteStat) int64 { return s.Errors }},
+		{"clove_dispatcher_handler_panics", "Handler calls that panicked.", func(s messages.RouteStat) int64 { return s.Panics }},
+	}
+	for _, c := range counters {
+		mw.family(c.name, "counter", c.help)
+		for i, name := range names {
+			for _, route := range stats[i].Routes {
+				mw.sample(c.name+"_total", routeLabels(name, route), float64(c.value(route)))
+			}
+		}
+	}
+
+	mw.family("clove_dispatcher_handlers_in_flight", "gauge", "Handlers currently running.")
+	for i, name := range names {
+		for _, route := range stats[i].Routes {
+			mw.sample("clove_dispatcher_handlers_in_flight", routeLabels(name, route), float64(route.InFlight))
+		}
+	}
+
+	mw.family("clove_dispatcher_handler_seconds", "histogram", "Handler latency.")
+	for i, name := range names {
+		for _, route := range stats[i].Routes {
+			mw.histogram("clove_dispatcher_handler_seconds", routeLabels(name, route), route.CallStat)
+		}
+	}
+}
+
+func writeStorageMetrics(mw *metricWriter, names []string, stats []messages.CallStat) {
+	mw.family("clove_storage_call_errors", "counter", "Storage calls that failed or timed out.")
+	for i, name := range names {
+		mw.sample("clove_storage_call_errors_total", []string{"client", name}, float64(stats[i].Errors))
+	}
+	mw.family("clove_storage_call_seconds", "histogram", "Storage call latency.")
+	for i, name := range names {
+		mw.histogram("clove_storage_call_seconds", []string{"client", name}, stats[i])
+	}
+}
+
+// 输出 OpenMetrics 文本的 http.Handler
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		if err := WriteTo(w); err != nil {
+			utils.LogVerbose(">>> 输出统计失败 %s", err.Error())
+		}
+	})
+}
+
+// 在 addr 上启动提供 /metrics 的 HTTP 服务，返回的服务可用于关闭
+func Serve(addr string) (*http.Server, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux}
+	go func() {
+		if err := server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			utils.LogError("统计服务异常退出 %s", err.Error())
+		}
+	}()
+	utils.LogInfo("统计服务已启动 %s", ln.Addr().String())
+	return server, nil
+}
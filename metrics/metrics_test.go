@@ -0,0 +1,196 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package metrics
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/messages"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/utils"
+)
+
+func TestMain(m *testing.M) {
+	utils.LogInit(utils.LogLevelError, "")
+	os.Exit(m.Run())
+}
+
+func TestFormatLabels(t *testing.T) {
+	if got := formatLabels(nil); got != "" {
+		t.Fatalf("formatLabels(nil) = %q", got)
+	}
+	got := formatLabels([]string{"a", "x", "b", "q\"u\\o\nte"})
+	if want := `{a="x",b="q\"u\\o\nte"}`; got != want {
+		t.Fatalf("formatLabels = %s; want %s", got, want)
+	}
+}
+
+func TestHistogramIsCumulative(t *testing.T) {
+	bounds := messages.LatencyBounds()
+	stat := messages.CallStat{Buckets: make([]int64, len(bounds)+1), TotalTime: 1500 * time.Millisecond}
+	stat.Buckets[0] = 2
+	stat.Buckets[3] = 1
+	stat.Buckets[len(bounds)] = 4
+
+	var buf bytes.Buffer
+	mw := &metricWriter{w: bufio.NewWriter(&buf)}
+	mw.histogram("h", []string{"k", "v"}, stat)
+	mw.w.Flush()
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(bounds)+3 {
+		t.Fatalf("%d lines; want %d", len(lines), len(bounds)+3)
+	}
+	if want := `h_bucket{k="v",le="5e-05"} 2`; lines[0] != want {
+		t.Fatalf("first bucket = %s; want %s", lines[0], want)
+	}
+	if want := `h_bucket{k="v",le="0.0005"} 3`; lines[3] != want {
+		t.Fatalf("bucket 3 = %s; want %s", lines[3], want)
+	}
+	if want := `h_bucket{k="v",le="10"} 3`; lines[len(bounds)-1] != want {
+		t.Fatalf("last bounded bucket = %s; want %s", lines[len(bounds)-1], want)
+	}
+	tail := lines[len(bounds):]
+	want := []string{`h_bucket{k="v",le="+Inf"} 7`, `h_count{k="v"} 7`, `h_sum{k="v"} 1.5`}
+	for i := range want {
+		if tail[i] != want[i] {
+			t.Fatalf("line %q; want %q", tail[i], want[i])
+		}
+	}
+}
+
+// 按 OpenMetrics 的要求检查: 每个指标族只声明一次且 TYPE 后紧跟 HELP，
+// 样本名属于最近声明的指标族并带有与类型对应的后缀，以 # EOF 结尾
+func checkOpenMetrics(t *testing.T, text string) map[string]string {
+	t.Helper()
+	if !strings.HasSuffix(text, "# EOF\n") {
+		t.Fatal("output must end with # EOF")
+	}
+	suffixes := map[string][]string{
+		"counter":   {"_total"},
+		"gauge":     {""},
+		"summary":   {"_count", "_sum"},
+		"histogram": {"_bucket", "_count", "_sum"},
+	}
+	samples := make(map[string]string)
+	declared := make(map[string]bool)
+	var family, tp string
+	lines := strings.Split(strings.TrimSuffix(text, "# EOF\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			parts := strings.Fields(line)
+			if len(parts) != 4 {
+				t.Fatalf("bad TYPE line %q", line)
+			}
+			family, tp = parts[2], parts[3]
+			if declared[family] {
+				t.Fatalf("family %s declared twice", family)
+			}
+			declared[family] = true
+			if _, ok := suffixes[tp]; !ok {
+				t.Fatalf("unknown type %q", tp)
+			}
+			if strings.HasSuffix(family, "_total") {
+				t.Fatalf("family name %s must not end with _total", family)
+			}
+			if i+1 >= len(lines) || !strings.HasPrefix(lines[i+1], "# HELP "+family+" ") {
+				t.Fatalf("TYPE %s not followed by its HELP", family)
+			}
+			i++
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			t.Fatalf("unexpected comment %q", line)
+		}
+		sp := strings.LastIndexByte(line, ' ')
+		if sp < 0 {
+			t.Fatalf("bad sample %q", line)
+		}
+		series := line[:sp]
+		name := series
+		if brace := strings.IndexByte(series, '{'); brace >= 0 {
+			name = series[:brace]
+		}
+		matched := false
+		for _, suffix := range suffixes[tp] {
+			if name == family+suffix {
+				matched = true
+			}
+		}
+		if !matched {
+			t.Fatalf("sample %s does not belong to %s family %s", name, tp, family)
+		}
+		if _, ok := samples[series]; ok {
+			t.Fatalf("series %s repeated", series)
+		}
+		samples[series] = line[sp+1:]
+	}
+	return samples
+}
+
+func TestWriteToRegisteredDispatcher(t *testing.T) {
+	d := messages.CreateDispatcherWithQueue(messages.CreateMessageQueue(8))
+	d.MessageMapped(messages.ProtocolSchemeC2S, 1, messages.MessageMatchAny, func(msg *messages.Message) error {
+		return fmt.Errorf("failed")
+	})
+	RegisterDispatcher("gate\"way", d)
+	defer Unregister("gate\"way")
+	nnet.IncTotalHandleRecvSize(3)
+
+	var buf bytes.Buffer
+	if err := WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	samples := checkOpenMetrics(t, buf.String())
+
+	want := map[string]string{
+		`clove_dispatcher_queue_capacity{dispatcher="gate\"way"}`:                                                                 "8",
+		`clove_dispatcher_handler_errors_total{dispatcher="gate\"way",handler="route",scheme="1",tag="1",type="*"}`:               "0",
+		`clove_dispatcher_handler_seconds_bucket{dispatcher="gate\"way",handler="default",scheme="*",tag="*",type="*",le="+Inf"}`: "0",
+	}
+	for series, value := range want {
+		if got, ok := samples[series]; !ok || got != value {
+			t.Fatalf("%s = %q (present %v); want %q", series, got, ok, value)
+		}
+	}
+	if _, ok := samples["clove_tcp_sent_bytes_total"]; !ok {
+		t.Fatal("network counters missing")
+	}
+	if got, want := samples["clove_handle_received_bytes_total"], fmt.Sprint(nnet.GetTotalHandleRecvSize()); got != want {
+		t.Fatalf("clove_handle_received_bytes_total = %q; want %q", got, want)
+	}
+}
+
+func TestHandlerServesOpenMetrics(t *testing.T) {
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("content type = %q", ct)
+	}
+	checkOpenMetrics(t, rec.Body.String())
+}
@@ -0,0 +1,78 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+/*
+本地对端进程凭据
+	unixgram         => 接收端开启 SO_PASSCRED 后由内核在每个数据报上附带 SCM_CREDENTIALS
+	unix/unixpacket  => 连接建立时通过 SO_PEERCRED 获取
+目前仅 Linux 支持，其它平台获取不到凭据，配置了 uid 白名单时所有数据都会被拒绝
+*/
+
+type PeerCredentials struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+type uidAllowlist map[uint32]struct{}
+
+func createUidAllowlist(uids []uint32) uidAllowlist {
+	if len(uids) == 0 {
+		return nil
+	}
+	l := make(uidAllowlist, len(uids))
+	for _, uid := range uids {
+		l[uid] = struct{}{}
+	}
+	return l
+}
+
+// 未配置白名单时全部放行，配置后没有凭据的对端一律拒绝
+func (receiver uidAllowlist) allow(cred *PeerCredentials) bool {
+	if receiver == nil {
+		return true
+	}
+	if cred == nil {
+		return false
+	}
+	_, ok := receiver[cred.Uid]
+	return ok
+}
+
+// 开启凭据接收的 unixgram 控制器解码数据报时，以此代替 UnixController 传给 OnDataDecoded
+// 凭据随数据报保存，消息被异步处理时读取到的仍是该数据报的发送者
+type UnixDatagramController struct {
+	*UnixController
+	cred PeerCredentials
+}
+
+func (receiver UnixDatagramController) GetPeerCredentials() (PeerCredentials, bool) {
+	return receiver.cred, true
+}
+
+// 获取控制器对端的凭据，unixgram 数据报的凭据由 OnDataDecoded 收到的控制器携带
+func PeerCredentialsOf(controller Controller) (PeerCredentials, bool) {
+	switch c := controller.(type) {
+	case *TCPController:
+		return c.GetPeerCredentials()
+	case UnixDatagramController:
+		return c.GetPeerCredentials()
+	}
+	return PeerCredentials{}, false
+}
@@ -0,0 +1,77 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"syscall"
+)
+
+var credentialsOobSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+func enablePassCredentials(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return sockErr
+}
+
+func parseCredentialsMessage(oob []byte) *PeerCredentials {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for i := range msgs {
+		if msgs[i].Header.Level != syscall.SOL_SOCKET || msgs[i].Header.Type != syscall.SCM_CREDENTIALS {
+			continue
+		}
+		ucred, err := syscall.ParseUnixCredentials(&msgs[i])
+		if err != nil {
+			return nil
+		}
+		return &PeerCredentials{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}
+	}
+	return nil
+}
+
+func readPeerCredentials(conn net.Conn) *PeerCredentials {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return nil
+	}
+	var ucred *syscall.Ucred
+	err = raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || ucred == nil {
+		return nil
+	}
+	return &PeerCredentials{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}
+}
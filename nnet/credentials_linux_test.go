@@ -0,0 +1,240 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/packets"
+)
+
+func TestDatagramCredentialsStayWithTheirDatagram(t *testing.T) {
+	conn, err := listenUnixgram(filepath.Join(t.TempDir(), "cred.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	dataRW := createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB)
+	var got []Controller
+	dataRW.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+		got = append(got, controller)
+		return nil
+	}
+	controller := createUnixController(*conn, dataRW)
+	bufs, _, err := dataRW.PackDatagrams(controller, codecs.IMMap{1: int64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	controller.queue = make(chan UnixDatagram, 3)
+	controller.queue <- UnixDatagram{addr: "a", data: bufs[0], cred: &PeerCredentials{Pid: 11, Uid: 1}}
+	controller.queue <- UnixDatagram{addr: "b", data: bufs[0], cred: &PeerCredentials{Pid: 22, Uid: 2}}
+	controller.queue <- UnixDatagram{addr: "c", data: bufs[0]}
+	close(controller.queue)
+	group := new(sync.WaitGroup)
+	group.Add(1)
+	controller.processData(group)
+
+	if len(got) != 3 {
+		t.Fatalf("decoded %d datagrams; want 3", len(got))
+	}
+	//之后的数据报不会改变之前的消息读取到的凭据
+	for i, pid := range []int32{11, 22} {
+		cred, ok := PeerCredentialsOf(got[i])
+		if !ok || cred.Pid != pid {
+			t.Fatalf("datagram %d credentials = %+v, %v; want pid %d", i, cred, ok, pid)
+		}
+		if dc, ok := got[i].(UnixDatagramController); !ok || dc.UnixController != controller || dc.GetSessionID() != controller.GetSessionID() {
+			t.Fatalf("datagram %d controller = %T", i, got[i])
+		}
+	}
+	if _, ok := PeerCredentialsOf(got[2]); ok || got[2] != Controller(controller) {
+		t.Fatal("datagram without credentials should get the plain controller")
+	}
+}
+
+func startCredentialsUDP(t *testing.T, setup func(udp *UnixUDP)) (string, chan Controller) {
+	t.Helper()
+	received := make(chan Controller, 4)
+	udp := CreateUnixUDPWithFormat(packets.PacketFormatNB, codecs.CodecIMv2)
+	udp.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+		received <- controller
+		return nil
+	}
+	setup(udp)
+	addr := filepath.Join(t.TempDir(), "server.sock")
+	if err := udp.Bind(addr); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(udp.Close)
+	return addr, received
+}
+
+func sendTestDatagram(t *testing.T, addr string) {
+	t.Helper()
+	client := CreateUnixUDPWithFormat(packets.PacketFormatNB, codecs.CodecIMv2)
+	if err := client.Bind(filepath.Join(t.TempDir(), "client.sock")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	if _, err := client.SendTo(addr, codecs.IMMap{1: int64(1)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUnixUDPReceivesSenderCredentials(t *testing.T) {
+	addr, received := startCredentialsUDP(t, func(udp *UnixUDP) { udp.SetPeerCredentials(true) })
+	sendTestDatagram(t, addr)
+	select {
+	case controller := <-received:
+		cred, ok := PeerCredentialsOf(controller)
+		if !ok || int(cred.Pid) != os.Getpid() || int(cred.Uid) != os.Getuid() || int(cred.Gid) != os.Getgid() {
+			t.Fatalf("credentials = %+v, %v", cred, ok)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("datagram not received")
+	}
+}
+
+func TestUnixUDPUidAllowlist(t *testing.T) {
+	uid := uint32(os.Getuid())
+	denied, deniedCh := startCredentialsUDP(t, func(udp *UnixUDP) { udp.SetAllowedUids(uid + 1) })
+	allowed, allowedCh := startCredentialsUDP(t, func(udp *UnixUDP) { udp.SetAllowedUids(uid) })
+	sendTestDatagram(t, denied)
+	sendTestDatagram(t, allowed)
+
+	select {
+	case <-allowedCh:
+	case <-time.After(2 * time.Second):
+		t.Fatal("datagram from an allowed uid not received")
+	}
+	select {
+	case <-deniedCh:
+		t.Fatal("datagram from a uid outside the allowlist was delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type fileHandleRecorder struct {
+	received chan FileHandleMeta
+}
+
+func (receiver *fileHandleRecorder) OnFileHandlesReceived(meta FileHandleMeta, fds []int) error {
+	closeFileHandles(fds)
+	receiver.received <- meta
+	return nil
+}
+
+func openFdCount(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("/proc/self/fd unavailable")
+	}
+	return len(entries)
+}
+
+func TestUnixMsgSenderCredentialsAndAllowlist(t *testing.T) {
+	var fds [2]int
+	if err := syscall.Pipe(fds[:]); err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(fds[0])
+	defer syscall.Close(fds[1])
+
+	bind := func(setup func(msg *UnixMsg)) (string, *fileHandleRecorder) {
+		recorder := &fileHandleRecorder{received: make(chan FileHandleMeta, 1)}
+		msg := CreateUnixMsg()
+		msg.SetControllerAssociatedObject(recorder)
+		setup(msg)
+		addr := filepath.Join(t.TempDir(), "fd.sock")
+		if err := msg.Bind(addr); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(msg.Close)
+		return addr, recorder
+	}
+	sender := CreateUnixMsg()
+	if err := sender.Bind(filepath.Join(t.TempDir(), "sender.sock")); err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+
+	addr, recorder := bind(func(msg *UnixMsg) { msg.SetPeerCredentials(true) })
+	if err := sender.SendFileHandles(addr, FileHandleMeta{Kind: FileHandleKindFile, Name: "pipe"}, fds[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case meta := <-recorder.received:
+		if meta.Name != "pipe" || meta.Sender == nil || int(meta.Sender.Pid) != os.Getpid() {
+			t.Fatalf("meta = %+v, sender %+v", meta, meta.Sender)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("file handles not received")
+	}
+
+	denied, deniedRecorder := bind(func(msg *UnixMsg) { msg.SetAllowedUids(uint32(os.Getuid()) + 1) })
+	before := openFdCount(t)
+	if err := sender.SendFileHandles(denied, FileHandleMeta{Kind: FileHandleKindFile}, fds[0]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-deniedRecorder.received:
+		t.Fatal("file handles from a uid outside the allowlist were delivered")
+	case <-time.After(100 * time.Millisecond):
+	}
+	//被拒绝的句柄需被关闭
+	waitFor(t, "rejected handles closed", func() bool { return openFdCount(t) <= before })
+}
+
+func TestCredentialsSettingsRejectedAfterSchedule(t *testing.T) {
+	dir := t.TempDir()
+	conn, err := listenUnixgram(filepath.Join(dir, "udp.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller := createUnixController(*conn, createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB))
+	controller.Schedule()
+	defer controller.Close()
+	if err := controller.EnablePeerCredentials(); err != errors.ErrorControllerScheduled {
+		t.Fatalf("EnablePeerCredentials after Schedule = %v", err)
+	}
+	if err := controller.SetAllowedUids(1); err != errors.ErrorControllerScheduled {
+		t.Fatalf("SetAllowedUids after Schedule = %v", err)
+	}
+
+	conn, err = listenUnixgram(filepath.Join(dir, "msg.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgController := createUnixMsgController(*conn)
+	msgController.Schedule()
+	defer msgController.Close()
+	if err := msgController.EnablePeerCredentials(); err != errors.ErrorControllerScheduled {
+		t.Fatalf("EnablePeerCredentials after Schedule = %v", err)
+	}
+	if err := msgController.SetAllowedUids(1); err != errors.ErrorControllerScheduled {
+		t.Fatalf("SetAllowedUids after Schedule = %v", err)
+	}
+}
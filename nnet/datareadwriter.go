@@ -19,6 +19,7 @@ package nnet
 
 import (
 	"bytes"
+	"sync"
 
 	"github.com/packing/clove/codecs"
 	"github.com/packing/clove/env"
@@ -41,6 +42,18 @@ type DataReadWriter struct {
 	format          *packets.PacketFormat
 	compressEnabled bool
 	virgin          bool
+	inbound         *inboundLimiter
+	fragmentation   DatagramFragmentation
+	assembler       *fragmentAssembler
+	compressId      string
+	mutex           sync.Mutex //保护读取协程对 format/codec/compressEnabled 的修改，其它协程读取时需持有
+}
+
+// 用于广播时对编码结果进行分组复用
+type packKey struct {
+	format   *packets.PacketFormat
+	codec    *codecs.Codec
+	compress string
 }
 
 func createDataReadWriter(codec *codecs.Codec, format *packets.PacketFormat) *DataReadWriter {
@@ -51,6 +64,65 @@ func createDataReadWriter(codec *codecs.Codec, format *packets.PacketFormat) *Da
 	return s
 }
 
+// 确定后 format/codec 不再变化，返回 true 后可直接读取
+func (receiver *DataReadWriter) isReady() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.format != nil && receiver.codec != nil
+}
+
+// 封包格式的标识，尚未确定时返回空字符串
+func (receiver *DataReadWriter) getFormatTag() string {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.format == nil {
+		return ""
+	}
+	return receiver.format.Tag
+}
+
+func (receiver *DataReadWriter) setFormat(format *packets.PacketFormat) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.format = format
+}
+
+func (receiver *DataReadWriter) setCodec(codec *codecs.Codec) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.codec = codec
+}
+
+// 设置压缩函数，id 标识压缩的实现及其使用的状态，id 相同的连接广播时共用压缩后的封包
+// id 为空表示不可共用，与加密的连接一样单独封包
+func (receiver *DataReadWriter) SetCompressor(id string, compress func([]byte) (error, []byte), uncompress func([]byte) (error, []byte)) {
+	receiver.compressId = id
+	receiver.OnCompress = compress
+	receiver.OnUncompress = uncompress
+}
+
+func (receiver *DataReadWriter) isCompressed() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.compressEnabled && receiver.OnCompress != nil
+}
+
+// 广播时能否与其他连接共用封包
+func (receiver *DataReadWriter) isPackShareable() bool {
+	if receiver.OnEncrypt != nil {
+		return false
+	}
+	return !receiver.isCompressed() || receiver.compressId != ""
+}
+
+func (receiver *DataReadWriter) getPackKey() packKey {
+	key := packKey{format: receiver.format, codec: receiver.codec}
+	if receiver.isCompressed() {
+		key.compress = receiver.compressId
+	}
+	return key
+}
+
 func (receiver *DataReadWriter) PeekPacketLength(stream []byte) int {
 	if receiver.format == nil {
 		return 0
@@ -85,7 +157,7 @@ func (receiver *DataReadWriter) ReadStream(controller Controller, buf *utils.Mut
 				return nil
 			}
 		}
-		receiver.format = pf
+		receiver.setFormat(pf)
 	}
 
 	if receiver.virgin {
@@ -99,7 +171,7 @@ func (receiver *DataReadWriter) ReadStream(controller Controller, buf *utils.Mut
 		if receiver.codec == nil {
 			if pto == codecs.ProtocolReserved && ptov == 0 && receiver.format == packets.PacketFormatWS {
 				utils.LogWarn("连接 %s 没有指定编解码器类型, 将会使用系统默认类型 %s", controller.GetSource(), wsCodecDefault.Name)
-				receiver.codec = wsCodecDefault
+				receiver.setCodec(wsCodecDefault)
 			} else {
 				//寻找解码器
 				err, codec := env.FindCodec(pto, ptov)
@@ -108,7 +180,7 @@ func (receiver *DataReadWriter) ReadStream(controller Controller, buf *utils.Mut
 					utils.LogWarn("连接 %s 找不到对应解码器, 将会被强行关闭", controller.GetSource())
 					return err
 				}
-				receiver.codec = codec
+				receiver.setCodec(codec)
 			}
 		}
 
@@ -134,6 +206,11 @@ dataCtrl:
 		//peekData = inData[:1024*1024]
 		inData, peekLen := buf.Peek(1024)
 		pl := receiver.PeekPacketLength(inData)
+		if pl == -1 && peekLen < buf.Len() {
+			//封包长度超出预读范围时以全部已接收数据重新判断，否则大于预读长度的封包永远无法解出
+			inData, _ = buf.Peek(buf.Len())
+			pl = receiver.PeekPacketLength(inData)
+		}
 		if pl == 0 {
 			utils.LogError("!!! 封包解包失败，连接 %s 将被关闭1", controller.GetSource())
 			return errors.ErrorDataNotMatch
@@ -154,7 +231,7 @@ dataCtrl:
 				utils.LogError("!!! 封包解包失败，连接 %s 将被关闭3", controller.GetSource())
 				return err
 			}
-			utils.LogError("!!! 解不出来包啊这是什么狗屁数据啊大哥", len(inData))
+			utils.LogError("!!! 解不出来包啊这是什么狗屁数据啊大哥 %d", len(inData))
 			break dataCtrl
 		}
 
@@ -178,12 +255,14 @@ dataCtrl:
 				utils.LogError("编解码器未能就绪, 连接 %s 将会被强行关闭", controller.GetSource())
 				return errors.ErrorCodecNotReady
 			}
-			receiver.codec = codec
+			receiver.setCodec(codec)
 		}
 
 		//根据对端封包标识标明对端是否支持压缩
-		if packet.CompressSupport {
-			receiver.compressEnabled = packet.CompressSupport
+		if packet.CompressSupport && !receiver.compressEnabled {
+			receiver.mutex.Lock()
+			receiver.compressEnabled = true
+			receiver.mutex.Unlock()
 		}
 
 		//controller.Read(readLen)
@@ -193,6 +272,18 @@ dataCtrl:
 		//utils.LogInfo("buf len => %d", buf.Len())
 		//utils.LogInfo("============================")
 
+		if receiver.inbound != nil {
+			admitted, err := receiver.inbound.admitPacket(readLen)
+			if err != nil {
+				utils.LogWarn("连接 %s 入站流量超出限制, 将会被强行关闭", controller.GetSource())
+				return err
+			}
+			if !admitted {
+				//超出限制的封包直接抛弃
+				continue
+			}
+		}
+
 		packetData := packet.Raw
 
 		//解密处理
@@ -245,13 +336,13 @@ dataCtrl:
 				goto dataDecode
 			}
 		} else if err != errors.ErrorDataNotEnough {
-			utils.LogInfo("Err: ", err)
-			utils.LogInfo("Raw: ", packetData)
+			utils.LogInfo("Err: %s", err)
+			utils.LogInfo("Raw: %v", packetData)
 			utils.LogInfo("readLen: %d", readLen)
 			utils.LogWarn("进行数据解码失败, 连接 %s 将会被强行关闭", controller.GetSource())
 			return err
 		} else {
-			utils.LogError("!!! 我他妈没解出来大哥我也不知道为什么", err)
+			utils.LogError("!!! 我他妈没解出来大哥我也不知道为什么 %s", err)
 			/*
 				if receiver.OnDataDecoded != nil {
 					err := receiver.OnDataDecoded(controller, controller.GetSource(), []byte(""))
@@ -265,7 +356,7 @@ dataCtrl:
 	return nil
 }
 
-func (receiver *DataReadWriter) PackStream(controller Controller, msgs ...codecs.IMData) ([]byte, []codecs.IMData, error) {
+func (receiver *DataReadWriter) encodeStream(controller Controller, msgs ...codecs.IMData) ([]byte, []codecs.IMData, error) {
 	if receiver.format == nil {
 		utils.LogWarn("!!! 发送未编码数据失败，连接 %s 封包解包器未就绪", controller.GetSource())
 		return []byte(""), msgs, errors.ErrorPacketFormatNotReady
@@ -288,8 +379,10 @@ func (receiver *DataReadWriter) PackStream(controller Controller, msgs ...codecs
 		}
 	}
 
-	finalData := bytes.Join(encodeDatas, []byte(""))
+	return bytes.Join(encodeDatas, []byte("")), errorMsgs, nil
+}
 
+func (receiver *DataReadWriter) packageStream(finalData []byte) ([]byte, error) {
 	packet := packets.Packet{
 		Encrypted:       false,
 		Compressed:      false,
@@ -306,7 +399,7 @@ func (receiver *DataReadWriter) PackStream(controller Controller, msgs ...codecs
 		}
 	}
 
-	if receiver.compressEnabled && (receiver.OnCompress != nil) {
+	if receiver.isCompressed() {
 		err, compressData := receiver.OnCompress(finalData)
 		if err == nil {
 			finalData = compressData
@@ -316,7 +409,20 @@ func (receiver *DataReadWriter) PackStream(controller Controller, msgs ...codecs
 
 	err, data := receiver.format.Packager.Package(&packet, finalData)
 	if err != nil {
-		return []byte(""), msgs, err
+		return []byte(""), err
+	}
+	return data, nil
+}
+
+func (receiver *DataReadWriter) PackStream(controller Controller, msgs ...codecs.IMData) ([]byte, []codecs.IMData, error) {
+	finalData, errorMsgs, err := receiver.encodeStream(controller, msgs...)
+	if err != nil {
+		return finalData, errorMsgs, err
+	}
+
+	data, err := receiver.packageStream(finalData)
+	if err != nil {
+		return data, msgs, err
 	}
 
 	return data, errorMsgs, err
@@ -334,6 +440,15 @@ func (receiver *DataReadWriter) ReadDatagram(controller Controller, from string,
 		return errors.ErrorCodecNotReady
 	}
 
+	if isDatagramFragment(data) {
+		if receiver.assembler == nil {
+			receiver.assembler = createFragmentAssembler()
+		}
+		if data = receiver.assembler.add(receiver.fragmentation, from, data); data == nil {
+			return nil
+		}
+	}
+
 	packetData := data
 
 	if receiver.format.UnixNeed {
@@ -373,15 +488,36 @@ dataDecode:
 	return nil
 }
 
+// 打包为数据报，超过分片大小的数据报会被切分为多个分片，由对端的 ReadDatagram 重组
+func (receiver *DataReadWriter) PackDatagrams(controller Controller, msgs ...codecs.IMData) ([][]byte, []codecs.IMData, error) {
+	data, remainMsgs, err := receiver.packDatagram(controller, msgs...)
+	if err != nil {
+		return nil, remainMsgs, err
+	}
+	return fragmentDatagram(data, receiver.fragmentation.fragmentSize()), remainMsgs, nil
+}
+
+// 打包为单个数据报，需要分片时返回 errors.ErrorDatagramTooLarge，此时应使用 PackDatagrams
 func (receiver *DataReadWriter) PackDatagram(controller Controller, msgs ...codecs.IMData) ([]byte, []codecs.IMData, error) {
+	bufs, remainMsgs, err := receiver.PackDatagrams(controller, msgs...)
+	if err != nil {
+		return []byte(""), remainMsgs, err
+	}
+	if len(bufs) > 1 {
+		return []byte(""), msgs, errors.ErrorDatagramTooLarge
+	}
+	return bufs[0], remainMsgs, nil
+}
+
+func (receiver *DataReadWriter) packDatagram(controller Controller, msgs ...codecs.IMData) ([]byte, []codecs.IMData, error) {
 
 	if controller != nil && receiver.format != packets.PacketFormatNBOrigin && receiver.format != packets.PacketFormatNB {
-		utils.LogError("封包打包器未能就绪, 连接 %s 将会被强行关闭", controller.GetSessionID())
+		utils.LogError("封包打包器未能就绪, 连接 %d 将会被强行关闭", controller.GetSessionID())
 		return []byte(""), msgs, errors.ErrorPacketFormatNotReady
 	}
 
 	if controller != nil && receiver.codec != codecs.CodecIMv1 && receiver.codec != codecs.CodecIMv2 {
-		utils.LogError("编解码器未能就绪, 连接 %s 将会被强行关闭", controller.GetSessionID())
+		utils.LogError("编解码器未能就绪, 连接 %d 将会被强行关闭", controller.GetSessionID())
 		return []byte(""), msgs, errors.ErrorCodecNotReady
 	}
 
@@ -394,7 +530,7 @@ func (receiver *DataReadWriter) PackDatagram(controller Controller, msgs ...code
 			encodeDatas = append(encodeDatas, data)
 		} else {
 			if controller != nil {
-				utils.LogError("连接 %s 编解码器返回了一个错误", controller.GetSessionID(), err)
+				utils.LogError("连接 %d 编解码器返回了一个错误 %s", controller.GetSessionID(), err)
 			}
 			errorMsgs = msgs[i:]
 			break
@@ -0,0 +1,154 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"os"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/env"
+	"github.com/packing/clove/errors"
+)
+
+/*
+带元数据的句柄转移协议，每批句柄对应一个数据报:
+	0        2         3
+	| magic  | version | IM 编码的元数据字典 |
+	句柄通过 SCM_RIGHTS 随数据报一起发送，元数据描述这批句柄的用途
+旧格式(4 字节的句柄数量)的数据报仍按 TCP 连接处理
+*/
+
+const (
+	FileHandleKindUnknown  = 0
+	FileHandleKindConn     = 1 //已建立的客户端连接
+	FileHandleKindListener = 2 //监听套接字
+	FileHandleKindFile     = 3 //普通文件，如日志文件
+	FileHandleKindShm      = 4 //共享内存
+)
+
+const (
+	FileHandleKeyKind          = 1
+	FileHandleKeyRemoteAddr    = 2
+	FileHandleKeyFormat        = 3
+	FileHandleKeyCodecProtocol = 4
+	FileHandleKeyCodecVersion  = 5
+	FileHandleKeyPending       = 6
+	FileHandleKeyName          = 7
+	FileHandleKeyExtra         = 8
+)
+
+const (
+	fileHandleMagic0      = 0x52
+	fileHandleMagic1      = 0x48
+	fileHandleVersion     = 1
+	fileHandleHeaderSize  = 3
+	fileHandleMaxBatch    = 253 //SCM_MAX_FD
+	fileHandleMaxDatagram = 64 * 1024
+)
+
+type FileHandleMeta struct {
+	Kind       int
+	RemoteAddr string //连接的对端地址
+	Format     string //已协商的封包格式标识，为空时由接收方重新嗅探
+	Codec      *codecs.Codec
+	Pending    []byte //已接收但尚未解析的数据
+	Name       string //文件路径或共享内存名称
+	Extra      codecs.IMMap
+	Sender     *PeerCredentials //接收方启用凭据后由内核提供的发送者凭据，不参与编码
+}
+
+func isFileHandleBatch(b []byte) bool {
+	return len(b) >= fileHandleHeaderSize && b[0] == fileHandleMagic0 && b[1] == fileHandleMagic1
+}
+
+func encodeFileHandleMeta(meta FileHandleMeta) ([]byte, error) {
+	m := codecs.IMMap{FileHandleKeyKind: meta.Kind}
+	if meta.RemoteAddr != "" {
+		m[FileHandleKeyRemoteAddr] = meta.RemoteAddr
+	}
+	if meta.Format != "" {
+		m[FileHandleKeyFormat] = meta.Format
+	}
+	if meta.Codec != nil {
+		m[FileHandleKeyCodecProtocol] = int(meta.Codec.Protocol)
+		m[FileHandleKeyCodecVersion] = int(meta.Codec.Version)
+	}
+	if len(meta.Pending) > 0 {
+		m[FileHandleKeyPending] = meta.Pending
+	}
+	if meta.Name != "" {
+		m[FileHandleKeyName] = meta.Name
+	}
+	if len(meta.Extra) > 0 {
+		m[FileHandleKeyExtra] = meta.Extra
+	}
+
+	var data codecs.IMData = m
+	err, body := codecs.CodecIMv2.Encoder.Encode(&data)
+	if err != nil {
+		return nil, err
+	}
+	if fileHandleHeaderSize+len(body) > fileHandleMaxDatagram {
+		return nil, errors.ErrorDatagramTooLarge
+	}
+	b := make([]byte, fileHandleHeaderSize, fileHandleHeaderSize+len(body))
+	b[0] = fileHandleMagic0
+	b[1] = fileHandleMagic1
+	b[2] = fileHandleVersion
+	return append(b, body...), nil
+}
+
+func decodeFileHandleMeta(b []byte) (FileHandleMeta, error) {
+	var meta FileHandleMeta
+	if !isFileHandleBatch(b) {
+		return meta, errors.ErrorDataNotMatch
+	}
+	err, data, _ := codecs.CodecIMv2.Decoder.Decode(b[fileHandleHeaderSize:])
+	if err != nil {
+		return meta, err
+	}
+	m, ok := data.(codecs.IMMap)
+	if !ok {
+		return meta, errors.ErrorDataNotMatch
+	}
+	reader := codecs.CreateMapReader(m)
+	meta.Kind = int(reader.IntValueOf(FileHandleKeyKind, FileHandleKindUnknown))
+	meta.RemoteAddr = reader.StrValueOf(FileHandleKeyRemoteAddr, "")
+	meta.Format = reader.StrValueOf(FileHandleKeyFormat, "")
+	meta.Name = reader.StrValueOf(FileHandleKeyName, "")
+	if pending, ok := reader.TryReadValue(FileHandleKeyPending).([]byte); ok {
+		meta.Pending = pending
+	}
+	if extra, ok := reader.TryReadValue(FileHandleKeyExtra).(codecs.IMMap); ok {
+		meta.Extra = extra
+	}
+	if protocol := reader.IntValueOf(FileHandleKeyCodecProtocol, 0); protocol != 0 {
+		version := reader.IntValueOf(FileHandleKeyCodecVersion, 0)
+		if err, codec := env.FindCodec(byte(protocol), byte(version)); err == nil {
+			meta.Codec = codec
+		}
+	}
+	return meta, nil
+}
+
+// 关闭未被接收方使用的句柄，避免泄漏
+func closeFileHandles(fds []int) {
+	for _, fd := range fds {
+		os.NewFile(uintptr(fd), "").Close()
+	}
+}
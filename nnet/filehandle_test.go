@@ -0,0 +1,97 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/env"
+	"github.com/packing/clove/errors"
+)
+
+func TestFileHandleMetaRoundTrip(t *testing.T) {
+	env.RegisterCodec(codecs.CodecIMv2)
+	meta := FileHandleMeta{
+		Kind:       FileHandleKindConn,
+		RemoteAddr: "10.0.0.1:4321",
+		Format:     "nb",
+		Codec:      codecs.CodecIMv2,
+		Pending:    []byte{1, 2, 3},
+		Name:       "/tmp/clove.log",
+		Extra:      codecs.IMMap{"route": "lobby"},
+		Sender:     &PeerCredentials{Pid: 1, Uid: 2, Gid: 3},
+	}
+	b, err := encodeFileHandleMeta(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isFileHandleBatch(b) || b[2] != fileHandleVersion {
+		t.Fatalf("header = %v", b[:fileHandleHeaderSize])
+	}
+
+	got, err := decodeFileHandleMeta(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != meta.Kind || got.RemoteAddr != meta.RemoteAddr || got.Format != meta.Format || got.Name != meta.Name {
+		t.Fatalf("meta = %+v", got)
+	}
+	if got.Codec != codecs.CodecIMv2 {
+		t.Fatalf("codec = %v; want IMv2", got.Codec)
+	}
+	if !bytes.Equal(got.Pending, meta.Pending) {
+		t.Fatalf("pending = %v", got.Pending)
+	}
+	if route := codecs.CreateMapReader(got.Extra).StrValueOf("route", ""); route != "lobby" {
+		t.Fatalf("extra = %v", got.Extra)
+	}
+	//发送者凭据由接收方的内核提供，不参与编码
+	if got.Sender != nil {
+		t.Fatalf("sender = %+v; want nil", got.Sender)
+	}
+}
+
+func TestFileHandleMetaMinimal(t *testing.T) {
+	b, err := encodeFileHandleMeta(FileHandleMeta{Kind: FileHandleKindListener})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeFileHandleMeta(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Kind != FileHandleKindListener || got.Codec != nil || got.Pending != nil || got.Extra != nil {
+		t.Fatalf("meta = %+v", got)
+	}
+}
+
+func TestFileHandleMetaRejectsLegacyBatch(t *testing.T) {
+	//旧格式为 4 字节的句柄数量
+	if _, err := decodeFileHandleMeta([]byte{1, 0, 0, 0}); err != errors.ErrorDataNotMatch {
+		t.Fatalf("err = %v; want ErrorDataNotMatch", err)
+	}
+}
+
+func TestFileHandleMetaTooLarge(t *testing.T) {
+	meta := FileHandleMeta{Kind: FileHandleKindConn, Pending: make([]byte, fileHandleMaxDatagram)}
+	if _, err := encodeFileHandleMeta(meta); err != errors.ErrorDatagramTooLarge {
+		t.Fatalf("err = %v; want ErrorDatagramTooLarge", err)
+	}
+}
@@ -0,0 +1,218 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/packing/clove/utils"
+)
+
+/*
+datagram fragment {
+magic 		-> byte (2)		0x52 0x46, 首字节最高位为0, 不会与 NB 包头混淆
+id 			-> uint64		发送方内唯一的消息ID
+index 		-> uint16		分片序号, 从0开始
+count 		-> uint16		分片总数
+total 		-> uint32		完整数据报长度
+payload 	-> memory
+}
+*/
+const (
+	fragmentHeaderLength = 18
+
+	DefaultDatagramFragmentSize    = 192 * 1024
+	DefaultDatagramFragmentTimeout = 5 * time.Second
+	DefaultDatagramPartialBytes    = 64 * 1024 * 1024
+)
+
+var fragmentMagic = [2]byte{0x52, 0x46}
+
+var datagramMessageId uint64
+
+func init() {
+	var b [8]byte
+	rand.Read(b[:])
+	datagramMessageId = binary.BigEndian.Uint64(b[:])
+}
+
+// 数据报分片及重组的配置，零值字段使用默认值
+type DatagramFragmentation struct {
+	FragmentSize    int           //超过该长度的数据报将被分片发送，小于0时不分片
+	Timeout         time.Duration //未收齐分片的消息保留的时间
+	MaxPartialBytes int           //所有未收齐消息占用内存的上限，超过时丢弃最早的消息
+}
+
+func (receiver DatagramFragmentation) fragmentSize() int {
+	if receiver.FragmentSize == 0 {
+		return DefaultDatagramFragmentSize
+	}
+	return receiver.FragmentSize
+}
+
+func isDatagramFragment(data []byte) bool {
+	return len(data) >= fragmentHeaderLength && data[0] == fragmentMagic[0] && data[1] == fragmentMagic[1]
+}
+
+// 将数据报切分为不超过 size 字节负载的分片
+func fragmentDatagram(data []byte, size int) [][]byte {
+	if size <= 0 || len(data) <= size {
+		return [][]byte{data}
+	}
+	count := (len(data) + size - 1) / size
+	if count > 0xFFFF {
+		//分片数超过上限时按上限重新计算分片大小
+		count = 0xFFFF
+		size = (len(data) + count - 1) / count
+		count = (len(data) + size - 1) / size
+	}
+	id := atomic.AddUint64(&datagramMessageId, 1)
+	fragments := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		end := (i + 1) * size
+		if end > len(data) {
+			end = len(data)
+		}
+		payload := data[i*size : end]
+		b := make([]byte, fragmentHeaderLength+len(payload))
+		copy(b, fragmentMagic[:])
+		binary.BigEndian.PutUint64(b[2:10], id)
+		binary.BigEndian.PutUint16(b[10:12], uint16(i))
+		binary.BigEndian.PutUint16(b[12:14], uint16(count))
+		binary.BigEndian.PutUint32(b[14:18], uint32(len(data)))
+		copy(b[fragmentHeaderLength:], payload)
+		fragments = append(fragments, b)
+	}
+	return fragments
+}
+
+type fragmentKey struct {
+	from string
+	id   uint64
+}
+
+type partialDatagram struct {
+	parts    [][]byte
+	received int
+	size     int
+	total    int
+	created  time.Time
+}
+
+type fragmentAssembler struct {
+	partials map[fragmentKey]*partialDatagram
+	bytes    int
+	mutex    sync.Mutex
+}
+
+func createFragmentAssembler() *fragmentAssembler {
+	a := new(fragmentAssembler)
+	a.partials = make(map[fragmentKey]*partialDatagram)
+	return a
+}
+
+func (receiver *fragmentAssembler) remove(key fragmentKey, p *partialDatagram) {
+	receiver.bytes -= p.size
+	delete(receiver.partials, key)
+}
+
+// 丢弃超时的消息，并在超出内存上限时从最早的消息开始丢弃
+func (receiver *fragmentAssembler) evict(config DatagramFragmentation, incoming int) {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDatagramFragmentTimeout
+	}
+	limit := config.MaxPartialBytes
+	if limit <= 0 {
+		limit = DefaultDatagramPartialBytes
+	}
+	now := time.Now()
+	for key, p := range receiver.partials {
+		if now.Sub(p.created) > timeout {
+			utils.LogWarn(">>> 来自 %s 的分片消息 %d 重组超时，已收到 %d/%d", key.from, key.id, p.received, len(p.parts))
+			receiver.remove(key, p)
+		}
+	}
+	for receiver.bytes+incoming > limit && len(receiver.partials) > 0 {
+		var oldestKey fragmentKey
+		var oldest *partialDatagram
+		for key, p := range receiver.partials {
+			if oldest == nil || p.created.Before(oldest.created) {
+				oldestKey, oldest = key, p
+			}
+		}
+		utils.LogWarn(">>> 分片重组占用内存超过上限，丢弃来自 %s 的消息 %d", oldestKey.from, oldestKey.id)
+		receiver.remove(oldestKey, oldest)
+	}
+}
+
+// 加入一个分片，收齐时返回完整的数据报
+func (receiver *fragmentAssembler) add(config DatagramFragmentation, from string, data []byte) []byte {
+	id := binary.BigEndian.Uint64(data[2:10])
+	index := int(binary.BigEndian.Uint16(data[10:12]))
+	count := int(binary.BigEndian.Uint16(data[12:14]))
+	total := int(binary.BigEndian.Uint32(data[14:18]))
+	payload := data[fragmentHeaderLength:]
+	if count == 0 || index >= count {
+		utils.LogWarn(">>> 来自 %s 的分片 %d 序号无效 %d/%d", from, id, index, count)
+		return nil
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	receiver.evict(config, len(payload))
+	key := fragmentKey{from: from, id: id}
+	p, ok := receiver.partials[key]
+	if !ok {
+		p = &partialDatagram{parts: make([][]byte, count), total: total, created: time.Now()}
+		receiver.partials[key] = p
+	}
+	if len(p.parts) != count || p.total != total {
+		utils.LogWarn(">>> 来自 %s 的分片消息 %d 信息不一致，已丢弃", from, id)
+		receiver.remove(key, p)
+		return nil
+	}
+	if p.parts[index] != nil {
+		return nil
+	}
+	part := make([]byte, len(payload))
+	copy(part, payload)
+	p.parts[index] = part
+	p.received += 1
+	p.size += len(part)
+	receiver.bytes += len(part)
+	if p.received < count {
+		return nil
+	}
+
+	receiver.remove(key, p)
+	if p.size != total {
+		utils.LogWarn(">>> 来自 %s 的分片消息 %d 长度不符 %d/%d", from, id, p.size, total)
+		return nil
+	}
+	full := make([]byte, 0, total)
+	for _, part := range p.parts {
+		full = append(full, part...)
+	}
+	return full
+}
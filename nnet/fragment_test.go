@@ -0,0 +1,218 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/packets"
+)
+
+func TestFragmentRoundTripOutOfOrder(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.Read(data)
+	fragments := fragmentDatagram(data, 1024)
+	if len(fragments) != 10 {
+		t.Fatalf("%d fragments; want 10", len(fragments))
+	}
+	for _, f := range fragments {
+		if !isDatagramFragment(f) || len(f) > fragmentHeaderLength+1024 {
+			t.Fatalf("bad fragment of %d bytes", len(f))
+		}
+	}
+
+	a := createFragmentAssembler()
+	config := DatagramFragmentation{}
+	var full []byte
+	for _, i := range rand.Perm(len(fragments)) {
+		if full != nil {
+			t.Fatal("reassembled before all fragments arrived")
+		}
+		full = a.add(config, "a", fragments[i])
+		//重复的分片被忽略
+		if full == nil && a.add(config, "a", fragments[i]) != nil {
+			t.Fatal("duplicate fragment completed the message")
+		}
+	}
+	if !bytes.Equal(full, data) {
+		t.Fatal("reassembled data differs")
+	}
+	if len(a.partials) != 0 || a.bytes != 0 {
+		t.Fatalf("assembler keeps %d partials, %d bytes", len(a.partials), a.bytes)
+	}
+}
+
+func TestFragmentSmallDatagramUnchanged(t *testing.T) {
+	data := []byte("small")
+	fragments := fragmentDatagram(data, 1024)
+	if len(fragments) != 1 || &fragments[0][0] != &data[0] || isDatagramFragment(fragments[0]) {
+		t.Fatal("small datagram should be sent as is")
+	}
+	if len(fragmentDatagram(make([]byte, 4096), -1)) != 1 {
+		t.Fatal("negative size disables fragmentation")
+	}
+	if (DatagramFragmentation{}).fragmentSize() != DefaultDatagramFragmentSize {
+		t.Fatal("zero FragmentSize should use the default")
+	}
+}
+
+func TestFragmentCountCapped(t *testing.T) {
+	data := make([]byte, 0x10000+10)
+	fragments := fragmentDatagram(data, 1)
+	if len(fragments) > 0xFFFF {
+		t.Fatalf("%d fragments exceed the uint16 count", len(fragments))
+	}
+	count := int(binary.BigEndian.Uint16(fragments[0][12:14]))
+	if count != len(fragments) {
+		t.Fatalf("header count %d; want %d", count, len(fragments))
+	}
+	a := createFragmentAssembler()
+	var full []byte
+	for _, f := range fragments {
+		full = a.add(DatagramFragmentation{}, "a", f)
+	}
+	if len(full) != len(data) {
+		t.Fatalf("reassembled %d bytes; want %d", len(full), len(data))
+	}
+}
+
+func TestFragmentSourcesAreSeparate(t *testing.T) {
+	fragments := fragmentDatagram([]byte("0123456789"), 5)
+	a := createFragmentAssembler()
+	if a.add(DatagramFragmentation{}, "a", fragments[0]) != nil {
+		t.Fatal("incomplete")
+	}
+	//同一消息ID来自不同地址时不会混合
+	if a.add(DatagramFragmentation{}, "b", fragments[1]) != nil {
+		t.Fatal("fragments from another source completed the message")
+	}
+	if full := a.add(DatagramFragmentation{}, "a", fragments[1]); string(full) != "0123456789" {
+		t.Fatalf("reassembled %q", full)
+	}
+}
+
+func TestFragmentTimeoutDropsPartial(t *testing.T) {
+	config := DatagramFragmentation{Timeout: 20 * time.Millisecond}
+	fragments := fragmentDatagram([]byte("0123456789"), 5)
+	a := createFragmentAssembler()
+	a.add(config, "a", fragments[0])
+	time.Sleep(40 * time.Millisecond)
+	//后续任何分片到达时清理超时的消息
+	if full := a.add(config, "a", fragments[1]); full != nil {
+		t.Fatalf("reassembled %q after timeout", full)
+	}
+	if len(a.partials) != 1 || a.bytes != 5 {
+		t.Fatalf("%d partials, %d bytes; want only the late fragment", len(a.partials), a.bytes)
+	}
+}
+
+func TestFragmentMemoryLimitDropsOldest(t *testing.T) {
+	config := DatagramFragmentation{MaxPartialBytes: 12}
+	first := fragmentDatagram([]byte("aaaaaaaaaa"), 5)
+	second := fragmentDatagram([]byte("bbbbbbbbbb"), 5)
+	third := fragmentDatagram([]byte("cccccccccc"), 5)
+	a := createFragmentAssembler()
+	a.add(config, "a", first[0])
+	time.Sleep(time.Millisecond)
+	a.add(config, "a", second[0])
+	time.Sleep(time.Millisecond)
+	//加入后将超过上限，丢弃最早的消息
+	a.add(config, "a", third[0])
+	if a.bytes > 12 || len(a.partials) != 2 {
+		t.Fatalf("%d partials, %d bytes", len(a.partials), a.bytes)
+	}
+	firstId := binary.BigEndian.Uint64(first[0][2:10])
+	if _, ok := a.partials[fragmentKey{from: "a", id: firstId}]; ok {
+		t.Fatal("oldest message should be evicted")
+	}
+	if full := a.add(config, "a", third[1]); string(full) != "cccccccccc" {
+		t.Fatalf("reassembled %q", full)
+	}
+}
+
+func TestFragmentRejectsInvalidHeaders(t *testing.T) {
+	a := createFragmentAssembler()
+	fragments := fragmentDatagram([]byte("0123456789"), 5)
+
+	bad := append([]byte(nil), fragments[0]...)
+	binary.BigEndian.PutUint16(bad[10:12], 2)
+	if a.add(DatagramFragmentation{}, "a", bad) != nil || len(a.partials) != 0 {
+		t.Fatal("index beyond count should be rejected")
+	}
+	binary.BigEndian.PutUint16(bad[12:14], 0)
+	if a.add(DatagramFragmentation{}, "a", bad) != nil || len(a.partials) != 0 {
+		t.Fatal("zero count should be rejected")
+	}
+
+	//同一消息的分片总数不一致时丢弃整个消息
+	a.add(DatagramFragmentation{}, "a", fragments[0])
+	bad = append([]byte(nil), fragments[1]...)
+	binary.BigEndian.PutUint16(bad[12:14], 3)
+	if a.add(DatagramFragmentation{}, "a", bad) != nil || len(a.partials) != 0 || a.bytes != 0 {
+		t.Fatalf("inconsistent fragment kept %d partials, %d bytes", len(a.partials), a.bytes)
+	}
+
+	//长度与声明的总长度不符
+	a.add(DatagramFragmentation{}, "a", fragments[0])
+	short := append([]byte(nil), fragments[1][:fragmentHeaderLength+2]...)
+	if a.add(DatagramFragmentation{}, "a", short) != nil || len(a.partials) != 0 || a.bytes != 0 {
+		t.Fatal("message with wrong total length should be dropped")
+	}
+}
+
+func TestPackDatagramRequiresFragmenting(t *testing.T) {
+	dataRW := createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB)
+	dataRW.fragmentation = DatagramFragmentation{FragmentSize: 1024}
+	var got []codecs.IMData
+	dataRW.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+		got = append(got, data)
+		return nil
+	}
+	controller := createTestController(t)
+	payload := make([]byte, 8192)
+	rand.Read(payload)
+	msg := codecs.IMMap{1: payload}
+
+	//超过分片大小时不能作为单个数据报发出
+	if _, remain, err := dataRW.PackDatagram(controller, msg); err != errors.ErrorDatagramTooLarge || len(remain) != 1 {
+		t.Fatalf("PackDatagram err = %v, %d remaining; want ErrorDatagramTooLarge", err, len(remain))
+	}
+	bufs, _, err := dataRW.PackDatagrams(controller, msg)
+	if err != nil || len(bufs) < 2 {
+		t.Fatalf("PackDatagrams = %d fragments, %v", len(bufs), err)
+	}
+	for _, buf := range bufs {
+		if err := dataRW.ReadDatagram(controller, "a", buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 1 {
+		t.Fatalf("decoded %d messages; want 1", len(got))
+	}
+
+	small, _, err := dataRW.PackDatagram(controller, codecs.IMMap{1: int64(1)})
+	if err != nil || isDatagramFragment(small) {
+		t.Fatalf("small datagram = %v, fragment %v", err, isDatagramFragment(small))
+	}
+}
@@ -0,0 +1,126 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+func TestMain(m *testing.M) {
+	utils.LogInit(utils.LogLevelError, "")
+	os.Exit(m.Run())
+}
+
+// 测试用的控制器，底层为内存管道，未调度时写入的数据停留在发送队列中
+func createTestController(t testing.TB) *TCPController {
+	local, remote := net.Pipe()
+	t.Cleanup(func() {
+		local.Close()
+		remote.Close()
+	})
+	return createTCPController(local, createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB))
+}
+
+// 取出发送队列中的全部封包
+func drainSendQueue(controller *TCPController) [][]byte {
+	var bufs [][]byte
+	for {
+		data, ok := controller.sendQueue.pop()
+		if !ok {
+			return bufs
+		}
+		bufs = append(bufs, data)
+	}
+}
+
+// 按 NB 封包格式及 IMv2 编解码器解出封包中的全部消息
+func decodeStream(t testing.TB, bufs ...[]byte) []codecs.IMData {
+	t.Helper()
+	var msgs []codecs.IMData
+	dataRW := createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB)
+	dataRW.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+		msgs = append(msgs, data)
+		return nil
+	}
+	buf := new(utils.MutexBuffer)
+	for _, b := range bufs {
+		buf.Write(b)
+	}
+	if err := dataRW.ReadStream(createTestController(t), buf); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return msgs
+}
+
+// 读取消息中 key 为 1 的整数
+func intOf(data codecs.IMData) int64 {
+	m, ok := data.(codecs.IMMap)
+	if !ok {
+		return -1
+	}
+	return codecs.CreateMapReader(m).IntValueOf(1, -1)
+}
+
+// 监听本地随机端口的服务器
+func startTestServer(t testing.TB, setup func(srv *TCPServer)) (*TCPServer, string) {
+	t.Helper()
+	srv := CreateTCPServer()
+	srv.Format = packets.PacketFormatNB
+	srv.Codec = codecs.CodecIMv2
+	if setup != nil {
+		setup(srv)
+	}
+	if err := srv.Bind("127.0.0.1:0", 0); err != nil {
+		t.Fatal(err)
+	}
+	srv.Schedule()
+	t.Cleanup(srv.Close)
+	return srv, srv.listener.Addr().String()
+}
+
+func connectTestClient(t testing.TB, addr string, setup func(client *TCPClient)) *TCPClient {
+	t.Helper()
+	client := CreateTCPClient(packets.PacketFormatNB, codecs.CodecIMv2)
+	if setup != nil {
+		setup(client)
+	}
+	if err := client.Connect(addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// 等待条件成立，超时后测试失败
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
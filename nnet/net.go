@@ -18,8 +18,8 @@
 package nnet
 
 import (
-	"math"
 	"sync"
+	"sync/atomic"
 
 	"github.com/packing/clove/codecs"
 )
@@ -61,10 +61,15 @@ type FileHandleController interface {
 	OnFileHandleReceived(fd int) error
 }
 
+// 接收带元数据的句柄批次，未被使用的句柄需由实现方关闭
+type FileHandleBatchController interface {
+	OnFileHandlesReceived(meta FileHandleMeta, fds []int) error
+}
+
 type SessionID = uint64
 
-var mutex sync.Mutex
-var mutex2 sync.Mutex
+var stopObservers = make([]OnControllerStop, 0)
+var stopObserversMutex sync.RWMutex
 
 var wsCodecDefault = codecs.CodecIMv2
 
@@ -73,105 +78,181 @@ var currentSessionId SessionID = 0
 var sendbufferSize = 1024
 var recvbufferSize = 1024
 
-var totalTcpSendSize = 0
-var totalTcpRecvSize = 0
+// 以下统计均以原子操作读写
+var totalTcpSendSize int64 = 0
+var totalTcpRecvSize int64 = 0
 
-var totalUnixSendSize = 0
-var totalUnixRecvSize = 0
+var totalUnixSendSize int64 = 0
+var totalUnixRecvSize int64 = 0
 
-var totalHandleRecvSize = 0
+var totalHandleRecvSize int64 = 0
 
-var decodeInstanceCount = 0
+var decodeInstanceCount int64 = 0
 
 var encodeTime int64 = 0
 var decodeTime int64 = 0
 var encodeCount int64 = 0
 var decodeCount int64 = 0
 
+const (
+	ControllerKindTCP     = "tcp"
+	ControllerKindUDP     = "udp"
+	ControllerKindUnix    = "unix"
+	ControllerKindUnixMsg = "unixmsg"
+)
+
+var controllerKinds = [...]string{ControllerKindTCP, ControllerKindUDP, ControllerKindUnix, ControllerKindUnixMsg}
+var controllerCounts [len(controllerKinds)]int64
+
+// 注册控制器停止调度时的全局观察者，在控制器自身的 OnStop 之后调用
+// 会话仍然保留的 TCP 连接(已转移给其他进程，或等待会话恢复)推迟到会话结束时调用，已转移的连接不再调用
+func AddControllerStopObserver(fn OnControllerStop) {
+	stopObserversMutex.Lock()
+	defer stopObserversMutex.Unlock()
+	stopObservers = append(stopObservers, fn)
+}
+
+func controllerKindIndex(controller Controller) int {
+	switch controller.(type) {
+	case *TCPController:
+		return 0
+	case *UDPController:
+		return 1
+	case *UnixController:
+		return 2
+	case *UnixMsgController:
+		return 3
+	}
+	return -1
+}
+
+func notifyControllerStart(controller Controller) {
+	if i := controllerKindIndex(controller); i >= 0 {
+		atomic.AddInt64(&controllerCounts[i], 1)
+	}
+}
+
+func notifyControllerStop(controller Controller) {
+	if i := controllerKindIndex(controller); i >= 0 {
+		atomic.AddInt64(&controllerCounts[i], -1)
+	}
+	if tc, ok := controller.(*TCPController); ok && tc.keepsSession() {
+		return
+	}
+	notifyStopObservers(controller)
+}
+
+func notifyStopObservers(controller Controller) {
+	stopObserversMutex.RLock()
+	observers := stopObservers
+	stopObserversMutex.RUnlock()
+	for _, fn := range observers {
+		fn(controller)
+	}
+}
+
 func SetWebsocketDefaultCodec(codec *codecs.Codec) {
 	wsCodecDefault = codec
 }
 
 func IncEncodeTime(tv int64) {
-	encodeTime += tv
-	encodeCount += 1
+	atomic.AddInt64(&encodeTime, tv)
+	atomic.AddInt64(&encodeCount, 1)
 }
 
 func IncDecodeTime(tv int64) {
-	decodeTime += tv
-	decodeCount += 1
+	atomic.AddInt64(&decodeTime, tv)
+	atomic.AddInt64(&decodeCount, 1)
 }
 
 func GetEncodeAgvTime() int64 {
-	if encodeCount > 0 {
-		return encodeTime / encodeCount
+	if count := atomic.LoadInt64(&encodeCount); count > 0 {
+		return atomic.LoadInt64(&encodeTime) / count
 	}
 	return 0
 }
 
 func GetDecodeAgvTime() int64 {
-	if decodeCount > 0 {
-		return decodeTime / decodeCount
+	if count := atomic.LoadInt64(&decodeCount); count > 0 {
+		return atomic.LoadInt64(&decodeTime) / count
 	}
 	return 0
 }
 
+// 返回累计的编码耗时(纳秒)及次数
+func GetEncodeTotal() (int64, int64) {
+	return atomic.LoadInt64(&encodeTime), atomic.LoadInt64(&encodeCount)
+}
+
+// 返回累计的解码耗时(纳秒)及次数
+func GetDecodeTotal() (int64, int64) {
+	return atomic.LoadInt64(&decodeTime), atomic.LoadInt64(&decodeCount)
+}
+
 func GetDecodeInstanceCount() int {
-	mutex2.Lock()
-	defer mutex2.Unlock()
-	return decodeInstanceCount
+	return int(atomic.LoadInt64(&decodeInstanceCount))
 }
 
 func IncDecodeInstanceCount() {
-	mutex2.Lock()
-	defer mutex2.Unlock()
-	decodeInstanceCount += 1
+	atomic.AddInt64(&decodeInstanceCount, 1)
 }
 
 func DecDecodeInstanceCount() {
-	mutex2.Lock()
-	defer mutex2.Unlock()
-	decodeInstanceCount -= 1
+	atomic.AddInt64(&decodeInstanceCount, -1)
 }
 
 func IncTotalTcpSendSize(s int) {
-	totalTcpSendSize += s
+	atomic.AddInt64(&totalTcpSendSize, int64(s))
 }
 
 func IncTotalTcpRecvSize(s int) {
-	totalTcpRecvSize += s
+	atomic.AddInt64(&totalTcpRecvSize, int64(s))
 }
 
 func GetTotalTcpSendSize() int {
-	return totalTcpSendSize
+	return int(atomic.LoadInt64(&totalTcpSendSize))
 }
 
 func GetTotalTcpRecvSize() int {
-	return totalTcpRecvSize
+	return int(atomic.LoadInt64(&totalTcpRecvSize))
 }
 
 func IncTotalUnixSendSize(s int) {
-	totalUnixSendSize += s
+	atomic.AddInt64(&totalUnixSendSize, int64(s))
 }
 
 func IncTotalUnixRecvSize(s int) {
-	totalUnixRecvSize += s
+	atomic.AddInt64(&totalUnixRecvSize, int64(s))
 }
 
 func GetTotalUnixSendSize() int {
-	return totalUnixSendSize
+	return int(atomic.LoadInt64(&totalUnixSendSize))
 }
 
 func GetTotalUnixRecvSize() int {
-	return totalUnixRecvSize
+	return int(atomic.LoadInt64(&totalUnixRecvSize))
 }
 
 func IncTotalHandleRecvSize(s int) {
-	totalHandleRecvSize += s
+	atomic.AddInt64(&totalHandleRecvSize, int64(s))
+}
+
+func GetTotalHandleRecvSize() int {
+	return int(atomic.LoadInt64(&totalHandleRecvSize))
 }
 
+// Deprecated: 返回的是接收的数量，请使用 GetTotalHandleRecvSize
 func GetTotalHandleSendSize() int {
-	return totalHandleRecvSize
+	return GetTotalHandleRecvSize()
+}
+
+// 各类型正在调度中的控制器数量，以 ControllerKind* 为键
+func GetControllerCounts() map[string]int64 {
+	counts := make(map[string]int64, len(controllerKinds))
+	for i, kind := range controllerKinds {
+		counts[kind] = atomic.LoadInt64(&controllerCounts[i])
+	}
+	return counts
 }
 
 func SetSendBufSize(s int) {
@@ -183,11 +264,10 @@ func SetRecvBufSize(s int) {
 }
 
 func NewSessionID() SessionID {
-	mutex.Lock()
-	defer mutex.Unlock()
-	currentSessionId += 1
-	if currentSessionId >= math.MaxUint64 {
-		currentSessionId = 1
+	for {
+		//溢出回绕后跳过0
+		if id := atomic.AddUint64(&currentSessionId, 1); id != 0 {
+			return id
+		}
 	}
-	return currentSessionId
 }
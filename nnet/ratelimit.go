@@ -0,0 +1,327 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+// 入站流量超出限制时的处理方式
+const (
+	RateLimitActionThrottle   = iota //暂缓读取，直到令牌足够
+	RateLimitActionDrop              //抛弃超出限制的封包
+	RateLimitActionDisconnect        //直接断开连接
+)
+
+// 单连接入站限制，速率为 0 表示不限制，Burst 为 0 时取速率值
+type InboundLimit struct {
+	PacketsPerSecond float64
+	PacketBurst      int
+	BytesPerSecond   float64
+	ByteBurst        int
+	Action           int
+}
+
+// 连接准入控制，Allow 不为空时仅允许其中的地址段接入，Deny 优先于 Allow
+type AdmissionControl struct {
+	MaxConnectionsPerIP int
+	AcceptRate          float64
+	AcceptBurst         int
+	IPAcceptRate        float64
+	IPAcceptBurst       int
+	Allow               []string
+	Deny                []string
+}
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func createTokenBucket(rate float64, burst int) *tokenBucket {
+	b := new(tokenBucket)
+	b.rate = rate
+	b.burst = float64(burst)
+	if b.burst <= 0 {
+		b.burst = rate
+	}
+	if b.burst < 1 {
+		b.burst = 1
+	}
+	b.tokens = b.burst
+	b.last = time.Now()
+	return b
+}
+
+func (receiver *tokenBucket) refill(now time.Time) {
+	receiver.tokens += now.Sub(receiver.last).Seconds() * receiver.rate
+	if receiver.tokens > receiver.burst {
+		receiver.tokens = receiver.burst
+	}
+	receiver.last = now
+}
+
+// 尝试取出 n 个令牌，超过桶容量的请求在桶满时也允许通过(令牌数会变为负数)
+func (receiver *tokenBucket) take(n float64) bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.refill(time.Now())
+	need := n
+	if need > receiver.burst {
+		need = receiver.burst
+	}
+	if receiver.tokens < need {
+		return false
+	}
+	receiver.tokens -= n
+	return true
+}
+
+// 预留 n 个令牌，返回需要等待的时长
+func (receiver *tokenBucket) reserve(n float64) time.Duration {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.refill(time.Now())
+	receiver.tokens -= n
+	if receiver.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-receiver.tokens / receiver.rate * float64(time.Second))
+}
+
+func (receiver *tokenBucket) idle(now time.Time) bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.refill(now)
+	return receiver.tokens >= receiver.burst
+}
+
+type inboundLimiter struct {
+	limit          InboundLimit
+	packets        *tokenBucket
+	bytes          *tokenBucket
+	droppedPackets int64
+}
+
+func createInboundLimiter(limit InboundLimit) *inboundLimiter {
+	if limit.PacketsPerSecond <= 0 && limit.BytesPerSecond <= 0 {
+		return nil
+	}
+	l := new(inboundLimiter)
+	l.limit = limit
+	if limit.PacketsPerSecond > 0 {
+		l.packets = createTokenBucket(limit.PacketsPerSecond, limit.PacketBurst)
+	}
+	if limit.BytesPerSecond > 0 {
+		l.bytes = createTokenBucket(limit.BytesPerSecond, limit.ByteBurst)
+	}
+	return l
+}
+
+// 读取原始数据时调用，仅在限速模式下按字节数暂缓读取
+func (receiver *inboundLimiter) throttleRead(n int) {
+	if receiver.bytes == nil || receiver.limit.Action != RateLimitActionThrottle {
+		return
+	}
+	if d := receiver.bytes.reserve(float64(n)); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// 每解出一个封包时调用，返回该封包是否应被处理
+func (receiver *inboundLimiter) admitPacket(n int) (bool, error) {
+	switch receiver.limit.Action {
+	case RateLimitActionThrottle:
+		//字节数已在读取时限速
+		if receiver.packets != nil {
+			if d := receiver.packets.reserve(1); d > 0 {
+				time.Sleep(d)
+			}
+		}
+		return true, nil
+	default:
+		if receiver.packets != nil && !receiver.packets.take(1) {
+			break
+		}
+		if receiver.bytes != nil && !receiver.bytes.take(float64(n)) {
+			break
+		}
+		return true, nil
+	}
+
+	if receiver.limit.Action == RateLimitActionDisconnect {
+		return false, errors.ErrorRateLimited
+	}
+	atomic.AddInt64(&receiver.droppedPackets, 1)
+	return false, nil
+}
+
+func (receiver *inboundLimiter) getDroppedPackets() int64 {
+	return atomic.LoadInt64(&receiver.droppedPackets)
+}
+
+type admission struct {
+	config      AdmissionControl
+	allow       []*net.IPNet
+	deny        []*net.IPNet
+	accept      *tokenBucket
+	ipBuckets   map[string]*tokenBucket
+	connections map[string]int
+	mutex       sync.Mutex
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			//允许直接填写单个地址
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, err
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			ipNet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func createAdmission(config AdmissionControl) (*admission, error) {
+	a := new(admission)
+	a.config = config
+	var err error
+	if a.allow, err = parseCIDRs(config.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parseCIDRs(config.Deny); err != nil {
+		return nil, err
+	}
+	if config.AcceptRate > 0 {
+		a.accept = createTokenBucket(config.AcceptRate, config.AcceptBurst)
+	}
+	a.ipBuckets = make(map[string]*tokenBucket)
+	a.connections = make(map[string]int)
+	return a, nil
+}
+
+func remoteIP(addr net.Addr) net.IP {
+	if addr == nil {
+		return nil
+	}
+	switch v := addr.(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 接收新连接时调用，检查地址黑白名单及接入频率
+func (receiver *admission) check(ip net.IP) error {
+	if ip != nil {
+		if containsIP(receiver.deny, ip) {
+			return errors.ErrorAddressDenied
+		}
+		if len(receiver.allow) > 0 && !containsIP(receiver.allow, ip) {
+			return errors.ErrorAddressDenied
+		}
+	}
+
+	if receiver.accept != nil && !receiver.accept.take(1) {
+		return errors.ErrorRateLimited
+	}
+
+	if ip != nil && receiver.config.IPAcceptRate > 0 {
+		receiver.mutex.Lock()
+		key := ip.String()
+		b, ok := receiver.ipBuckets[key]
+		if !ok {
+			//定期清理已经闲置的地址，避免无限增长
+			if len(receiver.ipBuckets) >= 4096 {
+				now := time.Now()
+				for k, v := range receiver.ipBuckets {
+					if v.idle(now) {
+						delete(receiver.ipBuckets, k)
+					}
+				}
+			}
+			b = createTokenBucket(receiver.config.IPAcceptRate, receiver.config.IPAcceptBurst)
+			receiver.ipBuckets[key] = b
+		}
+		receiver.mutex.Unlock()
+		if !b.take(1) {
+			return errors.ErrorRateLimited
+		}
+	}
+	return nil
+}
+
+func (receiver *admission) acquire(ip net.IP) error {
+	if ip == nil || receiver.config.MaxConnectionsPerIP <= 0 {
+		return nil
+	}
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	key := ip.String()
+	if receiver.connections[key] >= receiver.config.MaxConnectionsPerIP {
+		return errors.ErrorTooManyConnections
+	}
+	receiver.connections[key] += 1
+	return nil
+}
+
+func (receiver *admission) release(ip net.IP) {
+	if ip == nil || receiver.config.MaxConnectionsPerIP <= 0 {
+		return
+	}
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	key := ip.String()
+	receiver.connections[key] -= 1
+	if receiver.connections[key] <= 0 {
+		delete(receiver.connections, key)
+	}
+}
@@ -0,0 +1,103 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+// 建立一对本地 TCP 连接，返回客户端一侧及服务器一侧连接句柄的副本
+func acceptedFileHandle(t *testing.T) (net.Conn, int) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f, err := conn.(*net.TCPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fd
+}
+
+func TestFileHandleConnectionsPassAdmission(t *testing.T) {
+	srv := createTestServer()
+	srv.SetAdmissionControl(AdmissionControl{Deny: []string{"127.0.0.1"}})
+
+	client, fd := acceptedFileHandle(t)
+	if err := srv.processClientFromFileHandle(fd, nil); err != errors.ErrorAddressDenied {
+		t.Fatalf("err = %v; want ErrorAddressDenied", err)
+	}
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("denied connection should be closed")
+	}
+	if srv.GetTotal() != 0 {
+		t.Fatal("denied connection should not be registered")
+	}
+}
+
+func TestFileHandleConnectionsCountPerIP(t *testing.T) {
+	srv := createTestServer()
+	srv.SetAdmissionControl(AdmissionControl{MaxConnectionsPerIP: 1})
+
+	_, fd := acceptedFileHandle(t)
+	if err := srv.processClientFromFileHandle(fd, nil); err != nil {
+		t.Fatal(err)
+	}
+	_, fd = acceptedFileHandle(t)
+	if err := srv.processClientFromFileHandle(fd, nil); err != errors.ErrorTooManyConnections {
+		t.Fatalf("err = %v; want ErrorTooManyConnections", err)
+	}
+
+	//连接断开后释放名额
+	srv.eachControllers(func(controller *TCPController) {
+		controller.Close()
+	})
+	waitFor(t, "the controller to stop", func() bool { return srv.GetTotal() == 0 })
+	waitFor(t, "the per-IP slot to be released", func() bool {
+		srv.admission.mutex.Lock()
+		defer srv.admission.mutex.Unlock()
+		return len(srv.admission.connections) == 0
+	})
+	_, fd = acceptedFileHandle(t)
+	if err := srv.processClientFromFileHandle(fd, nil); err != nil {
+		t.Fatalf("after release: %v", err)
+	}
+}
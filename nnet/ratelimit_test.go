@@ -0,0 +1,214 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	b := createTokenBucket(10, 3)
+	for i := 0; i < 3; i++ {
+		if !b.take(1) {
+			t.Fatalf("take %d should succeed within burst", i)
+		}
+	}
+	if b.take(1) {
+		t.Fatal("take should fail once the burst is used")
+	}
+
+	//模拟经过 200 毫秒，补充 2 个令牌
+	b.last = b.last.Add(-200 * time.Millisecond)
+	if !b.take(2) {
+		t.Fatal("take should succeed after refill")
+	}
+	if b.take(1) {
+		t.Fatal("refill should not exceed elapsed time")
+	}
+
+	//补充不能超过桶容量
+	b.last = b.last.Add(-time.Hour)
+	b.refill(time.Now())
+	if b.tokens != 3 {
+		t.Fatalf("tokens = %v; want capped at 3", b.tokens)
+	}
+}
+
+func TestTokenBucketOversizedTakeWhenFull(t *testing.T) {
+	b := createTokenBucket(100, 10)
+	if !b.take(50) {
+		t.Fatal("an oversized request should pass when the bucket is full")
+	}
+	if b.take(1) {
+		t.Fatal("tokens should be negative after an oversized take")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	b := createTokenBucket(100, 1)
+	if d := b.reserve(1); d != 0 {
+		t.Fatalf("first reserve waits %v; want 0", d)
+	}
+	d := b.reserve(10)
+	if d < 90*time.Millisecond || d > 110*time.Millisecond {
+		t.Fatalf("reserve waits %v; want about 100ms", d)
+	}
+}
+
+func TestTokenBucketDefaultBurst(t *testing.T) {
+	if b := createTokenBucket(5, 0); b.burst != 5 {
+		t.Fatalf("burst = %v; want the rate", b.burst)
+	}
+	if b := createTokenBucket(0.5, 0); b.burst != 1 {
+		t.Fatalf("burst = %v; want at least 1", b.burst)
+	}
+}
+
+func TestInboundLimiterActions(t *testing.T) {
+	if createInboundLimiter(InboundLimit{}) != nil {
+		t.Fatal("a zero limit should not create a limiter")
+	}
+
+	drop := createInboundLimiter(InboundLimit{PacketsPerSecond: 1, PacketBurst: 2, Action: RateLimitActionDrop})
+	for i := 0; i < 2; i++ {
+		if ok, err := drop.admitPacket(10); !ok || err != nil {
+			t.Fatalf("packet %d: %v, %v", i, ok, err)
+		}
+	}
+	if ok, err := drop.admitPacket(10); ok || err != nil {
+		t.Fatalf("third packet: %v, %v; want dropped", ok, err)
+	}
+	if n := drop.getDroppedPackets(); n != 1 {
+		t.Fatalf("dropped = %d; want 1", n)
+	}
+
+	disconnect := createInboundLimiter(InboundLimit{BytesPerSecond: 100, ByteBurst: 100, Action: RateLimitActionDisconnect})
+	disconnect.admitPacket(100)
+	if _, err := disconnect.admitPacket(1); err != errors.ErrorRateLimited {
+		t.Fatalf("err = %v; want ErrorRateLimited", err)
+	}
+}
+
+func TestInboundLimiterThrottleWaits(t *testing.T) {
+	l := createInboundLimiter(InboundLimit{BytesPerSecond: 1000, ByteBurst: 10, Action: RateLimitActionThrottle})
+	st := time.Now()
+	l.throttleRead(10)
+	l.throttleRead(50)
+	if d := time.Since(st); d < 40*time.Millisecond {
+		t.Fatalf("throttled read returned after %v; want about 50ms", d)
+	}
+	if ok, err := l.admitPacket(60); !ok || err != nil {
+		t.Fatal("throttle mode should never drop packets")
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.0/8", "192.168.1.5", "::1", "fd00::/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"::1":         true,
+		"fd00::1":     true,
+		"11.0.0.1":    false,
+	}
+	for ip, want := range cases {
+		if got := containsIP(nets, net.ParseIP(ip)); got != want {
+			t.Errorf("contains(%s) = %v; want %v", ip, got, want)
+		}
+	}
+	if _, err := parseCIDRs([]string{"not-an-ip"}); err == nil {
+		t.Fatal("invalid entries should be rejected")
+	}
+}
+
+func TestAdmissionDenyOverridesAllow(t *testing.T) {
+	a, err := createAdmission(AdmissionControl{Allow: []string{"10.0.0.0/8"}, Deny: []string{"10.0.0.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.check(net.ParseIP("10.0.0.2")); err != nil {
+		t.Fatalf("allowed address rejected: %v", err)
+	}
+	if err := a.check(net.ParseIP("10.0.0.1")); err != errors.ErrorAddressDenied {
+		t.Fatalf("denied address: %v", err)
+	}
+	if err := a.check(net.ParseIP("172.16.0.1")); err != errors.ErrorAddressDenied {
+		t.Fatalf("address outside the allow list: %v", err)
+	}
+	if _, err := createAdmission(AdmissionControl{Deny: []string{"bad"}}); err == nil {
+		t.Fatal("invalid CIDR should fail")
+	}
+}
+
+func TestAdmissionAcceptRates(t *testing.T) {
+	a, _ := createAdmission(AdmissionControl{IPAcceptRate: 1, IPAcceptBurst: 2})
+	ip1, ip2 := net.ParseIP("1.1.1.1"), net.ParseIP("2.2.2.2")
+	a.check(ip1)
+	a.check(ip1)
+	if err := a.check(ip1); err != errors.ErrorRateLimited {
+		t.Fatalf("err = %v; want ErrorRateLimited", err)
+	}
+	if err := a.check(ip2); err != nil {
+		t.Fatalf("per-IP rate should not affect other addresses: %v", err)
+	}
+
+	global, _ := createAdmission(AdmissionControl{AcceptRate: 1, AcceptBurst: 1})
+	global.check(ip1)
+	if err := global.check(ip2); err != errors.ErrorRateLimited {
+		t.Fatalf("err = %v; want ErrorRateLimited", err)
+	}
+}
+
+func TestAdmissionConnectionsPerIP(t *testing.T) {
+	a, _ := createAdmission(AdmissionControl{MaxConnectionsPerIP: 2})
+	ip := net.ParseIP("1.1.1.1")
+	a.acquire(ip)
+	a.acquire(ip)
+	if err := a.acquire(ip); err != errors.ErrorTooManyConnections {
+		t.Fatalf("err = %v; want ErrorTooManyConnections", err)
+	}
+	a.release(ip)
+	if err := a.acquire(ip); err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	a.release(ip)
+	a.release(ip)
+	if len(a.connections) != 0 {
+		t.Fatalf("connections not cleaned up: %v", a.connections)
+	}
+}
+
+func TestRemoteIP(t *testing.T) {
+	if ip := remoteIP(&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 80}); !ip.Equal(net.ParseIP("1.2.3.4")) {
+		t.Fatalf("tcp addr = %v", ip)
+	}
+	if ip := remoteIP(&net.UnixAddr{Name: "/tmp/x.sock", Net: "unix"}); ip != nil {
+		t.Fatalf("unix addr = %v; want nil", ip)
+	}
+	if remoteIP(nil) != nil {
+		t.Fatal("nil addr should give nil")
+	}
+}
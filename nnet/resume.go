@@ -0,0 +1,358 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/utils"
+)
+
+/*
+会话恢复
+	双方为每条发出的消息分配递增的序号，并保留未被对端确认的消息(窗口)，消息以信封包装:
+		{kind: data, seq: 序号, ack: 已收到的最大序号, data: 原消息}
+	没有待发送的消息时，收到的消息由 {kind: ack, ack: 已收到的最大序号} 单独确认
+	握手:
+		客户端 => 服务器   {kind: hello, token: 上次分配的令牌(首次为空), ack: 已收到的最大序号}
+		服务器 => 客户端   {kind: welcome, token: 令牌, ack: 已收到的最大序号, resumed: 是否恢复了原会话}
+	握手完成后双方重发窗口中对端尚未确认的消息，重复的序号由接收方丢弃
+	分配了序号的消息必须按序到达对端，因此总是以阻塞方式写入发送队列，由窗口大小限制积压
+	服务器保留断开的会话 Timeout 时长，期间发往该会话的消息进入窗口，恢复后沿用原 SessionID
+	不支持会话恢复的客户端首个消息不是 hello，服务器按普通连接处理
+*/
+
+const (
+	resumeKeyKind    = 0x7F01
+	resumeKeyToken   = 0x7F02
+	resumeKeySeq     = 0x7F03
+	resumeKeyAck     = 0x7F04
+	resumeKeyData    = 0x7F05
+	resumeKeyResumed = 0x7F06
+)
+
+const (
+	resumeKindHello   = 1
+	resumeKindWelcome = 2
+	resumeKindData    = 3
+	resumeKindAck     = 4
+)
+
+type SessionResume struct {
+	//最多保留的未确认消息数，默认 1024，超出时发送返回 errors.ErrorSendQueueFull
+	Window int
+	//服务器保留断开会话的时长，默认 30 秒
+	Timeout time.Duration
+	//收到消息后最迟多久发送确认，默认 100 毫秒
+	AckDelay time.Duration
+}
+
+func (receiver SessionResume) normalize() SessionResume {
+	if receiver.Window <= 0 {
+		receiver.Window = 1024
+	}
+	if receiver.Timeout <= 0 {
+		receiver.Timeout = 30 * time.Second
+	}
+	if receiver.AckDelay <= 0 {
+		receiver.AckDelay = 100 * time.Millisecond
+	}
+	return receiver
+}
+
+type resumeItem struct {
+	seq uint64
+	msg codecs.IMData
+}
+
+type resumeState struct {
+	config     SessionResume
+	token      string
+	sessionId  SessionID
+	controller *TCPController //当前的连接，断开期间为 nil
+	ready      bool           //握手完成后才直接发送，否则只进入窗口
+	sendSeq    uint64
+	recvSeq    uint64
+	window     []resumeItem
+	unacked    int
+	ackTimer   *time.Timer
+	expire     *time.Timer
+	mutex      sync.Mutex
+	sendMutex  sync.Mutex //保证消息按序号顺序写入发送队列，写入时不持有 mutex
+}
+
+func createResumeState(config SessionResume) *resumeState {
+	s := new(resumeState)
+	s.config = config.normalize()
+	return s
+}
+
+func newResumeToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		utils.LogError("### 生成会话令牌失败. err: %s", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func resumeEnvelopeOf(data codecs.IMData) (*codecs.IMMapReader, int, bool) {
+	m, ok := data.(codecs.IMMap)
+	if !ok {
+		return nil, 0, false
+	}
+	reader := codecs.CreateMapReader(m)
+	kind := int(reader.IntValueOf(resumeKeyKind, 0))
+	return reader, kind, kind != 0
+}
+
+func (receiver *resumeState) attach(controller *TCPController) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.controller = controller
+	receiver.ready = false
+}
+
+// 连接断开时调用，controller 已被新连接取代时返回 false
+func (receiver *resumeState) detach(controller *TCPController) bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.controller != controller {
+		return false
+	}
+	receiver.controller = nil
+	receiver.ready = false
+	if receiver.ackTimer != nil {
+		receiver.ackTimer.Stop()
+		receiver.ackTimer = nil
+	}
+	return true
+}
+
+func (receiver *resumeState) send(priority int, policy int, msgs []codecs.IMData) ([]codecs.IMData, error) {
+	receiver.sendMutex.Lock()
+	defer receiver.sendMutex.Unlock()
+
+	receiver.mutex.Lock()
+	if len(receiver.window)+len(msgs) > receiver.config.Window {
+		receiver.mutex.Unlock()
+		return msgs, errors.ErrorSendQueueFull
+	}
+	start := len(receiver.window)
+	for _, msg := range msgs {
+		receiver.sendSeq += 1
+		receiver.window = append(receiver.window, resumeItem{seq: receiver.sendSeq, msg: msg})
+	}
+	controller := receiver.controller
+	if !receiver.ready || controller == nil {
+		receiver.mutex.Unlock()
+		return nil, nil
+	}
+	envelopes := receiver.envelopesLocked(receiver.window[start:])
+	receiver.mutex.Unlock()
+
+	//抛弃旧数据会在对端留下序号空洞，只允许阻塞或抛弃当前消息(随后撤销序号)
+	envelopePolicy := SendQueuePolicyBlock
+	if policy == SendQueuePolicyDropNewest {
+		envelopePolicy = policy
+	}
+	_, err := controller.sendData(priority, envelopePolicy, envelopes...)
+	if err != nil && err != errors.ErrorRemoteReqClose {
+		//未能写入发送队列，撤销序号，避免对端看到空洞
+		//sendMutex 保证期间没有其他消息分配序号
+		receiver.mutex.Lock()
+		receiver.window = receiver.window[:start]
+		receiver.sendSeq -= uint64(len(msgs))
+		receiver.mutex.Unlock()
+		return msgs, err
+	}
+	//连接已断开时消息保留在窗口中，恢复后重发
+	return nil, nil
+}
+
+// 以信封包装窗口中的消息并附带确认，调用方需持有 mutex
+func (receiver *resumeState) envelopesLocked(items []resumeItem) []codecs.IMData {
+	wrapped := make([]codecs.IMData, len(items))
+	for i, item := range items {
+		wrapped[i] = codecs.IMMap{
+			resumeKeyKind: resumeKindData,
+			resumeKeySeq:  int64(item.seq),
+			resumeKeyAck:  int64(receiver.recvSeq),
+			resumeKeyData: item.msg,
+		}
+	}
+	if len(items) > 0 {
+		receiver.unacked = 0
+	}
+	return wrapped
+}
+
+// 控制消息在持有 mutex 时发送，不能阻塞，发送失败的确认会在下次收到消息时补发
+// 调用方需持有 mutex
+func (receiver *resumeState) sendControlLocked(m codecs.IMMap) error {
+	if receiver.controller == nil {
+		return errors.ErrorRemoteReqClose
+	}
+	_, err := receiver.controller.sendData(SendPriorityControl, SendQueuePolicyDropNewest, m)
+	return err
+}
+
+// 丢弃对端已确认的消息，调用方需持有 mutex
+func (receiver *resumeState) trimLocked(ack uint64) {
+	i := 0
+	for i < len(receiver.window) && receiver.window[i].seq <= ack {
+		i++
+	}
+	if i > 0 {
+		receiver.window = append(receiver.window[:0], receiver.window[i:]...)
+	}
+}
+
+// 处理收到的信封，返回需要交给上层的消息
+func (receiver *resumeState) onData(reader *codecs.IMMapReader, kind int) (codecs.IMData, bool) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.trimLocked(uint64(reader.IntValueOf(resumeKeyAck, 0)))
+	if kind != resumeKindData {
+		return nil, false
+	}
+	seq := uint64(reader.IntValueOf(resumeKeySeq, 0))
+	if seq <= receiver.recvSeq {
+		//重发的消息已处理过
+		return nil, false
+	}
+	receiver.recvSeq = seq
+	receiver.unacked += 1
+	receiver.scheduleAckLocked()
+	return reader.TryReadValue(resumeKeyData), true
+}
+
+// 调用方需持有 mutex
+func (receiver *resumeState) scheduleAckLocked() {
+	if receiver.unacked >= receiver.config.Window/4 {
+		receiver.sendAckLocked()
+		return
+	}
+	if receiver.ackTimer != nil {
+		return
+	}
+	receiver.ackTimer = time.AfterFunc(receiver.config.AckDelay, func() {
+		receiver.mutex.Lock()
+		defer receiver.mutex.Unlock()
+		receiver.ackTimer = nil
+		if receiver.unacked > 0 {
+			receiver.sendAckLocked()
+		}
+	})
+}
+
+// 调用方需持有 mutex
+func (receiver *resumeState) sendAckLocked() {
+	if !receiver.ready || receiver.controller == nil {
+		return
+	}
+	if err := receiver.sendControlLocked(codecs.IMMap{resumeKeyKind: resumeKindAck, resumeKeyAck: int64(receiver.recvSeq)}); err == nil {
+		receiver.unacked = 0
+	}
+}
+
+func (receiver *resumeState) hello(controller *TCPController) error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.controller != controller {
+		return errors.ErrorRemoteReqClose
+	}
+	return receiver.sendControlLocked(codecs.IMMap{
+		resumeKeyKind:  resumeKindHello,
+		resumeKeyToken: receiver.token,
+		resumeKeyAck:   int64(receiver.recvSeq),
+	})
+}
+
+// 服务器完成握手: 回应 welcome 并重发客户端尚未收到的消息
+func (receiver *resumeState) welcome(controller *TCPController, ack uint64, resumed bool) error {
+	receiver.sendMutex.Lock()
+	defer receiver.sendMutex.Unlock()
+
+	receiver.mutex.Lock()
+	if receiver.controller != controller {
+		receiver.mutex.Unlock()
+		return errors.ErrorRemoteReqClose
+	}
+	err := receiver.sendControlLocked(codecs.IMMap{
+		resumeKeyKind:    resumeKindWelcome,
+		resumeKeyToken:   receiver.token,
+		resumeKeyAck:     int64(receiver.recvSeq),
+		resumeKeyResumed: resumed,
+	})
+	if err != nil {
+		receiver.mutex.Unlock()
+		return err
+	}
+	envelopes := receiver.replayLocked(ack)
+	receiver.mutex.Unlock()
+	return receiver.replay(controller, envelopes)
+}
+
+// 客户端收到 welcome，服务器没有恢复原会话时从头接收服务器的消息
+func (receiver *resumeState) onWelcome(controller *TCPController, reader *codecs.IMMapReader) (bool, error) {
+	receiver.sendMutex.Lock()
+	defer receiver.sendMutex.Unlock()
+
+	receiver.mutex.Lock()
+	if receiver.controller != controller {
+		receiver.mutex.Unlock()
+		return false, errors.ErrorRemoteReqClose
+	}
+	resumed := reader.BoolValueOf(resumeKeyResumed)
+	if !resumed {
+		if receiver.token != "" {
+			utils.LogWarn("### 会话 %s 未能恢复，窗口中的 %d 条消息将在新会话中重发", receiver.token, len(receiver.window))
+		}
+		receiver.recvSeq = 0
+	}
+	receiver.token = reader.StrValueOf(resumeKeyToken, "")
+	envelopes := receiver.replayLocked(uint64(reader.IntValueOf(resumeKeyAck, 0)))
+	receiver.mutex.Unlock()
+	return resumed, receiver.replay(controller, envelopes)
+}
+
+// 丢弃对端已确认的消息并开始直接发送，返回需要重发的信封
+// 调用方需持有 mutex 及 sendMutex
+func (receiver *resumeState) replayLocked(ack uint64) []codecs.IMData {
+	receiver.trimLocked(ack)
+	receiver.ready = true
+	envelopes := receiver.envelopesLocked(receiver.window)
+	if len(envelopes) == 0 && receiver.unacked > 0 {
+		receiver.sendAckLocked()
+	}
+	return envelopes
+}
+
+// 调用方需持有 sendMutex
+func (receiver *resumeState) replay(controller *TCPController, envelopes []codecs.IMData) error {
+	if len(envelopes) == 0 {
+		return nil
+	}
+	_, err := controller.sendData(SendPriorityNormal, SendQueuePolicyBlock, envelopes...)
+	return err
+}
@@ -0,0 +1,358 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+)
+
+// 按顺序记录收到的整数消息
+type intRecorder struct {
+	mutex sync.Mutex
+	got   []int64
+}
+
+func (receiver *intRecorder) record(controller Controller, addr string, data codecs.IMData) error {
+	receiver.mutex.Lock()
+	receiver.got = append(receiver.got, intOf(data))
+	receiver.mutex.Unlock()
+	return nil
+}
+
+func (receiver *intRecorder) values() []int64 {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return append([]int64(nil), receiver.got...)
+}
+
+// 收到的消息必须恰好是 0..n-1 且按顺序
+func checkInOrder(t *testing.T, what string, got []int64, n int) {
+	t.Helper()
+	if len(got) != n {
+		t.Fatalf("%s: got %d messages; want %d", what, len(got), n)
+	}
+	for i, v := range got {
+		if v != int64(i) {
+			t.Fatalf("%s: message %d = %d; want in order without duplicates", what, i, v)
+		}
+	}
+}
+
+// 记录停止观察者收到的会话，观察者为全局注册，只统计关心的会话
+type stopRecorder struct {
+	mutex sync.Mutex
+	stops map[SessionID]int
+}
+
+var stopRecorderOnce sync.Once
+var globalStops = &stopRecorder{stops: make(map[SessionID]int)}
+
+func watchControllerStops() *stopRecorder {
+	stopRecorderOnce.Do(func() {
+		AddControllerStopObserver(func(controller Controller) error {
+			globalStops.mutex.Lock()
+			globalStops.stops[controller.GetSessionID()] += 1
+			globalStops.mutex.Unlock()
+			return nil
+		})
+	})
+	return globalStops
+}
+
+func (receiver *stopRecorder) count(id SessionID) int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.stops[id]
+}
+
+// 服务器上唯一的连接
+func onlyController(srv *TCPServer) *TCPController {
+	var found *TCPController
+	srv.eachControllers(func(controller *TCPController) {
+		found = controller
+	})
+	return found
+}
+
+func TestBackoffWithJitterBounds(t *testing.T) {
+	max := time.Second
+	for _, retry := range []time.Duration{10 * time.Millisecond, 100 * time.Millisecond, 700 * time.Millisecond, time.Second} {
+		for i := 0; i < 200; i++ {
+			delay, next := backoffWithJitter(retry, max)
+			if delay < retry/2 || delay >= retry {
+				t.Fatalf("retry %s: delay %s out of [%s, %s)", retry, delay, retry/2, retry)
+			}
+			want := 2 * retry
+			if want > max {
+				want = max
+			}
+			if next != want {
+				t.Fatalf("retry %s: next = %s; want %s", retry, next, want)
+			}
+		}
+	}
+	//间隔过小时不加抖动
+	if delay, next := backoffWithJitter(1, max); delay != 1 || next != 2 {
+		t.Fatalf("tiny retry: delay %s, next %s", delay, next)
+	}
+}
+
+func TestResumeSendDoesNotHoldStateLock(t *testing.T) {
+	controller := createTestController(t)
+	//丢弃策略不适用于分配了序号的消息，队列满时应阻塞而不是丢弃窗口中的消息
+	controller.SetSendQueueLimit(SendQueueLimit{MaxMessages: 1, Policy: SendQueuePolicyDropOldest})
+	state := createResumeState(SessionResume{})
+	controller.resume = state
+	state.attach(controller)
+	state.ready = true
+
+	if _, err := controller.Send(codecs.IMMap{1: 1}); err != nil {
+		t.Fatal(err)
+	}
+	blocked := make(chan error, 1)
+	go func() {
+		_, err := controller.Send(codecs.IMMap{1: 2})
+		blocked <- err
+	}()
+	select {
+	case err := <-blocked:
+		t.Fatalf("send returned while the queue is full: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	//发送阻塞期间仍能处理收到的消息
+	processed := make(chan bool, 1)
+	go func() {
+		reader := codecs.CreateMapReader(codecs.IMMap{resumeKeyKind: resumeKindData, resumeKeySeq: int64(1), resumeKeyData: codecs.IMMap{1: 9}})
+		_, deliver := state.onData(reader, resumeKindData)
+		processed <- deliver
+	}()
+	select {
+	case deliver := <-processed:
+		if !deliver {
+			t.Fatal("data should be delivered")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receiving blocked behind a blocked send")
+	}
+
+	var seqs []int64
+	for len(seqs) < 2 {
+		data, ok := controller.sendQueue.pop()
+		if !ok {
+			time.Sleep(5 * time.Millisecond)
+			continue
+		}
+		for _, msg := range decodeStream(t, data) {
+			seqs = append(seqs, codecs.CreateMapReader(msg.(codecs.IMMap)).IntValueOf(resumeKeySeq, 0))
+		}
+	}
+	if err := <-blocked; err != nil {
+		t.Fatal(err)
+	}
+	if seqs[0] != 1 || seqs[1] != 2 {
+		t.Fatalf("seqs = %v; want [1 2]", seqs)
+	}
+}
+
+func TestResumeSurvivesMidStreamKill(t *testing.T) {
+	stops := watchControllerStops()
+	var serverGot, clientGot intRecorder
+	srv, addr := startTestServer(t, func(srv *TCPServer) {
+		srv.SetSessionResume(SessionResume{Timeout: 5 * time.Second, AckDelay: 10 * time.Millisecond})
+		srv.OnDataDecoded = serverGot.record
+	})
+	resumed := make(chan bool, 4)
+	client := connectTestClient(t, addr, func(client *TCPClient) {
+		client.SetAutoReconnect(AutoReconnect{RetryMin: 10 * time.Millisecond, RetryMax: 20 * time.Millisecond})
+		client.SetSessionResume(SessionResume{AckDelay: 10 * time.Millisecond})
+		client.OnDataDecoded = clientGot.record
+		client.OnReconnect = func(controller Controller, ok bool) error {
+			resumed <- ok
+			return nil
+		}
+	})
+	sessionId := client.GetSessionID()
+	waitFor(t, "session accepted", func() bool { return onlyController(srv) != nil && !onlyController(srv).isHandshaking() })
+	serverSession := onlyController(srv).GetSessionID()
+
+	const n = 400
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			client.Send(codecs.IMMap{1: i})
+			//广播经由会话分配序号
+			srv.Boardcast(codecs.IMMap{1: i})
+			if i%20 == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+
+	waitFor(t, "first messages", func() bool { return len(serverGot.values()) >= n/4 })
+	//从服务器一侧直接断开底层连接，双方都会有尚未送达的消息
+	srv.getController(serverSession).ioinner.Close()
+
+	select {
+	case ok := <-resumed:
+		if !ok {
+			t.Fatal("session should be resumed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("client did not reconnect")
+	}
+	<-done
+	waitFor(t, "all client messages", func() bool { return len(serverGot.values()) >= n })
+	waitFor(t, "all server messages", func() bool { return len(clientGot.values()) >= n })
+	time.Sleep(50 * time.Millisecond)
+	checkInOrder(t, "server", serverGot.values(), n)
+	checkInOrder(t, "client", clientGot.values(), n)
+
+	//会话在重连后继续，SessionID 不变，也不会通知停止观察者
+	if id := client.GetSessionID(); id != sessionId {
+		t.Fatalf("client session id changed from %d to %d", sessionId, id)
+	}
+	if id := onlyController(srv).GetSessionID(); id != serverSession {
+		t.Fatalf("server session id changed from %d to %d", serverSession, id)
+	}
+	if c := stops.count(sessionId); c != 0 {
+		t.Fatalf("client stop observers called %d times while the session continues", c)
+	}
+	if c := stops.count(serverSession); c != 0 {
+		t.Fatalf("server stop observers called %d times while the session continues", c)
+	}
+
+	client.Close()
+	waitFor(t, "session end", func() bool { return stops.count(sessionId) >= 1 })
+}
+
+func TestResumeSessionExpires(t *testing.T) {
+	stops := watchControllerStops()
+	byes := make(chan SessionID, 1)
+	srv, addr := startTestServer(t, func(srv *TCPServer) {
+		srv.SetSessionResume(SessionResume{Timeout: 150 * time.Millisecond})
+		srv.OnBye = func(controller Controller) error {
+			byes <- controller.GetSessionID()
+			return nil
+		}
+	})
+	//客户端不自动重连，断开后会话只保留在服务器一侧
+	client := connectTestClient(t, addr, func(client *TCPClient) {
+		client.SetSessionResume(SessionResume{})
+	})
+	waitFor(t, "handshake", func() bool {
+		client.resume.mutex.Lock()
+		defer client.resume.mutex.Unlock()
+		return client.resume.ready
+	})
+	token := client.resume.token
+	waitFor(t, "session accepted", func() bool { return onlyController(srv) != nil })
+	sessionId := onlyController(srv).GetSessionID()
+	stopped := stops.count(sessionId)
+
+	srv.getController(sessionId).ioinner.Close()
+	select {
+	case <-byes:
+		t.Fatal("OnBye called while the session is kept")
+	case <-time.After(75 * time.Millisecond):
+	}
+	select {
+	case id := <-byes:
+		if id != sessionId {
+			t.Fatalf("OnBye for %d; want %d", id, sessionId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not expire")
+	}
+	waitFor(t, "session removed", func() bool {
+		srv.mutex.Lock()
+		defer srv.mutex.Unlock()
+		_, ok := srv.resumeSessions[token]
+		return !ok && srv.getController(sessionId) == nil
+	})
+	waitFor(t, "stop observers", func() bool { return stops.count(sessionId) > stopped })
+
+	//过期的令牌只能建立新会话
+	fresh := connectTestClient(t, addr, func(client *TCPClient) {
+		client.SetSessionResume(SessionResume{})
+		client.resume.token = token
+	})
+	waitFor(t, "new session", func() bool {
+		fresh.resume.mutex.Lock()
+		defer fresh.resume.mutex.Unlock()
+		return fresh.resume.ready
+	})
+	fresh.resume.mutex.Lock()
+	newToken := fresh.resume.token
+	fresh.resume.mutex.Unlock()
+	if newToken == "" || newToken == token {
+		t.Fatalf("token = %q; want a new token", newToken)
+	}
+}
+
+func TestResumeAnnouncesControllerAfterHandshake(t *testing.T) {
+	srv, addr := startTestServer(t, func(srv *TCPServer) {
+		srv.SetSessionResume(SessionResume{Timeout: 5 * time.Second})
+	})
+
+	//尚未发送握手消息的连接不计入控制器数量
+	before := GetControllerCounts()[ControllerKindTCP]
+	raw, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	time.Sleep(50 * time.Millisecond)
+	if n := GetControllerCounts()[ControllerKindTCP]; n > before {
+		t.Fatalf("tcp controllers = %d before handshake; want at most %d", n, before)
+	}
+
+	resumed := make(chan bool, 1)
+	client := connectTestClient(t, addr, func(client *TCPClient) {
+		client.SetAutoReconnect(AutoReconnect{RetryMin: 10 * time.Millisecond, RetryMax: 20 * time.Millisecond})
+		client.SetSessionResume(SessionResume{})
+		client.OnReconnect = func(controller Controller, ok bool) error {
+			resumed <- ok
+			return nil
+		}
+	})
+	waitFor(t, "session accepted", func() bool { return onlyController(srv) != nil && !onlyController(srv).isHandshaking() })
+	first := onlyController(srv)
+	if !first.isAnnounced() {
+		t.Fatal("accepted controller should be announced")
+	}
+	first.ioinner.Close()
+	if ok := <-resumed; !ok {
+		t.Fatal("session should be resumed")
+	}
+
+	//恢复的连接在沿用原 SessionID 后才通知开始
+	waitFor(t, "resumed controller", func() bool { c := onlyController(srv); return c != nil && c != first })
+	second := onlyController(srv)
+	if second.GetSessionID() != first.GetSessionID() || second.isHandshaking() || !second.isAnnounced() {
+		t.Fatalf("resumed controller id %d (want %d), handshaking %v, announced %v",
+			second.GetSessionID(), first.GetSessionID(), second.isHandshaking(), second.isAnnounced())
+	}
+	client.Close()
+}
@@ -0,0 +1,74 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"sync"
+	"time"
+)
+
+// 合并发送配置，Window 为 0 表示不合并
+// 编码后小于 MaxBytes 的消息会在 Window 时间内按优先级合并为一个封包发送
+type SendCoalesce struct {
+	Window   time.Duration
+	MaxBytes int
+}
+
+type sendCoalescer struct {
+	config  SendCoalesce
+	pending [SendPriorityCount][]byte
+	timers  [SendPriorityCount]*time.Timer
+	mutex   sync.Mutex
+	//取出待合并数据并写入发送队列期间持有，保证与之后直接发送的数据按顺序入队
+	//写入发送队列可能阻塞，此时不持有 mutex，只追加数据的发送不受影响
+	flushMutex sync.Mutex
+}
+
+func createSendCoalescer() *sendCoalescer {
+	c := new(sendCoalescer)
+	return c
+}
+
+func (receiver *sendCoalescer) setConfig(config SendCoalesce) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.config = config
+}
+
+func (receiver *sendCoalescer) getConfig() SendCoalesce {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.config
+}
+
+func (receiver *sendCoalescer) enabled() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.config.Window > 0 && receiver.config.MaxBytes > 0
+}
+
+// 取出指定优先级的待合并数据，调用者需持有锁
+func (receiver *sendCoalescer) take(priority int) []byte {
+	if receiver.timers[priority] != nil {
+		receiver.timers[priority].Stop()
+		receiver.timers[priority] = nil
+	}
+	data := receiver.pending[priority]
+	receiver.pending[priority] = nil
+	return data
+}
@@ -0,0 +1,133 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+)
+
+func TestCoalescedSendsShareOnePacket(t *testing.T) {
+	controller := createTestController(t)
+	controller.SetSendCoalesce(SendCoalesce{Window: 30 * time.Millisecond, MaxBytes: 1024})
+
+	for i := 1; i <= 3; i++ {
+		if _, err := controller.Send(codecs.IMMap{1: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := controller.sendQueue.len(); n != 0 {
+		t.Fatalf("queued %d packets before the window elapsed", n)
+	}
+
+	time.Sleep(80 * time.Millisecond)
+	bufs := drainSendQueue(controller)
+	if len(bufs) != 1 {
+		t.Fatalf("got %d packets; want 1", len(bufs))
+	}
+	msgs := decodeStream(t, bufs...)
+	if len(msgs) != 3 || intOf(msgs[0]) != 1 || intOf(msgs[1]) != 2 || intOf(msgs[2]) != 3 {
+		t.Fatalf("decoded %v", msgs)
+	}
+}
+
+func TestControlPriorityBypassesCoalescing(t *testing.T) {
+	controller := createTestController(t)
+	controller.SetSendCoalesce(SendCoalesce{Window: time.Hour, MaxBytes: 1024})
+
+	controller.Send(codecs.IMMap{1: 1})
+	controller.SendWithPriority(SendPriorityControl, codecs.IMMap{1: 2})
+
+	bufs := drainSendQueue(controller)
+	if len(bufs) != 1 {
+		t.Fatalf("got %d packets; want only the control one", len(bufs))
+	}
+	if msgs := decodeStream(t, bufs...); len(msgs) != 1 || intOf(msgs[0]) != 2 {
+		t.Fatalf("decoded %v", msgs)
+	}
+}
+
+func TestCoalescingFlushesBeforeLargeMessage(t *testing.T) {
+	controller := createTestController(t)
+	controller.SetSendCoalesce(SendCoalesce{Window: time.Hour, MaxBytes: 64})
+
+	controller.Send(codecs.IMMap{1: 1})
+	controller.Send(codecs.IMMap{1: 2, 2: string(make([]byte, 128))})
+
+	bufs := drainSendQueue(controller)
+	if len(bufs) != 2 {
+		t.Fatalf("got %d packets; want 2", len(bufs))
+	}
+	msgs := decodeStream(t, bufs...)
+	if len(msgs) != 2 || intOf(msgs[0]) != 1 || intOf(msgs[1]) != 2 {
+		t.Fatalf("order not preserved: %v", msgs)
+	}
+}
+
+func TestDisablingCoalescingFlushesBufferedData(t *testing.T) {
+	controller := createTestController(t)
+	controller.SetSendCoalesce(SendCoalesce{Window: time.Hour, MaxBytes: 1024})
+
+	controller.Send(codecs.IMMap{1: 1})
+	controller.SetSendCoalesce(SendCoalesce{})
+	controller.Send(codecs.IMMap{1: 2})
+
+	bufs := drainSendQueue(controller)
+	if len(bufs) != 2 {
+		t.Fatalf("got %d packets; want 2", len(bufs))
+	}
+	msgs := decodeStream(t, bufs...)
+	if len(msgs) != 2 || intOf(msgs[0]) != 1 || intOf(msgs[1]) != 2 {
+		t.Fatalf("order not preserved: %v", msgs)
+	}
+}
+
+func TestBlockedFlushDoesNotStallCoalescedSends(t *testing.T) {
+	controller := createTestController(t)
+	controller.SetSendQueueLimit(SendQueueLimit{MaxMessages: 1, Policy: SendQueuePolicyBlock})
+	controller.SetSendCoalesce(SendCoalesce{Window: 10 * time.Millisecond, MaxBytes: 1024})
+
+	//占满发送队列，使窗口结束时的发出阻塞
+	controller.Write([]byte{0})
+	controller.Send(codecs.IMMap{1: 1})
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := controller.Send(codecs.IMMap{1: 2})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("send stalled behind the blocked flush")
+	}
+
+	//腾出空间后先前合并的数据得以发出
+	if data, ok := controller.sendQueue.pop(); !ok || len(data) != 1 {
+		t.Fatalf("popped %v", data)
+	}
+	waitFor(t, "coalesced flush", func() bool { return controller.sendQueue.len() == 1 })
+	controller.sendQueue.pop()
+	controller.Close()
+}
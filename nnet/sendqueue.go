@@ -0,0 +1,202 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"sync"
+
+	"github.com/packing/clove/errors"
+)
+
+// 发送队列满时的处理策略
+const (
+	SendQueuePolicyBlock      = iota //阻塞发送者直到队列有空余
+	SendQueuePolicyDropOldest        //抛弃最早入队的数据
+	SendQueuePolicyDropNewest        //抛弃当前待入队的数据
+	SendQueuePolicyDisconnect        //直接断开连接
+)
+
+// 发送优先级，数值越小越优先被发送
+const (
+	SendPriorityControl = iota
+	SendPriorityHigh
+	SendPriorityNormal
+	SendPriorityBulk
+	SendPriorityCount
+)
+
+// 发送队列限制，MaxBytes/MaxMessages 为 0 表示不限制
+type SendQueueLimit struct {
+	MaxBytes    int
+	MaxMessages int
+	Policy      int
+}
+
+type SendQueueStat struct {
+	Bytes           int
+	Messages        int
+	DroppedMessages int64
+	DroppedBytes    int64
+}
+
+type sendQueue struct {
+	limit           SendQueueLimit
+	items           [SendPriorityCount][][]byte
+	count           int
+	size            int
+	closed          bool
+	droppedMessages int64
+	droppedBytes    int64
+	mutex           sync.Mutex
+	cond            *sync.Cond
+}
+
+func createSendQueue() *sendQueue {
+	q := new(sendQueue)
+	for i := range q.items {
+		q.items[i] = make([][]byte, 0)
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (receiver *sendQueue) setLimit(limit SendQueueLimit) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.limit = limit
+	receiver.cond.Broadcast()
+}
+
+func (receiver *sendQueue) getLimit() SendQueueLimit {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.limit
+}
+
+func (receiver *sendQueue) isFull(l int) bool {
+	if receiver.count == 0 {
+		//空队列总是允许写入，避免单个超大数据永远无法发送
+		return false
+	}
+	if receiver.limit.MaxMessages > 0 && receiver.count >= receiver.limit.MaxMessages {
+		return true
+	}
+	if receiver.limit.MaxBytes > 0 && receiver.size+l > receiver.limit.MaxBytes {
+		return true
+	}
+	return false
+}
+
+func (receiver *sendQueue) drop(l int) {
+	receiver.droppedMessages += 1
+	receiver.droppedBytes += int64(l)
+}
+
+func (receiver *sendQueue) shift(priority int) []byte {
+	data := receiver.items[priority][0]
+	receiver.items[priority][0] = nil
+	receiver.items[priority] = receiver.items[priority][1:]
+	receiver.count -= 1
+	receiver.size -= len(data)
+	return data
+}
+
+// 抛弃优先级不高于 priority 的最早数据，低优先级的数据先被抛弃
+func (receiver *sendQueue) dropOldest(priority int) bool {
+	for p := SendPriorityCount - 1; p >= priority; p-- {
+		if len(receiver.items[p]) > 0 {
+			receiver.drop(len(receiver.shift(p)))
+			return true
+		}
+	}
+	return false
+}
+
+func (receiver *sendQueue) push(data []byte, priority int, policy int) error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+
+	if priority < 0 || priority >= SendPriorityCount {
+		priority = SendPriorityNormal
+	}
+
+	for !receiver.closed && receiver.isFull(len(data)) {
+		switch policy {
+		case SendQueuePolicyBlock:
+			receiver.cond.Wait()
+			continue
+		case SendQueuePolicyDropOldest:
+			if receiver.dropOldest(priority) {
+				continue
+			}
+		}
+		receiver.drop(len(data))
+		return errors.ErrorSendQueueFull
+	}
+
+	if receiver.closed {
+		return errors.ErrorRemoteReqClose
+	}
+
+	receiver.items[priority] = append(receiver.items[priority], data)
+	receiver.count += 1
+	receiver.size += len(data)
+	return nil
+}
+
+func (receiver *sendQueue) pop() ([]byte, bool) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	for p := 0; p < SendPriorityCount; p++ {
+		if len(receiver.items[p]) > 0 {
+			data := receiver.shift(p)
+			receiver.cond.Broadcast()
+			return data, true
+		}
+	}
+	return nil, false
+}
+
+func (receiver *sendQueue) len() int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.count
+}
+
+func (receiver *sendQueue) close() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.closed = true
+	for i := range receiver.items {
+		receiver.items[i] = nil
+	}
+	receiver.count = 0
+	receiver.size = 0
+	receiver.cond.Broadcast()
+}
+
+func (receiver *sendQueue) stat() SendQueueStat {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return SendQueueStat{
+		Bytes:           receiver.size,
+		Messages:        receiver.count,
+		DroppedMessages: receiver.droppedMessages,
+		DroppedBytes:    receiver.droppedBytes,
+	}
+}
@@ -0,0 +1,179 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+func TestSendQueuePopsByPriority(t *testing.T) {
+	q := createSendQueue()
+	q.push([]byte("bulk"), SendPriorityBulk, SendQueuePolicyBlock)
+	q.push([]byte("normal1"), SendPriorityNormal, SendQueuePolicyBlock)
+	q.push([]byte("control"), SendPriorityControl, SendQueuePolicyBlock)
+	q.push([]byte("normal2"), SendPriorityNormal, SendQueuePolicyBlock)
+	//越界的优先级按 Normal 处理
+	q.push([]byte("normal3"), SendPriorityCount+1, SendQueuePolicyBlock)
+
+	want := []string{"control", "normal1", "normal2", "normal3", "bulk"}
+	for _, w := range want {
+		data, ok := q.pop()
+		if !ok || string(data) != w {
+			t.Fatalf("pop = %q, %v; want %q", data, ok, w)
+		}
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestSendQueueDropNewest(t *testing.T) {
+	q := createSendQueue()
+	q.setLimit(SendQueueLimit{MaxMessages: 2, Policy: SendQueuePolicyDropNewest})
+	for i := 0; i < 2; i++ {
+		if err := q.push([]byte("ab"), SendPriorityNormal, SendQueuePolicyDropNewest); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := q.push([]byte("abc"), SendPriorityNormal, SendQueuePolicyDropNewest); err != errors.ErrorSendQueueFull {
+		t.Fatalf("err = %v; want ErrorSendQueueFull", err)
+	}
+	st := q.stat()
+	if st.Messages != 2 || st.Bytes != 4 || st.DroppedMessages != 1 || st.DroppedBytes != 3 {
+		t.Fatalf("stat = %+v", st)
+	}
+}
+
+func TestSendQueueDropOldestPrefersLowPriority(t *testing.T) {
+	q := createSendQueue()
+	q.setLimit(SendQueueLimit{MaxMessages: 3})
+	q.push([]byte("c"), SendPriorityControl, SendQueuePolicyDropOldest)
+	q.push([]byte("b1"), SendPriorityBulk, SendQueuePolicyDropOldest)
+	q.push([]byte("b2"), SendPriorityBulk, SendQueuePolicyDropOldest)
+
+	if err := q.push([]byte("n"), SendPriorityNormal, SendQueuePolicyDropOldest); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		data, ok := q.pop()
+		if !ok {
+			break
+		}
+		got = append(got, string(data))
+	}
+	if len(got) != 3 || got[0] != "c" || got[1] != "n" || got[2] != "b2" {
+		t.Fatalf("got %v; want [c n b2]", got)
+	}
+
+	//只剩更高优先级的数据时不能抛弃它们
+	q.push([]byte("c1"), SendPriorityControl, SendQueuePolicyDropOldest)
+	q.push([]byte("c2"), SendPriorityControl, SendQueuePolicyDropOldest)
+	q.push([]byte("c3"), SendPriorityControl, SendQueuePolicyDropOldest)
+	if err := q.push([]byte("n"), SendPriorityNormal, SendQueuePolicyDropOldest); err != errors.ErrorSendQueueFull {
+		t.Fatalf("err = %v; want ErrorSendQueueFull", err)
+	}
+}
+
+func TestSendQueueMaxBytesAllowsOversizedIntoEmptyQueue(t *testing.T) {
+	q := createSendQueue()
+	q.setLimit(SendQueueLimit{MaxBytes: 4})
+	if err := q.push(make([]byte, 16), SendPriorityNormal, SendQueuePolicyDropNewest); err != nil {
+		t.Fatalf("empty queue should accept oversized data: %v", err)
+	}
+	if err := q.push([]byte("a"), SendPriorityNormal, SendQueuePolicyDropNewest); err != errors.ErrorSendQueueFull {
+		t.Fatalf("err = %v; want ErrorSendQueueFull", err)
+	}
+}
+
+func TestSendQueueBlockWaitsForPop(t *testing.T) {
+	q := createSendQueue()
+	q.setLimit(SendQueueLimit{MaxMessages: 1})
+	q.push([]byte("a"), SendPriorityNormal, SendQueuePolicyBlock)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.push([]byte("b"), SendPriorityNormal, SendQueuePolicyBlock)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("push returned early: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.pop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after pop")
+	}
+	if data, _ := q.pop(); string(data) != "b" {
+		t.Fatalf("pop = %q; want b", data)
+	}
+}
+
+func TestSendQueueCloseReleasesBlockedSender(t *testing.T) {
+	q := createSendQueue()
+	q.setLimit(SendQueueLimit{MaxMessages: 1})
+	q.push([]byte("a"), SendPriorityNormal, SendQueuePolicyBlock)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- q.push([]byte("b"), SendPriorityNormal, SendQueuePolicyBlock)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	q.close()
+	select {
+	case err := <-done:
+		if err != errors.ErrorRemoteReqClose {
+			t.Fatalf("err = %v; want ErrorRemoteReqClose", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("push still blocked after close")
+	}
+	if q.len() != 0 {
+		t.Fatalf("len = %d after close", q.len())
+	}
+}
+
+func TestControllerDisconnectPolicyClosesConnection(t *testing.T) {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	controller := createTCPController(local, createDataReadWriter(nil, nil))
+	controller.SetSendQueueLimit(SendQueueLimit{MaxMessages: 1, Policy: SendQueuePolicyDisconnect})
+
+	if err := controller.write([]byte("a"), SendPriorityNormal, SendQueuePolicyDisconnect); err != nil {
+		t.Fatal(err)
+	}
+	if err := controller.write([]byte("b"), SendPriorityNormal, SendQueuePolicyDisconnect); err != errors.ErrorSendQueueFull {
+		t.Fatalf("err = %v; want ErrorSendQueueFull", err)
+	}
+	if err := controller.write([]byte("c"), SendPriorityNormal, SendQueuePolicyBlock); err != errors.ErrorRemoteReqClose {
+		t.Fatalf("err = %v; want ErrorRemoteReqClose after disconnect", err)
+	}
+	if _, err := remote.Read(make([]byte, 1)); err == nil {
+		t.Fatal("connection should be closed")
+	}
+}
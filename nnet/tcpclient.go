@@ -19,22 +19,50 @@ package nnet
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
 	"github.com/packing/clove/packets"
 	"github.com/packing/clove/utils"
 )
 
+// 断线自动重连的配置
+type AutoReconnect struct {
+	//重连的初始及最大间隔，默认 100 毫秒及 30 秒，每次失败后加倍并加入随机抖动
+	RetryMin time.Duration
+	RetryMax time.Duration
+	//连续失败多少次后放弃并触发 OnBye，0 表示不限
+	//连接建立后不足 RetryMax 又断开的也计为失败，避免对端接受后立即关闭时频繁重连
+	MaxAttempts int
+}
+
 type TCPClient struct {
 	DataController
 	SocketController
+	//自动重连成功后调用，resumed 表示服务器恢复了原会话(仅在启用会话恢复时可能为 true)
+	OnReconnect      func(controller Controller, resumed bool) error
 	Codec            *codecs.Codec
 	Format           *packets.PacketFormat
 	dataNotifyChan   chan int
 	controller       *TCPController
 	isClosed         bool
 	associatedObject interface{}
+	sendQueueLimit   SendQueueLimit
+	sendCoalesce     SendCoalesce
+	packetSize       int
+	dial             func() (net.Conn, error)
+	reconnect        *AutoReconnect
+	resume           *resumeState
+	connects         int
+	connectedAt      time.Time
+	retry            time.Duration
+	attempts         int
+	closeCh          chan struct{}
+	mutex            sync.Mutex
 }
 
 func CreateTCPClient(format *packets.PacketFormat, codec *codecs.Codec) *TCPClient {
@@ -49,6 +77,36 @@ func (receiver *TCPClient) SetControllerAssociatedObject(o interface{}) {
 	receiver.associatedObject = o
 }
 
+func (receiver *TCPClient) SetSendQueueLimit(limit SendQueueLimit) {
+	receiver.sendQueueLimit = limit
+	if receiver.controller != nil {
+		receiver.controller.SetSendQueueLimit(limit)
+	}
+}
+
+func (receiver *TCPClient) SetSendCoalesce(config SendCoalesce) {
+	receiver.sendCoalesce = config
+	if receiver.controller != nil {
+		receiver.controller.SetSendCoalesce(config)
+	}
+}
+
+// 连接断开后自动重连，需在 Connect 之前调用
+func (receiver *TCPClient) SetAutoReconnect(config AutoReconnect) {
+	if config.RetryMin <= 0 {
+		config.RetryMin = 100 * time.Millisecond
+	}
+	if config.RetryMax < config.RetryMin {
+		config.RetryMax = 30 * time.Second
+	}
+	receiver.reconnect = &config
+}
+
+// 启用会话恢复，重连后与服务器重发双方未确认的消息，服务器需同样启用，需在 Connect 之前调用
+func (receiver *TCPClient) SetSessionResume(config SessionResume) {
+	receiver.resume = createResumeState(config)
+}
+
 func (receiver *TCPClient) Connect(addr string, port int) error {
 	receiver.isClosed = true
 	address := fmt.Sprintf("%s:%d", addr, port)
@@ -59,13 +117,16 @@ func (receiver *TCPClient) Connect(addr string, port int) error {
 	if err != nil {
 		return err
 	}
-	conn, err := net.Dial("tcp", address)
+	dial := func() (net.Conn, error) {
+		return net.Dial("tcp", address)
+	}
+	conn, err := dial()
 	if err != nil {
 		utils.LogError("### 连接 %s 失败. err: %s", address, err)
 		return err
 	}
 
-	receiver.isClosed = false
+	receiver.start(dial)
 	receiver.processClient(conn)
 
 	utils.LogInfo("### 连接 %s 成功", address)
@@ -80,37 +141,274 @@ func (receiver *TCPClient) GetSessionID() SessionID {
 	return receiver.controller.GetSessionID()
 }
 
+func (receiver *TCPClient) GetController() *TCPController {
+	return receiver.controller
+}
+
+// 记录拨号方式以便重连，每次 Connect 都会重新开始
+func (receiver *TCPClient) start(dial func() (net.Conn, error)) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.dial = dial
+	receiver.isClosed = false
+	receiver.connects = 0
+	receiver.retry = 0
+	receiver.attempts = 0
+	receiver.closeCh = make(chan struct{})
+}
+
 func (receiver *TCPClient) processClient(conn net.Conn) {
 
 	dataRW := createDataReadWriter(receiver.Codec, receiver.Format)
 	dataRW.OnDataDecoded = receiver.OnDataDecoded
-	receiver.controller = createTCPController(conn, dataRW)
-	receiver.controller.SetAssociatedObject(receiver.associatedObject)
+	if receiver.resume != nil {
+		dataRW.OnDataDecoded = receiver.onResumeData
+	}
+	controller := createTCPController(conn, dataRW)
+	controller.SetAssociatedObject(receiver.associatedObject)
+	controller.SetSendQueueLimit(receiver.sendQueueLimit)
+	controller.SetSendCoalesce(receiver.sendCoalesce)
+	controller.setPacketSize(receiver.packetSize)
+	controller.resume = receiver.resume
+	if receiver.resume != nil {
+		//重连后沿用原会话的 SessionID，经由旧连接发起的调用仍能收到应答
+		if receiver.resume.sessionId == 0 {
+			receiver.resume.sessionId = controller.id
+		}
+		controller.id = receiver.resume.sessionId
+	}
 
-	receiver.controller.OnStop = func(controller Controller) error {
-		if receiver.OnBye != nil {
-			receiver.OnBye(controller)
+	controller.OnStop = func(controller Controller) error {
+		if receiver.lost(controller) {
+			if receiver.OnBye != nil {
+				receiver.OnBye(controller)
+			}
+			receiver.Close()
 		}
-		receiver.Close()
 		return nil
 	}
-	receiver.controller.Schedule()
 
-	if receiver.OnWelcome != nil {
-		receiver.OnWelcome(receiver.controller)
+	receiver.mutex.Lock()
+	receiver.controller = controller
+	receiver.connects += 1
+	receiver.connectedAt = time.Now()
+	reconnected := receiver.connects > 1
+	receiver.mutex.Unlock()
+
+	if receiver.resume != nil {
+		//握手完成前发送的消息只进入窗口
+		receiver.resume.attach(controller)
+	}
+	controller.Schedule()
+	if receiver.resume != nil {
+		receiver.resume.hello(controller)
+	}
+
+	if !reconnected {
+		if receiver.OnWelcome != nil {
+			receiver.OnWelcome(controller)
+		}
+	} else if receiver.resume == nil && receiver.OnReconnect != nil {
+		//启用会话恢复时在握手完成后调用
+		receiver.OnReconnect(controller, false)
+	}
+
+}
+
+// 连接断开时调用，返回 true 表示不再重连
+func (receiver *TCPClient) lost(controller Controller) bool {
+	receiver.mutex.Lock()
+	if receiver.controller != controller {
+		receiver.mutex.Unlock()
+		return false
+	}
+	if receiver.isClosed || receiver.reconnect == nil || receiver.dial == nil {
+		receiver.mutex.Unlock()
+		return true
+	}
+	config := *receiver.reconnect
+	dial := receiver.dial
+	closeCh := receiver.closeCh
+	current := receiver.controller
+	if time.Since(receiver.connectedAt) >= config.RetryMax {
+		receiver.retry = 0
+		receiver.attempts = 0
+	}
+	receiver.mutex.Unlock()
+
+	if receiver.resume != nil {
+		//断开期间发送的消息进入窗口，恢复后重发，会话结束前不取消经由该会话发起的调用
+		receiver.resume.detach(current)
+		current.keepSession()
+	}
+	utils.LogWarn("### 连接 %s 已断开，开始重连", controller.GetSource())
+	go receiver.goroutineReconnect(config, dial, closeCh)
+	return false
+}
+
+func (receiver *TCPClient) goroutineReconnect(config AutoReconnect, dial func() (net.Conn, error), closeCh chan struct{}) {
+	defer utils.LogPanic(recover())
+
+	//上一个连接很快断开时沿用之前的间隔，否则立即重连
+	receiver.mutex.Lock()
+	retry := receiver.retry
+	attempts := receiver.attempts
+	receiver.mutex.Unlock()
+	if retry == 0 {
+		retry = config.RetryMin
+	} else if config.MaxAttempts > 0 && attempts >= config.MaxAttempts {
+		utils.LogError("### 重连后连接多次很快断开，放弃")
+		receiver.giveUp()
+		return
+	} else if !receiver.waitReconnect(&retry, config, closeCh) {
+		return
+	}
+
+	for {
+		attempts++
+		conn, err := dial()
+		if err == nil {
+			receiver.mutex.Lock()
+			closed := receiver.isClosed
+			receiver.retry = retry
+			receiver.attempts = attempts
+			receiver.mutex.Unlock()
+			if closed {
+				conn.Close()
+				return
+			}
+			receiver.processClient(conn)
+			utils.LogInfo("### 重连 %s 成功", conn.RemoteAddr().String())
+			return
+		}
+		if config.MaxAttempts > 0 && attempts >= config.MaxAttempts {
+			utils.LogError("### 重连失败 %d 次，放弃. err: %s", attempts, err)
+			receiver.giveUp()
+			return
+		}
+		if !receiver.waitReconnect(&retry, config, closeCh) {
+			return
+		}
+	}
+}
+
+func (receiver *TCPClient) giveUp() {
+	receiver.mutex.Lock()
+	controller := receiver.controller
+	closed := receiver.isClosed
+	receiver.mutex.Unlock()
+	if closed {
+		return
+	}
+	if receiver.OnBye != nil {
+		receiver.OnBye(controller)
+	}
+	receiver.Close()
+}
+
+// 等待下次重连，客户端关闭时返回 false
+func (receiver *TCPClient) waitReconnect(retry *time.Duration, config AutoReconnect, closeCh chan struct{}) bool {
+	var delay time.Duration
+	delay, *retry = backoffWithJitter(*retry, config.RetryMax)
+	select {
+	case <-closeCh:
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+// 返回本次等待的时间及下次的间隔，等待时间在 [retry/2, retry) 之间随机，避免大量客户端同时重连
+func backoffWithJitter(retry time.Duration, max time.Duration) (time.Duration, time.Duration) {
+	next := retry * 2
+	if next > max {
+		next = max
+	}
+	half := int64(retry / 2)
+	if half <= 0 {
+		return retry, next
+	}
+	return time.Duration(half + rand.Int63n(half)), next
+}
+
+func (receiver *TCPClient) onResumeData(controller Controller, addr string, data codecs.IMData) error {
+	tc, ok := controller.(*TCPController)
+	reader, kind, isEnvelope := resumeEnvelopeOf(data)
+	if !ok || !isEnvelope {
+		if receiver.OnDataDecoded != nil {
+			return receiver.OnDataDecoded(controller, addr, data)
+		}
+		return nil
 	}
 
+	switch kind {
+	case resumeKindWelcome:
+		resumed, err := receiver.resume.onWelcome(tc, reader)
+		if err != nil {
+			return nil
+		}
+		receiver.mutex.Lock()
+		reconnected := receiver.connects > 1
+		receiver.mutex.Unlock()
+		if reconnected && receiver.OnReconnect != nil {
+			receiver.OnReconnect(controller, resumed)
+		}
+	case resumeKindData, resumeKindAck:
+		msg, deliver := receiver.resume.onData(reader, kind)
+		if deliver && receiver.OnDataDecoded != nil {
+			return receiver.OnDataDecoded(controller, addr, msg)
+		}
+	}
+	return nil
 }
 
 func (receiver *TCPClient) Close() {
-	if !receiver.isClosed {
-		receiver.controller.Close()
-		receiver.isClosed = true
+	receiver.mutex.Lock()
+	if receiver.isClosed {
+		receiver.mutex.Unlock()
+		return
+	}
+	receiver.isClosed = true
+	if receiver.closeCh != nil {
+		close(receiver.closeCh)
+		receiver.closeCh = nil
+	}
+	controller := receiver.controller
+	receiver.mutex.Unlock()
+	if controller != nil {
+		controller.Close()
+		//重连期间关闭，保留的会话随之结束
+		controller.endSession()
+	}
+}
+
+// 当前的连接，重连期间为断开的旧连接，客户端关闭后为 nil
+func (receiver *TCPClient) current() *TCPController {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.isClosed {
+		return nil
 	}
+	return receiver.controller
 }
 
 func (receiver *TCPClient) Send(data ...codecs.IMData) {
-	if !receiver.isClosed {
-		receiver.controller.Send(data...)
+	if controller := receiver.current(); controller != nil {
+		controller.Send(data...)
+	}
+}
+
+func (receiver *TCPClient) TrySend(data ...codecs.IMData) error {
+	controller := receiver.current()
+	if controller == nil {
+		return errors.ErrorRemoteReqClose
+	}
+	_, err := controller.TrySend(data...)
+	return err
+}
+
+func (receiver *TCPClient) SendWithPriority(priority int, data ...codecs.IMData) {
+	if controller := receiver.current(); controller != nil {
+		controller.SendWithPriority(priority, data...)
 	}
 }
@@ -18,9 +18,12 @@
 package nnet
 
 import (
+	"fmt"
 	"net"
+	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/packing/clove/codecs"
@@ -39,12 +42,15 @@ type TCPController struct {
 	OnStop           OnControllerStop
 	id               SessionID
 	recvBuffer       *utils.MutexBuffer
-	sendBuffer       *utils.MutexBuffer
+	sendQueue        *sendQueue
+	sendCoalescer    *sendCoalescer
 	ioinner          net.Conn
 	DataRW           *DataReadWriter
 	runableData      chan int
 	source           string
 	flowCh           chan int
+	flowDone         chan struct{}
+	flowMutex        sync.Mutex
 	sendCh           chan int
 	closeOnSended    bool
 	closeSendReq     bool
@@ -53,16 +59,33 @@ type TCPController struct {
 	associatedObject interface{}
 	mutex            sync.Mutex
 	tag              int
+	packetSize       int
+	peerCred         *PeerCredentials
+	readDone         chan struct{}
+	writeDone        chan struct{}
+	detached         bool
+	sessionKept      bool
+	resume           *resumeState
+	handshaking      bool
+	announced        bool
+	droppedBroadcast int64
 }
 
 func createTCPController(ioSrc net.Conn, dataRW *DataReadWriter) *TCPController {
 	sor := new(TCPController)
 	sor.recvBuffer = new(utils.MutexBuffer)
-	sor.sendBuffer = new(utils.MutexBuffer)
+	sor.sendQueue = createSendQueue()
+	sor.sendCoalescer = createSendCoalescer()
 	sor.ioinner = ioSrc
 	sor.DataRW = dataRW
-	sor.source = ioSrc.RemoteAddr().String()
 	sor.id = NewSessionID()
+	//unix 套接字的对端通常没有绑定地址(显示为空或 "@")，以本端地址加会话号区分
+	if addr := ioSrc.RemoteAddr(); addr != nil && addr.String() != "" && addr.String() != "@" {
+		sor.source = addr.String()
+	} else {
+		sor.source = fmt.Sprintf("%s#%d", ioSrc.LocalAddr().String(), sor.id)
+	}
+	sor.peerCred = readPeerCredentials(ioSrc)
 	sor.closeOnSended = false
 	sor.associatedObject = nil
 	sor.flowCh = nil
@@ -73,7 +96,7 @@ func (receiver *TCPController) SetAssociatedObject(o interface{}) {
 	receiver.associatedObject = o
 }
 
-func (receiver TCPController) GetAssociatedObject() interface{} {
+func (receiver *TCPController) GetAssociatedObject() interface{} {
 	return receiver.associatedObject
 }
 
@@ -81,29 +104,40 @@ func (receiver *TCPController) SetFlowQueueLimit(limit int) {
 	receiver.flowQueueLimit = limit
 }
 
+// 关闭流模式时关闭 flowDone，等待中的 LockProcess 返回 false，尚未送出的 UnlockProcess 直接放弃
 func (receiver *TCPController) SetFlowMode(b bool) {
+	receiver.flowMutex.Lock()
+	defer receiver.flowMutex.Unlock()
 	receiver.flowMode = b
 	if b {
 		if receiver.flowCh == nil {
 			receiver.flowCh = make(chan int)
-			receiver.UnlockProcess()
+			receiver.flowDone = make(chan struct{})
+			receiver.unlockProcessLocked()
 		}
 	} else {
 		if receiver.flowCh != nil {
-			close(receiver.flowCh)
+			close(receiver.flowDone)
 			receiver.flowCh = nil
+			receiver.flowDone = nil
 		}
 	}
 }
 
-func (receiver TCPController) IsFlowMode() bool {
+func (receiver *TCPController) IsFlowMode() bool {
+	receiver.flowMutex.Lock()
+	defer receiver.flowMutex.Unlock()
 	return receiver.flowMode
 }
 
 func (receiver *TCPController) LockProcess() bool {
-	if receiver.flowMode {
-		_, ok := <-receiver.flowCh
-		if !ok {
+	receiver.flowMutex.Lock()
+	flowCh, flowDone := receiver.flowCh, receiver.flowDone
+	receiver.flowMutex.Unlock()
+	if flowCh != nil {
+		select {
+		case <-flowCh:
+		case <-flowDone:
 			return false
 		}
 	}
@@ -111,9 +145,19 @@ func (receiver *TCPController) LockProcess() bool {
 }
 
 func (receiver *TCPController) UnlockProcess() {
-	if receiver.flowMode {
+	receiver.flowMutex.Lock()
+	defer receiver.flowMutex.Unlock()
+	receiver.unlockProcessLocked()
+}
+
+func (receiver *TCPController) unlockProcessLocked() {
+	if receiver.flowCh != nil {
+		flowCh, flowDone := receiver.flowCh, receiver.flowDone
 		go func() {
-			receiver.flowCh <- 1
+			select {
+			case flowCh <- 1:
+			case <-flowDone:
+			}
 		}()
 	}
 }
@@ -126,11 +170,11 @@ func (receiver *TCPController) GetTag() int {
 	return receiver.tag
 }
 
-func (receiver TCPController) GetSource() string {
+func (receiver *TCPController) GetSource() string {
 	return receiver.source
 }
 
-func (receiver TCPController) GetSessionID() SessionID {
+func (receiver *TCPController) GetSessionID() SessionID {
 	return receiver.id
 }
 
@@ -141,6 +185,7 @@ func (receiver *TCPController) Close() {
 		utils.LogPanic(recover())
 	}()
 	receiver.closeSendReq = true
+	receiver.sendQueue.close()
 	if receiver.sendCh != nil {
 		close(receiver.sendCh)
 		receiver.sendCh = nil
@@ -155,9 +200,18 @@ func (receiver *TCPController) Discard() {
 }
 
 func (receiver *TCPController) CloseOnSended() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
 	receiver.closeOnSended = true
 }
 
+// 是否已不再接受发送请求(已关闭或正在转移)
+func (receiver *TCPController) isSendClosed() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.closeSendReq
+}
+
 func (receiver *TCPController) Read(l int) ([]byte, int) {
 	return receiver.recvBuffer.Next(l)
 }
@@ -166,74 +220,285 @@ func (receiver *TCPController) Peek(l int) ([]byte, int) {
 	return receiver.recvBuffer.Peek(l)
 }
 
-func (receiver *TCPController) Write(data []byte) {
-	if receiver.closeSendReq {
+func (receiver *TCPController) SetSendQueueLimit(limit SendQueueLimit) {
+	receiver.sendQueue.setLimit(limit)
+}
+
+func (receiver *TCPController) GetSendQueueLimit() SendQueueLimit {
+	return receiver.sendQueue.getLimit()
+}
+
+func (receiver *TCPController) GetSendQueueStat() SendQueueStat {
+	return receiver.sendQueue.stat()
+}
+
+// 需在 Schedule 之前设置
+func (receiver *TCPController) SetInboundLimit(limit InboundLimit) {
+	receiver.DataRW.inbound = createInboundLimiter(limit)
+}
+
+func (receiver *TCPController) GetInboundDroppedPackets() int64 {
+	if receiver.DataRW.inbound == nil {
+		return 0
+	}
+	return receiver.DataRW.inbound.getDroppedPackets()
+}
+
+func (receiver *TCPController) dropBroadcast() {
+	atomic.AddInt64(&receiver.droppedBroadcast, 1)
+}
+
+// 广播、组播及组内发布未能下发到本连接的次数(编码、封包失败或发送队列已满)
+func (receiver *TCPController) GetDroppedBroadcasts() int64 {
+	return atomic.LoadInt64(&receiver.droppedBroadcast)
+}
+
+func (receiver *TCPController) notifySend() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.closeSendReq || receiver.sendCh == nil {
 		return
 	}
-	receiver.sendBuffer.Write(data)
+	select {
+	case receiver.sendCh <- 1:
+	default:
+	}
+}
 
-	go func() {
-		receiver.mutex.Lock()
-		defer func() {
-			receiver.mutex.Unlock()
-		}()
-		if receiver.closeSendReq {
-			return
+// 关闭合并时先发出已合并的数据，避免之后直接发送的数据越过它们
+func (receiver *TCPController) SetSendCoalesce(config SendCoalesce) {
+	c := receiver.sendCoalescer
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+	c.setConfig(config)
+	if config.Window > 0 && config.MaxBytes > 0 {
+		return
+	}
+	for priority := 0; priority < SendPriorityCount; priority++ {
+		if err := receiver.flushCoalescedPriority(priority, SendQueuePolicyBlock); err != nil && err != errors.ErrorRemoteReqClose {
+			utils.LogWarn(">>> 连接 %s 合并发送失败 %s", receiver.GetSource(), err.Error())
 		}
-		receiver.sendCh <- 1
-	}()
+	}
 }
 
-func (receiver *TCPController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+func (receiver *TCPController) GetSendCoalesce() SendCoalesce {
+	return receiver.sendCoalescer.getConfig()
+}
+
+func (receiver *TCPController) write(data []byte, priority int, policy int) error {
+	if receiver.isSendClosed() {
+		return errors.ErrorRemoteReqClose
+	}
+	err := receiver.sendQueue.push(data, priority, policy)
+	if err == errors.ErrorSendQueueFull && policy == SendQueuePolicyDisconnect {
+		utils.LogWarn(">>> 连接 %s 发送队列已满，将被强行关闭", receiver.GetSource())
+		receiver.Close()
+	}
+	if err != nil {
+		return err
+	}
+	receiver.notifySend()
+	return nil
+}
+
+func (receiver *TCPController) Write(data []byte) {
+	receiver.write(data, SendPriorityNormal, receiver.sendQueue.getLimit().Policy)
+}
+
+// 与Write相同，但发送队列已满时不会阻塞也不会抛弃旧数据，而是直接返回错误
+func (receiver *TCPController) TryWrite(data []byte) error {
+	return receiver.write(data, SendPriorityNormal, SendQueuePolicyDropNewest)
+}
+
+// 取出待合并数据封包后写入发送队列，调用者需持有合并器的 flushMutex
+func (receiver *TCPController) flushCoalescedPriority(priority int, policy int) error {
+	c := receiver.sendCoalescer
+	c.mutex.Lock()
+	data := c.take(priority)
+	c.mutex.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	buf, err := receiver.DataRW.packageStream(data)
+	if err != nil {
+		return err
+	}
+	err = receiver.write(buf, priority, policy)
+	if err == errors.ErrorSendQueueFull && policy == SendQueuePolicyDropNewest {
+		//不阻塞的发送遇到队列已满时，已合并的数据放回原处，留待之后发出
+		c.mutex.Lock()
+		c.pending[priority] = append(data, c.pending[priority]...)
+		receiver.scheduleCoalescedLocked(priority)
+		c.mutex.Unlock()
+	}
+	return err
+}
+
+// 将所有优先级的待合并数据送入发送队列
+func (receiver *TCPController) flushCoalesced() error {
+	c := receiver.sendCoalescer
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+	for priority := 0; priority < SendPriorityCount; priority++ {
+		if err := receiver.flushCoalescedPriority(priority, SendQueuePolicyBlock); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (receiver *TCPController) writeCoalesced(data []byte, priority int, policy int) error {
+	c := receiver.sendCoalescer
+	c.mutex.Lock()
+	if len(data) < c.config.MaxBytes && len(c.pending[priority])+len(data) <= c.config.MaxBytes {
+		receiver.appendCoalescedLocked(data, priority)
+		c.mutex.Unlock()
+		return nil
+	}
+	c.mutex.Unlock()
+
+	//保证同一优先级内的发送顺序，先发出已合并的数据
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+	if err := receiver.flushCoalescedPriority(priority, policy); err != nil {
+		return err
+	}
+
+	c.mutex.Lock()
+	if len(data) < c.config.MaxBytes {
+		receiver.appendCoalescedLocked(data, priority)
+		c.mutex.Unlock()
+		return nil
+	}
+	c.mutex.Unlock()
+	buf, err := receiver.DataRW.packageStream(data)
+	if err != nil {
+		return err
+	}
+	return receiver.write(buf, priority, policy)
+}
+
+// 追加待合并数据，并在窗口结束时发出，调用者需持有合并器的 mutex
+func (receiver *TCPController) appendCoalescedLocked(data []byte, priority int) {
+	c := receiver.sendCoalescer
+	c.pending[priority] = append(c.pending[priority], data...)
+	receiver.scheduleCoalescedLocked(priority)
+}
+
+// 调用者需持有合并器的 mutex
+func (receiver *TCPController) scheduleCoalescedLocked(priority int) {
+	c := receiver.sendCoalescer
+	if c.timers[priority] != nil {
+		return
+	}
+	c.timers[priority] = time.AfterFunc(c.config.Window, func() {
+		//写入发送队列时不持有 mutex，队列已满而阻塞时不影响其他发送追加数据
+		c.flushMutex.Lock()
+		defer c.flushMutex.Unlock()
+		if err := receiver.flushCoalescedPriority(priority, receiver.sendQueue.getLimit().Policy); err != nil && err != errors.ErrorRemoteReqClose {
+			utils.LogWarn(">>> 连接 %s 合并发送失败 %s", receiver.GetSource(), err.Error())
+		}
+	})
+}
+
+// 直接写入已封包的数据，合并器中还有同一优先级的数据时先发出它们
+func (receiver *TCPController) writePacked(buf []byte, priority int, policy int) error {
+	if priority == SendPriorityControl {
+		return receiver.write(buf, priority, policy)
+	}
+	c := receiver.sendCoalescer
+	c.flushMutex.Lock()
+	defer c.flushMutex.Unlock()
+	if err := receiver.flushCoalescedPriority(priority, policy); err != nil {
+		return err
+	}
+	return receiver.write(buf, priority, policy)
+}
+
+func (receiver *TCPController) send(priority int, policy int, msg ...codecs.IMData) ([]codecs.IMData, error) {
+	//启用会话恢复时由会话分配序号，并通过会话当前的连接发送
+	if receiver.resume != nil {
+		return receiver.resume.send(priority, policy, msg)
+	}
+	return receiver.sendData(priority, policy, msg...)
+}
+
+func (receiver *TCPController) sendData(priority int, policy int, msg ...codecs.IMData) ([]codecs.IMData, error) {
 	//utils.LogVerbose(">>> 连接 %s 发送客户端消息", receiver.GetSource())
-	if receiver.closeSendReq {
+	if receiver.isSendClosed() {
 		return msg, errors.ErrorRemoteReqClose
 	}
+	if priority < 0 || priority >= SendPriorityCount {
+		priority = SendPriorityNormal
+	}
+
+	//控制消息对延迟敏感，不参与合并
+	if priority != SendPriorityControl && receiver.sendCoalescer.enabled() {
+		st := time.Now().UnixNano()
+		data, remainMsgs, err := receiver.DataRW.encodeStream(receiver, msg...)
+		IncEncodeTime(time.Now().UnixNano() - st)
+		if err == nil {
+			if err = receiver.writeCoalesced(data, priority, policy); err != nil {
+				return msg, err
+			}
+		}
+		return remainMsgs, err
+	}
+
 	st := time.Now().UnixNano()
 	buf, remainMsgs, err := receiver.DataRW.PackStream(receiver, msg...)
 	IncEncodeTime(time.Now().UnixNano() - st)
 	if err == nil {
-		receiver.Write(buf)
+		if err = receiver.writePacked(buf, priority, policy); err != nil {
+			return msg, err
+		}
 	}
 	return remainMsgs, err
 }
 
+func (receiver *TCPController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+	return receiver.send(SendPriorityNormal, receiver.sendQueue.getLimit().Policy, msg...)
+}
+
+// 与Send相同，但发送队列已满时直接返回 errors.ErrorSendQueueFull
+func (receiver *TCPController) TrySend(msg ...codecs.IMData) ([]codecs.IMData, error) {
+	return receiver.send(SendPriorityNormal, SendQueuePolicyDropNewest, msg...)
+}
+
+func (receiver *TCPController) SendWithPriority(priority int, msg ...codecs.IMData) ([]codecs.IMData, error) {
+	return receiver.send(priority, receiver.sendQueue.getLimit().Policy, msg...)
+}
+
 func (receiver *TCPController) RawSend(msg ...codecs.IMData) error {
 	//utils.LogVerbose(">>> 连接 %s 发送客户端消息", receiver.GetSource())
-	if receiver.closeSendReq {
+	if receiver.resume != nil {
+		_, err := receiver.resume.send(SendPriorityNormal, receiver.sendQueue.getLimit().Policy, msg)
+		return err
+	}
+	if receiver.isSendClosed() {
 		return errors.ErrorRemoteReqClose
 	}
 	st := time.Now().UnixNano()
 	buf, _, err := receiver.DataRW.PackStream(receiver, msg...)
 	IncEncodeTime(time.Now().UnixNano() - st)
 	if err == nil {
-	sendProc:
-		receiver.ioinner.SetWriteDeadline(time.Now().Add(3 * time.Second))
-		n, sendErr := receiver.ioinner.Write(buf)
-		if sendErr == nil {
-			IncTotalTcpSendSize(n)
-			if n < len(buf) {
-				buf = buf[n:]
-				goto sendProc
-			} else {
-			}
-		} else {
-			utils.LogInfo("RawSend Fail!!! => ", sendErr)
+		if sendErr := receiver.writeFully(buf); sendErr != nil {
+			utils.LogInfo("RawSend Fail!!! => %s", sendErr)
 			return sendErr
 		}
 	}
 	return nil
 }
 
-func (receiver TCPController) ReadFrom() (string, []byte, int) {
+func (receiver *TCPController) ReadFrom() (string, []byte, int) {
 	return "", nil, 0
 }
 
-func (receiver TCPController) WriteTo(addr string, data []byte) {
+func (receiver *TCPController) WriteTo(addr string, data []byte) {
 
 }
 
-func (receiver TCPController) SendTo(addr string, msg ...codecs.IMData) ([]codecs.IMData, error) {
+func (receiver *TCPController) SendTo(addr string, msg ...codecs.IMData) ([]codecs.IMData, error) {
 	return nil, nil
 }
 
@@ -257,7 +522,7 @@ func (receiver *TCPController) processData(wg *sync.WaitGroup) {
 		if !ok {
 			break
 		}
-		if receiver.flowMode && len(receiver.runableData) > receiver.flowQueueLimit {
+		if receiver.IsFlowMode() && len(receiver.runableData) > receiver.flowQueueLimit {
 			utils.LogInfo(">>> 连接 %s 流处理队列长度超出限制，将被强行关闭", receiver.GetSource())
 			receiver.UnlockProcess()
 			receiver.Close()
@@ -281,11 +546,17 @@ func (receiver *TCPController) processData(wg *sync.WaitGroup) {
 func (receiver *TCPController) processRead(wg *sync.WaitGroup) {
 	defer func() {
 		close(receiver.runableData)
+		close(receiver.readDone)
 		wg.Done()
 		utils.LogPanic(recover())
 	}()
 
-	var b = make([]byte, recvbufferSize)
+	//面向报文的连接(unixpacket)每次读取必须容纳一个完整报文，否则超出部分会被丢弃
+	size := recvbufferSize
+	if receiver.packetSize > size {
+		size = receiver.packetSize
+	}
+	var b = make([]byte, size)
 
 	//utils.LogVerbose(">>> 连接 %s 开始处理I/O读取...", receiver.GetSource())
 	for {
@@ -294,6 +565,9 @@ func (receiver *TCPController) processRead(wg *sync.WaitGroup) {
 			IncTotalTcpRecvSize(n)
 			receiver.recvBuffer.Write(b[:n])
 			receiver.runableData <- n
+			if inbound := receiver.DataRW.inbound; inbound != nil {
+				inbound.throttleRead(n)
+			}
 			runtime.Gosched()
 		}
 		if err != nil || n == 0 {
@@ -305,49 +579,199 @@ func (receiver *TCPController) processRead(wg *sync.WaitGroup) {
 	utils.LogVerbose(">>> 连接 %s 停止处理I/O读取", receiver.GetSource())
 }
 
-func (receiver *TCPController) processWrite(wg *sync.WaitGroup) {
+// unix 连接对端进程的凭据，连接建立时获取
+func (receiver *TCPController) GetPeerCredentials() (PeerCredentials, bool) {
+	if receiver.peerCred == nil {
+		return PeerCredentials{}, false
+	}
+	return *receiver.peerCred, true
+}
+
+// 复制底层连接的句柄并停止本控制器，用于将连接转移给其它进程
+// 返回已接收但尚未解析的数据，需随句柄一并转移
+func (receiver *TCPController) Detach() (*os.File, []byte, error) {
+	src, ok := receiver.ioinner.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, nil, errors.ErrorUnsupportedNetwork
+	}
+
+	//合并中的数据先送入发送队列
+	if err := receiver.flushCoalesced(); err != nil {
+		return nil, nil, err
+	}
+
+	//不再接受新的发送请求，等待发送协程退出后写完队列中剩余的数据，保证转移前已发送的数据不丢失
+	receiver.mutex.Lock()
+	receiver.closeSendReq = true
+	if receiver.sendCh != nil {
+		close(receiver.sendCh)
+		receiver.sendCh = nil
+	}
+	receiver.mutex.Unlock()
+	if receiver.writeDone != nil {
+		<-receiver.writeDone
+	}
+	for {
+		data, ok := receiver.sendQueue.pop()
+		if !ok {
+			break
+		}
+		if err := receiver.writeFully(data); err != nil {
+			receiver.Close()
+			return nil, nil, err
+		}
+	}
+
+	f, err := src.File()
+	if err != nil {
+		receiver.Close()
+		return nil, nil, err
+	}
+
+	//句柄已复制，关闭原句柄不会断开连接，连接也不应被当作断开处理
+	receiver.mutex.Lock()
+	receiver.detached = true
+	receiver.mutex.Unlock()
+	receiver.Close()
+	if receiver.readDone != nil {
+		<-receiver.readDone
+	}
+	data, n := receiver.recvBuffer.Peek(receiver.recvBuffer.Len())
+	pending := make([]byte, n)
+	copy(pending, data)
+	receiver.recvBuffer.Reset()
+	return f, pending, nil
+}
+
+// 连接是否已通过 Detach 转移出去，此时 OnStop 不应再按连接断开处理
+func (receiver *TCPController) IsDetached() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.detached
+}
+
+// 握手期间连接已开始调度，但尚未被接纳，SessionID 可能在恢复会话时改变
+func (receiver *TCPController) isHandshaking() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.handshaking
+}
+
+func (receiver *TCPController) setHandshaking(b bool) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.handshaking = b
+}
+
+// 通知连接开始，握手中的连接在握手完成、SessionID 确定后才通知
+func (receiver *TCPController) announce() {
+	receiver.mutex.Lock()
+	announced := receiver.announced
+	receiver.announced = true
+	receiver.mutex.Unlock()
+	if !announced {
+		notifyControllerStart(receiver)
+	}
+}
+
+func (receiver *TCPController) isAnnounced() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.announced
+}
+
+// 连接断开后会话仍然保留(等待会话恢复)，在 OnStop 中调用
+func (receiver *TCPController) keepSession() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.sessionKept = true
+}
+
+// 连接已停止但会话仍在继续(已转移给其他进程，或等待会话恢复)
+func (receiver *TCPController) keepsSession() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.detached || receiver.sessionKept
+}
+
+// 保留的会话最终结束(恢复超时或客户端放弃重连)，补发停止通知
+func (receiver *TCPController) endSession() {
+	receiver.mutex.Lock()
+	kept := receiver.sessionKept
+	receiver.sessionKept = false
+	receiver.mutex.Unlock()
+	if kept {
+		notifyStopObservers(receiver)
+	}
+}
+
+// 用于句柄转移的元数据
+func (receiver *TCPController) fileHandleMeta(pending []byte) FileHandleMeta {
+	meta := FileHandleMeta{Kind: FileHandleKindConn, RemoteAddr: receiver.source, Pending: pending}
+	meta.Format = receiver.DataRW.getFormatTag()
+	meta.Codec = receiver.DataRW.codec
+	return meta
+}
+
+// 设置单次写入/读取的报文上限，仅用于面向报文的连接(unixpacket)，0 表示按字节流处理
+func (receiver *TCPController) setPacketSize(size int) {
+	receiver.packetSize = size
+}
+
+func (receiver *TCPController) writeFully(data []byte) error {
+	for len(data) > 0 {
+		chunk := data
+		if receiver.packetSize > 0 && len(chunk) > receiver.packetSize {
+			chunk = chunk[:receiver.packetSize]
+		}
+		//设置写超时，避免客户端一直不收包，导致服务器内存暴涨
+		receiver.ioinner.SetWriteDeadline(time.Now().Add(3 * time.Second))
+		n, err := receiver.ioinner.Write(chunk)
+		if n > 0 {
+			IncTotalTcpSendSize(n)
+			data = data[n:]
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendCh 由 Schedule 传入，Close 会将 receiver.sendCh 置空，持有原通道以便能收到关闭通知
+func (receiver *TCPController) processWrite(wg *sync.WaitGroup, sendCh chan int) {
 	defer func() {
+		close(receiver.writeDone)
 		wg.Done()
 		utils.LogPanic(recover())
 	}()
 
+main:
 	for {
-		_, ok := <-receiver.sendCh
-		if ok && !receiver.closeSendReq {
-			buf := make([]byte, sendbufferSize)
-
-		main:
-			sendBuffLen, _ := receiver.sendBuffer.Read(buf)
-			tobuf := buf[:sendBuffLen]
-			for sendBuffLen > 0 {
-				//设置写超时，避免客户端一直不收包，导致服务器内存暴涨
-				receiver.ioinner.SetWriteDeadline(time.Now().Add(3 * time.Second))
-				sizeWrited, sendErr := receiver.ioinner.Write(tobuf)
-				if sendErr == nil {
-					if sendBuffLen == sizeWrited {
-						if receiver.closeOnSended {
-							receiver.Close()
-						}
-
-						IncTotalTcpSendSize(sendBuffLen)
-						runtime.Gosched()
-						goto main
-					} else {
-						tobuf = tobuf[:sizeWrited]
-						sendBuffLen = sendBuffLen - sizeWrited
-						IncTotalTcpSendSize(sizeWrited)
-						continue
-					}
-				}
-				if sendErr != nil {
-					utils.LogError(">>> 连接 %s 发送数据超时或异常，关闭连接", receiver.GetSource())
-					utils.LogError(sendErr.Error())
-					receiver.Close()
-				}
+		_, ok := <-sendCh
+		if !ok || receiver.isSendClosed() {
+			break
+		}
+
+		for {
+			data, ok := receiver.sendQueue.pop()
+			if !ok {
 				break
 			}
-		} else {
-			break
+			if sendErr := receiver.writeFully(data); sendErr != nil {
+				utils.LogError(">>> 连接 %s 发送数据超时或异常，关闭连接", receiver.GetSource())
+				utils.LogError(sendErr.Error())
+				receiver.Close()
+				break main
+			}
+			runtime.Gosched()
+		}
+
+		receiver.mutex.Lock()
+		closeOnSended := receiver.closeOnSended
+		receiver.mutex.Unlock()
+		if closeOnSended {
+			receiver.Close()
 		}
 	}
 
@@ -355,18 +779,36 @@ func (receiver *TCPController) processWrite(wg *sync.WaitGroup) {
 }
 
 func (receiver *TCPController) Schedule() {
+	if !receiver.isHandshaking() {
+		receiver.announce()
+	}
 	receiver.runableData = make(chan int, 1024)
-	receiver.sendCh = make(chan int)
+	receiver.readDone = make(chan struct{})
+	receiver.writeDone = make(chan struct{})
+	//调度前已写入接收缓冲区的数据(如随句柄转移过来的未解析数据)需要立即处理
+	if n := receiver.recvBuffer.Len(); n > 0 {
+		receiver.runableData <- n
+	}
+	//容量为1的通知通道，预置一个信号以发送调度前已入队的数据
+	sendCh := make(chan int, 1)
+	sendCh <- 1
+	receiver.mutex.Lock()
+	receiver.sendCh = sendCh
+	receiver.mutex.Unlock()
 	wg := new(sync.WaitGroup)
 	wg.Add(3)
 	go func() {
 		go receiver.processData(wg)
 		go receiver.processRead(wg)
-		go receiver.processWrite(wg)
+		go receiver.processWrite(wg, sendCh)
 		wg.Wait()
 		if receiver.OnStop != nil {
 			receiver.OnStop(receiver)
 		}
+		//握手未完成的连接未曾通知开始
+		if receiver.isAnnounced() {
+			notifyControllerStop(receiver)
+		}
 		utils.LogVerbose(">>> TCP控制器 %s 已关闭调度", receiver.GetSource())
 	}()
 }
@@ -0,0 +1,146 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+// 一对已建立的本地 TCP 连接
+func createTCPPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-accepted
+	if server == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestDetachFlushesQueuedAndCoalescedData(t *testing.T) {
+	server, client := createTCPPair(t)
+	controller := createTCPController(server, createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB))
+	//合并窗口足够长，Detach 前数据只会停留在合并器中
+	controller.SetSendCoalesce(SendCoalesce{Window: time.Hour, MaxBytes: 64 * 1024})
+	stopped := make(chan bool, 1)
+	controller.OnStop = func(c Controller) error {
+		stopped <- c.(*TCPController).IsDetached()
+		return nil
+	}
+	controller.Schedule()
+
+	//客户端先发出半个封包，转移时应作为未解析数据带走
+	full, _, err := createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB).PackStream(nil, codecs.IMMap{1: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	half := full[:3]
+	if _, err := client.Write(half); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "partial packet", func() bool { return controller.recvBuffer.Len() == len(half) })
+
+	//直接入队而不通知发送协程，模拟尚未发出的队列数据
+	queued, _, err := controller.DataRW.PackStream(controller, codecs.IMMap{1: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	controller.sendQueue.push(queued, SendPriorityNormal, SendQueuePolicyBlock)
+	if _, err := controller.Send(codecs.IMMap{1: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	f, pending, err := controller.Detach()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if !bytes.Equal(pending, half) {
+		t.Fatalf("pending = %v; want %v", pending, half)
+	}
+
+	select {
+	case detached := <-stopped:
+		if !detached {
+			t.Fatal("OnStop should see the controller as detached")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnStop not called")
+	}
+
+	//转移前的数据已全部发出，转移后的句柄仍可继续发送
+	if _, err := f.Write(full); err != nil {
+		t.Fatal(err)
+	}
+	buf := new(utils.MutexBuffer)
+	var got []int64
+	dataRW := createDataReadWriter(codecs.CodecIMv2, packets.PacketFormatNB)
+	dataRW.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+		got = append(got, intOf(data))
+		return nil
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 4096)
+	for len(got) < 3 {
+		n, err := client.Read(b)
+		if err != nil {
+			t.Fatalf("read: %v (got %v)", err, got)
+		}
+		buf.Write(b[:n])
+		if err := dataRW.ReadStream(createTestController(t), buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 3 || got[0] != 1 || got[1] != 2 || got[2] != 100 {
+		t.Fatalf("got %v; want [1 2 100]", got)
+	}
+}
+
+func TestDetachUnsupportedConnection(t *testing.T) {
+	controller := createTestController(t)
+	if _, _, err := controller.Detach(); err == nil {
+		t.Fatal("Detach over a pipe should fail")
+	}
+	if controller.IsDetached() {
+		t.Fatal("controller should not be detached")
+	}
+}
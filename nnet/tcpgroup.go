@@ -0,0 +1,159 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"sync"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+)
+
+type tcpGroups struct {
+	members     map[string]map[SessionID]struct{}
+	memberships map[SessionID]map[string]struct{}
+	mutex       sync.RWMutex
+}
+
+func createTCPGroups() *tcpGroups {
+	g := new(tcpGroups)
+	g.members = make(map[string]map[SessionID]struct{})
+	g.memberships = make(map[SessionID]map[string]struct{})
+	return g
+}
+
+func (receiver *tcpGroups) join(group string, sessionid SessionID) {
+	m, ok := receiver.members[group]
+	if !ok {
+		m = make(map[SessionID]struct{})
+		receiver.members[group] = m
+	}
+	m[sessionid] = struct{}{}
+
+	gs, ok := receiver.memberships[sessionid]
+	if !ok {
+		gs = make(map[string]struct{})
+		receiver.memberships[sessionid] = gs
+	}
+	gs[group] = struct{}{}
+}
+
+func (receiver *tcpGroups) leave(group string, sessionid SessionID) {
+	m, ok := receiver.members[group]
+	if ok {
+		delete(m, sessionid)
+		if len(m) == 0 {
+			delete(receiver.members, group)
+		}
+	}
+
+	gs, ok := receiver.memberships[sessionid]
+	if ok {
+		delete(gs, group)
+		if len(gs) == 0 {
+			delete(receiver.memberships, sessionid)
+		}
+	}
+}
+
+func (receiver *tcpGroups) leaveAll(sessionid SessionID) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	for group := range receiver.memberships[sessionid] {
+		receiver.leave(group, sessionid)
+	}
+}
+
+func (receiver *TCPServer) Join(group string, sessionid SessionID) error {
+	receiver.groups.mutex.Lock()
+	defer receiver.groups.mutex.Unlock()
+	//在锁内确认连接仍然存在，连接断开时会先移出控制器表再在锁内清理其所属分组
+	if receiver.getController(sessionid) == nil {
+		return errors.ErrorSessionIsNotExists
+	}
+	receiver.groups.join(group, sessionid)
+	return nil
+}
+
+func (receiver *TCPServer) Leave(group string, sessionid SessionID) {
+	receiver.groups.mutex.Lock()
+	defer receiver.groups.mutex.Unlock()
+	receiver.groups.leave(group, sessionid)
+}
+
+func (receiver *TCPServer) LeaveAll(sessionid SessionID) {
+	receiver.groups.leaveAll(sessionid)
+}
+
+func (receiver *TCPServer) GetGroupMembers(group string) []SessionID {
+	receiver.groups.mutex.RLock()
+	defer receiver.groups.mutex.RUnlock()
+	m := receiver.groups.members[group]
+	sessionids := make([]SessionID, 0, len(m))
+	for sessionid := range m {
+		sessionids = append(sessionids, sessionid)
+	}
+	return sessionids
+}
+
+func (receiver *TCPServer) GetGroupMemberCount(group string) int {
+	receiver.groups.mutex.RLock()
+	defer receiver.groups.mutex.RUnlock()
+	return len(receiver.groups.members[group])
+}
+
+func (receiver *TCPServer) GetGroups() []string {
+	receiver.groups.mutex.RLock()
+	defer receiver.groups.mutex.RUnlock()
+	groups := make([]string, 0, len(receiver.groups.members))
+	for group := range receiver.groups.members {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (receiver *TCPServer) GetJoinedGroups(sessionid SessionID) []string {
+	receiver.groups.mutex.RLock()
+	defer receiver.groups.mutex.RUnlock()
+	gs := receiver.groups.memberships[sessionid]
+	groups := make([]string, 0, len(gs))
+	for group := range gs {
+		groups = append(groups, group)
+	}
+	return groups
+}
+
+func (receiver *TCPServer) Publish(group string, msg ...codecs.IMData) {
+	if receiver.closed() {
+		return
+	}
+
+	receiver.groups.mutex.RLock()
+	m := receiver.groups.members[group]
+	controllers := make([]*TCPController, 0, len(m))
+	for sessionid := range m {
+		controller := receiver.getController(sessionid)
+		if controller == nil {
+			continue
+		}
+		controllers = append(controllers, controller)
+	}
+	receiver.groups.mutex.RUnlock()
+
+	receiver.fanout(controllers, msg...)
+}
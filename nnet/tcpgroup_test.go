@@ -0,0 +1,127 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+)
+
+func TestGroupJoinPublishLeave(t *testing.T) {
+	srv := createTestServer()
+	controllers := addTestControllers(t, srv, 3, codecs.CodecIMv2)
+	a, b := controllers[0].GetSessionID(), controllers[1].GetSessionID()
+
+	srv.Join("room", a)
+	srv.Join("room", b)
+	srv.Join("lobby", b)
+	if err := srv.Join("room", SessionID(0)); err != errors.ErrorSessionIsNotExists {
+		t.Fatalf("err = %v; want ErrorSessionIsNotExists", err)
+	}
+
+	if n := srv.GetGroupMemberCount("room"); n != 2 {
+		t.Fatalf("room has %d members; want 2", n)
+	}
+	groups := srv.GetJoinedGroups(b)
+	sort.Strings(groups)
+	if len(groups) != 2 || groups[0] != "lobby" || groups[1] != "room" {
+		t.Fatalf("joined groups = %v", groups)
+	}
+
+	srv.Publish("room", codecs.IMMap{1: 1})
+	for i, want := range []int{1, 1, 0} {
+		if n := controllers[i].sendQueue.len(); n != want {
+			t.Fatalf("controller %d queued %d packets; want %d", i, n, want)
+		}
+	}
+
+	srv.Leave("room", a)
+	srv.LeaveAll(b)
+	if n := srv.GetGroupMemberCount("room"); n != 0 {
+		t.Fatalf("room has %d members after leaving", n)
+	}
+	if len(srv.GetGroups()) != 0 {
+		t.Fatalf("empty groups should be removed: %v", srv.GetGroups())
+	}
+}
+
+func TestGroupMembershipRemovedOnDisconnect(t *testing.T) {
+	var joined int32
+	srv, addr := startTestServer(t, func(srv *TCPServer) {
+		srv.OnWelcome = func(controller Controller) error {
+			srv.Join("room", controller.GetSessionID())
+			atomic.AddInt32(&joined, 1)
+			return nil
+		}
+	})
+
+	clients := make([]*TCPClient, 4)
+	for i := range clients {
+		clients[i] = connectTestClient(t, addr, nil)
+	}
+	waitFor(t, "clients to join", func() bool { return srv.GetGroupMemberCount("room") == 4 })
+
+	clients[0].Close()
+	clients[1].Close()
+	waitFor(t, "disconnected clients to leave", func() bool { return srv.GetGroupMemberCount("room") == 2 })
+	for _, sessionid := range srv.GetGroupMembers("room") {
+		if srv.getController(sessionid) == nil {
+			t.Fatalf("group still lists disconnected session %d", sessionid)
+		}
+	}
+}
+
+func TestGroupConcurrentJoinAndDisconnect(t *testing.T) {
+	srv, addr := startTestServer(t, nil)
+	const n = 20
+	for i := 0; i < n; i++ {
+		connectTestClient(t, addr, nil)
+	}
+	waitFor(t, "clients to connect", func() bool { return srv.GetTotal() == n })
+
+	var sessionids []SessionID
+	srv.eachControllers(func(controller *TCPController) {
+		sessionids = append(sessionids, controller.GetSessionID())
+	})
+
+	var wg sync.WaitGroup
+	for i, sessionid := range sessionids {
+		wg.Add(1)
+		go func(i int, sessionid SessionID) {
+			defer wg.Done()
+			if i%2 == 0 {
+				srv.CloseController(sessionid)
+			}
+			srv.Join("room", sessionid)
+			srv.Publish("room", codecs.IMMap{1: i})
+		}(i, sessionid)
+	}
+	wg.Wait()
+
+	waitFor(t, "closed controllers to stop", func() bool { return srv.GetTotal() == n/2 })
+	for _, sessionid := range srv.GetGroupMembers("room") {
+		if srv.getController(sessionid) == nil {
+			t.Fatalf("group lists closed session %d", sessionid)
+		}
+	}
+}
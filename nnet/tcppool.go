@@ -0,0 +1,482 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+/*
+多地址的 TCP 客户端连接池
+	每个地址维持一条连接，发送时按均衡策略选择一条已连接的连接:
+		PoolBalanceRoundRobin     => 轮询
+		PoolBalanceLeastInflight  => 在途请求最少，发送一条消息在途数加一，收到一条消息减一
+		PoolBalanceConsistentHash => 按 key 的一致性哈希，目标不可用时顺延到哈希环上的下一个地址
+	连接断开后按指数退避加随机抖动重连
+	全部地址都不可用时，按 PendingPolicy 缓存待发送的消息直到有连接恢复，或直接返回错误
+*/
+
+const (
+	PoolBalanceRoundRobin     = 0
+	PoolBalanceLeastInflight  = 1
+	PoolBalanceConsistentHash = 2
+)
+
+const (
+	PoolPendingBuffer = 0 //缓存，超过 PendingLimit 时返回错误
+	PoolPendingFail   = 1 //直接返回错误
+)
+
+// 返回当前可用的地址列表，格式为 host:port
+type PoolResolver func() ([]string, error)
+
+type TCPPoolConfig struct {
+	//静态地址列表，与 Resolver 同时设置时以 Resolver 的结果为准
+	Endpoints []string
+	Resolver  PoolResolver
+	//重新调用 Resolver 的间隔，默认 10 秒
+	ResolveInterval time.Duration
+	Balance         int
+	//一致性哈希中每个地址的虚拟节点数，默认 64
+	Replicas int
+	//重连的初始及最大间隔，默认 100 毫秒及 30 秒
+	RetryMin time.Duration
+	RetryMax time.Duration
+	//所有地址都不可用时的处理方式
+	PendingPolicy int
+	PendingLimit  int
+}
+
+type poolEndpoint struct {
+	addr      string
+	client    *TCPClient
+	connected bool
+	removed   bool
+	inflight  int64
+	retry     time.Duration
+}
+
+type poolPending struct {
+	key  string
+	msgs []codecs.IMData
+}
+
+type poolRingNode struct {
+	hash uint32
+	addr string
+}
+
+type TCPPool struct {
+	DataController
+	SocketController
+	Codec  *codecs.Codec
+	Format *packets.PacketFormat
+
+	config    TCPPoolConfig
+	endpoints map[string]*poolEndpoint
+	order     []string
+	ring      []poolRingNode
+	pending   []poolPending
+	next      uint64
+	isClosed  bool
+	closeCh   chan struct{}
+	mutex     sync.Mutex
+}
+
+func CreateTCPPool(format *packets.PacketFormat, codec *codecs.Codec, config TCPPoolConfig) *TCPPool {
+	if config.ResolveInterval <= 0 {
+		config.ResolveInterval = 10 * time.Second
+	}
+	if config.Replicas <= 0 {
+		config.Replicas = 64
+	}
+	if config.RetryMin <= 0 {
+		config.RetryMin = 100 * time.Millisecond
+	}
+	if config.RetryMax < config.RetryMin {
+		config.RetryMax = 30 * time.Second
+	}
+	if config.PendingLimit <= 0 {
+		config.PendingLimit = 1024
+	}
+	pool := new(TCPPool)
+	pool.Codec = codec
+	pool.Format = format
+	pool.config = config
+	pool.endpoints = make(map[string]*poolEndpoint)
+	pool.isClosed = true
+	return pool
+}
+
+// 连接全部地址，部分地址连接失败时在后台重连，不返回错误
+func (receiver *TCPPool) Start() error {
+	addrs := receiver.config.Endpoints
+	if receiver.config.Resolver != nil {
+		resolved, err := receiver.config.Resolver()
+		if err != nil {
+			return err
+		}
+		addrs = resolved
+	}
+
+	receiver.mutex.Lock()
+	receiver.isClosed = false
+	receiver.closeCh = make(chan struct{})
+	receiver.mutex.Unlock()
+
+	receiver.setEndpoints(addrs)
+	if receiver.config.Resolver != nil {
+		go receiver.goroutineResolve(receiver.closeCh)
+	}
+	return nil
+}
+
+func (receiver *TCPPool) Close() {
+	receiver.mutex.Lock()
+	if receiver.isClosed {
+		receiver.mutex.Unlock()
+		return
+	}
+	receiver.isClosed = true
+	close(receiver.closeCh)
+	clients := make([]*TCPClient, 0, len(receiver.endpoints))
+	for _, ep := range receiver.endpoints {
+		ep.removed = true
+		if ep.client != nil {
+			clients = append(clients, ep.client)
+		}
+	}
+	receiver.endpoints = make(map[string]*poolEndpoint)
+	receiver.order = nil
+	receiver.ring = nil
+	receiver.pending = nil
+	receiver.mutex.Unlock()
+
+	for _, client := range clients {
+		client.Close()
+	}
+}
+
+// 当前的地址列表及各自是否已连接
+func (receiver *TCPPool) GetEndpoints() map[string]bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	eps := make(map[string]bool, len(receiver.endpoints))
+	for addr, ep := range receiver.endpoints {
+		eps[addr] = ep.connected
+	}
+	return eps
+}
+
+func (receiver *TCPPool) GetPendingCount() int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return len(receiver.pending)
+}
+
+func (receiver *TCPPool) Send(msgs ...codecs.IMData) error {
+	return receiver.SendWithKey("", msgs...)
+}
+
+// key 仅在 PoolBalanceConsistentHash 策略下有效
+func (receiver *TCPPool) SendWithKey(key string, msgs ...codecs.IMData) error {
+	tried := make(map[string]bool)
+	for {
+		receiver.mutex.Lock()
+		if receiver.isClosed {
+			receiver.mutex.Unlock()
+			return errors.ErrorRemoteReqClose
+		}
+		ep := receiver.pick(key, tried)
+		if ep == nil {
+			err := receiver.addPending(key, msgs)
+			receiver.mutex.Unlock()
+			return err
+		}
+		client := ep.client
+		receiver.mutex.Unlock()
+
+		if err := client.TrySend(msgs...); err != nil {
+			//发送队列已满或连接已关闭，尝试下一个地址
+			tried[ep.addr] = true
+			continue
+		}
+		atomic.AddInt64(&ep.inflight, int64(len(msgs)))
+		return nil
+	}
+}
+
+// 调用方需持有 mutex
+func (receiver *TCPPool) addPending(key string, msgs []codecs.IMData) error {
+	if receiver.config.PendingPolicy == PoolPendingFail {
+		return errors.ErrorPeerUnreachable
+	}
+	if len(receiver.pending) >= receiver.config.PendingLimit {
+		return errors.ErrorSendQueueFull
+	}
+	receiver.pending = append(receiver.pending, poolPending{key: key, msgs: msgs})
+	return nil
+}
+
+// 按均衡策略选择一个已连接的地址，调用方需持有 mutex
+func (receiver *TCPPool) pick(key string, tried map[string]bool) *poolEndpoint {
+	usable := func(addr string) *poolEndpoint {
+		ep := receiver.endpoints[addr]
+		if ep == nil || !ep.connected || tried[addr] {
+			return nil
+		}
+		return ep
+	}
+
+	switch receiver.config.Balance {
+	case PoolBalanceConsistentHash:
+		if len(receiver.ring) == 0 {
+			return nil
+		}
+		h := crc32.ChecksumIEEE([]byte(key))
+		i := sort.Search(len(receiver.ring), func(i int) bool { return receiver.ring[i].hash >= h })
+		for n := 0; n < len(receiver.ring); n++ {
+			if ep := usable(receiver.ring[(i+n)%len(receiver.ring)].addr); ep != nil {
+				return ep
+			}
+		}
+	case PoolBalanceLeastInflight:
+		var best *poolEndpoint
+		for _, addr := range receiver.order {
+			if ep := usable(addr); ep != nil {
+				if best == nil || atomic.LoadInt64(&ep.inflight) < atomic.LoadInt64(&best.inflight) {
+					best = ep
+				}
+			}
+		}
+		return best
+	default:
+		n := uint64(len(receiver.order))
+		for i := uint64(0); i < n; i++ {
+			if ep := usable(receiver.order[(receiver.next+i)%n]); ep != nil {
+				receiver.next += i + 1
+				return ep
+			}
+		}
+	}
+	return nil
+}
+
+// 以新的地址列表替换当前列表，新增的地址立即连接，移除的地址断开
+func (receiver *TCPPool) setEndpoints(addrs []string) {
+	receiver.mutex.Lock()
+	if receiver.isClosed {
+		receiver.mutex.Unlock()
+		return
+	}
+	fresh := make(map[string]bool, len(addrs))
+	var added []*poolEndpoint
+	for _, addr := range addrs {
+		if fresh[addr] {
+			continue
+		}
+		fresh[addr] = true
+		if _, ok := receiver.endpoints[addr]; !ok {
+			ep := &poolEndpoint{addr: addr, retry: receiver.config.RetryMin}
+			receiver.endpoints[addr] = ep
+			added = append(added, ep)
+		}
+	}
+	var removed []*TCPClient
+	for addr, ep := range receiver.endpoints {
+		if !fresh[addr] {
+			ep.removed = true
+			if ep.client != nil {
+				removed = append(removed, ep.client)
+			}
+			delete(receiver.endpoints, addr)
+			utils.LogInfo("### 连接池移除地址 %s", addr)
+		}
+	}
+	receiver.rebuild()
+	receiver.mutex.Unlock()
+
+	for _, client := range removed {
+		client.Close()
+	}
+	for _, ep := range added {
+		go receiver.connect(ep)
+	}
+}
+
+// 重建轮询顺序及哈希环，调用方需持有 mutex
+func (receiver *TCPPool) rebuild() {
+	receiver.order = make([]string, 0, len(receiver.endpoints))
+	for addr := range receiver.endpoints {
+		receiver.order = append(receiver.order, addr)
+	}
+	sort.Strings(receiver.order)
+
+	receiver.ring = make([]poolRingNode, 0, len(receiver.order)*receiver.config.Replicas)
+	for _, addr := range receiver.order {
+		for i := 0; i < receiver.config.Replicas; i++ {
+			h := crc32.ChecksumIEEE([]byte(addr + "#" + strconv.Itoa(i)))
+			receiver.ring = append(receiver.ring, poolRingNode{hash: h, addr: addr})
+		}
+	}
+	sort.Slice(receiver.ring, func(i, j int) bool { return receiver.ring[i].hash < receiver.ring[j].hash })
+}
+
+func (receiver *TCPPool) connect(ep *poolEndpoint) {
+	defer utils.LogPanic(recover())
+
+	for {
+		receiver.mutex.Lock()
+		if ep.removed || receiver.isClosed {
+			receiver.mutex.Unlock()
+			return
+		}
+		receiver.mutex.Unlock()
+
+		client := CreateTCPClient(receiver.Format, receiver.Codec)
+		client.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+			if atomic.AddInt64(&ep.inflight, -1) < 0 {
+				atomic.StoreInt64(&ep.inflight, 0)
+			}
+			if receiver.OnDataDecoded != nil {
+				return receiver.OnDataDecoded(controller, addr, data)
+			}
+			return nil
+		}
+		client.OnBye = func(controller Controller) error {
+			receiver.disconnected(ep, client)
+			if receiver.OnBye != nil {
+				return receiver.OnBye(controller)
+			}
+			return nil
+		}
+		//先记录 client，连接建立后立即断开时 disconnected 才能识别
+		receiver.mutex.Lock()
+		ep.client = client
+		receiver.mutex.Unlock()
+		if err := client.Connect(ep.addr, 0); err == nil {
+			if !receiver.connected(ep, client) {
+				client.Close()
+			}
+			return
+		}
+
+		receiver.mutex.Lock()
+		ep.client = nil
+		delay := receiver.backoff(ep)
+		receiver.mutex.Unlock()
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// 返回本次等待的时间并加倍下次的间隔，调用方需持有 mutex
+func (receiver *TCPPool) backoff(ep *poolEndpoint) time.Duration {
+	var delay time.Duration
+	delay, ep.retry = backoffWithJitter(ep.retry, receiver.config.RetryMax)
+	return delay
+}
+
+func (receiver *TCPPool) connected(ep *poolEndpoint, client *TCPClient) bool {
+	receiver.mutex.Lock()
+	if ep.removed || receiver.isClosed || ep.client != client {
+		receiver.mutex.Unlock()
+		return false
+	}
+	ep.connected = true
+	ep.retry = receiver.config.RetryMin
+	atomic.StoreInt64(&ep.inflight, 0)
+	pending := receiver.pending
+	receiver.pending = nil
+	receiver.mutex.Unlock()
+
+	if receiver.OnWelcome != nil {
+		receiver.OnWelcome(client.GetController())
+	}
+
+	//连接恢复后按原有的均衡策略发送缓存的消息
+	for i, p := range pending {
+		if err := receiver.SendWithKey(p.key, p.msgs...); err != nil {
+			utils.LogWarn("### 连接池发送缓存消息失败，丢弃 %d 条. err: %s", len(pending)-i, err)
+			break
+		}
+	}
+	return true
+}
+
+func (receiver *TCPPool) disconnected(ep *poolEndpoint, client *TCPClient) {
+	receiver.mutex.Lock()
+	if ep.client != client {
+		receiver.mutex.Unlock()
+		return
+	}
+	ep.client = nil
+	ep.connected = false
+	reconnect := !ep.removed && !receiver.isClosed
+	var delay time.Duration
+	if reconnect {
+		delay = receiver.backoff(ep)
+	}
+	receiver.mutex.Unlock()
+
+	if !reconnect {
+		return
+	}
+	utils.LogWarn("### 连接池地址 %s 已断开，%s 后重连", ep.addr, delay)
+	go func() {
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-time.After(delay):
+		}
+		receiver.connect(ep)
+	}()
+}
+
+func (receiver *TCPPool) goroutineResolve(closeCh chan struct{}) {
+	defer utils.LogPanic(recover())
+
+	ticker := time.NewTicker(receiver.config.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-closeCh:
+			return
+		case <-ticker.C:
+		}
+		addrs, err := receiver.config.Resolver()
+		if err != nil {
+			utils.LogWarn("### 连接池解析地址失败. err: %s", err)
+			continue
+		}
+		receiver.setEndpoints(addrs)
+	}
+}
@@ -0,0 +1,293 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/packets"
+)
+
+// 记录收到的消息的测试服务器
+type poolTestServer struct {
+	srv   *TCPServer
+	addr  string
+	mutex sync.Mutex
+	got   []int64
+}
+
+func (receiver *poolTestServer) received() []int64 {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return append([]int64(nil), receiver.got...)
+}
+
+// 在 addr 上启动服务器，addr 为空时使用随机端口
+func startPoolTestServer(t *testing.T, addr string) *poolTestServer {
+	t.Helper()
+	s := new(poolTestServer)
+	if addr == "" {
+		addr = "127.0.0.1:0"
+	}
+	s.srv = CreateTCPServer()
+	s.srv.Format = packets.PacketFormatNB
+	s.srv.Codec = codecs.CodecIMv2
+	s.srv.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+		s.mutex.Lock()
+		s.got = append(s.got, intOf(data))
+		s.mutex.Unlock()
+		return nil
+	}
+	if err := s.srv.Bind(addr, 0); err != nil {
+		t.Fatal(err)
+	}
+	s.srv.Schedule()
+	t.Cleanup(s.srv.Close)
+	s.addr = s.srv.listener.Addr().String()
+	return s
+}
+
+// 本地空闲端口
+func freeTCPAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func startTestPool(t *testing.T, config TCPPoolConfig) *TCPPool {
+	t.Helper()
+	if config.RetryMin == 0 {
+		config.RetryMin = 10 * time.Millisecond
+		config.RetryMax = 20 * time.Millisecond
+	}
+	pool := CreateTCPPool(packets.PacketFormatNB, codecs.CodecIMv2, config)
+	if err := pool.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func waitPoolConnected(t *testing.T, pool *TCPPool, want int) {
+	t.Helper()
+	waitFor(t, "pool connections", func() bool {
+		n := 0
+		for _, ok := range pool.GetEndpoints() {
+			if ok {
+				n++
+			}
+		}
+		return n == want
+	})
+}
+
+// 返回收到 value 的服务器
+func receiverOf(servers []*poolTestServer, value int64) *poolTestServer {
+	for _, s := range servers {
+		for _, v := range s.received() {
+			if v == value {
+				return s
+			}
+		}
+	}
+	return nil
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	servers := []*poolTestServer{startPoolTestServer(t, ""), startPoolTestServer(t, ""), startPoolTestServer(t, "")}
+	pool := startTestPool(t, TCPPoolConfig{Endpoints: []string{servers[0].addr, servers[1].addr, servers[2].addr}})
+	waitPoolConnected(t, pool, 3)
+
+	for i := 0; i < 9; i++ {
+		if err := pool.Send(codecs.IMMap{1: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "all messages", func() bool {
+		return len(servers[0].received())+len(servers[1].received())+len(servers[2].received()) == 9
+	})
+	for i, s := range servers {
+		if n := len(s.received()); n != 3 {
+			t.Fatalf("server %d got %d messages; want 3", i, n)
+		}
+	}
+}
+
+func TestPoolConsistentHashFailover(t *testing.T) {
+	servers := []*poolTestServer{startPoolTestServer(t, ""), startPoolTestServer(t, ""), startPoolTestServer(t, "")}
+	pool := startTestPool(t, TCPPoolConfig{
+		Endpoints: []string{servers[0].addr, servers[1].addr, servers[2].addr},
+		Balance:   PoolBalanceConsistentHash,
+	})
+	waitPoolConnected(t, pool, 3)
+
+	//每个 key 发送两次，相同的 key 总是落在同一地址上
+	const keys = 30
+	owner := make(map[int]*poolTestServer)
+	for k := 0; k < keys; k++ {
+		for n := 0; n < 2; n++ {
+			if err := pool.SendWithKey("user"+strconv.Itoa(k), codecs.IMMap{1: k*10 + n}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	waitFor(t, "hashed messages", func() bool {
+		total := 0
+		for _, s := range servers {
+			total += len(s.received())
+		}
+		return total == keys*2
+	})
+	for k := 0; k < keys; k++ {
+		a, b := receiverOf(servers, int64(k*10)), receiverOf(servers, int64(k*10+1))
+		if a == nil || a != b {
+			t.Fatalf("key %d split across servers", k)
+		}
+		owner[k] = a
+	}
+
+	//关闭其中一个地址后，原本属于它的 key 顺延到其他地址，其余 key 不受影响
+	dead := owner[0]
+	dead.srv.Close()
+	waitPoolConnected(t, pool, 2)
+	for k := 0; k < keys; k++ {
+		if err := pool.SendWithKey("user"+strconv.Itoa(k), codecs.IMMap{1: 1000 + k}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "failover messages", func() bool {
+		for k := 0; k < keys; k++ {
+			if receiverOf(servers, int64(1000+k)) == nil {
+				return false
+			}
+		}
+		return true
+	})
+	for k := 0; k < keys; k++ {
+		s := receiverOf(servers, int64(1000+k))
+		if s == dead {
+			t.Fatalf("key %d sent to a closed server", k)
+		}
+		if owner[k] != dead && s != owner[k] {
+			t.Fatalf("key %d moved although its server is alive", k)
+		}
+	}
+}
+
+func TestPoolLeastInflight(t *testing.T) {
+	busy := startPoolTestServer(t, "")
+	idle := startPoolTestServer(t, "")
+	pool := startTestPool(t, TCPPoolConfig{Endpoints: []string{busy.addr, idle.addr}, Balance: PoolBalanceLeastInflight})
+	waitPoolConnected(t, pool, 2)
+
+	pool.mutex.Lock()
+	ep := pool.endpoints[busy.addr]
+	pool.mutex.Unlock()
+	atomic.StoreInt64(&ep.inflight, 5)
+	for i := 0; i < 3; i++ {
+		if err := pool.Send(codecs.IMMap{1: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "messages", func() bool { return len(idle.received()) == 3 })
+	if n := len(busy.received()); n != 0 {
+		t.Fatalf("busy server got %d messages", n)
+	}
+}
+
+func TestPoolFlushesPendingOnReconnect(t *testing.T) {
+	addr := freeTCPAddr(t)
+	pool := startTestPool(t, TCPPoolConfig{Endpoints: []string{addr}, PendingLimit: 3})
+
+	for i := 0; i < 3; i++ {
+		if err := pool.Send(codecs.IMMap{1: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pool.Send(codecs.IMMap{1: 3}); err != errors.ErrorSendQueueFull {
+		t.Fatalf("err = %v; want ErrorSendQueueFull", err)
+	}
+	if n := pool.GetPendingCount(); n != 3 {
+		t.Fatalf("pending = %d; want 3", n)
+	}
+
+	//地址恢复后缓存的消息按顺序发出
+	s := startPoolTestServer(t, addr)
+	waitFor(t, "pending flushed", func() bool { return len(s.received()) == 3 })
+	if got := s.received(); got[0] != 0 || got[1] != 1 || got[2] != 2 {
+		t.Fatalf("got %v; want [0 1 2]", got)
+	}
+	if n := pool.GetPendingCount(); n != 0 {
+		t.Fatalf("pending = %d after flush", n)
+	}
+}
+
+func TestPoolPendingFail(t *testing.T) {
+	pool := startTestPool(t, TCPPoolConfig{Endpoints: []string{freeTCPAddr(t)}, PendingPolicy: PoolPendingFail})
+	if err := pool.Send(codecs.IMMap{1: 1}); err != errors.ErrorPeerUnreachable {
+		t.Fatalf("err = %v; want ErrorPeerUnreachable", err)
+	}
+	if n := pool.GetPendingCount(); n != 0 {
+		t.Fatalf("pending = %d", n)
+	}
+}
+
+func TestPoolResolverUpdatesEndpoints(t *testing.T) {
+	a := startPoolTestServer(t, "")
+	b := startPoolTestServer(t, "")
+	var mutex sync.Mutex
+	addrs := []string{a.addr}
+	pool := startTestPool(t, TCPPoolConfig{
+		ResolveInterval: 10 * time.Millisecond,
+		Resolver: func() ([]string, error) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return append([]string(nil), addrs...), nil
+		},
+	})
+	waitPoolConnected(t, pool, 1)
+
+	mutex.Lock()
+	addrs = []string{b.addr}
+	mutex.Unlock()
+	waitFor(t, "endpoint switch", func() bool {
+		eps := pool.GetEndpoints()
+		_, hasA := eps[a.addr]
+		return !hasA && eps[b.addr]
+	})
+	if err := pool.Send(codecs.IMMap{1: 7}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "message on new endpoint", func() bool { return len(b.received()) == 1 })
+
+	pool.Close()
+	if err := pool.Send(codecs.IMMap{1: 8}); err != errors.ErrorRemoteReqClose {
+		t.Fatalf("err = %v after close; want ErrorRemoteReqClose", err)
+	}
+}
@@ -18,14 +18,17 @@
 package nnet
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"os"
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/env"
 	"github.com/packing/clove/errors"
 	"github.com/packing/clove/packets"
 	"github.com/packing/clove/utils"
@@ -48,14 +51,23 @@ type TCPServer struct {
 	Format            *packets.PacketFormat
 	limit             int64
 	total             int64
-	listener          *net.TCPListener
+	listener          net.Listener
 	controllers       *sync.Map
+	groups            *tcpGroups
 	isClosed          bool
 	handleTransfer    *UnixMsg
 	handleReceiveAddr string
 	OnConnectAccepted func(conn net.Conn) error
 	ControllerCome    OnControllerCome
 	sendChan          chan *TCPSend
+	sendQueueLimit    SendQueueLimit
+	sendCoalesce      SendCoalesce
+	inboundLimit      InboundLimit
+	admission         *admission
+	packetSize        int
+	allowedUids       uidAllowlist
+	resumeConfig      *SessionResume
+	resumeSessions    map[string]*resumeState
 	mutex             sync.Mutex
 }
 
@@ -77,6 +89,40 @@ func (receiver *TCPServer) SetHandleTransfer(dest string, transfer *UnixMsg) {
 	receiver.handleReceiveAddr = dest
 }
 
+// 设置新连接的发送队列限制，已建立的连接不受影响
+func (receiver *TCPServer) SetSendQueueLimit(limit SendQueueLimit) {
+	receiver.sendQueueLimit = limit
+}
+
+// 设置新连接的合并发送配置，已建立的连接不受影响
+func (receiver *TCPServer) SetSendCoalesce(config SendCoalesce) {
+	receiver.sendCoalesce = config
+}
+
+// 设置新连接的入站流量限制，已建立的连接不受影响
+func (receiver *TCPServer) SetInboundLimit(limit InboundLimit) {
+	receiver.inboundLimit = limit
+}
+
+func (receiver *TCPServer) SetAdmissionControl(config AdmissionControl) error {
+	a, err := createAdmission(config)
+	if err != nil {
+		return err
+	}
+	receiver.admission = a
+	return nil
+}
+
+// 允许客户端断线后恢复会话，会话保留期间沿用原 SessionID，发往该会话的消息在恢复后送达
+// 未启用会话恢复的客户端不受影响，需在 Bind 之前调用
+func (receiver *TCPServer) SetSessionResume(config SessionResume) {
+	config = config.normalize()
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.resumeConfig = &config
+	receiver.resumeSessions = make(map[string]*resumeState)
+}
+
 func (receiver *TCPServer) GetTotal() int {
 	var i = 0
 	receiver.controllers.Range(func(key, value interface{}) bool {
@@ -86,8 +132,109 @@ func (receiver *TCPServer) GetTotal() int {
 	return i
 }
 
-func (receiver TCPServer) OnFileHandleReceived(fd int) error {
-	return receiver.processClientFromFileHandle(fd)
+// 按数据包格式统计当前连接数，尚未识别出格式的连接计入 "unknown"
+func (receiver *TCPServer) GetFormatCounts() map[string]int {
+	counts := make(map[string]int)
+	if receiver.controllers == nil {
+		return counts
+	}
+	receiver.controllers.Range(func(key, value interface{}) bool {
+		tag := "unknown"
+		if controller, ok := value.(*TCPController); ok {
+			if t := controller.DataRW.getFormatTag(); t != "" {
+				tag = t
+			}
+		}
+		counts[tag] += 1
+		return true
+	})
+	return counts
+}
+
+func (receiver *TCPServer) OnFileHandleReceived(fd int) error {
+	return receiver.processClientFromFileHandle(fd, nil)
+}
+
+// 接收转移过来的连接或监听套接字，其它类型的句柄会被关闭
+func (receiver *TCPServer) OnFileHandlesReceived(meta FileHandleMeta, fds []int) error {
+	switch meta.Kind {
+	case FileHandleKindConn:
+		var lastErr error
+		for _, fd := range fds {
+			if err := receiver.processClientFromFileHandle(fd, &meta); err != nil {
+				lastErr = err
+			}
+		}
+		return lastErr
+	case FileHandleKindListener:
+		if len(fds) != 1 || receiver.listener != nil {
+			closeFileHandles(fds)
+			return errors.ErrorUnexpectedFileHandle
+		}
+		f := os.NewFile(uintptr(fds[0]), "listener-from-old")
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		if receiver.closed() {
+			receiver.serve(listener)
+			receiver.Schedule()
+		} else {
+			//已通过 ServeWithoutListener 运行，只需开始接收新连接
+			receiver.listener = listener
+			go func() {
+				defer utils.LogPanic(recover())
+				receiver.acceptLoop()
+			}()
+		}
+		utils.LogInfo("### 接管监听 %s 成功", listener.Addr().String())
+		return nil
+	}
+	closeFileHandles(fds)
+	return errors.ErrorUnexpectedFileHandle
+}
+
+// 将连接转移给 SetHandleTransfer 指定的进程，本进程中的控制器随之停止
+func (receiver *TCPServer) TransferController(sessionid SessionID) error {
+	if receiver.handleTransfer == nil {
+		return errors.ErrorHandleTransferNotSet
+	}
+	controller := receiver.getController(sessionid)
+	if controller == nil {
+		return errors.ErrorSessionIsNotExists
+	}
+	f, pending, err := controller.Detach()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return receiver.handleTransfer.SendFileHandles(receiver.handleReceiveAddr, controller.fileHandleMeta(pending), int(f.Fd()))
+}
+
+// 将监听套接字转移给 SetHandleTransfer 指定的进程，本进程不再接收新连接，已有连接不受影响
+func (receiver *TCPServer) TransferListener() error {
+	if receiver.handleTransfer == nil {
+		return errors.ErrorHandleTransferNotSet
+	}
+	src, ok := receiver.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.ErrorUnsupportedNetwork
+	}
+	f, err := src.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	meta := FileHandleMeta{Kind: FileHandleKindListener, RemoteAddr: receiver.listener.Addr().String()}
+	if err = receiver.handleTransfer.SendFileHandles(receiver.handleReceiveAddr, meta, int(f.Fd())); err != nil {
+		return err
+	}
+	//套接字文件已由接收方继续使用，不能删除
+	if unixListener, ok := receiver.listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+	return receiver.listener.Close()
 }
 
 func (receiver *TCPServer) Bind(addr string, port int) error {
@@ -100,28 +247,61 @@ func (receiver *TCPServer) Bind(addr string, port int) error {
 	if err != nil {
 		return err
 	}
-	receiver.listener, err = net.ListenTCP("tcp", tcpAddr)
+	listener, err := net.ListenTCP("tcp", tcpAddr)
 	if err != nil {
 		utils.LogError("### 监听 %s 失败. err: %s", address, err)
 		return err
 	}
 
-	receiver.isClosed = false
-	receiver.controllers = new(sync.Map)
+	receiver.serve(listener)
 
 	utils.LogInfo("### 监听 %s 成功", address)
 
 	return err
 }
 
+// 以 SO_REUSEPORT 方式监听，多个进程可绑定同一地址，由内核分配新连接
+func (receiver *TCPServer) BindReusePort(addr string, port int) error {
+	receiver.isClosed = true
+	address := fmt.Sprintf("%s:%d", addr, port)
+	if port == 0 {
+		address = addr
+	}
+	lc := net.ListenConfig{Control: setReusePort}
+	listener, err := lc.Listen(context.Background(), "tcp", address)
+	if err != nil {
+		utils.LogError("### 监听 %s 失败. err: %s", address, err)
+		return err
+	}
+
+	receiver.serve(listener)
+
+	utils.LogInfo("### 以 SO_REUSEPORT 方式监听 %s 成功", address)
+
+	return nil
+}
+
+func (receiver *TCPServer) serve(listener net.Listener) {
+	receiver.listener = listener
+	receiver.mutex.Lock()
+	receiver.isClosed = false
+	receiver.mutex.Unlock()
+	receiver.controllers = new(sync.Map)
+	receiver.groups = createTCPGroups()
+}
+
 func (receiver *TCPServer) ServeWithoutListener() error {
 	receiver.isClosed = false
 	receiver.controllers = new(sync.Map)
+	receiver.groups = createTCPGroups()
 
 	//只有实际服务器才有下发需求，才需要初始化发送队列
-	receiver.sendChan = make(chan *TCPSend, 128)
+	sendChan := make(chan *TCPSend, 128)
+	receiver.mutex.Lock()
+	receiver.sendChan = sendChan
+	receiver.mutex.Unlock()
 
-	go receiver.goroutineSend()
+	go receiver.goroutineSend(sendChan)
 	utils.LogInfo("### 无监听服务启动成功")
 
 	return nil
@@ -158,39 +338,101 @@ func (receiver *TCPServer) eachControllers(fn func(*TCPController)) {
 	})
 }
 
-func (receiver TCPServer) GetController(sessid SessionID) *TCPController {
+func (receiver *TCPServer) GetController(sessid SessionID) *TCPController {
 	return receiver.getController(sessid)
 }
 
-func (receiver *TCPServer) processClientFromFileHandle(fd int) error {
+// meta 不为空时按转移前协商好的封包格式及编解码器继续处理，并先处理随句柄转移过来的未解析数据
+func (receiver *TCPServer) processClientFromFileHandle(fd int, meta *FileHandleMeta) error {
 
 	//utils.LogInfo(">>> 接收到转移来到新连接句柄 %d", fd)
 
 	f := os.NewFile(uintptr(fd), "fd-from-old")
 	fc, err := net.FileConn(f)
+	//FileConn 会复制句柄，原句柄需要关闭
+	f.Close()
 	if err != nil {
-		utils.LogError("构造连接对象失败", err)
+		utils.LogError("构造连接对象失败 %s", err)
 		return err
 	}
 
+	//转移过来的连接同样需要经过准入控制
+	admission := receiver.admission
+	ip := remoteIP(fc.RemoteAddr())
+	if ip == nil && meta != nil {
+		if host, _, err := net.SplitHostPort(meta.RemoteAddr); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	if admission != nil {
+		err = admission.check(ip)
+		if err == nil {
+			err = admission.acquire(ip)
+		}
+		if err != nil {
+			utils.LogVerbose("=== 拒绝转移来的连接 %s: %s", ip, err.Error())
+			fc.Close()
+			return err
+		}
+	}
+	release := func() {
+		if admission != nil {
+			admission.release(ip)
+		}
+	}
+
 	atomic.AddInt64(&receiver.total, 1)
 
 	dataRW := createDataReadWriter(receiver.Codec, receiver.Format)
 	dataRW.OnDataDecoded = receiver.OnDataDecoded
+	if meta != nil {
+		if meta.Format != "" {
+			if err, format := env.FindPacketFormat(meta.Format); err == nil {
+				//握手等预处理已在原进程完成
+				dataRW.format = format
+				dataRW.virgin = false
+			}
+		}
+		if meta.Codec != nil {
+			dataRW.codec = meta.Codec
+		}
+	}
 	controller := createTCPController(fc, dataRW)
+	if meta != nil {
+		if meta.RemoteAddr != "" {
+			controller.source = meta.RemoteAddr
+		}
+		controller.recvBuffer.Write(meta.Pending)
+	}
+	controller.SetSendQueueLimit(receiver.sendQueueLimit)
+	controller.SetSendCoalesce(receiver.sendCoalesce)
+	controller.SetInboundLimit(receiver.inboundLimit)
+	controller.setPacketSize(receiver.packetSize)
+
+	if !receiver.allowedUids.allow(controller.peerCred) {
+		utils.LogVerbose("=== 拒绝转移来的连接 %s: %s", controller.GetSource(), errors.ErrorPeerNotAllowed.Error())
+		atomic.AddInt64(&receiver.total, -1)
+		release()
+		fc.Close()
+		return errors.ErrorPeerNotAllowed
+	}
 
 	controller.OnStop = func(controller Controller) error {
-		if receiver.OnBye != nil {
+		//已转移给其他进程的连接并未断开，不触发 OnBye
+		if receiver.OnBye != nil && !controller.(*TCPController).IsDetached() {
 			receiver.OnBye(controller)
 		}
 		atomic.AddInt64(&receiver.total, -1)
 		receiver.delController(controller)
+		receiver.groups.leaveAll(controller.GetSessionID())
+		release()
 		return nil
 	}
 
 	if receiver.ControllerCome != nil {
 		if err = receiver.ControllerCome(controller); err != nil {
 			atomic.AddInt64(&receiver.total, -1)
+			release()
 			return err
 		}
 	}
@@ -211,45 +453,246 @@ func (receiver *TCPServer) processClient(conn net.Conn) {
 		conn.Close()
 		return
 	}
+
+	admission := receiver.admission
+	ip := remoteIP(conn.RemoteAddr())
+	if admission != nil {
+		if err := admission.acquire(ip); err != nil {
+			utils.LogVerbose("=== 拒绝来自 %s 的连接: %s", conn.RemoteAddr().String(), err.Error())
+			conn.Close()
+			return
+		}
+	}
+	release := func() {
+		if admission != nil {
+			admission.release(ip)
+		}
+	}
+
 	atomic.AddInt64(&receiver.total, 1)
 
 	dataRW := createDataReadWriter(receiver.Codec, receiver.Format)
 	dataRW.OnDataDecoded = receiver.OnDataDecoded
 	controller := createTCPController(conn, dataRW)
+	controller.SetSendQueueLimit(receiver.sendQueueLimit)
+	controller.SetSendCoalesce(receiver.sendCoalesce)
+	controller.SetInboundLimit(receiver.inboundLimit)
+	controller.setPacketSize(receiver.packetSize)
+
+	if !receiver.allowedUids.allow(controller.peerCred) {
+		utils.LogVerbose("=== 拒绝来自 %s 的连接: %s", controller.GetSource(), errors.ErrorPeerNotAllowed.Error())
+		atomic.AddInt64(&receiver.total, -1)
+		release()
+		conn.Close()
+		return
+	}
 
 	controller.OnStop = func(controller Controller) error {
+		atomic.AddInt64(&receiver.total, -1)
+		release()
+		tc := controller.(*TCPController)
+		//已转移给其他进程的连接并未断开，不保留会话也不触发 OnBye
+		if tc.IsDetached() {
+			if tc.resume != nil {
+				receiver.mutex.Lock()
+				delete(receiver.resumeSessions, tc.resume.token)
+				receiver.mutex.Unlock()
+			}
+			receiver.delController(controller)
+			receiver.groups.leaveAll(controller.GetSessionID())
+			return nil
+		}
+		if receiver.resumeDetach(tc) {
+			return nil
+		}
 		if receiver.OnBye != nil {
 			receiver.OnBye(controller)
 		}
-		atomic.AddInt64(&receiver.total, -1)
 		receiver.delController(controller)
+		receiver.groups.leaveAll(controller.GetSessionID())
 		return nil
 	}
 
+	if receiver.resumeConfig != nil {
+		//等待客户端的第一个消息，确定是恢复会话还是新连接后再接纳
+		dataRW.OnDataDecoded = receiver.onResumeData
+		controller.setHandshaking(true)
+		controller.Schedule()
+		return
+	}
+
+	if receiver.welcome(controller) != nil {
+		atomic.AddInt64(&receiver.total, -1)
+		release()
+		return
+	}
+}
+
+// 接纳新连接
+func (receiver *TCPServer) welcome(controller *TCPController) error {
 	if receiver.ControllerCome != nil {
 		if err := receiver.ControllerCome(controller); err != nil {
-			atomic.AddInt64(&receiver.total, -1)
-			return
+			return err
 		}
 	}
 
 	receiver.addController(controller)
 
-	controller.Schedule()
+	//握手中的连接已在调度，SessionID 确定后才通知开始
+	if controller.isHandshaking() {
+		controller.setHandshaking(false)
+		controller.announce()
+	} else {
+		controller.Schedule()
+	}
 
 	if receiver.OnWelcome != nil {
 		receiver.OnWelcome(controller)
 	}
+	return nil
+}
+
+// 连接断开时调用，返回 true 表示会话仍然保留(或连接尚未被接纳)，不需要触发 OnBye
+func (receiver *TCPServer) resumeDetach(controller *TCPController) bool {
+	if controller.isHandshaking() {
+		return true
+	}
+	state := controller.resume
+	if state == nil {
+		return false
+	}
+	if !state.detach(controller) {
+		//已被恢复的新连接取代，会话在新连接上继续
+		controller.keepSession()
+		return true
+	}
+
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.isClosed {
+		delete(receiver.resumeSessions, state.token)
+		return false
+	}
+	//会话保留期间不取消经由该会话发起的调用，恢复后的连接沿用相同的 SessionID
+	controller.keepSession()
+	state.mutex.Lock()
+	state.expire = time.AfterFunc(state.config.Timeout, func() {
+		receiver.resumeExpire(state, controller)
+	})
+	state.mutex.Unlock()
+	return true
+}
+
+// 会话保留超时，按连接断开处理
+func (receiver *TCPServer) resumeExpire(state *resumeState, controller *TCPController) {
+	receiver.mutex.Lock()
+	state.mutex.Lock()
+	expired := state.controller == nil && receiver.resumeSessions[state.token] == state
+	if expired {
+		delete(receiver.resumeSessions, state.token)
+	}
+	state.mutex.Unlock()
+	receiver.mutex.Unlock()
+	if !expired {
+		return
+	}
+
+	utils.LogVerbose("=== 会话 %d 保留超时", state.sessionId)
+	if receiver.OnBye != nil {
+		receiver.OnBye(controller)
+	}
+	controller.endSession()
+	receiver.delController(controller)
+	receiver.groups.leaveAll(controller.GetSessionID())
+}
+
+func (receiver *TCPServer) onResumeData(controller Controller, addr string, data codecs.IMData) error {
+	tc := controller.(*TCPController)
+	reader, kind, isEnvelope := resumeEnvelopeOf(data)
+	if tc.isHandshaking() {
+		if isEnvelope && kind == resumeKindHello {
+			return receiver.resumeHandshake(tc, reader)
+		}
+		//不支持会话恢复的客户端，按普通连接处理
+		if err := receiver.welcome(tc); err != nil {
+			return err
+		}
+	} else if isEnvelope && tc.resume != nil {
+		msg, deliver := tc.resume.onData(reader, kind)
+		if !deliver {
+			return nil
+		}
+		data = msg
+	}
+	if receiver.OnDataDecoded != nil {
+		return receiver.OnDataDecoded(controller, addr, data)
+	}
+	return nil
+}
+
+func (receiver *TCPServer) resumeHandshake(controller *TCPController, reader *codecs.IMMapReader) error {
+	token := reader.StrValueOf(resumeKeyToken, "")
+	ack := uint64(reader.IntValueOf(resumeKeyAck, 0))
+
+	receiver.mutex.Lock()
+	state, ok := receiver.resumeSessions[token]
+	if ok {
+		state.mutex.Lock()
+		if state.expire != nil {
+			state.expire.Stop()
+			state.expire = nil
+		}
+		old := state.controller
+		state.mutex.Unlock()
+		receiver.mutex.Unlock()
+
+		//沿用原会话的 SessionID 及关联对象，替换会话表中的旧连接
+		if prev := receiver.getController(state.sessionId); prev != nil {
+			controller.SetAssociatedObject(prev.GetAssociatedObject())
+			controller.SetTag(prev.GetTag())
+		}
+		controller.id = state.sessionId
+		controller.resume = state
+		controller.setHandshaking(false)
+		state.attach(controller)
+		receiver.addController(controller)
+		//握手完成，以恢复后的 SessionID 通知开始
+		controller.announce()
+		if old != nil {
+			//客户端认为旧连接已断开，服务器可能尚未察觉
+			old.Close()
+		}
+		utils.LogVerbose("=== 会话 %d 从 %s 恢复", state.sessionId, controller.GetSource())
+		return state.welcome(controller, ack, true)
+	}
+
+	if token != "" {
+		utils.LogVerbose("=== 会话 %s 已过期，%s 建立新会话", token, controller.GetSource())
+	}
+	state = createResumeState(*receiver.resumeConfig)
+	state.token = newResumeToken()
+	state.sessionId = controller.GetSessionID()
+	receiver.resumeSessions[state.token] = state
+	receiver.mutex.Unlock()
+
+	controller.resume = state
+	state.attach(controller)
+	if err := receiver.welcome(controller); err != nil {
+		receiver.mutex.Lock()
+		delete(receiver.resumeSessions, state.token)
+		receiver.mutex.Unlock()
+		return err
+	}
+	return state.welcome(controller, 0, false)
 }
 
 func (receiver *TCPServer) goroutineAccept() {
 	defer utils.LogPanic(recover())
 
-	if receiver.OnConnectAccepted == nil {
-		//只有实际服务器才有下发需求，才需要初始化发送队列
-		receiver.sendChan = make(chan *TCPSend, 128)
-	}
+	receiver.acceptLoop()
+}
 
+func (receiver *TCPServer) acceptLoop() {
 	for {
 		conn, err := receiver.listener.Accept()
 		if err != nil {
@@ -262,6 +705,14 @@ func (receiver *TCPServer) goroutineAccept() {
 			continue
 		}
 
+		if admission := receiver.admission; admission != nil {
+			if err := admission.check(remoteIP(conn.RemoteAddr())); err != nil {
+				utils.LogVerbose("=== 拒绝来自 %s 的连接: %s", conn.RemoteAddr().String(), err.Error())
+				conn.Close()
+				continue
+			}
+		}
+
 		go func() {
 			if receiver.OnConnectAccepted == nil {
 				receiver.processClient(conn)
@@ -275,18 +726,45 @@ func (receiver *TCPServer) goroutineAccept() {
 }
 
 func (receiver *TCPServer) Close() {
-	if !receiver.isClosed {
-		receiver.listener.Close()
-		receiver.closeAllController()
-		receiver.isClosed = true
+	receiver.mutex.Lock()
+	if receiver.isClosed {
+		receiver.mutex.Unlock()
+		return
+	}
+	receiver.isClosed = true
+	receiver.mutex.Unlock()
+
+	receiver.listener.Close()
+	receiver.eachControllers(func(controller *TCPController) {
+		controller.Close()
+	})
+	receiver.closeResumeSessions()
+}
+
+func (receiver *TCPServer) closed() bool {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.isClosed
+}
+
+// 服务器关闭后不再保留断开的会话，立即按超时处理
+func (receiver *TCPServer) closeResumeSessions() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	for _, state := range receiver.resumeSessions {
+		state.mutex.Lock()
+		if state.controller == nil && state.expire != nil {
+			state.expire.Reset(0)
+		}
+		state.mutex.Unlock()
 	}
 }
 
-func (receiver *TCPServer) goroutineSend() {
+func (receiver *TCPServer) goroutineSend(sendChan chan *TCPSend) {
 	defer utils.LogPanic(recover())
 
-	for !receiver.isClosed {
-		ts, ok := <-receiver.sendChan
+	for !receiver.closed() {
+		ts, ok := <-sendChan
 		if ok {
 			if ts.sessionId > 0 {
 				ctrl := receiver.getController(ts.sessionId)
@@ -294,30 +772,29 @@ func (receiver *TCPServer) goroutineSend() {
 					ctrl.RawSend(ts.msgs...)
 				}
 			} else {
-				receiver.eachControllers(func(controller *TCPController) {
-					controller.RawSend(ts.msgs...)
-				})
+				receiver.Boardcast(ts.msgs...)
 			}
 		} else {
 			//下发队列已销毁,退出发送处理
 			break
 		}
 	}
-	close(receiver.sendChan)
+	close(sendChan)
 }
 
 func (receiver *TCPServer) Schedule() {
+	var sendChan chan *TCPSend
+	if receiver.OnConnectAccepted == nil {
+		//只有实际服务器才有下发需求，才需要初始化发送队列
+		sendChan = make(chan *TCPSend, 128)
+		receiver.mutex.Lock()
+		receiver.sendChan = sendChan
+		receiver.mutex.Unlock()
+	}
 	go receiver.goroutineAccept()
-	go receiver.goroutineSend()
-}
-
-func (receiver *TCPServer) closeAllController(msg ...codecs.IMData) {
-	if receiver.isClosed {
-		return
+	if sendChan != nil {
+		go receiver.goroutineSend(sendChan)
 	}
-	receiver.eachControllers(func(controller *TCPController) {
-		controller.Close()
-	})
 }
 
 func (receiver *TCPServer) CloseController(sessionid SessionID) error {
@@ -330,35 +807,130 @@ func (receiver *TCPServer) CloseController(sessionid SessionID) error {
 }
 
 func (receiver *TCPServer) Send(sessionid SessionID, msg ...codecs.IMData) ([]codecs.IMData, error) {
-	if receiver.isClosed {
+	receiver.mutex.Lock()
+	closed := receiver.isClosed
+	sendChan := receiver.sendChan
+	receiver.mutex.Unlock()
+	if closed {
 		return msg, errors.ErrorSessionIsNotExists
 	}
 	ts := TCPSend{sessionId: sessionid, msgs: msg}
 	go func() {
-		receiver.sendChan <- &ts
+		sendChan <- &ts
 	}()
 
 	return []codecs.IMData{}, nil
 }
 
+// 对一组连接下发相同消息，相同编解码器的连接只编码一次，相同封包参数的连接共享封包后的数据
+// 绑定了加密函数的连接因加密结果可能与连接相关，仅复用编码结果，单独进行封包
+// 未能下发的连接计入其 GetDroppedBroadcasts
+// 队列已满的连接直接抛弃本次消息，避免个别慢连接拖住整个广播
+func (receiver *TCPServer) fanout(controllers []*TCPController, msgs ...codecs.IMData) {
+	encoded := make(map[*codecs.Codec][]byte)
+	failed := make(map[*codecs.Codec]bool)
+	packed := make(map[packKey][]byte)
+
+	for _, controller := range controllers {
+		dataRW := controller.DataRW
+		if controller.resume != nil {
+			//启用会话恢复的连接需要单独分配序号
+			if _, err := controller.send(SendPriorityNormal, SendQueuePolicyDropNewest, msgs...); err != nil {
+				controller.dropBroadcast()
+			}
+			continue
+		}
+		if !dataRW.isReady() {
+			//尚未确定封包格式或编解码器
+			controller.dropBroadcast()
+			continue
+		}
+
+		if failed[dataRW.codec] {
+			controller.dropBroadcast()
+			continue
+		}
+		data, ok := encoded[dataRW.codec]
+		if !ok {
+			st := time.Now().UnixNano()
+			d, remainMsgs, err := dataRW.encodeStream(controller, msgs...)
+			IncEncodeTime(time.Now().UnixNano() - st)
+			if err == nil && len(remainMsgs) > 0 {
+				//部分消息无法编码
+				err = errors.ErrorTypeNotSupported
+			}
+			if err != nil {
+				utils.LogWarn(">>> 广播消息以编解码器 %s 编码失败 %s", dataRW.codec.Name, err.Error())
+				failed[dataRW.codec] = true
+				controller.dropBroadcast()
+				continue
+			}
+			data = d
+			encoded[dataRW.codec] = data
+		}
+
+		if controller.sendCoalescer.enabled() {
+			//与该连接的其他发送一同合并，保证不越过合并中的消息
+			if err := controller.writeCoalesced(data, SendPriorityNormal, SendQueuePolicyDropNewest); err != nil {
+				controller.dropBroadcast()
+			}
+			continue
+		}
+
+		var buf []byte
+		if !dataRW.isPackShareable() {
+			b, err := dataRW.packageStream(data)
+			if err != nil {
+				utils.LogWarn(">>> 连接 %s 广播消息封包失败 %s", controller.GetSource(), err.Error())
+				controller.dropBroadcast()
+				continue
+			}
+			buf = b
+		} else {
+			key := dataRW.getPackKey()
+			buf, ok = packed[key]
+			if !ok {
+				b, err := dataRW.packageStream(data)
+				if err != nil {
+					utils.LogWarn(">>> 连接 %s 广播消息封包失败 %s", controller.GetSource(), err.Error())
+					controller.dropBroadcast()
+					continue
+				}
+				buf = b
+				packed[key] = buf
+			}
+		}
+
+		if err := controller.writePacked(buf, SendPriorityNormal, SendQueuePolicyDropNewest); err != nil {
+			controller.dropBroadcast()
+		}
+	}
+}
+
 func (receiver *TCPServer) Mutilcast(sessionids []SessionID, msg ...codecs.IMData) {
-	if receiver.isClosed {
+	if receiver.closed() {
 		return
 	}
 
+	controllers := make([]*TCPController, 0, len(sessionids))
 	for _, sessionid := range sessionids {
 		controller := receiver.getController(sessionid)
 		if controller == nil {
 			continue
 		}
-		receiver.Send(sessionid, msg...)
+		controllers = append(controllers, controller)
 	}
+	receiver.fanout(controllers, msg...)
 }
 
 func (receiver *TCPServer) Boardcast(msg ...codecs.IMData) {
-	if receiver.isClosed {
+	if receiver.closed() {
 		return
 	}
 
-	receiver.Send(0, msg...)
+	controllers := make([]*TCPController, 0)
+	receiver.eachControllers(func(controller *TCPController) {
+		controllers = append(controllers, controller)
+	})
+	receiver.fanout(controllers, msg...)
 }
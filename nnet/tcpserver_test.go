@@ -0,0 +1,367 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/env"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+// 不监听端口的服务器，连接由测试直接加入
+func createTestServer() *TCPServer {
+	srv := CreateTCPServer()
+	srv.controllers = new(sync.Map)
+	srv.groups = createTCPGroups()
+	return srv
+}
+
+func addTestControllers(t testing.TB, srv *TCPServer, n int, codec *codecs.Codec) []*TCPController {
+	controllers := make([]*TCPController, n)
+	for i := range controllers {
+		local, remote := net.Pipe()
+		t.Cleanup(func() {
+			local.Close()
+			remote.Close()
+		})
+		controllers[i] = createTCPController(local, createDataReadWriter(codec, packets.PacketFormatNB))
+		srv.addController(controllers[i])
+	}
+	return controllers
+}
+
+func TestBoardcastSharesPacketPerGroup(t *testing.T) {
+	srv := createTestServer()
+	plain := addTestControllers(t, srv, 3, codecs.CodecIMv2)
+	other := addTestControllers(t, srv, 2, codecs.CodecIMv1)
+	encrypted := addTestControllers(t, srv, 1, codecs.CodecIMv2)[0]
+	encrypted.DataRW.OnEncrypt = func(data []byte) (error, []byte) {
+		return nil, append([]byte(nil), data...)
+	}
+
+	srv.Boardcast(codecs.IMMap{1: 7})
+
+	var shared []byte
+	for _, controller := range plain {
+		bufs := drainSendQueue(controller)
+		if len(bufs) != 1 {
+			t.Fatalf("got %d packets; want 1", len(bufs))
+		}
+		if shared == nil {
+			shared = bufs[0]
+		} else if &shared[0] != &bufs[0][0] {
+			t.Fatal("controllers with the same codec and format should share the packet")
+		}
+		if msgs := decodeStream(t, bufs...); len(msgs) != 1 || intOf(msgs[0]) != 7 {
+			t.Fatalf("decoded %v", msgs)
+		}
+	}
+	for _, controller := range other {
+		bufs := drainSendQueue(controller)
+		if len(bufs) != 1 || &bufs[0][0] == &shared[0] {
+			t.Fatal("a different codec should get its own packet")
+		}
+	}
+	if bufs := drainSendQueue(encrypted); len(bufs) != 1 || &bufs[0][0] == &shared[0] {
+		t.Fatal("an encrypted controller should be packaged individually")
+	}
+}
+
+func TestBoardcastSharesCompressedPacketById(t *testing.T) {
+	srv := createTestServer()
+	controllers := addTestControllers(t, srv, 4, codecs.CodecIMv2)
+	//同一函数字面量的不同闭包，各自带有不同的状态
+	compressor := func(suffix byte) func([]byte) (error, []byte) {
+		return func(data []byte) (error, []byte) {
+			return nil, append(append([]byte(nil), data...), suffix)
+		}
+	}
+	for _, controller := range controllers {
+		controller.DataRW.compressEnabled = true
+	}
+	controllers[0].DataRW.SetCompressor("a", compressor('a'), nil)
+	controllers[1].DataRW.SetCompressor("a", compressor('a'), nil)
+	controllers[2].DataRW.SetCompressor("b", compressor('b'), nil)
+	controllers[3].DataRW.SetCompressor("", compressor('c'), nil)
+
+	srv.Boardcast(codecs.IMMap{1: 1})
+
+	bufs := make([][]byte, len(controllers))
+	for i, controller := range controllers {
+		got := drainSendQueue(controller)
+		if len(got) != 1 {
+			t.Fatalf("controller %d got %d packets; want 1", i, len(got))
+		}
+		bufs[i] = got[0]
+	}
+	if &bufs[0][0] != &bufs[1][0] {
+		t.Fatal("controllers with the same compressor id should share the packet")
+	}
+	for i, suffix := range []byte{'a', 'a', 'b', 'c'} {
+		if b := bufs[i]; b[len(b)-1] != suffix {
+			t.Fatalf("controller %d got bytes compressed by %q", i, b[len(b)-1])
+		}
+	}
+}
+
+func TestMutilcastCountsDrops(t *testing.T) {
+	srv := createTestServer()
+	controllers := addTestControllers(t, srv, 3, codecs.CodecIMv2)
+	//队列已满且不允许阻塞
+	controllers[0].SetSendQueueLimit(SendQueueLimit{MaxMessages: 1, Policy: SendQueuePolicyDropNewest})
+	controllers[0].Write([]byte("x"))
+	//尚未确定编解码器
+	controllers[1].DataRW.codec = nil
+
+	ids := []SessionID{controllers[0].GetSessionID(), controllers[1].GetSessionID(), controllers[2].GetSessionID()}
+	srv.Mutilcast(ids, codecs.IMMap{1: 1})
+
+	if n := controllers[0].GetDroppedBroadcasts(); n != 1 {
+		t.Fatalf("full queue dropped = %d; want 1", n)
+	}
+	if n := controllers[1].GetDroppedBroadcasts(); n != 1 {
+		t.Fatalf("unready controller dropped = %d; want 1", n)
+	}
+	if n := controllers[2].GetDroppedBroadcasts(); n != 0 {
+		t.Fatalf("healthy controller dropped = %d; want 0", n)
+	}
+	if n := controllers[2].sendQueue.len(); n != 1 {
+		t.Fatalf("healthy controller queued %d packets; want 1", n)
+	}
+}
+
+func TestBoardcastCountsEncodeFailures(t *testing.T) {
+	srv := createTestServer()
+	controllers := addTestControllers(t, srv, 2, codecs.CodecIMv2)
+
+	srv.Boardcast(codecs.IMMap{1: 1}, make(chan int))
+
+	for _, controller := range controllers {
+		if n := controller.GetDroppedBroadcasts(); n != 1 {
+			t.Fatalf("dropped = %d; want 1", n)
+		}
+		if n := controller.sendQueue.len(); n != 0 {
+			t.Fatalf("queued %d packets after an encode failure", n)
+		}
+	}
+}
+
+func TestBoardcastKeepsOrderWithCoalescedSends(t *testing.T) {
+	srv := createTestServer()
+	controller := addTestControllers(t, srv, 1, codecs.CodecIMv2)[0]
+	controller.SetSendCoalesce(SendCoalesce{Window: time.Hour, MaxBytes: 1024})
+
+	controller.Send(codecs.IMMap{1: 1})
+	srv.Boardcast(codecs.IMMap{1: 2})
+	controller.Send(codecs.IMMap{1: 3})
+	controller.SetSendCoalesce(SendCoalesce{})
+
+	msgs := decodeStream(t, drainSendQueue(controller)...)
+	if len(msgs) != 3 || intOf(msgs[0]) != 1 || intOf(msgs[1]) != 2 || intOf(msgs[2]) != 3 {
+		t.Fatalf("order not preserved: %v", msgs)
+	}
+}
+
+func TestBoardcastDoesNotBlockOnFullQueue(t *testing.T) {
+	srv := createTestServer()
+	controllers := addTestControllers(t, srv, 2, codecs.CodecIMv2)
+	//连接自身的策略为阻塞，广播仍不应等待
+	controllers[0].SetSendQueueLimit(SendQueueLimit{MaxMessages: 1, Policy: SendQueuePolicyBlock})
+	controllers[0].Write([]byte("x"))
+
+	done := make(chan struct{})
+	go func() {
+		srv.Boardcast(codecs.IMMap{1: 1})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		controllers[0].Close()
+		t.Fatal("broadcast blocked on a full queue")
+	}
+
+	if n := controllers[0].GetDroppedBroadcasts(); n != 1 {
+		t.Fatalf("full queue dropped = %d; want 1", n)
+	}
+	if n := controllers[1].sendQueue.len(); n != 1 {
+		t.Fatalf("healthy controller queued %d packets; want 1", n)
+	}
+}
+
+func TestAccessorsDoNotCopyCounters(t *testing.T) {
+	srv := createTestServer()
+	controller := addTestControllers(t, srv, 1, codecs.CodecIMv2)[0]
+	controller.SetSendQueueLimit(SendQueueLimit{MaxMessages: 1, Policy: SendQueuePolicyDropNewest})
+	controller.Write([]byte("x"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			srv.Boardcast(codecs.IMMap{1: i})
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		controller.GetSource()
+		controller.GetSessionID()
+	}
+	<-done
+	if n := controller.GetDroppedBroadcasts(); n != 100 {
+		t.Fatalf("dropped = %d; want 100", n)
+	}
+}
+
+func TestFormatCountsWhileDetectingFormat(t *testing.T) {
+	env.RegisterPacketFormat(packets.PacketFormatNB)
+	env.RegisterCodec(codecs.CodecIMv2)
+	srv := createTestServer()
+	controllers := addTestControllers(t, srv, 3, codecs.CodecIMv2)
+	sender := createTestController(t)
+	data, _, err := sender.DataRW.PackStream(sender, codecs.IMMap{1: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//封包格式由读取协程在收到数据后确定
+	done := make(chan struct{})
+	for _, controller := range controllers {
+		controller.DataRW.format = nil
+	}
+	go func() {
+		defer close(done)
+		for _, controller := range controllers {
+			buf := new(utils.MutexBuffer)
+			buf.Write(data)
+			controller.DataRW.ReadStream(controller, buf)
+		}
+	}()
+	for {
+		srv.GetFormatCounts()
+		select {
+		case <-done:
+			if n := srv.GetFormatCounts()[packets.PacketFormatNB.Tag]; n != 3 {
+				t.Fatalf("counted %d %s connections; want 3", n, packets.PacketFormatNB.Tag)
+			}
+			return
+		default:
+		}
+	}
+}
+
+func benchmarkBoardcast(b *testing.B, n int, perController bool) {
+	srv := createTestServer()
+	controllers := addTestControllers(b, srv, n, codecs.CodecIMv2)
+	msg := codecs.IMMap{1: 1, 2: "broadcast message body", 3: codecs.IMSlice{1, 2, 3, 4}}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if perController {
+			for _, controller := range controllers {
+				controller.Send(msg)
+			}
+		} else {
+			srv.Boardcast(msg)
+		}
+
+		b.StopTimer()
+		for _, controller := range controllers {
+			drainSendQueue(controller)
+		}
+		b.StartTimer()
+	}
+}
+
+// 一次编码，所有连接共享封包
+func BenchmarkBoardcast10k(b *testing.B) {
+	benchmarkBoardcast(b, 10000, false)
+}
+
+// 对照组: 每个连接单独编码封包
+func BenchmarkSendPerController10k(b *testing.B) {
+	benchmarkBoardcast(b, 10000, true)
+}
+
+func TestFlowModeOffReleasesLockProcess(t *testing.T) {
+	controller := createTestController(t)
+	controller.SetFlowMode(true)
+	//开启时放行一次
+	if !controller.LockProcess() {
+		t.Fatal("first LockProcess should pass")
+	}
+	result := make(chan bool)
+	go func() {
+		result <- controller.LockProcess()
+	}()
+	controller.UnlockProcess()
+	if !<-result {
+		t.Fatal("LockProcess should pass after UnlockProcess")
+	}
+	go func() {
+		result <- controller.LockProcess()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	controller.SetFlowMode(false)
+	select {
+	case ok := <-result:
+		if ok {
+			t.Fatal("waiting LockProcess should fail when flow mode is turned off")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("LockProcess still waiting after flow mode is turned off")
+	}
+	if controller.IsFlowMode() || !controller.LockProcess() {
+		t.Fatal("LockProcess should pass without flow mode")
+	}
+}
+
+func TestServerCloseWhileSending(t *testing.T) {
+	server := CreateTCPServer()
+	if err := server.Bind("127.0.0.1:0", 0); err != nil {
+		t.Fatal(err)
+	}
+	server.Schedule()
+	conn, err := net.Dial("tcp", server.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	group := new(sync.WaitGroup)
+	group.Add(1)
+	go func() {
+		defer group.Done()
+		for i := 0; i < 100; i++ {
+			server.Send(1, codecs.IMMap{1: int64(i)})
+			server.Boardcast(codecs.IMMap{1: int64(i)})
+		}
+	}()
+	time.Sleep(5 * time.Millisecond)
+	server.Close()
+	group.Wait()
+	if _, err := server.Send(1, codecs.IMMap{1: int64(1)}); err == nil {
+		t.Fatal("Send after Close should fail")
+	}
+}
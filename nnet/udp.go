@@ -69,7 +69,7 @@ func (receiver *UDP) processClient(conn net.UDPConn) {
 	dataRW.OnDataDecoded = receiver.OnDataDecoded
 	receiver.controller = createUDPController(conn, dataRW)
 	receiver.controller.OnStop = func(controller Controller) error {
-		utils.LogInfo("udp端口 %s 已经退出监听", controller.GetSessionID())
+		utils.LogInfo("udp端口 %d 已经退出监听", controller.GetSessionID())
 		//receiver.controller = nil
 		return nil
 	}
@@ -121,9 +121,11 @@ func (receiver UDPController) WriteTo(addr string, data []byte) {
 }
 
 func (receiver *UDPController) SendTo(addr string, msg ...codecs.IMData) ([]codecs.IMData, error) {
-	buf, remainMsgs, err := receiver.DataRW.PackDatagram(receiver, msg...)
+	bufs, remainMsgs, err := receiver.DataRW.PackDatagrams(receiver, msg...)
 	if err == nil {
-		receiver.WriteTo(addr, buf)
+		for _, buf := range bufs {
+			receiver.WriteTo(addr, buf)
+		}
 	}
 	return remainMsgs, err
 }
@@ -166,6 +168,7 @@ func (receiver *UDPController) processRead(group *sync.WaitGroup) {
 }
 
 func (receiver *UDPController) Schedule() {
+	notifyControllerStart(receiver)
 	receiver.queue = make(chan UDPDatagram, 10240)
 	go func() {
 		group := new(sync.WaitGroup)
@@ -178,5 +181,6 @@ func (receiver *UDPController) Schedule() {
 		if receiver.OnStop != nil {
 			receiver.OnStop(receiver)
 		}
+		notifyControllerStop(receiver)
 	}()
 }
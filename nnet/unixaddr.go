@@ -0,0 +1,196 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/utils"
+)
+
+/*
+unix 套接字地址
+	以 "@" 开头的地址为 Linux 抽象命名空间地址，不占用文件系统路径，进程退出后自动释放
+	其余地址为文件系统路径，绑定前会清理无人监听的残留套接字文件，关闭时删除
+*/
+
+const UnixAbstractPrefix = "@"
+
+type UnixSocketConfig struct {
+	//自动生成的客户端地址所在目录，为空时使用 os.TempDir()
+	Dir string
+	//套接字文件权限，为 0 时不修改
+	Mode os.FileMode
+	//为 true 时将套接字文件属主修改为 Uid/Gid
+	Chown bool
+	Uid   int
+	Gid   int
+	//自动生成的客户端地址使用抽象命名空间(仅 Linux 有效)
+	Abstract bool
+}
+
+var unixSocketConfig UnixSocketConfig
+var unixSocketConfigMutex sync.RWMutex
+var unixClientAddrSeq uint64
+
+// 设置 unix 套接字的全局配置，仅影响之后绑定的地址
+func SetUnixSocketConfig(config UnixSocketConfig) {
+	unixSocketConfigMutex.Lock()
+	defer unixSocketConfigMutex.Unlock()
+	unixSocketConfig = config
+}
+
+func GetUnixSocketConfig() UnixSocketConfig {
+	unixSocketConfigMutex.RLock()
+	defer unixSocketConfigMutex.RUnlock()
+	return unixSocketConfig
+}
+
+func IsAbstractUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, UnixAbstractPrefix)
+}
+
+func abstractUnixSupported() bool {
+	return runtime.GOOS == "linux" || runtime.GOOS == "android"
+}
+
+// 生成进程内唯一的客户端地址，name 为地址前缀，如 "nbdb_client"
+func NewUnixClientAddr(name string) string {
+	config := GetUnixSocketConfig()
+	base := fmt.Sprintf("%s_%d_%d", name, os.Getpid(), atomic.AddUint64(&unixClientAddrSeq, 1))
+	if config.Abstract && abstractUnixSupported() {
+		return UnixAbstractPrefix + base
+	}
+	dir := config.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, base+".sock")
+}
+
+// 绑定前的准备: 创建配置的套接字目录，并清理无人监听的残留套接字文件
+func prepareUnixSocket(network string, addr string) error {
+	if IsAbstractUnixAddr(addr) {
+		if !abstractUnixSupported() {
+			return errors.ErrorUnsupportedNetwork
+		}
+		return nil
+	}
+
+	config := GetUnixSocketConfig()
+	if dir := filepath.Dir(addr); config.Dir != "" && filepath.Clean(config.Dir) == dir {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	fi, err := os.Lstat(addr)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		//不是套接字文件，不能删除
+		return errors.ErrorUnixAddrInUse
+	}
+
+	conn, err := net.Dial(network, addr)
+	if err == nil {
+		conn.Close()
+		return errors.ErrorUnixAddrInUse
+	}
+	if !strings.Contains(err.Error(), "connection refused") {
+		return err
+	}
+	utils.LogWarn("### 清理残留的套接字文件 %s", addr)
+	if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 绑定成功后按配置修改套接字文件的权限及属主
+func finishUnixSocket(addr string) error {
+	if IsAbstractUnixAddr(addr) {
+		return nil
+	}
+	config := GetUnixSocketConfig()
+	if config.Mode != 0 {
+		if err := os.Chmod(addr, config.Mode); err != nil {
+			return err
+		}
+	}
+	if config.Chown {
+		if err := os.Chown(addr, config.Uid, config.Gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeUnixSocket(addr string) {
+	if addr == "" || IsAbstractUnixAddr(addr) {
+		return
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		utils.LogWarn("### 删除套接字文件 %s 失败. err: %s", addr, err)
+	}
+}
+
+// 目标地址是否可能存在，抽象命名空间地址无法预先判断
+func unixAddrExists(addr string) error {
+	if IsAbstractUnixAddr(addr) {
+		return nil
+	}
+	_, err := os.Stat(addr)
+	if err != nil && os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// 绑定 unixgram 地址，包含残留清理及权限设置
+func listenUnixgram(addr string) (*net.UnixConn, error) {
+	if err := prepareUnixSocket("unixgram", addr); err != nil {
+		return nil, err
+	}
+	unixAddr, err := net.ResolveUnixAddr("unixgram", addr)
+	if err != nil {
+		return nil, err
+	}
+	unixConn, err := net.ListenUnixgram("unixgram", unixAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err = finishUnixSocket(addr); err != nil {
+		unixConn.Close()
+		removeUnixSocket(addr)
+		return nil, err
+	}
+	return unixConn, nil
+}
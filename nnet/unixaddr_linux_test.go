@@ -0,0 +1,162 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/packing/clove/errors"
+)
+
+func withUnixSocketConfig(t *testing.T, config UnixSocketConfig) {
+	old := GetUnixSocketConfig()
+	SetUnixSocketConfig(config)
+	t.Cleanup(func() { SetUnixSocketConfig(old) })
+}
+
+// 留下一个无人监听的套接字文件，模拟进程异常退出
+func leaveStaleSocket(t *testing.T, network, path string) {
+	t.Helper()
+	addr := &net.UnixAddr{Name: path, Net: network}
+	if network == "unixgram" {
+		conn, err := net.ListenUnixgram(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	} else {
+		ln, err := net.ListenUnix(network, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ln.SetUnlinkOnClose(false)
+		ln.Close()
+	}
+	if _, err := os.Lstat(path); err != nil {
+		t.Fatalf("stale socket missing: %v", err)
+	}
+}
+
+func TestNewUnixClientAddr(t *testing.T) {
+	dir := t.TempDir()
+	withUnixSocketConfig(t, UnixSocketConfig{Dir: dir})
+	a, b := NewUnixClientAddr("nbdb_client"), NewUnixClientAddr("nbdb_client")
+	if a == b {
+		t.Fatalf("client addresses collide: %s", a)
+	}
+	if filepath.Dir(a) != dir || !strings.HasPrefix(filepath.Base(a), "nbdb_client_") || !strings.HasSuffix(a, ".sock") {
+		t.Fatalf("addr = %s", a)
+	}
+
+	SetUnixSocketConfig(UnixSocketConfig{Abstract: true})
+	if addr := NewUnixClientAddr("nbkv_client"); !IsAbstractUnixAddr(addr) {
+		t.Fatalf("addr = %s; want abstract", addr)
+	}
+}
+
+func TestBindCleansStaleSocket(t *testing.T) {
+	for _, network := range []string{UnixNetworkStream, UnixNetworkPacket} {
+		path := filepath.Join(t.TempDir(), "stale.sock")
+		leaveStaleSocket(t, network, path)
+		srv := CreateUnixServer(network)
+		if err := srv.Bind(path); err != nil {
+			t.Fatalf("%s: bind over stale socket: %v", network, err)
+		}
+		srv.Close()
+		if _, err := os.Lstat(path); !os.IsNotExist(err) {
+			t.Fatalf("%s: socket file left after Close: %v", network, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "stale_gram.sock")
+	leaveStaleSocket(t, "unixgram", path)
+	conn, err := listenUnixgram(path)
+	if err != nil {
+		t.Fatalf("unixgram bind over stale socket: %v", err)
+	}
+	conn.Close()
+}
+
+func TestBindRefusesLiveSocketAndRegularFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "live.sock")
+	srv := CreateUnixServer(UnixNetworkStream)
+	if err := srv.Bind(path); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	other := CreateUnixServer(UnixNetworkStream)
+	if err := other.Bind(path); err != errors.ErrorUnixAddrInUse {
+		t.Fatalf("err = %v; want ErrorUnixAddrInUse", err)
+	}
+
+	file := filepath.Join(t.TempDir(), "file.sock")
+	if err := os.WriteFile(file, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listenUnixgram(file); err != errors.ErrorUnixAddrInUse {
+		t.Fatalf("err = %v; want ErrorUnixAddrInUse", err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "data" {
+		t.Fatal("regular file must not be removed")
+	}
+}
+
+func TestBindAppliesDirAndMode(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "sockets")
+	withUnixSocketConfig(t, UnixSocketConfig{Dir: dir, Mode: 0600})
+	path := NewUnixClientAddr("mode")
+	conn, err := listenUnixgram(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 || fi.Mode()&os.ModeSocket == 0 {
+		t.Fatalf("mode = %v; want socket 0600", fi.Mode())
+	}
+}
+
+func TestAbstractAddressLeavesNoFile(t *testing.T) {
+	addr := UnixAbstractPrefix + filepath.Base(t.TempDir()) + "_abstract"
+	srv := CreateUnixServer(UnixNetworkStream)
+	if err := srv.Bind(addr); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if _, err := os.Lstat(addr); !os.IsNotExist(err) {
+		t.Fatal("abstract address must not create a file")
+	}
+	conn, err := net.Dial(UnixNetworkStream, addr)
+	if err != nil {
+		t.Fatalf("dial abstract address: %v", err)
+	}
+	conn.Close()
+	if err := unixAddrExists(addr); err != nil {
+		t.Fatal(err)
+	}
+	if err := unixAddrExists(filepath.Join(t.TempDir(), "missing.sock")); err == nil {
+		t.Fatal("missing path should be reported")
+	}
+}
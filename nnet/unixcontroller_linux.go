@@ -40,6 +40,7 @@ goroutine 3 => process data
 type UnixDatagram struct {
 	addr string
 	data []byte
+	cred *PeerCredentials
 }
 
 type UnixSendBuffer struct {
@@ -63,8 +64,13 @@ type UnixController struct {
 	closeSendReq     bool
 	associatedObject interface{}
 
-	mutex sync.Mutex
-	tag   int
+	mutex    sync.Mutex
+	tag      int
+	reliable *unixReliable
+
+	passCred    bool
+	allowedUids uidAllowlist
+	scheduled   bool
 }
 
 func createUnixController(ioSrc net.UnixConn, dataRW *DataReadWriter) *UnixController {
@@ -83,13 +89,13 @@ func createUnixControllerWithBufferSize(ioSrc net.UnixConn, dataRW *DataReadWrit
 	if bufWSize >= 0 {
 		err := sor.ioinner.SetReadBuffer(bufRSize)
 		if err != nil {
-			utils.LogError("SetReadBuffer error: ", err)
+			utils.LogError("SetReadBuffer error: %s", err)
 		}
 	}
 	if bufWSize >= 0 {
 		err := sor.ioinner.SetWriteBuffer(bufWSize)
 		if err != nil {
-			utils.LogError("SetWriteBuffer error: ", err)
+			utils.LogError("SetWriteBuffer error: %s", err)
 		}
 	}
 	return sor
@@ -111,18 +117,21 @@ func (receiver *UnixController) GetAssociatedObject() interface{} {
 	return receiver.associatedObject
 }
 
-func (receiver UnixController) GetSource() string {
+func (receiver *UnixController) GetSource() string {
 	return receiver.ioinner.LocalAddr().String()
 }
 
-func (receiver UnixController) GetSessionID() SessionID {
+func (receiver *UnixController) GetSessionID() SessionID {
 	return receiver.id
 }
 
-func (receiver UnixController) Close() {
+func (receiver *UnixController) Close() {
 	receiver.mutex.Lock()
 	defer receiver.mutex.Unlock()
 
+	if receiver.sendCh == nil {
+		return
+	}
 	close(receiver.sendCh)
 	receiver.sendCh = nil
 
@@ -133,33 +142,114 @@ func (receiver UnixController) Close() {
 	receiver.ioinner.Close()
 }
 
-func (receiver UnixController) Discard() {
+func (receiver *UnixController) Discard() {
 }
 
-func (receiver UnixController) CloseOnSended() {
+func (receiver *UnixController) CloseOnSended() {
+	receiver.mutex.Lock()
 	receiver.closeOnSended = true
+	receiver.mutex.Unlock()
 }
 
-func (receiver UnixController) Read(l int) ([]byte, int) {
+func (receiver *UnixController) Read(l int) ([]byte, int) {
 	return nil, 0
 }
 
-func (receiver UnixController) Peek(l int) ([]byte, int) {
+func (receiver *UnixController) Peek(l int) ([]byte, int) {
 	return nil, 0
 }
 
-func (receiver UnixController) Write(data []byte) {
+func (receiver *UnixController) Write(data []byte) {
 }
 
-func (receiver UnixController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+func (receiver *UnixController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
 	return msg, errors.ErrorDataSentIncomplete
 }
 
-func (receiver UnixController) ReadFrom() (string, []byte, int) {
+func (receiver *UnixController) ReadFrom() (string, []byte, int) {
 	return "", nil, 0
 }
 
+// 启用可靠模式，需在 Schedule 之前调用，对端也需启用
+// onLost 在对端被判定不可达时调用，可为 nil
+func (receiver *UnixController) SetReliable(config UnixReliableConfig, onLost OnPeerLost) {
+	receiver.reliable = createUnixReliable(config, receiver.writeRaw, onLost)
+}
+
+func (receiver *UnixController) IsReliable() bool {
+	return receiver.reliable != nil
+}
+
+// 可靠模式下发往 addr 且尚未被确认的数据报数量
+func (receiver *UnixController) GetPendingCount(addr string) int {
+	if receiver.reliable == nil {
+		return 0
+	}
+	return receiver.reliable.pendingCount(addr)
+}
+
+// 开启 SO_PASSCRED，之后收到的每个数据报都会附带发送者的凭据，需在 Schedule 之前调用，之后调用返回 errors.ErrorControllerScheduled
+// 开启后 OnDataDecoded 收到的控制器为携带该数据报凭据的 UnixDatagramController
+func (receiver *UnixController) EnablePeerCredentials() error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.enablePeerCredentialsLocked()
+}
+
+func (receiver *UnixController) enablePeerCredentialsLocked() error {
+	if receiver.scheduled {
+		return errors.ErrorControllerScheduled
+	}
+	if err := enablePassCredentials(&receiver.ioinner); err != nil {
+		return err
+	}
+	receiver.passCred = true
+	return nil
+}
+
+// 只处理指定 uid 的进程发来的数据报，其余的在解码前直接丢弃，需在 Schedule 之前调用，之后调用返回 errors.ErrorControllerScheduled
+func (receiver *UnixController) SetAllowedUids(uids ...uint32) error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.scheduled {
+		return errors.ErrorControllerScheduled
+	}
+	receiver.allowedUids = createUidAllowlist(uids)
+	if receiver.allowedUids == nil {
+		return nil
+	}
+	return receiver.enablePeerCredentialsLocked()
+}
+
+// 调度后凭据设置不再改变，读取协程在开始时取一次
+func (receiver *UnixController) credentialsConfig() (bool, uidAllowlist) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.passCred, receiver.allowedUids
+}
+
 func (receiver *UnixController) WriteTo(addr string, data []byte) {
+	if err := receiver.writeTo(addr, data); err != nil {
+		utils.LogError(">>> 向 %s 发送数据失败 %s", addr, err.Error())
+	}
+}
+
+func (receiver *UnixController) writeTo(addr string, data []byte) error {
+	if receiver.reliable != nil {
+		if len(data)+reliableHeaderLength > 1024*1024 {
+			return errors.ErrorDatagramTooLarge
+		}
+		wrapped, err := receiver.reliable.wrap(addr, data)
+		if err != nil {
+			return err
+		}
+		data = wrapped
+	}
+	receiver.writeRaw(addr, data)
+	return nil
+}
+
+func (receiver *UnixController) writeRaw(addr string, data []byte) {
 	uData := UnixDatagram{addr: addr, data: data}
 
 	go func() {
@@ -181,17 +271,21 @@ func (receiver *UnixController) clearSendBuffer(addr string) {
 
 func (receiver *UnixController) SendTo(addr string, msg ...codecs.IMData) ([]codecs.IMData, error) {
 	st := time.Now().UnixNano()
-	buf, remainMsgs, err := receiver.DataRW.PackDatagram(receiver, msg...)
+	bufs, remainMsgs, err := receiver.DataRW.PackDatagrams(receiver, msg...)
 	IncEncodeTime(time.Now().UnixNano() - st)
 	if err == nil {
-		receiver.WriteTo(addr, buf)
+		for _, buf := range bufs {
+			if err = receiver.writeTo(addr, buf); err != nil {
+				return msg, err
+			}
+		}
 	} else {
-		utils.LogInfo(">>> 请求发送数据时编码器返回错误", err)
+		utils.LogInfo(">>> 请求发送数据时编码器返回错误 %s", err)
 	}
 	return remainMsgs, err
 }
 
-func (receiver UnixController) SendFdTo(addr string, fds ...int) error {
+func (receiver *UnixController) SendFdTo(addr string, fds ...int) error {
 	unixAddr, err := net.ResolveUnixAddr("unixgram", addr)
 	if err != nil {
 		return err
@@ -214,8 +308,12 @@ func (receiver *UnixController) processData(group *sync.WaitGroup) {
 		if !ok {
 			break
 		}
+		var controller Controller = receiver
+		if datagram.cred != nil {
+			controller = UnixDatagramController{UnixController: receiver, cred: *datagram.cred}
+		}
 		st := time.Now().UnixNano()
-		err := receiver.DataRW.ReadDatagram(receiver, datagram.addr, datagram.data)
+		err := receiver.DataRW.ReadDatagram(controller, datagram.addr, datagram.data)
 		IncDecodeTime(time.Now().UnixNano() - st)
 		if err != nil {
 			receiver.ioinner.Close()
@@ -231,37 +329,71 @@ func (receiver *UnixController) processRead(group *sync.WaitGroup) {
 	}()
 
 	var b = make([]byte, 1024*1024)
+	var oob []byte
+	passCred, allowedUids := receiver.credentialsConfig()
+	if passCred {
+		oob = make([]byte, credentialsOobSize)
+	}
 
 	for {
-		n, addr, err := receiver.ioinner.ReadFromUnix(b)
+		var n int
+		var addr *net.UnixAddr
+		var cred *PeerCredentials
+		var err error
+		if passCred {
+			var oobn int
+			n, oobn, _, addr, err = receiver.ioinner.ReadMsgUnix(b, oob)
+			if err == nil {
+				cred = parseCredentialsMessage(oob[:oobn])
+			}
+		} else {
+			n, addr, err = receiver.ioinner.ReadFromUnix(b)
+		}
 		if err != nil {
 			break
 		}
 		IncTotalUnixRecvSize(n)
 
-		pl := receiver.DataRW.PeekPacketLength(b[:n])
-		if pl == 0 {
-			utils.LogInfo("数据流出错，抛弃数据 => %d", n)
+		//在确认及解码之前拦截，未被允许的对端收不到可靠模式的确认
+		if !allowedUids.allow(cred) {
+			utils.LogVerbose("=== 拒绝来自 %s 的数据报: %s", addr.String(), errors.ErrorPeerNotAllowed.Error())
 			continue
 		}
-		if pl == -1 {
-			utils.LogInfo("获取到的数据不足以构成完整包，抛弃数据 => %d", n)
-			continue
+
+		data := b[:n]
+		if receiver.reliable != nil {
+			var deliver bool
+			if data, deliver = receiver.reliable.unwrap(addr.String(), data); !deliver {
+				continue
+			}
+			n = len(data)
 		}
 
-		if n < pl {
-			utils.LogInfo("获取到的数据不足以构成完整包，抛弃数据")
-			continue
+		//分片在 ReadDatagram 中重组后再检查
+		if !isDatagramFragment(data) {
+			pl := receiver.DataRW.PeekPacketLength(data)
+			if pl == 0 {
+				utils.LogInfo("数据流出错，抛弃数据 => %d", n)
+				continue
+			}
+			if pl == -1 {
+				utils.LogInfo("获取到的数据不足以构成完整包，抛弃数据 => %d", n)
+				continue
+			}
+
+			if n < pl {
+				utils.LogInfo("获取到的数据不足以构成完整包，抛弃数据")
+				continue
+			}
 		}
 
 		bs := make([]byte, n)
-		copy(bs, b[:n])
-		datagram := UnixDatagram{addr: addr.String(), data: bs}
+		copy(bs, data)
+		datagram := UnixDatagram{addr: addr.String(), data: bs, cred: cred}
 		receiver.queue <- datagram
 	}
 
 	close(receiver.queue)
-	group.Done()
 }
 
 func (receiver *UnixController) innerProcessWrite(uData UnixDatagram) error {
@@ -289,11 +421,12 @@ func (receiver *UnixController) innerProcessWrite(uData UnixDatagram) error {
 			runtime.Gosched()
 			continue
 		}
-		if strings.Contains(sendErr.Error(), "sendto: connection refused") {
-			runtime.Gosched()
-			return nil
-		}
-		if strings.Contains(sendErr.Error(), "sendto: no such file or directory") {
+		if strings.Contains(sendErr.Error(), "sendto: connection refused") ||
+			strings.Contains(sendErr.Error(), "sendto: no such file or directory") {
+			//对端已不存在，可靠模式下通知发送方，否则丢弃数据
+			if receiver.reliable != nil {
+				receiver.reliable.peerLost(uData.addr, errors.WithStack(sendErr))
+			}
 			runtime.Gosched()
 			return nil
 		}
@@ -387,7 +520,7 @@ func (receiver *UnixController) innerProcessWrite(uData UnixDatagram) error {
 
 }
 
-func (receiver *UnixController) processWrite(wg *sync.WaitGroup) {
+func (receiver *UnixController) processWrite(wg *sync.WaitGroup, sendCh chan UnixDatagram) {
 	defer func() {
 		wg.Done()
 		utils.LogPanic(recover())
@@ -395,7 +528,7 @@ func (receiver *UnixController) processWrite(wg *sync.WaitGroup) {
 
 main:
 	for {
-		uData, ok := <-receiver.sendCh
+		uData, ok := <-sendCh
 		if ok {
 			if err := receiver.innerProcessWrite(uData); err != nil {
 				utils.LogError(">>> 连接 %s 发生不可忽略的错误，连接即将被关闭", receiver.GetSource())
@@ -419,20 +552,33 @@ main:
 }
 
 func (receiver *UnixController) Schedule() {
+	sendCh := make(chan UnixDatagram, 1024)
+	receiver.mutex.Lock()
+	receiver.scheduled = true
+	receiver.sendCh = sendCh
+	receiver.mutex.Unlock()
+	notifyControllerStart(receiver)
 	receiver.queue = make(chan UnixDatagram, 1024)
 	receiver.closeCh = make(chan int)
-	receiver.sendCh = make(chan UnixDatagram, 1024)
 	group := new(sync.WaitGroup)
 	group.Add(3)
 
+	if receiver.reliable != nil {
+		go receiver.reliable.run()
+	}
+
 	go func() {
 		go receiver.processData(group)
 		go receiver.processRead(group)
-		go receiver.processWrite(group)
+		go receiver.processWrite(group, sendCh)
 		group.Wait()
+		if receiver.reliable != nil {
+			receiver.reliable.stop()
+		}
 		if receiver.OnStop != nil {
 			receiver.OnStop(receiver)
 		}
+		notifyControllerStop(receiver)
 		utils.LogError(">>> UNIX控制器 %s 已关闭调度", receiver.GetSource())
 	}()
 }
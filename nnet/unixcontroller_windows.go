@@ -47,27 +47,27 @@ func (receiver *UnixController) SetAssociatedObject(o interface{}) {}
 
 func (receiver *UnixController) GetAssociatedObject() interface{} { return nil }
 
-func (receiver UnixController) GetSource() string { return "" }
+func (receiver *UnixController) GetSource() string { return "" }
 
-func (receiver UnixController) GetSessionID() SessionID { return SessionID(0) }
+func (receiver *UnixController) GetSessionID() SessionID { return SessionID(0) }
 
-func (receiver UnixController) Close() {}
+func (receiver *UnixController) Close() {}
 
-func (receiver UnixController) Discard() {}
+func (receiver *UnixController) Discard() {}
 
-func (receiver UnixController) CloseOnSended() {}
+func (receiver *UnixController) CloseOnSended() {}
 
-func (receiver UnixController) Read(l int) ([]byte, int) { return nil, 0 }
+func (receiver *UnixController) Read(l int) ([]byte, int) { return nil, 0 }
 
-func (receiver UnixController) Peek(l int) ([]byte, int) { return nil, 0 }
+func (receiver *UnixController) Peek(l int) ([]byte, int) { return nil, 0 }
 
-func (receiver UnixController) Write(data []byte) {}
+func (receiver *UnixController) Write(data []byte) {}
 
-func (receiver UnixController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+func (receiver *UnixController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
 	return msg, errors.ErrorDataSentIncomplete
 }
 
-func (receiver UnixController) ReadFrom() (string, []byte, int) { return "", nil, 0 }
+func (receiver *UnixController) ReadFrom() (string, []byte, int) { return "", nil, 0 }
 
 func (receiver *UnixController) WriteTo(addr string, data []byte) {}
 
@@ -75,6 +75,14 @@ func (receiver *UnixController) SendTo(addr string, msg ...codecs.IMData) ([]cod
 	return nil, nil
 }
 
-func (receiver UnixController) SendFdTo(addr string, fds ...int) error { return nil }
+func (receiver *UnixController) SendFdTo(addr string, fds ...int) error { return nil }
+
+func (receiver *UnixController) EnablePeerCredentials() error {
+	return errors.ErrorCredentialsUnsupported
+}
+
+func (receiver *UnixController) SetAllowedUids(uids ...uint32) error {
+	return errors.ErrorCredentialsUnsupported
+}
 
 func (receiver *UnixController) Schedule() {}
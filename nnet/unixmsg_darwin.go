@@ -19,6 +19,7 @@ package nnet
 
 import (
 	"net"
+	"sync"
 
 	"github.com/packing/clove/errors"
 	"github.com/packing/clove/utils"
@@ -27,11 +28,16 @@ import (
 type UnixMsg struct {
 	controller *UnixMsgController
 	isClosed   bool
+	mutex      sync.Mutex
+	addr       string
 
 	bufWSize int
 	bufRSize int
 
 	associatedObject interface{}
+
+	passCred    bool
+	allowedUids []uint32
 }
 
 func CreateUnixMsg() *UnixMsg {
@@ -50,49 +56,97 @@ func (receiver *UnixMsg) SetControllerAssociatedObject(o interface{}) {
 	receiver.associatedObject = o
 }
 
+// 接收句柄时获取发送者的凭据，写入 FileHandleMeta.Sender，需在 Bind 之前调用
+func (receiver *UnixMsg) SetPeerCredentials(enable bool) {
+	receiver.passCred = enable
+}
+
+// 只接收指定 uid 的进程发来的句柄，需在 Bind 之前调用，不传参数表示不限制
+func (receiver *UnixMsg) SetAllowedUids(uids ...uint32) {
+	receiver.allowedUids = uids
+}
+
 func (receiver *UnixMsg) Bind(addr string) error {
 	receiver.isClosed = true
-	unixAddr, err := net.ResolveUnixAddr("unixgram", addr)
+	unixConn, err := listenUnixgram(addr)
 	if err != nil {
 		return err
 	}
 
-	unixConn, err := net.ListenUnixgram("unixgram", unixAddr)
-	if err != nil {
+	receiver.addr = addr
+	receiver.isClosed = false
+	if err = receiver.processClient(*unixConn); err != nil {
+		receiver.isClosed = true
+		unixConn.Close()
+		removeUnixSocket(addr)
 		return err
 	}
 
-	receiver.isClosed = false
-	receiver.processClient(*unixConn)
-
 	return nil
 }
 
-func (receiver *UnixMsg) processClient(conn net.UnixConn) {
+func (receiver *UnixMsg) processClient(conn net.UnixConn) error {
 	receiver.controller = createUnixMsgControllerWithBufferSize(conn, receiver.bufWSize, receiver.bufRSize)
 	receiver.controller.SetAssociatedObject(receiver.associatedObject)
+	if receiver.passCred {
+		if err := receiver.controller.EnablePeerCredentials(); err != nil {
+			return err
+		}
+	}
+	if err := receiver.controller.SetAllowedUids(receiver.allowedUids...); err != nil {
+		return err
+	}
 
 	receiver.controller.OnStop = func(controller Controller) error {
 		utils.LogInfo(">>> unix消息端口 %d 已经退出监听", controller.GetSessionID())
+		receiver.mutex.Lock()
 		receiver.controller = nil
 		receiver.isClosed = true
+		receiver.mutex.Unlock()
 		return nil
 	}
 
 	receiver.controller.Schedule()
 
+	return nil
 }
 
-func (receiver *UnixMsg) SendTo(addr string, fds ...int) error {
+// 控制器退出调度时会在其协程中清空，已关闭时返回 nil
+func (receiver *UnixMsg) getController() *UnixMsgController {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
 	if receiver.isClosed {
+		return nil
+	}
+	return receiver.controller
+}
+
+func (receiver *UnixMsg) SendTo(addr string, fds ...int) error {
+	controller := receiver.getController()
+	if controller == nil {
 		return errors.ErrorDataSentIncomplete
 	}
-	return receiver.controller.SendFdTo(addr, fds...)
+	return controller.SendFdTo(addr, fds...)
+}
+
+func (receiver *UnixMsg) SendFileHandles(addr string, meta FileHandleMeta, fds ...int) error {
+	controller := receiver.getController()
+	if controller == nil {
+		return errors.ErrorDataSentIncomplete
+	}
+	return controller.SendFileHandlesTo(addr, meta, fds...)
 }
 
 func (receiver *UnixMsg) Close() {
-	if !receiver.isClosed {
-		receiver.controller.Close()
-		receiver.isClosed = true
+	receiver.mutex.Lock()
+	controller := receiver.controller
+	closed := receiver.isClosed
+	receiver.isClosed = true
+	receiver.mutex.Unlock()
+	if !closed {
+		if controller != nil {
+			controller.Close()
+		}
+		removeUnixSocket(receiver.addr)
 	}
 }
@@ -34,7 +34,13 @@ func CreateUnixMsgWithBufferSize(bufWriteSize int, bufReadSize int) *UnixMsg {
 }
 
 func (receiver *UnixMsg) SetControllerAssociatedObject(o interface{}) {}
+func (receiver *UnixMsg) SetPeerCredentials(enable bool)              {}
+func (receiver *UnixMsg) SetAllowedUids(uids ...uint32)               {}
 func (receiver *UnixMsg) Bind(addr string) error                      { return nil }
-func (receiver *UnixMsg) processClient(conn net.UnixConn)             {}
+func (receiver *UnixMsg) processClient(conn net.UnixConn) error       { return nil }
 func (receiver *UnixMsg) SendTo(addr string, fds ...int) error        { return nil }
 func (receiver *UnixMsg) Close()                                      {}
+
+func (receiver *UnixMsg) SendFileHandles(addr string, meta FileHandleMeta, fds ...int) error {
+	return nil
+}
@@ -38,6 +38,7 @@ type UnixMsgData struct {
 	addr string
 	b    []byte
 	oob  []byte
+	cred *PeerCredentials
 }
 
 type UnixMsgController struct {
@@ -49,6 +50,11 @@ type UnixMsgController struct {
 	associatedObject interface{}
 
 	tag int
+
+	mutex       sync.Mutex
+	passCred    bool
+	allowedUids uidAllowlist
+	scheduled   bool
 }
 
 func createUnixMsgController(ioSrc net.UnixConn) *UnixMsgController {
@@ -63,13 +69,13 @@ func createUnixMsgControllerWithBufferSize(ioSrc net.UnixConn, bufWSize int, buf
 	if bufWSize >= 0 {
 		err := sor.ioinner.SetReadBuffer(bufRSize)
 		if err != nil {
-			utils.LogError("SetReadBuffer error: ", err)
+			utils.LogError("SetReadBuffer error: %s", err)
 		}
 	}
 	if bufWSize >= 0 {
 		err := sor.ioinner.SetWriteBuffer(bufWSize)
 		if err != nil {
-			utils.LogError("SetWriteBuffer error: ", err)
+			utils.LogError("SetWriteBuffer error: %s", err)
 		}
 	}
 	return sor
@@ -91,40 +97,79 @@ func (receiver *UnixMsgController) GetTag() int {
 	return receiver.tag
 }
 
-func (receiver UnixMsgController) GetSource() string {
+// 开启 SO_PASSCRED，之后收到的每批句柄都会附带发送者的凭据，写入 FileHandleMeta.Sender，需在 Schedule 之前调用，之后调用返回 errors.ErrorControllerScheduled
+func (receiver *UnixMsgController) EnablePeerCredentials() error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.enablePeerCredentialsLocked()
+}
+
+func (receiver *UnixMsgController) enablePeerCredentialsLocked() error {
+	if receiver.scheduled {
+		return errors.ErrorControllerScheduled
+	}
+	if err := enablePassCredentials(&receiver.ioinner); err != nil {
+		return err
+	}
+	receiver.passCred = true
+	return nil
+}
+
+// 只接收指定 uid 的进程发来的句柄，其余的句柄在交给接收方之前直接关闭，需在 Schedule 之前调用，之后调用返回 errors.ErrorControllerScheduled
+func (receiver *UnixMsgController) SetAllowedUids(uids ...uint32) error {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.scheduled {
+		return errors.ErrorControllerScheduled
+	}
+	receiver.allowedUids = createUidAllowlist(uids)
+	if receiver.allowedUids == nil {
+		return nil
+	}
+	return receiver.enablePeerCredentialsLocked()
+}
+
+// 调度后凭据设置不再改变，读取协程在开始时取一次
+func (receiver *UnixMsgController) credentialsConfig() (bool, uidAllowlist) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.passCred, receiver.allowedUids
+}
+
+func (receiver *UnixMsgController) GetSource() string {
 	return receiver.ioinner.LocalAddr().String()
 }
 
-func (receiver UnixMsgController) GetSessionID() SessionID {
+func (receiver *UnixMsgController) GetSessionID() SessionID {
 	return receiver.id
 }
 
-func (receiver UnixMsgController) Close() {
+func (receiver *UnixMsgController) Close() {
 	receiver.ioinner.Close()
 }
 
-func (receiver UnixMsgController) Discard() {
+func (receiver *UnixMsgController) Discard() {
 }
 
-func (receiver UnixMsgController) CloseOnSended() {
+func (receiver *UnixMsgController) CloseOnSended() {
 }
 
-func (receiver UnixMsgController) Read(l int) ([]byte, int) {
+func (receiver *UnixMsgController) Read(l int) ([]byte, int) {
 	return nil, 0
 }
 
-func (receiver UnixMsgController) Peek(l int) ([]byte, int) {
+func (receiver *UnixMsgController) Peek(l int) ([]byte, int) {
 	return nil, 0
 }
 
-func (receiver UnixMsgController) Write(data []byte) {
+func (receiver *UnixMsgController) Write(data []byte) {
 }
 
-func (receiver UnixMsgController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+func (receiver *UnixMsgController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
 	return msg, errors.ErrorDataSentIncomplete
 }
 
-func (receiver UnixMsgController) ReadFrom() (string, []byte, int) {
+func (receiver *UnixMsgController) ReadFrom() (string, []byte, int) {
 	return "", nil, 0
 }
 
@@ -138,7 +183,7 @@ func (receiver *UnixMsgController) SendTo(addr string, msg ...codecs.IMData) ([]
 	return nil, nil
 }
 
-func (receiver UnixMsgController) SendFdTo(addr string, fds ...int) error {
+func (receiver *UnixMsgController) SendFdTo(addr string, fds ...int) error {
 	unixAddr, err := net.ResolveUnixAddr("unixgram", addr)
 	if err != nil {
 		return err
@@ -157,6 +202,78 @@ func (receiver UnixMsgController) SendFdTo(addr string, fds ...int) error {
 	return err
 }
 
+// 发送一批带元数据的句柄，接收方按元数据中的类型处理
+func (receiver *UnixMsgController) SendFileHandlesTo(addr string, meta FileHandleMeta, fds ...int) error {
+	if len(fds) == 0 || len(fds) > fileHandleMaxBatch {
+		return errors.ErrorDatagramTooLarge
+	}
+	unixAddr, err := net.ResolveUnixAddr("unixgram", addr)
+	if err != nil {
+		return err
+	}
+	b, err := encodeFileHandleMeta(meta)
+	if err != nil {
+		return err
+	}
+	oob := syscall.UnixRights(fds...)
+	_, _, err = receiver.ioinner.WriteMsgUnix(b, oob, unixAddr)
+	return err
+}
+
+func (receiver *UnixMsgController) processBatch(msg UnixMsgData) {
+	fds := parseUnixRights(msg.oob)
+	if len(fds) == 0 {
+		return
+	}
+	IncTotalHandleRecvSize(len(fds))
+
+	meta, err := decodeFileHandleMeta(msg.b)
+	if err != nil {
+		utils.LogError(">>> 来自 %s 的句柄元数据解析失败: %s", msg.addr, err.Error())
+		closeFileHandles(fds)
+		return
+	}
+	meta.Sender = msg.cred
+
+	if batchCtrl, ok := receiver.associatedObject.(FileHandleBatchController); ok {
+		go func() {
+			if err := batchCtrl.OnFileHandlesReceived(meta, fds); err != nil {
+				utils.LogError(">>> 处理来自 %s 的句柄失败: %s", msg.addr, err.Error())
+			}
+		}()
+		return
+	}
+
+	//只支持旧接口的接收方仍可接收连接
+	if fdctrl, ok := receiver.associatedObject.(FileHandleController); ok && meta.Kind == FileHandleKindConn {
+		for _, fd := range fds {
+			go func(fd int) {
+				fdctrl.OnFileHandleReceived(fd)
+			}(fd)
+		}
+		return
+	}
+
+	utils.LogWarn(">>> 没有可以处理类型为 %d 的句柄的对象，句柄将被关闭", meta.Kind)
+	closeFileHandles(fds)
+}
+
+func parseUnixRights(oob []byte) []int {
+	scms, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	var fds []int
+	for i := range scms {
+		rights, err := syscall.ParseUnixRights(&scms[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	return fds
+}
+
 func (receiver *UnixMsgController) processData(group *sync.WaitGroup) {
 	defer utils.LogPanic(recover())
 	for {
@@ -164,6 +281,10 @@ func (receiver *UnixMsgController) processData(group *sync.WaitGroup) {
 		if !ok {
 			break
 		}
+		if isFileHandleBatch(msg.b) {
+			receiver.processBatch(msg)
+			continue
+		}
 		fdctrl, ok := receiver.associatedObject.(FileHandleController)
 		if !ok {
 			continue
@@ -195,14 +316,33 @@ func (receiver *UnixMsgController) processData(group *sync.WaitGroup) {
 
 func (receiver *UnixMsgController) processRead(group *sync.WaitGroup) {
 	defer utils.LogPanic(recover())
+	//带元数据的批次需要更大的缓冲区，读取后按实际长度复制
+	b := make([]byte, fileHandleMaxDatagram)
+	oobSize := syscall.CmsgSpace(fileHandleMaxBatch * 4)
+	passCred, allowedUids := receiver.credentialsConfig()
+	if passCred {
+		oobSize += credentialsOobSize
+	}
+	oob := make([]byte, oobSize)
 	for {
-		b := make([]byte, 4)
-		oob := make([]byte, 1024)
-		bn, oobn, _, addr, err := receiver.ioinner.ReadMsgUnix(b, oob)
+		bn, oobn, flags, addr, err := receiver.ioinner.ReadMsgUnix(b, oob)
 		if err != nil {
 			break
 		}
-		msg := UnixMsgData{addr: addr.String(), b: b[:bn], oob: oob[:oobn]}
+		if flags&(syscall.MSG_TRUNC|syscall.MSG_CTRUNC) != 0 {
+			utils.LogWarn(">>> 来自 %s 的句柄数据报被截断", addr.String())
+		}
+		var cred *PeerCredentials
+		if passCred {
+			cred = parseCredentialsMessage(oob[:oobn])
+		}
+		//未被允许的进程发来的句柄已由内核安装到本进程，需关闭以免泄漏
+		if !allowedUids.allow(cred) {
+			utils.LogVerbose("=== 拒绝来自 %s 的句柄: %s", addr.String(), errors.ErrorPeerNotAllowed.Error())
+			closeFileHandles(parseUnixRights(oob[:oobn]))
+			continue
+		}
+		msg := UnixMsgData{addr: addr.String(), b: append([]byte(nil), b[:bn]...), oob: append([]byte(nil), oob[:oobn]...), cred: cred}
 		receiver.queue <- msg
 		runtime.Gosched()
 	}
@@ -212,6 +352,10 @@ func (receiver *UnixMsgController) processRead(group *sync.WaitGroup) {
 }
 
 func (receiver *UnixMsgController) Schedule() {
+	receiver.mutex.Lock()
+	receiver.scheduled = true
+	receiver.mutex.Unlock()
+	notifyControllerStart(receiver)
 	receiver.queue = make(chan UnixMsgData, 10240)
 	group := new(sync.WaitGroup)
 	group.Add(2)
@@ -223,6 +367,7 @@ func (receiver *UnixMsgController) Schedule() {
 		if receiver.OnStop != nil {
 			receiver.OnStop(receiver)
 		}
+		notifyControllerStop(receiver)
 		utils.LogError(">>> UNIX消息控制器 %s 已关闭调度", receiver.GetSource())
 	}()
 }
@@ -51,39 +51,39 @@ func (receiver *UnixMsgController) GetTag() int {
 	return 0
 }
 
-func (receiver UnixMsgController) GetSource() string {
+func (receiver *UnixMsgController) GetSource() string {
 	return ""
 }
 
-func (receiver UnixMsgController) GetSessionID() SessionID {
+func (receiver *UnixMsgController) GetSessionID() SessionID {
 	return SessionID(0)
 }
 
-func (receiver UnixMsgController) Close() {
+func (receiver *UnixMsgController) Close() {
 }
 
-func (receiver UnixMsgController) Discard() {
+func (receiver *UnixMsgController) Discard() {
 }
 
-func (receiver UnixMsgController) CloseOnSended() {
+func (receiver *UnixMsgController) CloseOnSended() {
 }
 
-func (receiver UnixMsgController) Read(l int) ([]byte, int) {
+func (receiver *UnixMsgController) Read(l int) ([]byte, int) {
 	return nil, 0
 }
 
-func (receiver UnixMsgController) Peek(l int) ([]byte, int) {
+func (receiver *UnixMsgController) Peek(l int) ([]byte, int) {
 	return nil, 0
 }
 
-func (receiver UnixMsgController) Write(data []byte) {
+func (receiver *UnixMsgController) Write(data []byte) {
 }
 
-func (receiver UnixMsgController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
+func (receiver *UnixMsgController) Send(msg ...codecs.IMData) ([]codecs.IMData, error) {
 	return msg, errors.ErrorDataSentIncomplete
 }
 
-func (receiver UnixMsgController) ReadFrom() (string, []byte, int) {
+func (receiver *UnixMsgController) ReadFrom() (string, []byte, int) {
 	return "", nil, 0
 }
 
@@ -94,6 +94,18 @@ func (receiver *UnixMsgController) SendTo(addr string, msg ...codecs.IMData) ([]
 	return nil, nil
 }
 
-func (receiver UnixMsgController) SendFdTo(addr string, fds ...int) error { return nil }
+func (receiver *UnixMsgController) SendFdTo(addr string, fds ...int) error { return nil }
+
+func (receiver *UnixMsgController) SendFileHandlesTo(addr string, meta FileHandleMeta, fds ...int) error {
+	return nil
+}
+
+func (receiver *UnixMsgController) EnablePeerCredentials() error {
+	return errors.ErrorCredentialsUnsupported
+}
+
+func (receiver *UnixMsgController) SetAllowedUids(uids ...uint32) error {
+	return errors.ErrorCredentialsUnsupported
+}
 
 func (receiver *UnixMsgController) Schedule() {}
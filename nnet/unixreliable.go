@@ -0,0 +1,325 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/utils"
+)
+
+/*
+reliable datagram header {
+magic 		-> byte (2)		0x52 0x55, 首字节最高位为0, 不会与 NB 包头混淆
+kind 		-> byte (1)		1: 数据, 2: 确认
+epoch 		-> uint32		发送方每次启用可靠模式时随机生成, 对端据此重置去重状态
+seq 		-> uint64		按对端地址递增的序号
+payload 	-> memory		仅数据报文携带
+}
+*/
+const (
+	reliableHeaderLength = 15
+	reliableKindData     = 1
+	reliableKindAck      = 2
+
+	//每个对端去重窗口内最多记录的乱序序号
+	reliableRecvWindow = 4096
+	//没有待确认数据的对端超过该时间未通信则清除其状态
+	reliablePeerIdle = time.Minute
+	reliableTick     = 10 * time.Millisecond
+)
+
+var reliableMagic = [2]byte{0x52, 0x55}
+
+// unix 数据报可靠模式的配置，双方都需启用
+type UnixReliableConfig struct {
+	RetransmitTimeout    time.Duration //首次重传等待时间，默认 50ms，之后每次翻倍
+	MaxRetransmitTimeout time.Duration //重传等待时间上限，默认 1s
+	MaxRetries           int           //最大重传次数，默认 5，超过后认为对端已不可达
+	MaxPending           int           //每个对端最多的待确认数据报，默认 1024，超过时发送返回 ErrorSendQueueFull
+	LostHold             time.Duration //对端被判定不可达后，在此时间内发往它的数据直接返回 ErrorPeerUnreachable，默认 1s
+}
+
+type OnPeerLost func(addr string, err error)
+
+type reliablePending struct {
+	data     []byte
+	attempts int
+	rto      time.Duration
+	deadline time.Time
+}
+
+type reliablePeer struct {
+	nextSeq   uint64
+	pending   map[uint64]*reliablePending
+	lostUntil time.Time
+	lastSeen  time.Time
+
+	recvEpoch uint32
+	recvBase  uint64
+	recvSeen  map[uint64]struct{}
+}
+
+type unixReliable struct {
+	config  UnixReliableConfig
+	epoch   uint32
+	peers   map[string]*reliablePeer
+	send    func(addr string, data []byte)
+	onLost  OnPeerLost
+	closeCh chan int
+	mutex   sync.Mutex
+}
+
+func createUnixReliable(config UnixReliableConfig, send func(string, []byte), onLost OnPeerLost) *unixReliable {
+	if config.RetransmitTimeout <= 0 {
+		config.RetransmitTimeout = 50 * time.Millisecond
+	}
+	if config.MaxRetransmitTimeout < config.RetransmitTimeout {
+		config.MaxRetransmitTimeout = time.Second
+		if config.MaxRetransmitTimeout < config.RetransmitTimeout {
+			config.MaxRetransmitTimeout = config.RetransmitTimeout
+		}
+	}
+	if config.MaxRetries <= 0 {
+		config.MaxRetries = 5
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 1024
+	}
+	if config.LostHold <= 0 {
+		config.LostHold = time.Second
+	}
+	r := new(unixReliable)
+	r.config = config
+	r.peers = make(map[string]*reliablePeer)
+	r.send = send
+	r.onLost = onLost
+	r.closeCh = make(chan int)
+	var b [4]byte
+	rand.Read(b[:])
+	r.epoch = binary.BigEndian.Uint32(b[:])
+	return r
+}
+
+func (receiver *unixReliable) header(kind byte, seq uint64, payloadLen int) []byte {
+	b := make([]byte, reliableHeaderLength, reliableHeaderLength+payloadLen)
+	copy(b, reliableMagic[:])
+	b[2] = kind
+	binary.BigEndian.PutUint32(b[3:7], receiver.epoch)
+	binary.BigEndian.PutUint64(b[7:15], seq)
+	return b
+}
+
+func (receiver *unixReliable) peer(addr string) *reliablePeer {
+	p, ok := receiver.peers[addr]
+	if !ok {
+		p = new(reliablePeer)
+		p.pending = make(map[uint64]*reliablePending)
+		p.recvSeen = make(map[uint64]struct{})
+		receiver.peers[addr] = p
+	}
+	p.lastSeen = time.Now()
+	return p
+}
+
+// 为数据报加上可靠模式头并登记为待确认
+func (receiver *unixReliable) wrap(addr string, payload []byte) ([]byte, error) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	p := receiver.peer(addr)
+	now := time.Now()
+	if now.Before(p.lostUntil) {
+		return nil, errors.ErrorPeerUnreachable
+	}
+	if len(p.pending) >= receiver.config.MaxPending {
+		return nil, errors.ErrorSendQueueFull
+	}
+	p.nextSeq += 1
+	data := append(receiver.header(reliableKindData, p.nextSeq, len(payload)), payload...)
+	p.pending[p.nextSeq] = &reliablePending{
+		data:     data,
+		rto:      receiver.config.RetransmitTimeout,
+		deadline: now.Add(receiver.config.RetransmitTimeout),
+	}
+	return data, nil
+}
+
+// 处理收到的数据报，返回需要交给解码器的数据
+// 确认报文及重复的数据报返回 false，不带可靠模式头的数据报原样返回
+func (receiver *unixReliable) unwrap(addr string, datagram []byte) ([]byte, bool) {
+	if len(datagram) < reliableHeaderLength || datagram[0] != reliableMagic[0] || datagram[1] != reliableMagic[1] {
+		return datagram, true
+	}
+	kind := datagram[2]
+	epoch := binary.BigEndian.Uint32(datagram[3:7])
+	seq := binary.BigEndian.Uint64(datagram[7:15])
+
+	receiver.mutex.Lock()
+	p := receiver.peer(addr)
+	//收到对端的任何报文都说明其仍然存在
+	p.lostUntil = time.Time{}
+
+	if kind == reliableKindAck {
+		if epoch == receiver.epoch {
+			delete(p.pending, seq)
+		}
+		receiver.mutex.Unlock()
+		return nil, false
+	}
+	if kind != reliableKindData {
+		receiver.mutex.Unlock()
+		return nil, false
+	}
+
+	if epoch != p.recvEpoch {
+		p.recvEpoch = epoch
+		p.recvBase = 0
+		p.recvSeen = make(map[uint64]struct{})
+	}
+	duplicate := seq <= p.recvBase
+	if !duplicate {
+		_, duplicate = p.recvSeen[seq]
+	}
+	if !duplicate {
+		p.recvSeen[seq] = struct{}{}
+		if len(p.recvSeen) > reliableRecvWindow {
+			//缺失的序号已被发送方放弃，跳过它们
+			p.recvBase = seq - reliableRecvWindow
+			for s := range p.recvSeen {
+				if s <= p.recvBase {
+					delete(p.recvSeen, s)
+				}
+			}
+		}
+		for {
+			if _, ok := p.recvSeen[p.recvBase+1]; !ok {
+				break
+			}
+			delete(p.recvSeen, p.recvBase+1)
+			p.recvBase += 1
+		}
+	}
+	receiver.mutex.Unlock()
+
+	//重复的数据报同样需要确认，之前的确认可能已丢失
+	ack := make([]byte, reliableHeaderLength)
+	copy(ack, reliableMagic[:])
+	ack[2] = reliableKindAck
+	binary.BigEndian.PutUint32(ack[3:7], epoch)
+	binary.BigEndian.PutUint64(ack[7:15], seq)
+	receiver.send(addr, ack)
+
+	if duplicate {
+		return nil, false
+	}
+	return datagram[reliableHeaderLength:], true
+}
+
+// 对端已不可达，放弃其所有待确认数据并通知
+func (receiver *unixReliable) peerLost(addr string, err error) {
+	receiver.mutex.Lock()
+	p := receiver.peer(addr)
+	p.pending = make(map[uint64]*reliablePending)
+	p.lostUntil = time.Now().Add(receiver.config.LostHold)
+	receiver.mutex.Unlock()
+
+	utils.LogWarn(">>> 可靠数据报对端 %s 不可达 %s", addr, err.Error())
+	if receiver.onLost != nil {
+		receiver.onLost(addr, err)
+	}
+}
+
+func (receiver *unixReliable) pendingCount(addr string) int {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if p, ok := receiver.peers[addr]; ok {
+		return len(p.pending)
+	}
+	return 0
+}
+
+func (receiver *unixReliable) retransmit() {
+	type outgoing struct {
+		addr string
+		data []byte
+	}
+	var resend []outgoing
+	var lost []string
+
+	now := time.Now()
+	receiver.mutex.Lock()
+	for addr, p := range receiver.peers {
+		if len(p.pending) == 0 {
+			if now.Sub(p.lastSeen) > reliablePeerIdle && now.After(p.lostUntil) {
+				delete(receiver.peers, addr)
+			}
+			continue
+		}
+		for _, pending := range p.pending {
+			if now.Before(pending.deadline) {
+				continue
+			}
+			if pending.attempts >= receiver.config.MaxRetries {
+				lost = append(lost, addr)
+				break
+			}
+			pending.attempts += 1
+			pending.rto *= 2
+			if pending.rto > receiver.config.MaxRetransmitTimeout {
+				pending.rto = receiver.config.MaxRetransmitTimeout
+			}
+			pending.deadline = now.Add(pending.rto)
+			resend = append(resend, outgoing{addr: addr, data: pending.data})
+		}
+	}
+	receiver.mutex.Unlock()
+
+	for _, o := range resend {
+		receiver.send(o.addr, o.data)
+	}
+	for _, addr := range lost {
+		receiver.peerLost(addr, errors.ErrorPeerUnreachable)
+	}
+}
+
+func (receiver *unixReliable) run() {
+	ticker := time.NewTicker(reliableTick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-ticker.C:
+			receiver.retransmit()
+		}
+	}
+}
+
+func (receiver *unixReliable) stop() {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	select {
+	case <-receiver.closeCh:
+	default:
+		close(receiver.closeCh)
+	}
+}
@@ -0,0 +1,228 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/errors"
+)
+
+// 记录发出的数据报，不做实际发送
+type datagramSink struct {
+	mutex sync.Mutex
+	sent  [][]byte
+}
+
+func (receiver *datagramSink) send(addr string, data []byte) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	receiver.sent = append(receiver.sent, data)
+}
+
+func (receiver *datagramSink) take() [][]byte {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	sent := receiver.sent
+	receiver.sent = nil
+	return sent
+}
+
+func TestReliableDeduplicatesAndAcks(t *testing.T) {
+	sender := createUnixReliable(UnixReliableConfig{}, func(string, []byte) {}, nil)
+	acks := new(datagramSink)
+	receiver := createUnixReliable(UnixReliableConfig{}, acks.send, nil)
+
+	d1, _ := sender.wrap("b", []byte("one"))
+	d2, _ := sender.wrap("b", []byte("two"))
+	d3, _ := sender.wrap("b", []byte("three"))
+	if sender.pendingCount("b") != 3 {
+		t.Fatalf("pending = %d; want 3", sender.pendingCount("b"))
+	}
+
+	//乱序及重复到达
+	var delivered []string
+	for _, d := range [][]byte{d2, d1, d2, d3, d1} {
+		if payload, ok := receiver.unwrap("a", d); ok {
+			delivered = append(delivered, string(payload))
+		}
+	}
+	if len(delivered) != 3 || delivered[0] != "two" || delivered[1] != "one" || delivered[2] != "three" {
+		t.Fatalf("delivered %v", delivered)
+	}
+	//重复的数据报同样被确认
+	sent := acks.take()
+	if len(sent) != 5 {
+		t.Fatalf("sent %d acks; want 5", len(sent))
+	}
+	for _, ack := range sent {
+		if _, ok := sender.unwrap("b", ack); ok {
+			t.Fatal("ack must not be delivered")
+		}
+	}
+	if sender.pendingCount("b") != 0 {
+		t.Fatalf("pending = %d after acks", sender.pendingCount("b"))
+	}
+	if p := receiver.peers["a"]; p.recvBase != 3 || len(p.recvSeen) != 0 {
+		t.Fatalf("recvBase %d, seen %d", p.recvBase, len(p.recvSeen))
+	}
+}
+
+func TestReliablePassesPlainDatagrams(t *testing.T) {
+	r := createUnixReliable(UnixReliableConfig{}, func(string, []byte) { t.Fatal("plain datagram must not be acked") }, nil)
+	for _, plain := range [][]byte{[]byte("x"), []byte{0x52, 0x55, 1}, make([]byte, 32)} {
+		payload, ok := r.unwrap("a", plain)
+		if !ok || string(payload) != string(plain) {
+			t.Fatalf("plain datagram %v altered", plain)
+		}
+	}
+}
+
+func TestReliableNewEpochResetsDedupe(t *testing.T) {
+	acks := new(datagramSink)
+	receiver := createUnixReliable(UnixReliableConfig{}, acks.send, nil)
+	first := createUnixReliable(UnixReliableConfig{}, func(string, []byte) {}, nil)
+	d, _ := first.wrap("b", []byte("old"))
+	if _, ok := receiver.unwrap("a", d); !ok {
+		t.Fatal("first datagram should be delivered")
+	}
+
+	//对端重启后序号从 1 开始
+	restarted := createUnixReliable(UnixReliableConfig{}, func(string, []byte) {}, nil)
+	restarted.epoch = first.epoch + 1
+	d, _ = restarted.wrap("b", []byte("new"))
+	if payload, ok := receiver.unwrap("a", d); !ok || string(payload) != "new" {
+		t.Fatal("datagram from a new epoch was treated as duplicate")
+	}
+
+	//旧纪元的确认不会清除新数据
+	stale := receiver.header(reliableKindAck, 1, 0)
+	restarted.unwrap("b", stale)
+	if restarted.pendingCount("b") != 1 {
+		t.Fatal("ack with another epoch should be ignored")
+	}
+}
+
+func TestReliableRetransmitsWithBackoff(t *testing.T) {
+	sink := new(datagramSink)
+	r := createUnixReliable(UnixReliableConfig{
+		RetransmitTimeout:    10 * time.Millisecond,
+		MaxRetransmitTimeout: 25 * time.Millisecond,
+		MaxRetries:           10,
+	}, sink.send, nil)
+	data, _ := r.wrap("b", []byte("payload"))
+
+	r.retransmit()
+	if len(sink.take()) != 0 {
+		t.Fatal("retransmitted before the timeout")
+	}
+	wantRto := []time.Duration{20 * time.Millisecond, 25 * time.Millisecond, 25 * time.Millisecond}
+	for i, rto := range wantRto {
+		r.mutex.Lock()
+		pending := r.peers["b"].pending[1]
+		pending.deadline = time.Now().Add(-time.Millisecond)
+		r.mutex.Unlock()
+
+		r.retransmit()
+		sent := sink.take()
+		if len(sent) != 1 || string(sent[0]) != string(data) {
+			t.Fatalf("attempt %d sent %d datagrams", i+1, len(sent))
+		}
+		r.mutex.Lock()
+		attempts, got := pending.attempts, pending.rto
+		r.mutex.Unlock()
+		if attempts != i+1 || got != rto {
+			t.Fatalf("attempt %d: attempts %d rto %v; want rto %v", i+1, attempts, got, rto)
+		}
+	}
+}
+
+func TestReliablePeerLostAfterMaxRetries(t *testing.T) {
+	sink := new(datagramSink)
+	lost := make(chan error, 1)
+	r := createUnixReliable(UnixReliableConfig{
+		RetransmitTimeout: 5 * time.Millisecond,
+		MaxRetries:        2,
+		LostHold:          time.Hour,
+	}, sink.send, func(addr string, err error) {
+		if addr == "b" {
+			lost <- err
+		}
+	})
+	go r.run()
+	defer r.stop()
+	r.wrap("b", []byte("payload"))
+
+	select {
+	case err := <-lost:
+		if err != errors.ErrorPeerUnreachable {
+			t.Fatalf("err = %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("peer was not reported lost")
+	}
+	if n := len(sink.take()); n != 2 {
+		t.Fatalf("retransmitted %d times; want 2", n)
+	}
+	if r.pendingCount("b") != 0 {
+		t.Fatal("pending data should be dropped for a lost peer")
+	}
+	if _, err := r.wrap("b", []byte("again")); err != errors.ErrorPeerUnreachable {
+		t.Fatalf("err = %v; want ErrorPeerUnreachable during LostHold", err)
+	}
+
+	//收到对端的任何报文后恢复发送
+	peer := createUnixReliable(UnixReliableConfig{}, func(string, []byte) {}, nil)
+	d, _ := peer.wrap("a", []byte("hello"))
+	r.unwrap("b", d)
+	if _, err := r.wrap("b", []byte("again")); err != nil {
+		t.Fatalf("err = %v after hearing from peer", err)
+	}
+}
+
+func TestReliableMaxPending(t *testing.T) {
+	r := createUnixReliable(UnixReliableConfig{MaxPending: 2}, func(string, []byte) {}, nil)
+	r.wrap("b", nil)
+	r.wrap("b", nil)
+	if _, err := r.wrap("b", nil); err != errors.ErrorSendQueueFull {
+		t.Fatalf("err = %v; want ErrorSendQueueFull", err)
+	}
+	//其他对端不受影响
+	if _, err := r.wrap("c", nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReliableSkipsSeqsBeyondWindow(t *testing.T) {
+	r := createUnixReliable(UnixReliableConfig{}, func(string, []byte) {}, nil)
+	sender := createUnixReliable(UnixReliableConfig{MaxPending: 2 * reliableRecvWindow}, func(string, []byte) {}, nil)
+	//序号 1 丢失，之后的序号超出去重窗口
+	sender.wrap("a", nil)
+	for i := 0; i < reliableRecvWindow+1; i++ {
+		d, _ := sender.wrap("a", nil)
+		if _, ok := r.unwrap("b", d); !ok {
+			t.Fatalf("datagram %d dropped", i+2)
+		}
+	}
+	p := r.peers["b"]
+	if p.recvBase != reliableRecvWindow+2 || len(p.recvSeen) != 0 {
+		t.Fatalf("recvBase %d, seen %d", p.recvBase, len(p.recvSeen))
+	}
+}
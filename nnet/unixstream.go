@@ -0,0 +1,161 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"net"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+/*
+面向连接的 unix 套接字传输
+	unix       => SOCK_STREAM，字节流，与 TCP 完全一致
+	unixpacket => SOCK_SEQPACKET，有序且保留报文边界，单次读写不超过 unixPacketSize
+两者都复用 TCPController，因此具备断线通知(OnBye)、有序投递以及数据包格式嗅探
+*/
+
+const (
+	UnixNetworkStream = "unix"
+	UnixNetworkPacket = "unixpacket"
+)
+
+// unixpacket 单个报文的上限，需小于系统默认的发送缓冲区
+const unixPacketSize = 64 * 1024
+
+func unixPacketSizeOf(network string) (int, error) {
+	switch network {
+	case UnixNetworkStream:
+		return 0, nil
+	case UnixNetworkPacket:
+		return unixPacketSize, nil
+	}
+	return 0, errors.ErrorUnsupportedNetwork
+}
+
+type UnixServer struct {
+	*TCPServer
+	network string
+	path    string
+}
+
+// network 为 UnixNetworkStream 或 UnixNetworkPacket
+func CreateUnixServer(network string) *UnixServer {
+	srv := new(UnixServer)
+	srv.TCPServer = CreateTCPServer()
+	srv.network = network
+	return srv
+}
+
+func CreateUnixServerWithLimit(network string, limit int64) *UnixServer {
+	srv := new(UnixServer)
+	srv.TCPServer = CreateTCPServerWithLimit(limit)
+	srv.network = network
+	return srv
+}
+
+func (receiver UnixServer) GetNetwork() string {
+	return receiver.network
+}
+
+func (receiver UnixServer) GetPath() string {
+	return receiver.path
+}
+
+// 只接受指定 uid 的进程发起的连接，需在 Bind 之前调用，不传参数表示不限制
+func (receiver *UnixServer) SetAllowedUids(uids ...uint32) {
+	receiver.allowedUids = createUidAllowlist(uids)
+}
+
+func (receiver *UnixServer) Bind(path string) error {
+	receiver.isClosed = true
+	packetSize, err := unixPacketSizeOf(receiver.network)
+	if err != nil {
+		return err
+	}
+	if err = prepareUnixSocket(receiver.network, path); err != nil {
+		return err
+	}
+	unixAddr, err := net.ResolveUnixAddr(receiver.network, path)
+	if err != nil {
+		return err
+	}
+	//监听器关闭时会自动删除套接字文件
+	listener, err := net.ListenUnix(receiver.network, unixAddr)
+	if err != nil {
+		utils.LogError("### 监听 %s://%s 失败. err: %s", receiver.network, path, err)
+		return err
+	}
+	if err = finishUnixSocket(path); err != nil {
+		listener.Close()
+		return err
+	}
+
+	receiver.path = path
+	receiver.packetSize = packetSize
+	receiver.serve(listener)
+
+	utils.LogInfo("### 监听 %s://%s 成功", receiver.network, path)
+
+	return nil
+}
+
+type UnixClient struct {
+	*TCPClient
+	network string
+}
+
+// network 为 UnixNetworkStream 或 UnixNetworkPacket，format 为 nil 时按首个数据包嗅探格式
+func CreateUnixClient(network string, format *packets.PacketFormat, codec *codecs.Codec) *UnixClient {
+	cli := new(UnixClient)
+	cli.TCPClient = CreateTCPClient(format, codec)
+	cli.network = network
+	return cli
+}
+
+func (receiver UnixClient) GetNetwork() string {
+	return receiver.network
+}
+
+func (receiver *UnixClient) Connect(path string) error {
+	receiver.isClosed = true
+	packetSize, err := unixPacketSizeOf(receiver.network)
+	if err != nil {
+		return err
+	}
+	network := receiver.network
+	dial := func() (net.Conn, error) {
+		return net.Dial(network, path)
+	}
+	conn, err := dial()
+	if err != nil {
+		utils.LogError("### 连接 %s://%s 失败. err: %s", receiver.network, path, err)
+		return err
+	}
+
+	receiver.packetSize = packetSize
+	receiver.start(dial)
+	receiver.processClient(conn)
+
+	utils.LogInfo("### 连接 %s://%s 成功", receiver.network, path)
+
+	return nil
+}
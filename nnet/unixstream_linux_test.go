@@ -0,0 +1,131 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package nnet
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/env"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/packets"
+)
+
+func TestUnixServerClientEcho(t *testing.T) {
+	env.RegisterPacketFormat(packets.PacketFormatNB)
+	for _, network := range []string{UnixNetworkStream, UnixNetworkPacket} {
+		t.Run(network, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "echo.sock")
+			srv := CreateUnixServer(network)
+			//不指定格式，按首个数据包嗅探
+			srv.Codec = codecs.CodecIMv2
+			var mutex sync.Mutex
+			welcomed, byes := 0, 0
+			srv.OnWelcome = func(controller Controller) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				welcomed++
+				return nil
+			}
+			srv.OnBye = func(controller Controller) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				byes++
+				return nil
+			}
+			srv.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+				_, err := controller.Send(data)
+				return err
+			}
+			if err := srv.Bind(path); err != nil {
+				t.Fatal(err)
+			}
+			srv.Schedule()
+			defer srv.Close()
+			if srv.GetPath() != path || srv.GetNetwork() != network {
+				t.Fatalf("path %s network %s", srv.GetPath(), srv.GetNetwork())
+			}
+
+			var got []codecs.IMData
+			client := CreateUnixClient(network, packets.PacketFormatNB, codecs.CodecIMv2)
+			client.OnDataDecoded = func(controller Controller, addr string, data codecs.IMData) error {
+				mutex.Lock()
+				defer mutex.Unlock()
+				got = append(got, data)
+				return nil
+			}
+			if err := client.Connect(path); err != nil {
+				t.Fatal(err)
+			}
+
+			//超过单个 unixpacket 报文上限的消息需分多次写出
+			big := make([]byte, 3*unixPacketSize)
+			const count = 100
+			for i := 0; i < count; i++ {
+				msg := codecs.IMMap{1: int64(i)}
+				if i == count/2 {
+					msg[2] = big
+				}
+				client.Send(msg)
+			}
+			waitFor(t, "echoes", func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return len(got) == count
+			})
+			mutex.Lock()
+			for i, data := range got {
+				if intOf(data) != int64(i) {
+					t.Fatalf("echo %d has seq %d", i, intOf(data))
+				}
+			}
+			if b, _ := got[count/2].(codecs.IMMap)[2].([]byte); len(b) != len(big) {
+				t.Fatalf("large message echoed with %d bytes", len(b))
+			}
+			mutex.Unlock()
+			if counts := srv.GetFormatCounts(); counts[packets.PacketFormatNB.Tag] != 1 {
+				t.Fatalf("format counts = %v", counts)
+			}
+
+			client.Close()
+			waitFor(t, "OnBye", func() bool {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return byes == 1
+			})
+			mutex.Lock()
+			if welcomed != 1 {
+				t.Fatalf("welcomed %d times", welcomed)
+			}
+			mutex.Unlock()
+		})
+	}
+}
+
+func TestUnixServerRejectsUnsupportedNetwork(t *testing.T) {
+	srv := CreateUnixServer("unixgram")
+	if err := srv.Bind(filepath.Join(t.TempDir(), "x.sock")); err != errors.ErrorUnsupportedNetwork {
+		t.Fatalf("err = %v; want ErrorUnsupportedNetwork", err)
+	}
+	client := CreateUnixClient("tcp", nil, codecs.CodecIMv2)
+	if err := client.Connect("x"); err != errors.ErrorUnsupportedNetwork {
+		t.Fatalf("err = %v; want ErrorUnsupportedNetwork", err)
+	}
+}
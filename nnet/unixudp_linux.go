@@ -19,7 +19,7 @@ package nnet
 
 import (
 	"net"
-	"os"
+	"sync"
 
 	"github.com/packing/clove/codecs"
 	"github.com/packing/clove/errors"
@@ -34,11 +34,19 @@ type UnixUDP struct {
 	dataNotifyChan chan int
 	controller     *UnixController
 	isClosed       bool
+	mutex          sync.Mutex
 	addr           string
 	bufWSize       int
 	bufRSize       int
+	reliable       *UnixReliableConfig
+	fragmentation  DatagramFragmentation
+	passCred       bool
+	allowedUids    []uint32
 
 	associatedObject interface{}
+
+	//可靠模式下对端被判定不可达时调用
+	OnPeerLost OnPeerLost
 }
 
 func CreateUnixUDPWithFormat(format *packets.PacketFormat, codec *codecs.Codec) *UnixUDP {
@@ -59,54 +67,110 @@ func (receiver *UnixUDP) SetControllerAssociatedObject(o interface{}) {
 	receiver.associatedObject = o
 }
 
+// 启用可靠模式: 带序号及确认的发送、超时重传与去重，需在 Bind 之前调用，对端也需启用
+func (receiver *UnixUDP) SetReliable(config UnixReliableConfig) {
+	receiver.reliable = &config
+}
+
+// 设置大数据报的分片及重组参数，需在 Bind 之前调用，默认超过 DefaultDatagramFragmentSize 的数据报会被分片
+func (receiver *UnixUDP) SetFragmentation(config DatagramFragmentation) {
+	receiver.fragmentation = config
+}
+
+// 接收数据报时获取发送者的凭据，在 OnDataDecoded 中通过 PeerCredentialsOf 读取，需在 Bind 之前调用
+func (receiver *UnixUDP) SetPeerCredentials(enable bool) {
+	receiver.passCred = enable
+}
+
+// 只处理指定 uid 的进程发来的数据报，需在 Bind 之前调用，不传参数表示不限制
+func (receiver *UnixUDP) SetAllowedUids(uids ...uint32) {
+	receiver.allowedUids = uids
+}
+
 func (receiver *UnixUDP) Bind(addr string) error {
 	receiver.isClosed = true
-	unixAddr, err := net.ResolveUnixAddr("unixgram", addr)
-	if err != nil {
-		return err
-	}
-
-	unixConn, err := net.ListenUnixgram("unixgram", unixAddr)
+	unixConn, err := listenUnixgram(addr)
 	if err != nil {
 		return err
 	}
 
 	receiver.addr = addr
 	receiver.isClosed = false
-	receiver.processClient(*unixConn)
+	if err = receiver.processClient(*unixConn); err != nil {
+		receiver.isClosed = true
+		unixConn.Close()
+		removeUnixSocket(addr)
+		return err
+	}
 
 	return nil
 }
 
-func (receiver UnixUDP) GetBindAddr() string {
+func (receiver *UnixUDP) GetBindAddr() string {
 	return receiver.addr
 }
 
-func (receiver *UnixUDP) processClient(conn net.UnixConn) {
+func (receiver *UnixUDP) GetController() *UnixController {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	return receiver.controller
+}
+
+// 控制器退出调度时会在其协程中清空，已关闭时返回 nil
+func (receiver *UnixUDP) getController() *UnixController {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	if receiver.isClosed {
+		return nil
+	}
+	return receiver.controller
+}
+
+func (receiver *UnixUDP) processClient(conn net.UnixConn) error {
 
 	dataRW := createDataReadWriter(receiver.Codec, receiver.Format)
 	dataRW.OnDataDecoded = receiver.OnDataDecoded
+	dataRW.fragmentation = receiver.fragmentation
 	receiver.controller = createUnixControllerWithBufferSize(conn, dataRW, receiver.bufWSize, receiver.bufRSize)
 	receiver.controller.SetAssociatedObject(receiver.associatedObject)
+	if receiver.passCred {
+		if err := receiver.controller.EnablePeerCredentials(); err != nil {
+			return err
+		}
+	}
+	if err := receiver.controller.SetAllowedUids(receiver.allowedUids...); err != nil {
+		return err
+	}
+	if receiver.reliable != nil {
+		receiver.controller.SetReliable(*receiver.reliable, func(addr string, err error) {
+			if receiver.OnPeerLost != nil {
+				receiver.OnPeerLost(addr, err)
+			}
+		})
+	}
 
 	receiver.controller.OnStop = func(controller Controller) error {
-		utils.LogInfo("unix端口 %s 已经退出监听", controller.GetSessionID())
+		utils.LogInfo("unix端口 %d 已经退出监听", controller.GetSessionID())
+		receiver.mutex.Lock()
 		receiver.controller = nil
 		receiver.isClosed = true
+		receiver.mutex.Unlock()
 		return nil
 	}
 
 	receiver.controller.Schedule()
 
+	return nil
 }
 
 func (receiver *UnixUDP) SendTo(addr string, msgs ...codecs.IMData) ([]codecs.IMData, error) {
-	if receiver.isClosed {
+	controller := receiver.getController()
+	if controller == nil {
 		return msgs, errors.ErrorDataSentIncomplete
 	}
-	_, err := os.Stat(addr)
-	if err == nil || !os.IsNotExist(err) {
-		return receiver.controller.SendTo(addr, msgs...)
+	err := unixAddrExists(addr)
+	if err == nil {
+		return controller.SendTo(addr, msgs...)
 	} else {
 		utils.LogError("无法向 %s 发送数据, 请确认它是否仍存在", addr)
 		return msgs, err
@@ -114,13 +178,24 @@ func (receiver *UnixUDP) SendTo(addr string, msgs ...codecs.IMData) ([]codecs.IM
 }
 
 func (receiver *UnixUDP) SendFileHandler(addr string, fds ...int) error {
-	return receiver.controller.SendFdTo(addr, fds...)
+	controller := receiver.getController()
+	if controller == nil {
+		return errors.ErrorDataSentIncomplete
+	}
+	return controller.SendFdTo(addr, fds...)
 }
 
 func (receiver *UnixUDP) Close() {
-	if !receiver.isClosed {
-		//receiver.controller.Close()
-		receiver.controller.CloseOnSended()
-		receiver.isClosed = true
+	receiver.mutex.Lock()
+	controller := receiver.controller
+	closed := receiver.isClosed
+	receiver.isClosed = true
+	receiver.mutex.Unlock()
+	if !closed {
+		//controller.Close()
+		if controller != nil {
+			controller.CloseOnSended()
+		}
+		removeUnixSocket(receiver.addr)
 	}
 }
@@ -26,6 +26,8 @@ type UnixUDP struct {
 	DataController
 	Codec  *codecs.Codec
 	Format *packets.PacketFormat
+
+	OnPeerLost OnPeerLost
 }
 
 func CreateUnixUDPWithFormat(format *packets.PacketFormat, codec *codecs.Codec) *UnixUDP {
@@ -42,14 +44,30 @@ func CreateUnixUDPWithFormatAndBufferSize(format *packets.PacketFormat, codec *c
 func (receiver *UnixUDP) SetControllerAssociatedObject(o interface{}) {
 }
 
+func (receiver *UnixUDP) SetReliable(config UnixReliableConfig) {
+}
+
+func (receiver *UnixUDP) SetFragmentation(config DatagramFragmentation) {
+}
+
+func (receiver *UnixUDP) SetPeerCredentials(enable bool) {
+}
+
+func (receiver *UnixUDP) SetAllowedUids(uids ...uint32) {
+}
+
 func (receiver *UnixUDP) Bind(addr string) error {
 	return nil
 }
 
-func (receiver UnixUDP) GetBindAddr() string {
+func (receiver *UnixUDP) GetBindAddr() string {
 	return ""
 }
 
+func (receiver *UnixUDP) GetController() *UnixController {
+	return nil
+}
+
 func (receiver *UnixUDP) SendTo(addr string, msgs ...codecs.IMData) ([]codecs.IMData, error) {
 	return nil, nil
 }
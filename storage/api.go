@@ -18,11 +18,8 @@
 package storage
 
 import (
-	"fmt"
-	"math"
-	"os"
+	"context"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/packing/clove/codecs"
@@ -47,27 +44,20 @@ type Transaction struct {
 	args   []interface{}
 }
 
-type ResultWaiter struct {
-	ch chan interface{}
-	tr *time.Timer
-	id int64
-}
-
 type Client struct {
 	udpUnix   *nnet.UnixUDP
 	tcpNormal *nnet.TCPClient
 	addr      string
 	unixMode  bool
-	lock      sync.Mutex
 	timeOut   time.Duration
-	waiters   *sync.Map
-	uniqueId  int64
+	stats     *messages.CallStats
+	ctx       context.Context
+	reliable  *nnet.UnixReliableConfig
 }
 
 func CreateClientWithBufferSize(addr string, timeOut time.Duration, buffWriteSize int, buffReadSize int) *Client {
 	kv := new(Client)
 	kv.timeOut = timeOut
-	kv.waiters = new(sync.Map)
 	if err := kv.Initialize(addr, buffWriteSize, buffReadSize); err != nil {
 		utils.LogError("CreateClient error: %s", err.Error())
 		return nil
@@ -79,93 +69,70 @@ func CreateClient(addr string, timeOut time.Duration) *Client {
 	return CreateClientWithBufferSize(addr, timeOut, -1, -1)
 }
 
-func (receiver *Client) Close() {
-	receiver.waiters.Range(func(key, value interface{}) bool {
-		v, ok := value.(ResultWaiter)
-		if ok {
-			close(v.ch)
-		}
-		return true
-	})
-
-	if receiver.udpUnix != nil {
-		receiver.udpUnix.Close()
-	}
-	if receiver.tcpNormal != nil {
-		receiver.tcpNormal.Close()
-	}
-}
-
-func (receiver *Client) makeCmdId(cmdId *int64) {
-	receiver.lock.Lock()
-	defer receiver.lock.Unlock()
-	receiver.uniqueId += 1
-	if receiver.uniqueId >= math.MaxInt64 {
-		receiver.uniqueId = 1
+// 创建在 unix 数据报上使用可靠模式的客户端，存储服务端也需启用可靠模式
+// 服务端不可达时，等待中的调用立即失败而不必等到超时
+func CreateReliableClient(addr string, timeOut time.Duration, config nnet.UnixReliableConfig) *Client {
+	kv := new(Client)
+	kv.timeOut = timeOut
+	kv.reliable = &config
+	if err := kv.Initialize(addr, -1, -1); err != nil {
+		utils.LogError("CreateClient error: %s", err.Error())
+		return nil
 	}
-	*cmdId = receiver.uniqueId
+	return kv
 }
 
-func (receiver *Client) addWaiter(waiter ResultWaiter) {
-	receiver.waiters.Store(waiter.id, waiter)
+// 返回与原客户端共用连接及统计、以 ctx 发起调用的客户端
+// ctx 中的链路上下文会随请求发往存储服务，ctx 的截止时间与超时设置取先到者
+func (receiver *Client) WithContext(ctx context.Context) *Client {
+	c := *receiver
+	c.ctx = ctx
+	return &c
 }
 
-func (receiver *Client) delWaiter(cmdId int64, fn func(*ResultWaiter)) {
-	w, ok := receiver.waiters.Load(cmdId)
-	if fn != nil {
-		if ok {
-			v, ok := w.(ResultWaiter)
-			if ok {
-				fn(&v)
-			} else {
-				fn(nil)
-			}
-		}
-	}
-	if ok {
-		receiver.waiters.Delete(cmdId)
+func (receiver *Client) context() context.Context {
+	if receiver.ctx == nil {
+		return context.Background()
 	}
+	return receiver.ctx
 }
 
-func (receiver *Client) execWaiter(cmdId int64, fn func(*ResultWaiter)) bool {
-	w, ok := receiver.waiters.Load(cmdId)
-	if ok {
-		v, ok := w.(ResultWaiter)
-		if ok {
-			fn(&v)
-		} else {
-			fn(nil)
+func (receiver *Client) getController() nnet.Controller {
+	if receiver.unixMode {
+		if c := receiver.udpUnix.GetController(); c != nil {
+			return c
+		}
+	} else {
+		if c := receiver.tcpNormal.GetController(); c != nil {
+			return c
 		}
 	}
-	return true
+	return nil
 }
 
-func (receiver *Client) onKeyValueMsgRet(controller nnet.Controller, _ string, msg codecs.IMData) error {
-	mapMsg, ok := msg.(codecs.IMMap)
-	if !ok {
-		return nil
-	} else {
+func (receiver *Client) Close() {
+	if controller := receiver.getController(); controller != nil {
+		messages.CancelCalls(controller)
 	}
 
-	reader := codecs.CreateMapReader(mapMsg)
-
-	cmdId := reader.IntValueOf(messages.ProtocolKeySerial, 0)
-	if cmdId > 0 {
-		receiver.delWaiter(cmdId, func(waiter *ResultWaiter) {
-			if waiter == nil {
-				return
-			}
-			go func() {
-				waiter.ch <- reader.TryReadValue(messages.ProtocolKeyBody)
-			}()
-		})
+	if receiver.udpUnix != nil {
+		receiver.udpUnix.Close()
 	}
+	if receiver.tcpNormal != nil {
+		receiver.tcpNormal.Close()
+	}
+}
 
+func (receiver *Client) onKeyValueMsgRet(controller nnet.Controller, addr string, msg codecs.IMData) error {
+	messages.ResolveCall(controller, addr, msg)
 	return nil
 }
 
 func (receiver *Client) Initialize(addr string, buffWSize int, buffRSize int) error {
 	receiver.addr = addr
+	if receiver.stats == nil {
+		receiver.stats = new(messages.CallStats)
+	}
 	//receiver.lookupChan = make(chan interface{}, 10240)
 	if strings.Contains(addr, ":") {
 		receiver.unixMode = false
@@ -174,7 +141,7 @@ func (receiver *Client) Initialize(addr string, buffWSize int, buffRSize int) er
 		receiver.tcpNormal.OnDataDecoded = receiver.onKeyValueMsgRet
 		err := receiver.tcpNormal.Connect(addr, 0)
 		if err != nil {
-			utils.LogInfo("连接 storage => %s 失败. %s", err.Error())
+			utils.LogInfo("连接 storage => %s 失败. %s", addr, err.Error())
 			return err
 		}
 
@@ -183,7 +150,15 @@ func (receiver *Client) Initialize(addr string, buffWSize int, buffRSize int) er
 		receiver.udpUnix = nnet.CreateUnixUDPWithFormatAndBufferSize(packets.PacketFormatNB, codecs.CodecIMv2, buffWSize, buffRSize)
 		receiver.udpUnix.OnDataDecoded = receiver.onKeyValueMsgRet
 		receiver.udpUnix.SetControllerAssociatedObject(receiver)
-		myAddr := fmt.Sprintf("/tmp/nbdb_client_%d.sock", os.Getpid())
+		if receiver.reliable != nil {
+			receiver.udpUnix.SetReliable(*receiver.reliable)
+			receiver.udpUnix.OnPeerLost = func(string, error) {
+				if controller := receiver.getController(); controller != nil {
+					messages.CancelCalls(controller)
+				}
+			}
+		}
+		myAddr := nnet.NewUnixClientAddr("nbdb_client")
 		err := receiver.udpUnix.Bind(myAddr)
 		if err != nil {
 			return err
@@ -192,79 +167,56 @@ func (receiver *Client) Initialize(addr string, buffWSize int, buffRSize int) er
 	return nil
 }
 
-func (receiver *Client) sendCmdWithRet(cmdData codecs.IMMap) (interface{}, error) {
-	defer func() {
-	}()
-
-	var cmdId int64 = 0
-	receiver.makeCmdId(&cmdId)
-
-	cmdData[messages.ProtocolKeySerial] = cmdId
+// 存储调用的次数、失败次数及耗时统计，超时计为失败
+func (receiver *Client) GetCallStat() messages.CallStat {
+	return receiver.stats.Snapshot()
+}
 
-	recvChan := make(chan interface{})
+func (receiver *Client) call(ctx context.Context, cmdData codecs.IMMap) (interface{}, error) {
+	controller := receiver.getController()
+	if controller == nil {
+		return nil, CmdErrorRet
+	}
 
-	tr := time.NewTimer(receiver.timeOut)
-	go func() {
-		<-tr.C
-		receiver.delWaiter(cmdId, func(waiter *ResultWaiter) {
-			if waiter != nil {
-				go func() {
-					recvChan <- nil
-				}()
-			}
-		})
+	var reply *messages.Message
+	var err error
+	receiver.stats.Begin()
+	st := time.Now()
+	defer func() {
+		receiver.stats.End(time.Since(st), err)
 	}()
-
-	waiter := ResultWaiter{id: cmdId, tr: tr, ch: recvChan}
-	receiver.addWaiter(waiter)
-
 	if receiver.unixMode {
 		cmdData[messages.ProtocolKeyUnixAddr] = receiver.udpUnix.GetBindAddr()
-		receiver.udpUnix.SendTo(receiver.addr, cmdData)
+		reply, err = messages.CallData(ctx, controller, receiver.addr, cmdData)
 	} else {
-		receiver.tcpNormal.Send(cmdData)
+		reply, err = messages.CallData(ctx, controller, "", cmdData)
+	}
+	if err != nil {
+		return nil, CmdErrorRet
 	}
 
-	ret, ok := <-recvChan
-	if ok {
-		close(recvChan)
-		return ret, nil
+	//应答消息体可能不是字典，需从原始数据中读取
+	srcData, ok := reply.GetSrcData().(codecs.IMMap)
+	if !ok {
+		return nil, nil
 	}
+	return codecs.CreateMapReader(srcData).TryReadValue(messages.ProtocolKeyBody), nil
+}
 
-	return nil, CmdErrorRet
+func (receiver *Client) sendCmdWithRet(cmdData codecs.IMMap) (interface{}, error) {
+	ctx, cancel := context.WithTimeout(receiver.context(), receiver.timeOut)
+	defer cancel()
+	return receiver.call(ctx, cmdData)
 }
 
 func (receiver *Client) sendCmdWithRetNotTimeout(cmdData codecs.IMMap) (interface{}, error) {
-	defer func() {
-	}()
-
-	var cmdId int64 = 0
-	receiver.makeCmdId(&cmdId)
-
-	cmdData[messages.ProtocolKeySerial] = cmdId
-
-	recvChan := make(chan interface{})
-
-	waiter := ResultWaiter{id: cmdId, tr: nil, ch: recvChan}
-	receiver.addWaiter(waiter)
-
-	if receiver.unixMode {
-		cmdData[messages.ProtocolKeyUnixAddr] = receiver.udpUnix.GetBindAddr()
-		receiver.udpUnix.SendTo(receiver.addr, cmdData)
-	} else {
-		receiver.tcpNormal.Send(cmdData)
-	}
-
-	ret, ok := <-recvChan
-	if ok {
-		close(recvChan)
-		return ret, nil
-	}
-
-	return nil, CmdErrorRet
+	return receiver.call(receiver.context(), cmdData)
 }
 
 func (receiver *Client) sendCmdWithoutRet(cmdData codecs.IMMap) error {
+	if tc, ok := messages.TraceFromContext(receiver.context()); ok {
+		cmdData[messages.ProtocolKeyTrace] = tc.String()
+	}
 	if receiver.unixMode {
 		cmdData[messages.ProtocolKeyUnixAddr] = receiver.udpUnix.GetBindAddr()
 		receiver.udpUnix.SendTo(receiver.addr, cmdData)
@@ -0,0 +1,487 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/messages"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+/*
+master/worker 进程模型
+	master 启动 N 个 worker 子进程(默认以相同的命令行启动自身)，worker 崩溃后按退避间隔重启
+	新连接的分配方式:
+		BalanceHandoff   => master 监听端口，接受连接后通过 UnixMsg 将句柄轮流转移给 worker
+		BalanceReusePort => 每个 worker 以 SO_REUSEPORT 监听同一端口，由内核分配
+	worker 启动后发送 ProtocolTypeSlaveHello，之后定期发送 ProtocolTypeHeart 上报 cpu/内存/协程数，
+	超过 HeartbeatTimeout 没有心跳的 worker 会被强制结束并重启
+*/
+
+const (
+	BalanceHandoff   = "handoff"
+	BalanceReusePort = "reuseport"
+)
+
+// master 通过环境变量将配置传递给 worker
+const (
+	EnvWorkerId   = "CLOVE_WORKER_ID"
+	EnvMasterAddr = "CLOVE_MASTER_ADDR"
+	EnvBalance    = "CLOVE_BALANCE"
+	EnvListenAddr = "CLOVE_LISTEN_ADDR"
+	EnvHeartbeat  = "CLOVE_HEARTBEAT"
+)
+
+type Config struct {
+	//worker 数量，默认为 cpu 核数
+	Workers int
+	//worker 的启动命令，默认以相同参数启动当前程序
+	Command string
+	Args    []string
+	//附加给 worker 的环境变量，格式为 key=value
+	Env     []string
+	Balance string
+	//worker 退出后首次重启的等待时间，连续崩溃时加倍，直到 MaxRestartDelay
+	RestartDelay    time.Duration
+	MaxRestartDelay time.Duration
+	//worker 上报心跳的间隔及判定失联的超时
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+}
+
+type WorkerStat struct {
+	Id            int
+	Pid           int
+	Ready         bool
+	Restarts      int
+	StartTime     time.Time
+	LastHeartbeat time.Time
+	Cpu           float64 //cpu 占用百分比
+	Mem           int64   //向系统申请的内存字节数
+	Goroutine     int
+	Handled       int64 //转移给该 worker 的连接数
+}
+
+type workerProc struct {
+	stat    WorkerStat
+	cmd     *exec.Cmd
+	addr    string
+	msgAddr string
+	delay   time.Duration
+	exited  bool //当前进程已退出，由 wait 在持有 mutex 时设置
+}
+
+type Master struct {
+	OnWorkerCome func(WorkerStat)
+	OnWorkerBye  func(WorkerStat)
+
+	config   Config
+	address  string
+	server   *nnet.TCPServer
+	report   *nnet.UnixUDP
+	transfer *nnet.UnixMsg
+	workers  []*workerProc
+	next     uint64
+	mutex    sync.Mutex
+	closed   bool
+	closeCh  chan struct{}
+}
+
+func CreateMaster(config Config) *Master {
+	if config.Workers <= 0 {
+		config.Workers = runtime.NumCPU()
+	}
+	if config.Command == "" {
+		config.Command = os.Args[0]
+		if config.Args == nil {
+			config.Args = os.Args[1:]
+		}
+	}
+	if config.Balance == "" {
+		config.Balance = BalanceHandoff
+	}
+	if config.RestartDelay <= 0 {
+		config.RestartDelay = time.Second
+	}
+	if config.MaxRestartDelay < config.RestartDelay {
+		config.MaxRestartDelay = 30 * time.Second
+	}
+	if config.HeartbeatInterval <= 0 {
+		config.HeartbeatInterval = time.Second
+	}
+	if config.HeartbeatTimeout <= config.HeartbeatInterval {
+		config.HeartbeatTimeout = 5 * config.HeartbeatInterval
+	}
+	m := new(Master)
+	m.config = config
+	m.closeCh = make(chan struct{})
+	return m
+}
+
+// 设置对外服务的地址，需在 Start 之前调用
+// BalanceHandoff 模式下由 master 监听，BalanceReusePort 模式下仅将地址传递给 worker
+func (receiver *Master) Listen(addr string, port int) error {
+	receiver.address = fmt.Sprintf("%s:%d", addr, port)
+	if port == 0 {
+		receiver.address = addr
+	}
+	if receiver.config.Balance != BalanceHandoff {
+		return nil
+	}
+	receiver.server = nnet.CreateTCPServer()
+	receiver.server.OnConnectAccepted = receiver.handoff
+	if err := receiver.server.Bind(receiver.address, 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (receiver *Master) Start() error {
+	receiver.report = nnet.CreateUnixUDPWithFormat(packets.PacketFormatNB, codecs.CodecIMv2)
+	receiver.report.OnDataDecoded = receiver.onReport
+	if err := receiver.report.Bind(nnet.NewUnixClientAddr("clove_master")); err != nil {
+		return err
+	}
+	if receiver.config.Balance == BalanceHandoff {
+		receiver.transfer = nnet.CreateUnixMsg()
+		if err := receiver.transfer.Bind(nnet.NewUnixClientAddr("clove_master_fd")); err != nil {
+			receiver.report.Close()
+			return err
+		}
+	}
+
+	receiver.mutex.Lock()
+	for i := 0; i < receiver.config.Workers; i++ {
+		w := &workerProc{stat: WorkerStat{Id: i + 1}, delay: receiver.config.RestartDelay}
+		receiver.workers = append(receiver.workers, w)
+		if err := receiver.spawn(w); err != nil {
+			receiver.mutex.Unlock()
+			receiver.Stop()
+			return err
+		}
+	}
+	receiver.mutex.Unlock()
+
+	if receiver.server != nil {
+		receiver.server.Schedule()
+	}
+	go receiver.watch()
+	return nil
+}
+
+func (receiver *Master) Stop() {
+	receiver.mutex.Lock()
+	if receiver.closed {
+		receiver.mutex.Unlock()
+		return
+	}
+	receiver.closed = true
+	close(receiver.closeCh)
+	var procs []*os.Process
+	for _, w := range receiver.workers {
+		if w.cmd != nil && w.cmd.Process != nil && !w.exited {
+			procs = append(procs, w.cmd.Process)
+		}
+	}
+	receiver.mutex.Unlock()
+
+	if receiver.server != nil {
+		receiver.server.Close()
+	}
+	for _, p := range procs {
+		p.Kill()
+	}
+	if receiver.report != nil {
+		receiver.report.Close()
+	}
+	if receiver.transfer != nil {
+		receiver.transfer.Close()
+	}
+}
+
+func (receiver *Master) GetWorkerStats() []WorkerStat {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	stats := make([]WorkerStat, len(receiver.workers))
+	for i, w := range receiver.workers {
+		stats[i] = w.stat
+	}
+	return stats
+}
+
+// 调用方需持有 mutex
+func (receiver *Master) spawn(w *workerProc) error {
+	cmd := exec.Command(receiver.config.Command, receiver.config.Args...)
+	cmd.Env = append(os.Environ(), receiver.config.Env...)
+	cmd.Env = append(cmd.Env,
+		fmt.Sprintf("%s=%d", EnvWorkerId, w.stat.Id),
+		fmt.Sprintf("%s=%s", EnvMasterAddr, receiver.report.GetBindAddr()),
+		fmt.Sprintf("%s=%s", EnvBalance, receiver.config.Balance),
+		fmt.Sprintf("%s=%s", EnvListenAddr, receiver.address),
+		fmt.Sprintf("%s=%d", EnvHeartbeat, receiver.config.HeartbeatInterval.Milliseconds()))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.SysProcAttr = workerSysProcAttr()
+	if err := cmd.Start(); err != nil {
+		utils.LogError("### 启动 worker %d 失败. err: %s", w.stat.Id, err)
+		return err
+	}
+
+	w.cmd = cmd
+	w.exited = false
+	w.msgAddr = ""
+	w.stat.Pid = cmd.Process.Pid
+	w.stat.Ready = false
+	w.stat.StartTime = time.Now()
+	w.stat.LastHeartbeat = time.Time{}
+	utils.LogInfo("### worker %d 已启动, pid %d", w.stat.Id, w.stat.Pid)
+
+	go receiver.wait(w, cmd)
+	return nil
+}
+
+func (receiver *Master) wait(w *workerProc, cmd *exec.Cmd) {
+	err := cmd.Wait()
+
+	receiver.mutex.Lock()
+	if w.cmd != cmd {
+		receiver.mutex.Unlock()
+		return
+	}
+	w.exited = true
+	ready := w.stat.Ready
+	w.stat.Ready = false
+	//被强制结束的 worker 来不及删除自己的套接字文件
+	removeSocket(w.addr)
+	removeSocket(w.msgAddr)
+	w.addr = ""
+	w.msgAddr = ""
+	stat := w.stat
+	closed := receiver.closed
+	//运行时间较长的 worker 退出后按初始间隔重启
+	if time.Since(stat.StartTime) > receiver.config.MaxRestartDelay {
+		w.delay = receiver.config.RestartDelay
+	}
+	delay := receiver.nextDelay(w)
+	receiver.mutex.Unlock()
+
+	if ready && receiver.OnWorkerBye != nil {
+		receiver.OnWorkerBye(stat)
+	}
+	if closed {
+		return
+	}
+	utils.LogError("### worker %d (pid %d) 已退出: %v, %s 后重启", stat.Id, stat.Pid, err, delay)
+	receiver.restart(w, delay)
+}
+
+// 返回本次重启前的等待时间，并将下次的等待时间加倍，直到 MaxRestartDelay
+// 调用方需持有 mutex
+func (receiver *Master) nextDelay(w *workerProc) time.Duration {
+	delay := w.delay
+	w.delay *= 2
+	if w.delay > receiver.config.MaxRestartDelay {
+		w.delay = receiver.config.MaxRestartDelay
+	}
+	return delay
+}
+
+// 等待 delay 后重启 worker，启动失败时按退避间隔继续重试，直到成功或 master 停止
+func (receiver *Master) restart(w *workerProc, delay time.Duration) {
+	for {
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-time.After(delay):
+		}
+
+		receiver.mutex.Lock()
+		if receiver.closed {
+			receiver.mutex.Unlock()
+			return
+		}
+		w.stat.Restarts += 1
+		if receiver.spawn(w) == nil {
+			receiver.mutex.Unlock()
+			return
+		}
+		delay = receiver.nextDelay(w)
+		receiver.mutex.Unlock()
+	}
+}
+
+// worker 进程仍在运行且超过 timeout 没有心跳，调用方需持有 mutex
+func (w *workerProc) heartbeatExpired(now time.Time, timeout time.Duration) bool {
+	if w.cmd == nil || w.cmd.Process == nil || w.exited {
+		return false
+	}
+	last := w.stat.LastHeartbeat
+	if last.IsZero() {
+		last = w.stat.StartTime
+	}
+	return now.Sub(last) > timeout
+}
+
+// 结束超时未上报心跳的 worker，由 wait 负责重启
+func (receiver *Master) watch() {
+	ticker := time.NewTicker(receiver.config.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now()
+		receiver.mutex.Lock()
+		for _, w := range receiver.workers {
+			if w.heartbeatExpired(now, receiver.config.HeartbeatTimeout) {
+				utils.LogError("### worker %d (pid %d) 心跳超时，强制结束", w.stat.Id, w.stat.Pid)
+				w.cmd.Process.Kill()
+			}
+		}
+		receiver.mutex.Unlock()
+	}
+}
+
+func (receiver *Master) getWorker(id int) *workerProc {
+	for _, w := range receiver.workers {
+		if w.stat.Id == id {
+			return w
+		}
+	}
+	return nil
+}
+
+func (receiver *Master) onReport(controller nnet.Controller, addr string, data codecs.IMData) error {
+	msg, err := messages.MessageFromData(controller, addr, data)
+	if err != nil {
+		return nil
+	}
+	reader := codecs.CreateMapReader(msg.GetBody())
+	id := int(reader.IntValueOf(messages.ProtocolKeyId, 0))
+
+	receiver.mutex.Lock()
+	w := receiver.getWorker(id)
+	if w == nil || receiver.closed {
+		receiver.mutex.Unlock()
+		return nil
+	}
+	var come bool
+	switch msg.GetType() {
+	case messages.ProtocolTypeSlaveHello:
+		come = !w.stat.Ready
+		w.addr = reader.StrValueOf(messages.ProtocolKeyUnixAddr, "")
+		w.msgAddr = reader.StrValueOf(messages.ProtocolKeyUnixMsgAddr, "")
+		w.stat.Ready = true
+		w.stat.LastHeartbeat = time.Now()
+	case messages.ProtocolTypeHeart:
+		w.stat.LastHeartbeat = time.Now()
+		w.stat.Cpu = reader.FloatValueOf(messages.ProtocolKeyCpu, 0)
+		w.stat.Mem = reader.IntValueOf(messages.ProtocolKeyMem, 0)
+		w.stat.Goroutine = int(reader.IntValueOf(messages.ProtocolKeyGoroutine, 0))
+	}
+	stat := w.stat
+	receiver.mutex.Unlock()
+
+	if come && receiver.OnWorkerCome != nil {
+		receiver.OnWorkerCome(stat)
+	}
+	return nil
+}
+
+// 按轮询将新连接转移给就绪的 worker，全部失败时连接会被关闭
+func (receiver *Master) handoff(conn net.Conn) error {
+	src, ok := conn.(interface{ File() (*os.File, error) })
+	if !ok {
+		return errors.ErrorUnsupportedNetwork
+	}
+	f, err := src.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	meta := nnet.FileHandleMeta{Kind: nnet.FileHandleKindConn, RemoteAddr: conn.RemoteAddr().String()}
+	receiver.mutex.Lock()
+	n := len(receiver.workers)
+	receiver.mutex.Unlock()
+	for i := 0; i < n; i++ {
+		w, addr := receiver.pick()
+		if w == nil {
+			break
+		}
+		err = receiver.transfer.SendFileHandles(addr, meta, int(f.Fd()))
+		receiver.mutex.Lock()
+		id := w.stat.Id
+		if err == nil {
+			w.stat.Handled += 1
+		}
+		receiver.mutex.Unlock()
+		if err == nil {
+			return nil
+		}
+		utils.LogError("### 向 worker %d 转移连接失败. err: %s", id, err)
+	}
+	utils.LogError("### 没有可用的 worker, 连接 %s 将被关闭", meta.RemoteAddr)
+	return errors.ErrorNoWorkerAvailable
+}
+
+func (receiver *Master) pick() (*workerProc, string) {
+	receiver.mutex.Lock()
+	defer receiver.mutex.Unlock()
+	n := uint64(len(receiver.workers))
+	for i := uint64(0); i < n; i++ {
+		w := receiver.workers[(receiver.next+i)%n]
+		if w.stat.Ready && w.msgAddr != "" {
+			receiver.next += i + 1
+			return w, w.msgAddr
+		}
+	}
+	return nil, ""
+}
+
+func removeSocket(addr string) {
+	if addr == "" || nnet.IsAbstractUnixAddr(addr) {
+		return
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		utils.LogWarn("### 删除套接字文件 %s 失败. err: %s", addr, err)
+	}
+}
+
+func parseHeartbeat(s string) time.Duration {
+	ms, err := strconv.Atoi(s)
+	if err != nil || ms <= 0 {
+		return time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
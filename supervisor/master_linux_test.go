@@ -0,0 +1,161 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/packets"
+)
+
+// 等待条件成立，超时后测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatchKillsWorkerWithoutHeartbeat(t *testing.T) {
+	m := CreateMaster(Config{
+		Workers:           1,
+		Command:           "sleep",
+		Args:              []string{"30"},
+		RestartDelay:      time.Hour,
+		HeartbeatInterval: 10 * time.Millisecond,
+		HeartbeatTimeout:  50 * time.Millisecond,
+	})
+	if err := m.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop()
+
+	m.mutex.Lock()
+	w := m.workers[0]
+	m.mutex.Unlock()
+	waitFor(t, "worker killed", func() bool {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return w.exited
+	})
+	if stats := m.GetWorkerStats(); stats[0].Restarts != 0 || stats[0].Ready {
+		t.Fatalf("stat = %+v", stats[0])
+	}
+}
+
+func TestRestartRetriesFailedSpawn(t *testing.T) {
+	m := CreateMaster(Config{
+		Command:         "/nonexistent/clove-worker",
+		RestartDelay:    time.Millisecond,
+		MaxRestartDelay: 4 * time.Millisecond,
+	})
+	m.report = nnet.CreateUnixUDPWithFormat(packets.PacketFormatNB, codecs.CodecIMv2)
+	if err := m.report.Bind(nnet.NewUnixClientAddr("clove_master_test")); err != nil {
+		t.Fatal(err)
+	}
+	w := &workerProc{stat: WorkerStat{Id: 1}, delay: m.config.RestartDelay}
+	m.workers = []*workerProc{w}
+
+	done := make(chan struct{})
+	go func() {
+		m.restart(w, m.nextDelay(w))
+		close(done)
+	}()
+	waitFor(t, "spawn retries", func() bool {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		return w.stat.Restarts >= 3
+	})
+	m.mutex.Lock()
+	delay := w.delay
+	m.mutex.Unlock()
+	if delay != m.config.MaxRestartDelay {
+		t.Fatalf("delay = %s; want %s", delay, m.config.MaxRestartDelay)
+	}
+
+	m.Stop()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("restart loop did not stop with master")
+	}
+}
+
+func TestHandoffCountsHandledConnections(t *testing.T) {
+	m := CreateMaster(Config{Command: "worker"})
+	m.transfer = nnet.CreateUnixMsg()
+	if err := m.transfer.Bind(nnet.NewUnixClientAddr("clove_master_fd_test")); err != nil {
+		t.Fatal(err)
+	}
+	defer m.transfer.Close()
+	worker := nnet.CreateUnixMsg()
+	workerAddr := nnet.NewUnixClientAddr("clove_worker_fd_test")
+	if err := worker.Bind(workerAddr); err != nil {
+		t.Fatal(err)
+	}
+	defer worker.Close()
+	m.workers = []*workerProc{{stat: WorkerStat{Id: 1, Ready: true}, msgAddr: workerAddr}}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	//统计与转移并发进行
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.GetWorkerStats()
+			}
+		}
+	}()
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.handoff(conn)
+		conn.Close()
+		client.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+
+	if stats := m.GetWorkerStats(); stats[0].Handled != 3 {
+		t.Fatalf("handled = %d; want 3", stats[0].Handled)
+	}
+}
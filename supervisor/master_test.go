@@ -0,0 +1,118 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/packing/clove/utils"
+)
+
+func TestMain(m *testing.M) {
+	utils.LogInit(utils.LogLevelError, "")
+	os.Exit(m.Run())
+}
+
+func TestCreateMasterDefaults(t *testing.T) {
+	m := CreateMaster(Config{Command: "worker", RestartDelay: 2 * time.Second, MaxRestartDelay: time.Second})
+	c := m.config
+	if c.Workers <= 0 || c.Balance != BalanceHandoff {
+		t.Fatalf("config = %+v", c)
+	}
+	//上限小于初始间隔时使用默认上限
+	if c.RestartDelay != 2*time.Second || c.MaxRestartDelay != 30*time.Second {
+		t.Fatalf("restart delay = %s, max %s", c.RestartDelay, c.MaxRestartDelay)
+	}
+	if c.HeartbeatInterval != time.Second || c.HeartbeatTimeout != 5*time.Second {
+		t.Fatalf("heartbeat = %s, timeout %s", c.HeartbeatInterval, c.HeartbeatTimeout)
+	}
+}
+
+func TestNextDelayDoublesUpToMax(t *testing.T) {
+	m := CreateMaster(Config{Command: "worker", RestartDelay: time.Second, MaxRestartDelay: 5 * time.Second})
+	w := &workerProc{delay: m.config.RestartDelay}
+	want := []time.Duration{1, 2, 4, 5, 5}
+	for i, d := range want {
+		if got := m.nextDelay(w); got != d*time.Second {
+			t.Fatalf("delay %d = %s; want %s", i, got, d*time.Second)
+		}
+	}
+}
+
+func TestHeartbeatExpired(t *testing.T) {
+	now := time.Now()
+	running := &exec.Cmd{Process: &os.Process{Pid: 1}}
+	cases := []struct {
+		name string
+		w    *workerProc
+		want bool
+	}{
+		{"not started", &workerProc{}, false},
+		{"recent start", &workerProc{cmd: running, stat: WorkerStat{StartTime: now.Add(-time.Second)}}, false},
+		{"no heartbeat since start", &workerProc{cmd: running, stat: WorkerStat{StartTime: now.Add(-time.Minute)}}, true},
+		{"recent heartbeat", &workerProc{cmd: running, stat: WorkerStat{StartTime: now.Add(-time.Minute), LastHeartbeat: now.Add(-time.Second)}}, false},
+		{"stale heartbeat", &workerProc{cmd: running, stat: WorkerStat{StartTime: now.Add(-time.Hour), LastHeartbeat: now.Add(-time.Minute)}}, true},
+		{"exited", &workerProc{cmd: running, exited: true, stat: WorkerStat{StartTime: now.Add(-time.Hour)}}, false},
+	}
+	for _, c := range cases {
+		if got := c.w.heartbeatExpired(now, 10*time.Second); got != c.want {
+			t.Errorf("%s: expired = %v; want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPickRoundRobinSkipsNotReady(t *testing.T) {
+	m := CreateMaster(Config{Command: "worker"})
+	m.workers = []*workerProc{
+		{stat: WorkerStat{Id: 1, Ready: true}, msgAddr: "a"},
+		{stat: WorkerStat{Id: 2}, msgAddr: "b"},
+		{stat: WorkerStat{Id: 3, Ready: true}, msgAddr: "c"},
+		{stat: WorkerStat{Id: 4, Ready: true}},
+	}
+	var got []string
+	for i := 0; i < 4; i++ {
+		_, addr := m.pick()
+		got = append(got, addr)
+	}
+	if got[0] != "a" || got[1] != "c" || got[2] != "a" || got[3] != "c" {
+		t.Fatalf("picked %v; want [a c a c]", got)
+	}
+
+	m.workers = []*workerProc{{stat: WorkerStat{Id: 1}}}
+	if w, addr := m.pick(); w != nil || addr != "" {
+		t.Fatalf("pick = %v, %q; want none", w, addr)
+	}
+}
+
+func TestParseHeartbeat(t *testing.T) {
+	cases := map[string]time.Duration{
+		"250": 250 * time.Millisecond,
+		"":    time.Second,
+		"0":   time.Second,
+		"-5":  time.Second,
+		"abc": time.Second,
+	}
+	for s, want := range cases {
+		if got := parseHeartbeat(s); got != want {
+			t.Errorf("parseHeartbeat(%q) = %s; want %s", s, got, want)
+		}
+	}
+}
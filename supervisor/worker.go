@@ -0,0 +1,197 @@
+/*
+ * Licensed to the Apache Software Foundation (ASF) under one or more
+ * contributor license agreements.  See the NOTICE file distributed with
+ * this work for additional information regarding copyright ownership.
+ * The ASF licenses this file to You under the Apache License, Version 2.0
+ * (the "License"); you may not use this file except in compliance with
+ * the License.  You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package supervisor
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/packing/clove/codecs"
+	"github.com/packing/clove/errors"
+	"github.com/packing/clove/messages"
+	"github.com/packing/clove/nnet"
+	"github.com/packing/clove/packets"
+	"github.com/packing/clove/utils"
+)
+
+// 连续多少次心跳发送失败后认为 master 已失联
+const masterLostThreshold = 3
+
+type Worker struct {
+	//master 失联时调用，默认记录日志后退出进程
+	OnMasterLost func()
+
+	id         int
+	masterAddr string
+	interval   time.Duration
+	server     *nnet.TCPServer
+	report     *nnet.UnixUDP
+	transfer   *nnet.UnixMsg
+	lastCpu    time.Duration
+	lastTime   time.Time
+	closeOnce  sync.Once
+	closeCh    chan struct{}
+}
+
+// 当前进程是否由 master 启动
+func IsWorker() bool {
+	return os.Getenv(EnvWorkerId) != "" && os.Getenv(EnvMasterAddr) != ""
+}
+
+func GetWorkerId() int {
+	id, _ := strconv.Atoi(os.Getenv(EnvWorkerId))
+	return id
+}
+
+// 按 master 传递的配置启动 server 并开始上报心跳
+// BalanceReusePort 模式下 server 以 SO_REUSEPORT 监听，BalanceHandoff 模式下 server 只接收 master 转移过来的连接
+func StartWorker(server *nnet.TCPServer) (*Worker, error) {
+	if !IsWorker() {
+		return nil, errors.ErrorNotWorker
+	}
+	w := new(Worker)
+	w.id = GetWorkerId()
+	w.masterAddr = os.Getenv(EnvMasterAddr)
+	w.interval = parseHeartbeat(os.Getenv(EnvHeartbeat))
+	w.server = server
+	w.closeCh = make(chan struct{})
+	w.OnMasterLost = func() {
+		utils.LogError("### worker %d 与 master 失联，退出", w.id)
+		os.Exit(1)
+	}
+
+	var msgAddr string
+	switch os.Getenv(EnvBalance) {
+	case BalanceReusePort:
+		if err := server.BindReusePort(os.Getenv(EnvListenAddr), 0); err != nil {
+			return nil, err
+		}
+		server.Schedule()
+	default:
+		if err := server.ServeWithoutListener(); err != nil {
+			return nil, err
+		}
+		w.transfer = nnet.CreateUnixMsg()
+		w.transfer.SetControllerAssociatedObject(server)
+		msgAddr = nnet.NewUnixClientAddr("clove_worker_fd")
+		if err := w.transfer.Bind(msgAddr); err != nil {
+			server.Close()
+			return nil, err
+		}
+	}
+
+	reportAddr := nnet.NewUnixClientAddr("clove_worker")
+	w.report = nnet.CreateUnixUDPWithFormat(packets.PacketFormatNB, codecs.CodecIMv2)
+	if err := w.report.Bind(reportAddr); err != nil {
+		w.Stop()
+		return nil, err
+	}
+
+	w.lastCpu = processCPUTime()
+	w.lastTime = time.Now()
+	hello := messages.CreateS2SMessage(messages.ProtocolTypeSlaveHello)
+	hello.SetTag(messages.ProtocolTagSlave)
+	hello.SetBody(codecs.IMMap{
+		messages.ProtocolKeyId:          w.id,
+		messages.ProtocolKeyUnixAddr:    reportAddr,
+		messages.ProtocolKeyUnixMsgAddr: msgAddr,
+	})
+	if err := w.send(hello); err != nil {
+		w.Stop()
+		return nil, err
+	}
+
+	go w.heartbeat()
+	return w, nil
+}
+
+func (receiver *Worker) GetId() int {
+	return receiver.id
+}
+
+func (receiver *Worker) Stop() {
+	receiver.closeOnce.Do(func() {
+		close(receiver.closeCh)
+		receiver.server.Close()
+		if receiver.transfer != nil {
+			receiver.transfer.Close()
+		}
+		if receiver.report != nil {
+			receiver.report.Close()
+		}
+	})
+}
+
+func (receiver *Worker) send(msg *messages.Message) error {
+	data, err := messages.DataFromMessage(msg)
+	if err != nil {
+		return err
+	}
+	_, err = receiver.report.SendTo(receiver.masterAddr, data)
+	return err
+}
+
+func (receiver *Worker) heartbeat() {
+	defer utils.LogPanic(recover())
+
+	ticker := time.NewTicker(receiver.interval)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-receiver.closeCh:
+			return
+		case <-ticker.C:
+		}
+
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		now := time.Now()
+		cpu := processCPUTime()
+		var percent float64
+		if elapsed := now.Sub(receiver.lastTime); elapsed > 0 {
+			percent = float64(cpu-receiver.lastCpu) / float64(elapsed) * 100
+		}
+		receiver.lastCpu = cpu
+		receiver.lastTime = now
+
+		msg := messages.CreateS2SMessage(messages.ProtocolTypeHeart)
+		msg.SetTag(messages.ProtocolTagSlave)
+		msg.SetBody(codecs.IMMap{
+			messages.ProtocolKeyId:        receiver.id,
+			messages.ProtocolKeyCpu:       percent,
+			messages.ProtocolKeyMem:       int64(ms.Sys),
+			messages.ProtocolKeyGoroutine: runtime.NumGoroutine(),
+		})
+		if err := receiver.send(msg); err != nil {
+			failures += 1
+			utils.LogWarn("### worker %d 上报心跳失败. err: %s", receiver.id, err)
+			if failures >= masterLostThreshold {
+				if receiver.OnMasterLost != nil {
+					receiver.OnMasterLost()
+				}
+				return
+			}
+			continue
+		}
+		failures = 0
+	}
+}
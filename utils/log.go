@@ -156,6 +156,6 @@ func LogPanic(ierr interface{}) {
 
             return string(buf)
         }
-        LogError("panic:", err, "\nstack:"+st(false))
+        LogError("panic: %v\nstack:%s", err, st(false))
     }
 }
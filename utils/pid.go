@@ -27,7 +27,7 @@ import (
 func GeneratePID(pidFile string) {
     pf, err := os.OpenFile(pidFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0664)
     if err != nil {
-        LogError("Write pidfile error!", err)
+        LogError("Write pidfile error! %s", err)
         return
     }
 
@@ -38,13 +38,13 @@ func GeneratePID(pidFile string) {
 func RemovePID(pidFile string) {
     err, pids := ReadPIDs(pidFile)
     if err != nil {
-        LogError("Remove from pidfile error!", err)
+        LogError("Remove from pidfile error! %s", err)
         return
     }
 
     pf, err := os.OpenFile(pidFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
     if err != nil {
-        LogError("Remove from pidfile error!", err)
+        LogError("Remove from pidfile error! %s", err)
         return
     }
 
@@ -60,7 +60,7 @@ func RemovePID(pidFile string) {
 func ReadPIDs(pidFile string) (error, []int) {
     pf, err := os.Open(pidFile)
     if err != nil {
-        LogError("read from pidfile error!", err)
+        LogError("read from pidfile error! %s", err)
         return err, nil
     }
 
@@ -68,7 +68,7 @@ func ReadPIDs(pidFile string) (error, []int) {
     n, err := pf.Read(bs)
     pf.Close()
     if err != nil {
-        LogError("read from pidfile error!", err)
+        LogError("read from pidfile error! %s", err)
         return err, nil
     }
     ctx := string(bs[:n])